@@ -98,7 +98,7 @@ const docTemplate = `{
         },
         "/api/logs": {
             "post": {
-                "description": "设置应用程序的日志级别",
+                "description": "设置应用程序的日志级别，或在运行时修改日志文件的路径、大小上限和备份数量",
                 "consumes": [
                     "application/json"
                 ],
@@ -108,7 +108,7 @@ const docTemplate = `{
                 "tags": [
                     "logs"
                 ],
-                "summary": "设置日志级别",
+                "summary": "设置日志级别和日志文件",
                 "parameters": [
                     {
                         "description": "日志级别设置",
@@ -167,13 +167,48 @@ const docTemplate = `{
                         "description": "OK",
                         "schema": {
                             "$ref": "#/definitions/completions.CompletionResponse"
+                        },
+                        "headers": {
+                            "X-Completion-Id": {
+                                "type": "string",
+                                "description": "补全请求ID"
+                            },
+                            "X-Completion-Status": {
+                                "type": "string",
+                                "description": "补全状态"
+                            }
                         }
                     },
                     "400": {
                         "description": "Bad Request",
                         "schema": {
-                            "type": "object",
-                            "additionalProperties": true
+                            "$ref": "#/definitions/completions.CompletionResponse"
+                        },
+                        "headers": {
+                            "X-Completion-Id": {
+                                "type": "string",
+                                "description": "补全请求ID"
+                            },
+                            "X-Completion-Status": {
+                                "type": "string",
+                                "description": "补全状态"
+                            }
+                        }
+                    },
+                    "429": {
+                        "description": "Too Many Requests",
+                        "schema": {
+                            "$ref": "#/definitions/completions.CompletionResponse"
+                        },
+                        "headers": {
+                            "X-Completion-Id": {
+                                "type": "string",
+                                "description": "补全请求ID"
+                            },
+                            "X-Completion-Status": {
+                                "type": "string",
+                                "description": "补全状态"
+                            }
                         }
                     },
                     "500": {
@@ -182,6 +217,80 @@ const docTemplate = `{
                             "type": "object",
                             "additionalProperties": true
                         }
+                    },
+                    "503": {
+                        "description": "Service Unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/completions.CompletionResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/completion-agent/api/v1/debug/prompt": {
+            "post": {
+                "description": "执行完整的前置处理(上下文合并、截断、FIM组装、停用词)，返回将要发给模型的prompt和停用词，不调用模型",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "debug"
+                ],
+                "summary": "预览提示词",
+                "parameters": [
+                    {
+                        "description": "补全请求",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/completions.CompletionRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/completions.PromptPreview"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "503": {
+                        "description": "Service Unavailable",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/completion-agent/api/v1/models": {
+            "get": {
+                "description": "列出已配置的补全模型及其标签，供客户端选择模型",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "models"
+                ],
+                "summary": "模型列表",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/server.ModelsResponse"
+                        }
                     }
                 }
             }
@@ -209,9 +318,56 @@ const docTemplate = `{
                     }
                 }
             }
+        },
+        "/readyz": {
+            "get": {
+                "description": "初始化完成后，向每个模型发送max_tokens为1的试补全，报告各模型是否可达；尚未初始化完成或没有可达的模型时返回503",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "health"
+                ],
+                "summary": "就绪检查",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/server.ReadyResponse"
+                        }
+                    },
+                    "503": {
+                        "description": "Service Unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/server.ReadyResponse"
+                        }
+                    }
+                }
+            }
         }
     },
     "definitions": {
+        "codebase_context.ContextSnippet": {
+            "type": "object",
+            "properties": {
+                "filepath": {
+                    "description": "片段所在文件",
+                    "type": "string"
+                },
+                "length": {
+                    "description": "片段内容长度(字节)",
+                    "type": "integer"
+                },
+                "score": {
+                    "description": "检索得分，定义检索没有得分",
+                    "type": "number"
+                },
+                "source": {
+                    "description": "检索来源: definition/semantic/relation",
+                    "type": "string"
+                }
+            }
+        },
         "completions.CalculateHideScore": {
             "type": "object",
             "properties": {
@@ -238,6 +394,14 @@ const docTemplate = `{
         "completions.CompletionChoice": {
             "type": "object",
             "properties": {
+                "replace_range": {
+                    "description": "建议替换的范围，为空表示在光标处插入",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/completions.ReplaceRange"
+                        }
+                    ]
+                },
                 "text": {
                     "type": "string"
                 }
@@ -384,49 +548,230 @@ const docTemplate = `{
                 }
             }
         },
+        "completions.PromptPreview": {
+            "type": "object",
+            "properties": {
+                "max_tokens": {
+                    "description": "最大输出token数",
+                    "type": "integer"
+                },
+                "model": {
+                    "description": "实际调用的模型",
+                    "type": "string"
+                },
+                "prompt": {
+                    "description": "发给模型的prompt",
+                    "type": "string"
+                },
+                "prompt_tokens": {
+                    "description": "prompt的token数",
+                    "type": "integer"
+                },
+                "rejected": {
+                    "description": "被过滤器拒绝的原因",
+                    "type": "string"
+                },
+                "snippets": {
+                    "description": "拼入上下文的片段，按拼接顺序",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/codebase_context.ContextSnippet"
+                    }
+                },
+                "stop": {
+                    "description": "停用词",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "suffix": {
+                    "description": "非FIM模式下单独发送的后缀",
+                    "type": "string"
+                },
+                "temperature": {
+                    "description": "温度",
+                    "type": "number"
+                }
+            }
+        },
+        "completions.ReplaceRange": {
+            "type": "object",
+            "properties": {
+                "end": {
+                    "description": "替换范围的终点，相对光标的偏移，不小于0",
+                    "type": "integer"
+                },
+                "start": {
+                    "description": "替换范围的起点，相对光标的偏移，不大于0",
+                    "type": "integer"
+                }
+            }
+        },
         "model.CompletionStatus": {
             "type": "string",
             "enum": [
-                "sucess",
-                "modelError",
-                "reqError",
+                "success",
                 "empty",
-                "processEmpty",
+                "reqError",
                 "serverError",
-                "reject",
-                "timeout"
+                "modelError",
+                "rejected",
+                "timeout",
+                "canceled",
+                "busy",
+                "noSuggestion",
+                "authError",
+                "rateLimited"
             ],
             "x-enum-comments": {
+                "StatusAuthError": "模型服务认证失败",
+                "StatusBusy": "服务端繁忙",
+                "StatusCanceled": "用户取消",
+                "StatusEmpty": "补全结果为空",
                 "StatusModelError": "模型响应错误",
+                "StatusNoSuggestion": "模型正常响应但没有给出建议(choices为空)",
+                "StatusRateLimited": "请求频率超出限制(模型服务或本服务限流)",
                 "StatusRejected": "根据规则拒绝补全",
                 "StatusReqError": "请求存在错误",
-                "StatusServerError": "服务端错误"
+                "StatusServerError": "服务端错误",
+                "StatusSuccess": "补全成功",
+                "StatusTimeout": "补全请求超时"
             },
             "x-enum-descriptions": [
-                "",
-                "模型响应错误",
+                "补全成功",
+                "补全结果为空",
                 "请求存在错误",
-                "",
-                "",
                 "服务端错误",
+                "模型响应错误",
                 "根据规则拒绝补全",
-                ""
+                "补全请求超时",
+                "用户取消",
+                "服务端繁忙",
+                "模型正常响应但没有给出建议(choices为空)",
+                "模型服务认证失败",
+                "请求频率超出限制(模型服务或本服务限流)"
             ],
             "x-enum-varnames": [
                 "StatusSuccess",
-                "StatusModelError",
-                "StatusReqError",
                 "StatusEmpty",
-                "CompletionProcessEmpty",
+                "StatusReqError",
                 "StatusServerError",
+                "StatusModelError",
                 "StatusRejected",
-                "StatusTimeout"
+                "StatusTimeout",
+                "StatusCanceled",
+                "StatusBusy",
+                "StatusNoSuggestion",
+                "StatusAuthError",
+                "StatusRateLimited"
             ]
         },
         "server.LogSettings": {
             "type": "object",
             "properties": {
                 "level": {
+                    "description": "日志级别，为空表示不修改",
+                    "type": "string"
+                },
+                "maxBackups": {
+                    "description": "保留的备份文件数量，0表示保留全部，未指定表示不修改",
+                    "type": "integer"
+                },
+                "maxSize": {
+                    "description": "单个日志文件的最大字节数，为0表示不修改",
+                    "type": "integer"
+                },
+                "path": {
+                    "description": "日志文件路径，为空表示不修改",
+                    "type": "string"
+                }
+            }
+        },
+        "server.ModelInfo": {
+            "type": "object",
+            "properties": {
+                "fimMode": {
+                    "description": "是否由服务端填充FIM标记",
+                    "type": "boolean"
+                },
+                "modelName": {
+                    "description": "真实的模型名称",
+                    "type": "string"
+                },
+                "modelTitle": {
+                    "description": "模型标题",
+                    "type": "string"
+                },
+                "provider": {
+                    "description": "模型供应商",
+                    "type": "string"
+                },
+                "tags": {
+                    "description": "模型标签，补全请求可按标签选择模型",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                }
+            }
+        },
+        "server.ModelReadiness": {
+            "type": "object",
+            "properties": {
+                "error": {
+                    "description": "不可达的原因",
+                    "type": "string"
+                },
+                "latencyMs": {
+                    "description": "试补全耗时(毫秒)",
+                    "type": "integer"
+                },
+                "modelName": {
+                    "description": "真实的模型名称",
+                    "type": "string"
+                },
+                "modelTitle": {
+                    "description": "模型标题",
+                    "type": "string"
+                },
+                "reachable": {
+                    "description": "模型服务是否正常响应",
+                    "type": "boolean"
+                },
+                "status": {
+                    "description": "试补全的补全状态",
+                    "type": "string"
+                }
+            }
+        },
+        "server.ModelsResponse": {
+            "type": "object",
+            "properties": {
+                "models": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/server.ModelInfo"
+                    }
+                }
+            }
+        },
+        "server.ReadyResponse": {
+            "type": "object",
+            "properties": {
+                "models": {
+                    "description": "各模型的检查结果",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/server.ModelReadiness"
+                    }
+                },
+                "status": {
+                    "description": "ready、unavailable或initializing",
+                    "type": "string"
+                },
+                "time": {
+                    "description": "检查时间",
                     "type": "string"
                 }
             }
@@ -19,17 +19,22 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
 	"time"
 
 	_ "completion-agent/docs"
+	"completion-agent/pkg/codebase_context"
+	"completion-agent/pkg/completions"
 	"completion-agent/pkg/config"
 	"completion-agent/pkg/env"
 	"completion-agent/pkg/logger"
 	_ "completion-agent/pkg/logger"
+	"completion-agent/pkg/metrics"
 	"completion-agent/pkg/model"
+	"completion-agent/pkg/selftest"
 	"completion-agent/pkg/tokenizers"
 	"completion-agent/server"
 
@@ -72,8 +77,14 @@ func main() {
 
 	// 解析命令行参数
 	var (
-		port = flag.String("port", "8080", "服务器端口")
-		mode = flag.String("mode", "release", "运行模式 (debug/release)")
+		port        = flag.String("port", "8080", "服务器端口")
+		mode        = flag.String("mode", "release", "运行模式 (debug/release)")
+		logCompress = flag.Bool("log-compress", false, "是否gzip压缩轮转后的日志备份")
+		logBackups  = flag.Int("log-max-backups", 1, "保留的日志备份数量，0表示保留全部")
+		logDaily    = flag.Bool("log-rotate-daily", false, "是否每天零点后轮转日志")
+		logAsync    = flag.Bool("log-async", false, "是否异步写日志文件，缓冲区满时丢弃日志")
+		selfTest    = flag.Bool("selftest", false, "执行启动自检(分词器、模型、上下文服务)，输出报告后退出")
+		configPath  = flag.String("config", "", "配置文件路径，默认取COMPLETION_AGENT_CONFIG环境变量，未设置时为~/.costrict/config/completion-agent.json")
 	)
 	flag.Parse()
 
@@ -85,12 +96,19 @@ func main() {
 		env.DebugMode = true
 	}
 	// 初始化日志系统
-	logger.InitLogger("", *mode, 5*1024*1024) // 默认路径，同步输出到控制台和文件，最大5MB
+	logger.InitLogger("", *mode, logger.Options{ // 默认路径，同步输出到控制台和文件，最大5MB
+		MaxSize:     5 * 1024 * 1024,
+		MaxBackups:  *logBackups,
+		Compress:    *logCompress,
+		RotateDaily: *logDaily,
+		AsyncLog:    *logAsync,
+	})
 	defer logger.Sync()
 
-	initConfig()
-	initTokenizer()
-	initModels()
+	initConfig(*configPath)
+	if *selfTest {
+		runSelftest()
+	}
 
 	// 创建路由
 	r := server.SetupRouter()
@@ -99,6 +117,17 @@ func main() {
 	addr := "127.0.0.1:" + *port
 	srv := server.NewServer(addr, r)
 
+	// 服务启动后再初始化其余组件，期间/healthz可用于存活检查，/readyz和补全接口返回503
+	go func() {
+		initFilters()
+		initMetrics()
+		initTokenizer()
+		initModels()
+		initContextKeepalive()
+		server.SetReady()
+		zap.L().Info("Service is ready")
+	}()
+
 	// 启动服务器
 	if err := srv.Start(); err != nil {
 		logger.Fatal("服务器运行失败", zap.Error(err))
@@ -182,6 +211,24 @@ func setFixedOffset(tz string) {
 	fmt.Printf("已使用固定偏移量设置时区: %s (UTC%+d)\n", tz, offset/3600)
 }
 
+/**
+ * 执行启动自检后退出
+ * @description
+ * - 依次检查分词器、每个模型的试补全、上下文服务的可达性
+ * - 报告输出到标准输出
+ * - 全部通过时退出码为0，否则为1
+ * - 用于部署前在CI/CD中验证配置
+ */
+func runSelftest() {
+	zap.L().Info("Run selftest")
+	if !selftest.Run(context.Background(), os.Stdout) {
+		logger.Sync()
+		os.Exit(1)
+	}
+	logger.Sync()
+	os.Exit(0)
+}
+
 /**
  * 初始化模型实例
  * @description
@@ -199,6 +246,53 @@ func setFixedOffset(tz string) {
 func initModels() {
 	zap.L().Info("Initialize model instances")
 	if err := model.Init(config.Config.Models); err != nil {
+		logger.Fatal("初始化模型失败", zap.Error(err))
+		panic(err)
+	}
+}
+
+/**
+ * 启动上下文服务保活探测
+ * @description
+ * - 按context.keepaliveInterval配置的间隔探测已启用的上下文服务
+ * - 未配置间隔时不启动
+ * - 探测失败只记录告警日志，不影响程序运行
+ */
+func initContextKeepalive() {
+	interval := config.Context.KeepaliveInterval.Duration()
+	if interval <= 0 {
+		return
+	}
+	zap.L().Info("Start context service keepalive", zap.Duration("interval", interval))
+	codebase_context.StartKeepalive(context.Background(), interval)
+}
+
+/**
+ * 初始化补全拒绝规则
+ * @description
+ * - 按wrapper配置创建共享的补全拒绝规则链
+ * - 语法过滤器的正则表达式在此编译，配置错误时直接终止程序
+ * @throws
+ * - 如果规则配置错误(如正则表达式非法)，会导致程序panic并退出
+ */
+func initFilters() {
+	zap.L().Info("Initialize completion filters")
+	if err := completions.InitFilterChain(config.Wrapper); err != nil {
+		logger.Fatal("初始化补全拒绝规则失败", zap.Error(err))
+		panic(err)
+	}
+}
+
+/**
+ * 初始化指标
+ * @description
+ * - 按server.metrics配置设置耗时分布指标的桶
+ * @throws
+ * - 如果桶配置不合法(非正数或未严格递增)，会导致程序panic并退出
+ */
+func initMetrics() {
+	if err := metrics.SetDurationBuckets(config.Server.Metrics.DurationBuckets); err != nil {
+		logger.Fatal("初始化指标失败", zap.Error(err))
 		panic(err)
 	}
 }
@@ -226,19 +320,26 @@ func initTokenizer() {
 
 /**
  * 初始化配置
+ * @param {string} path - -config指定的配置文件路径，为空时使用默认路径
  * @description
  * - 记录配置加载开始日志
- * - 调用config包的LoadConfig方法加载配置文件
+ * - 未指定路径时调用config包的LoadConfig方法加载默认配置文件，否则调用LoadConfigFromFile
  * - 如果加载失败，记录错误日志并抛出panic终止程序
  * - 用于main函数中初始化应用程序配置
  * @throws
  * - 如果配置加载失败，会导致程序panic并退出
  */
-func initConfig() {
-	zap.L().Info("Fetch and load configures")
+func initConfig(path string) {
+	zap.L().Info("Fetch and load configures", zap.String("path", path))
 	config.UpdateRemoteConfigs()
-	if err := config.LoadConfig(); err != nil {
-		logger.Fatal("加载.costrict/config/completion-agent.json失败", zap.Error(err))
+	if path == "" {
+		if err := config.LoadConfig(); err != nil {
+			logger.Fatal("加载.costrict/config/completion-agent.json失败", zap.Error(err))
+			panic(err)
+		}
+	} else if err := config.LoadConfigFromFile(path); err != nil {
+		logger.Fatal("加载配置文件失败", zap.String("path", path), zap.Error(err))
 		panic(err)
 	}
+	logger.SetLogPromptContent(config.Server.LogPromptContent)
 }
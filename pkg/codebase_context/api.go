@@ -3,6 +3,7 @@ package codebase_context
 import (
 	"bytes"
 	"completion-agent/pkg/config"
+	"completion-agent/pkg/logger"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -83,11 +84,36 @@ func kvs2UrlValues(kvs map[string]interface{}) url.Values {
 func headers2zapAny(headers http.Header) map[string]interface{} {
 	headerMap := make(map[string]interface{})
 	for key, values := range headers {
+		// 凭证不写入日志
+		if key == "Authorization" {
+			headerMap[key] = "[redacted]"
+			continue
+		}
 		headerMap[key] = values
 	}
 	return headerMap
 }
 
+// Ping 向服务地址发送HEAD请求，用于保活连接及探测服务是否可达
+func (c *APIClient) Ping(ctx context.Context, requestURL string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, requestURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	// 只要服务能正常应答即视为可达，路由不支持HEAD方法(4xx)不算故障
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("ping failed with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
 // doRequest 发送HTTP请求
 func (c *APIClient) DoRequest(ctx context.Context, requestURL string, params RequestParam, headers http.Header, method string) (*ResponseData, error) {
 	var req *http.Request
@@ -125,7 +151,7 @@ func (c *APIClient) DoRequest(ctx context.Context, requestURL string, params Req
 	if err != nil {
 		zap.L().Warn("Request failed", zap.Error(err),
 			zap.String("url", requestURL),
-			zap.String("body", string(body)))
+			logger.Sensitive("body", string(body)))
 		return nil, err
 	}
 	defer resp.Body.Close()
@@ -136,7 +162,7 @@ func (c *APIClient) DoRequest(ctx context.Context, requestURL string, params Req
 			zap.Int("status", resp.StatusCode),
 			zap.String("url", requestURL),
 			zap.Any("headers", headers2zapAny(req.Header)),
-			zap.String("params", string(body)),
+			logger.Sensitive("params", string(body)),
 			zap.String("resp", string(data)))
 		return nil, fmt.Errorf("request failed with status %d", resp.StatusCode)
 	}
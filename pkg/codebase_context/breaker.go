@@ -0,0 +1,119 @@
+package codebase_context
+
+import (
+	"completion-agent/pkg/config"
+	"completion-agent/pkg/metrics"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// defaultSourceCooldown is how long a failing source is skipped when context.breaker.cooldown is unset
+const defaultSourceCooldown = 30 * time.Second
+
+// sourceBreaker tracks consecutive failures of one context source
+type sourceBreaker struct {
+	failures  int       // 连续失败次数
+	openUntil time.Time // 跳过该来源直到此时间，零值表示未跳过过
+	probing   bool      // 冷却结束后已放行一个探测请求，结果返回前其他请求继续跳过
+}
+
+/**
+ * Circuit breaker state of every context source (definition/semantic/relation)
+ * @description
+ * - Independent of the model circuit breaker
+ * - now can be replaced in tests
+ */
+var sourceBreakers = struct {
+	states map[string]*sourceBreaker
+	now    func() time.Time
+	mutex  sync.Mutex
+}{states: make(map[string]*sourceBreaker), now: time.Now}
+
+func breakerConfig() config.BreakerConfig {
+	if config.Context == nil {
+		return config.BreakerConfig{}
+	}
+	return config.Context.Breaker
+}
+
+/**
+ * Record the result of a request to a context source
+ * @param {string} source - Context source, one of SourceDefinition/SourceSemantic/SourceRelation
+ * @param {config.BreakerConfig} cfg - context.breaker, read before the request so abandoned
+ *   searches don't touch the config after the caller returned
+ * @param {error} err - Error returned by the request, nil on success
+ * @description
+ * - Does nothing unless context.breaker.failures is configured
+ * - Requests canceled by the caller are not counted; timeouts and service errors are
+ * - Once the consecutive failures reach the threshold the source is skipped for the cooldown
+ * - After the cooldown a single request probes the source again: one more failure skips it
+ *   again immediately, a success closes the breaker; any result ends the probe
+ */
+func recordSourceResult(source string, cfg config.BreakerConfig, err error) {
+	sourceBreakers.mutex.Lock()
+	defer sourceBreakers.mutex.Unlock()
+	b, ok := sourceBreakers.states[source]
+	if ok {
+		b.probing = false
+	}
+	if cfg.Failures <= 0 || errors.Is(err, context.Canceled) {
+		return
+	}
+	if !ok {
+		b = &sourceBreaker{}
+		sourceBreakers.states[source] = b
+	}
+	if err == nil {
+		if b.failures >= cfg.Failures {
+			zap.L().Info("Context source circuit breaker closed", zap.String("source", source))
+			metrics.SetContextSourceOpen(source, false)
+		}
+		b.failures = 0
+		return
+	}
+	b.failures++
+	now := sourceBreakers.now()
+	if b.failures >= cfg.Failures && !now.Before(b.openUntil) {
+		cooldown := cfg.Cooldown.Duration()
+		if cooldown <= 0 {
+			cooldown = defaultSourceCooldown
+		}
+		b.openUntil = now.Add(cooldown)
+		zap.L().Warn("Context source circuit breaker opened",
+			zap.String("source", source),
+			zap.Int("failures", b.failures),
+			zap.Error(err),
+			zap.Duration("cooldown", cooldown))
+		metrics.SetContextSourceOpen(source, true)
+	}
+}
+
+/**
+ * Check whether requests to a context source should be skipped
+ * @param {string} source - Context source
+ * @returns {bool} Returns true while the source's breaker is open; the skip is counted in metrics
+ * @description
+ * - Once the cooldown has passed, only one request is let through to probe the source;
+ *   others keep skipping it until the probe's result is recorded
+ */
+func skipSource(source string) bool {
+	sourceBreakers.mutex.Lock()
+	defer sourceBreakers.mutex.Unlock()
+	b, ok := sourceBreakers.states[source]
+	if !ok {
+		return false
+	}
+	if sourceBreakers.now().Before(b.openUntil) || b.probing {
+		metrics.IncrementContextSourceSkipped(source)
+		return true
+	}
+	// 冷却已结束但熔断仍打开，放行的这个请求作为探测
+	if failures := breakerConfig().Failures; failures > 0 && b.failures >= failures {
+		b.probing = true
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+package codebase_context
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"completion-agent/pkg/config"
+)
+
+func Test_SourceBreaker(t *testing.T) {
+	var semanticCalls, definitionCalls atomic.Int32
+	semanticUp := atomic.Bool{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/definition":
+			definitionCalls.Add(1)
+			w.Write([]byte(`{"data": {"list": []}}`))
+		case "/semantic":
+			semanticCalls.Add(1)
+			if !semanticUp.Load() {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Write([]byte(`{"data": {"list": []}}`))
+		}
+	}))
+	defer srv.Close()
+
+	savedNow := sourceBreakers.now
+	defer func() {
+		sourceBreakers.now = savedNow
+		sourceBreakers.states = make(map[string]*sourceBreaker)
+	}()
+	var cfg config.ContextConfig
+	err := json.Unmarshal([]byte(`{
+		"definition": {"url": "`+srv.URL+`/definition"},
+		"semantic": {"url": "`+srv.URL+`/semantic"},
+		"relation": {"disabled": true},
+		"breaker": {"failures": 2, "cooldown": "10s"}
+	}`), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withConfig(t, &cfg)
+	now := time.Unix(1000, 0)
+	sourceBreakers.now = func() time.Time { return now }
+	sourceBreakers.states = make(map[string]*sourceBreaker)
+
+	client := NewContextClient()
+	request := func() []string {
+		return client.RequestContext(context.Background(), "client", "/project", "/project/main.go",
+			[]string{"func main() {"}, []string{"main"}, nil).Skipped
+	}
+
+	// 连续失败两次后跳过语义检索，定义检索不受影响
+	request()
+	if got := request(); len(got) != 0 {
+		t.Fatalf("skipped = %v before the breaker opened", got)
+	}
+	if got := request(); len(got) != 1 || got[0] != SourceSemantic {
+		t.Fatalf("skipped = %v, want [semantic]", got)
+	}
+	if semanticCalls.Load() != 2 || definitionCalls.Load() != 3 {
+		t.Fatalf("calls = %d semantic, %d definition; want 2, 3", semanticCalls.Load(), definitionCalls.Load())
+	}
+
+	// 冷却结束后重新探测，仍然失败时立即再次跳过
+	now = now.Add(11 * time.Second)
+	request()
+	skipped := request()
+	if semanticCalls.Load() != 3 || len(skipped) != 1 {
+		t.Fatalf("semantic calls = %d, skipped = %v after re-probe", semanticCalls.Load(), skipped)
+	}
+
+	// 服务恢复后，探测成功即关闭熔断
+	semanticUp.Store(true)
+	now = now.Add(11 * time.Second)
+	request()
+	skipped = request()
+	if semanticCalls.Load() != 5 || len(skipped) != 0 {
+		t.Fatalf("semantic calls = %d, skipped = %v after recovery", semanticCalls.Load(), skipped)
+	}
+}
+
+func Test_SourceBreakerSingleProbe(t *testing.T) {
+	savedNow := sourceBreakers.now
+	defer func() {
+		sourceBreakers.now = savedNow
+		sourceBreakers.states = make(map[string]*sourceBreaker)
+	}()
+	withConfig(t, &config.ContextConfig{Breaker: config.BreakerConfig{Failures: 1}})
+	now := time.Unix(1000, 0)
+	sourceBreakers.now = func() time.Time { return now }
+	sourceBreakers.states = make(map[string]*sourceBreaker)
+
+	recordSourceResult(SourceSemantic, config.Context.Breaker, errors.New("unavailable"))
+	if !skipSource(SourceSemantic) {
+		t.Fatal("source should be skipped during the cooldown")
+	}
+
+	// 冷却结束后只放行一个探测请求，结果返回前其他请求仍然跳过
+	now = now.Add(time.Minute)
+	if skipSource(SourceSemantic) {
+		t.Fatal("the first request after the cooldown should probe the source")
+	}
+	if !skipSource(SourceSemantic) || !skipSource(SourceSemantic) {
+		t.Fatal("requests should be skipped while the probe is in flight")
+	}
+
+	// 探测被调用方取消时不计入失败，但允许下一个请求重新探测
+	recordSourceResult(SourceSemantic, config.Context.Breaker, context.Canceled)
+	if skipSource(SourceSemantic) {
+		t.Fatal("a canceled probe should let the next request probe again")
+	}
+	recordSourceResult(SourceSemantic, config.Context.Breaker, nil)
+	if skipSource(SourceSemantic) || skipSource(SourceSemantic) {
+		t.Fatal("source should not be skipped after a successful probe")
+	}
+}
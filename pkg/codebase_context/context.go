@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 
@@ -34,11 +35,58 @@ func NewContextClient() *ContextClient {
 	}
 }
 
+// ContextSnippet 拼入上下文的检索片段，用于说明补全参考了哪些代码
+type ContextSnippet struct {
+	Source   string  `json:"source"`          // 检索来源: definition/semantic/relation
+	FilePath string  `json:"filepath"`        // 片段所在文件
+	Score    float64 `json:"score,omitempty"` // 检索得分，定义检索没有得分
+	Length   int     `json:"length"`          // 片段内容长度(字节)
+}
+
+// 上下文片段的检索来源
+const (
+	SourceDefinition = "definition"
+	SourceSemantic   = "semantic"
+	SourceRelation   = "relation"
+)
+
 // SearchResult 搜索结果
 type SearchResult struct {
 	DefinitionResults []*ResponseData
 	SemanticResults   []*ResponseData
 	RelationResults   []*ResponseData
+	Skipped           []string // 本次请求因熔断被跳过的来源
+}
+
+// searchResults 并发检索的结果槽位，总超时返回后仍在进行的检索不会再修改已返回的结果
+type searchResults struct {
+	mutex sync.Mutex
+	data  []*ResponseData
+}
+
+func newSearchResults(n int) *searchResults {
+	return &searchResults{data: make([]*ResponseData, n)}
+}
+
+func (r *searchResults) set(idx int, data *ResponseData) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.data[idx] = data
+}
+
+// snapshot 返回当前已完成的结果副本
+func (r *searchResults) snapshot() []*ResponseData {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]*ResponseData(nil), r.data...)
+}
+
+// withRequestTimeout 按context.requestTimeout限制单个检索请求的耗时
+func withRequestTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if timeout := config.Context.RequestTimeout.Duration(); timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
 }
 
 /**
@@ -50,24 +98,28 @@ type SearchResult struct {
  * @param {string} codeSnippet - Code snippet to search for definitions
  * @param {http.Header} headers - HTTP headers for the request
  * @param {sync.WaitGroup} wg - Wait group for synchronization
- * @param {[]*ResponseData} results - Slice to store search results
- * @param {int} idx - Index in results slice to store the result
+ * @param {*searchResults} results - Result slots shared with the caller
+ * @param {int} idx - Index of the slot to store the result
  * @description
  * - Performs asynchronous definition search for code snippet
- * - Updates results slice at specified index with search result
- * - Handles errors by storing error result in results slice
+ * - Bounds the request by context.requestTimeout
+ * - Stores the result in the slot at idx on success; failed searches leave the slot empty
  * - Signals completion via done() on wait group
  * @example
  * wg.Add(1)
  * go client.searchDefinitionAsync(ctx, "client-id", "/codebase", "file.go", "func test()", headers, &wg, results, 0)
  */
 func (c *ContextClient) searchDefinitionAsync(ctx context.Context, clientID, codebasePath, filePath, codeSnippet string,
-	headers http.Header, wg *sync.WaitGroup, results []*ResponseData, idx int) {
+	headers http.Header, wg *sync.WaitGroup, results *searchResults, idx int) {
 	defer wg.Done()
 
+	ctx, cancel := withRequestTimeout(ctx)
+	defer cancel()
+	breaker := breakerConfig()
 	data, err := c.searchDefinition(ctx, clientID, codebasePath, filePath, codeSnippet, headers)
-	if err != nil {
-		results[idx] = data
+	recordSourceResult(SourceDefinition, breaker, err)
+	if err == nil {
+		results.set(idx, data)
 	}
 }
 
@@ -80,24 +132,28 @@ func (c *ContextClient) searchDefinitionAsync(ctx context.Context, clientID, cod
  * @param {string} codeSnippet - Code snippet to search for relations
  * @param {http.Header} headers - HTTP headers for the request
  * @param {sync.WaitGroup} wg - Wait group for synchronization
- * @param {[]*ResponseData} results - Slice to store search results
- * @param {int} idx - Index in results slice to store the result
+ * @param {*searchResults} results - Result slots shared with the caller
+ * @param {int} idx - Index of the slot to store the result
  * @description
  * - Performs asynchronous relation search for code snippet
- * - Updates results slice at specified index with search result
- * - Handles errors by storing error result in results slice
+ * - Bounds the request by context.requestTimeout
+ * - Stores the result in the slot at idx on success; failed searches leave the slot empty
  * - Signals completion via done() on wait group
  * @example
  * wg.Add(1)
  * go client.searchRelationAsync(ctx, "client-id", "/codebase", "file.go", "func test()", headers, &wg, results, 1)
  */
 func (c *ContextClient) searchRelationAsync(ctx context.Context, clientID, codebasePath, filePath, codeSnippet string,
-	headers http.Header, wg *sync.WaitGroup, results []*ResponseData, idx int) {
+	headers http.Header, wg *sync.WaitGroup, results *searchResults, idx int) {
 	defer wg.Done()
 
+	ctx, cancel := withRequestTimeout(ctx)
+	defer cancel()
+	breaker := breakerConfig()
 	data, err := c.searchRelation(ctx, clientID, codebasePath, filePath, codeSnippet, headers)
-	if err != nil {
-		results[idx] = data
+	recordSourceResult(SourceRelation, breaker, err)
+	if err == nil {
+		results.set(idx, data)
 	}
 }
 
@@ -109,24 +165,28 @@ func (c *ContextClient) searchRelationAsync(ctx context.Context, clientID, codeb
  * @param {string} query - Semantic query string to search for
  * @param {http.Header} headers - HTTP headers for the request
  * @param {sync.WaitGroup} wg - Wait group for synchronization
- * @param {[]*ResponseData} results - Slice to store search results
- * @param {int} idx - Index in results slice to store the result
+ * @param {*searchResults} results - Result slots shared with the caller
+ * @param {int} idx - Index of the slot to store the result
  * @description
  * - Performs asynchronous semantic search for code
- * - Updates results slice at specified index with search result
- * - Handles errors by storing error result in results slice
+ * - Bounds the request by context.requestTimeout
+ * - Stores the result in the slot at idx on success; failed searches leave the slot empty
  * - Signals completion via done() on wait group
  * @example
  * wg.Add(1)
  * go client.searchSemanticAsync(ctx, "client-id", "/codebase", "database query", headers, &wg, results, 2)
  */
 func (c *ContextClient) searchSemanticAsync(ctx context.Context, clientID, codebasePath, query string, headers http.Header,
-	wg *sync.WaitGroup, results []*ResponseData, idx int) {
+	wg *sync.WaitGroup, results *searchResults, idx int) {
 	defer wg.Done()
 
+	ctx, cancel := withRequestTimeout(ctx)
+	defer cancel()
+	breaker := breakerConfig()
 	data, err := c.searchSemantic(ctx, clientID, codebasePath, query, headers)
-	if err != nil {
-		results[idx] = data
+	recordSourceResult(SourceSemantic, breaker, err)
+	if err == nil {
+		results.set(idx, data)
 	}
 }
 
@@ -143,9 +203,12 @@ func (c *ContextClient) searchSemanticAsync(ctx context.Context, clientID, codeb
  * @description
  * - Performs parallel searches for definitions, relations and semantic matches
  * - Uses goroutines for concurrent execution of different search types
- * - Sets up timeout context based on configuration
- * - Returns partial results if context timeout occurs
+ * - Bounds each search by requestTimeout and all of them by totalTimeout
+ * - Returns partial results if context timeout occurs: searches that already
+ *   returned are used, slow ones are abandoned
  * - Respects configuration flags for enabling/disabling specific search types
+ * - Skips sources whose circuit breaker is open after repeated failures (context.breaker),
+ *   and reports the sources skipped for this request in Skipped
  * @example
  * result := client.RequestContext(ctx, "client-id", "/codebase", "file.go",
  *     []string{"func test()"}, []string{"database query"}, headers)
@@ -156,18 +219,36 @@ func (c *ContextClient) RequestContext(ctx context.Context, clientID, codebasePa
 		return &SearchResult{}
 	}
 
-	// 创建上下文，设置超时
-	ctx, cancel := context.WithTimeout(ctx, config.Context.TotalTimeout.Duration())
+	// 创建上下文，设置总超时
+	var cancel context.CancelFunc
+	if timeout := config.Context.TotalTimeout.Duration(); timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
 	defer cancel()
 
 	var wg sync.WaitGroup
 	// 初始化结果数组
-	definitionResults := make([]*ResponseData, len(codeSnippets))
-	relationResults := make([]*ResponseData, len(codeSnippets))
-	semanticResults := make([]*ResponseData, len(queries))
+	definitionResults := newSearchResults(len(codeSnippets))
+	relationResults := newSearchResults(len(codeSnippets))
+	semanticResults := newSearchResults(len(queries))
+
+	// 来源已禁用或没有要检索的内容时不请求，也不占用熔断的探测机会
+	var skipped []string
+	search := func(source string, disabled bool, items []string) bool {
+		if disabled || !slices.ContainsFunc(items, func(s string) bool { return s != "" }) {
+			return false
+		}
+		if skipSource(source) {
+			skipped = append(skipped, source)
+			return false
+		}
+		return true
+	}
 
 	// 定义检索
-	if len(codeSnippets) > 0 && !config.Context.Definition.Disabled {
+	if search(SourceDefinition, config.Context.Definition.Disabled, codeSnippets) {
 		for i, codeSnippet := range codeSnippets {
 			if codeSnippet == "" {
 				continue
@@ -177,7 +258,7 @@ func (c *ContextClient) RequestContext(ctx context.Context, clientID, codebasePa
 		}
 	}
 	// 调用链检索
-	if len(codeSnippets) > 0 && !config.Context.Relation.Disabled {
+	if search(SourceRelation, config.Context.Relation.Disabled, codeSnippets) {
 		for i, codeSnippet := range codeSnippets {
 			if codeSnippet == "" {
 				continue
@@ -188,7 +269,7 @@ func (c *ContextClient) RequestContext(ctx context.Context, clientID, codebasePa
 	}
 
 	// 语义检索
-	if len(queries) > 0 && !config.Context.Semantic.Disabled {
+	if search(SourceSemantic, config.Context.Semantic.Disabled, queries) {
 		for i, query := range queries {
 			if query == "" {
 				continue
@@ -212,9 +293,10 @@ func (c *ContextClient) RequestContext(ctx context.Context, clientID, codebasePa
 		zap.L().Warn("Context timeout, returning partial results", zap.Error(ctx.Err()))
 	}
 	return &SearchResult{
-		DefinitionResults: definitionResults,
-		SemanticResults:   semanticResults,
-		RelationResults:   relationResults,
+		DefinitionResults: definitionResults.snapshot(),
+		SemanticResults:   semanticResults.snapshot(),
+		RelationResults:   relationResults.snapshot(),
+		Skipped:           skipped,
 	}
 }
 
@@ -235,15 +317,41 @@ func (c *ContextClient) RequestContext(ctx context.Context, clientID, codebasePa
  * - Extracts semantic search content from prefix (last 4 lines)
  * - Builds code snippets for definition search
  * - Performs multi-source context retrieval (definition, semantic, relation)
- * - Parses and combines results from all search types
+ * - Parses results from all search types and merges them within the configured budget
  * - Adds comments to the final context result
  * @example
  * context := client.GetContext(ctx, "client-id", "/project", "src/file.go",
  *     "func main() {", "}", "import fmt", headers)
  */
 func (c *ContextClient) GetContext(ctx context.Context, clientID, projectPath, filePath, prefix, suffix, importContent string, headers http.Header) string {
+	codeContext, _, _ := c.GetContextWithSnippets(ctx, clientID, projectPath, filePath, prefix, suffix, importContent, headers, ContextBudget(0))
+	return codeContext
+}
+
+/**
+ * Get context information together with the snippets it was built from
+ * @param {context.Context} ctx - Context for request cancellation and timeout
+ * @param {string} clientID - Client identifier for the request
+ * @param {string} projectPath - Path to the project root
+ * @param {string} filePath - Path to the file being analyzed (relative to project)
+ * @param {string} prefix - Code content before cursor position
+ * @param {string} suffix - Code content after cursor position
+ * @param {string} importContent - Import statements for the file
+ * @param {http.Header} headers - HTTP headers for the requests
+ * @param {int} budget - Token budget for the merged snippets, see ContextBudget; 0 means unlimited
+ * @returns {string, []ContextSnippet, []string} Returns formatted context, the snippets merged into it in order,
+ *   and the sources skipped by their circuit breaker for this request
+ * @description
+ * - Same retrieval and formatting as GetContext
+ * - Snippets repeating code already in the prefix or suffix are dropped by DropOverlapping
+ * - Snippets are ranked, deduplicated and cut to the budget by MergeSnippets; when the
+ *   commented context still exceeds the budget, the lowest ranked snippets are dropped
+ * - Additionally reports source, file path, score and length of every merged snippet
+ * - Used to explain which context a completion was based on
+ */
+func (c *ContextClient) GetContextWithSnippets(ctx context.Context, clientID, projectPath, filePath, prefix, suffix, importContent string, headers http.Header, budget int) (string, []ContextSnippet, []string) {
 	if clientID == "" || projectPath == "" || filePath == "" || (prefix == "" && suffix == "") {
-		return ""
+		return "", nil, nil
 	}
 
 	// 构建完整文件路径
@@ -274,37 +382,33 @@ func (c *ContextClient) GetContext(ctx context.Context, clientID, projectPath, f
 	// 解析关系检索结果
 	relationCodes := parseRelation(searchResult.RelationResults)
 
-	var allCodes []string
-
-	// 合并定义检索结果
+	var retrieved []RetrievedSnippet
 	for _, item := range defCodes {
-		allCodes = append(allCodes, item.FilePath, item.Content)
-		// if len(item) > 1 {
-		// 	allCodes = append(allCodes, item[1:]...)
-		// }
+		retrieved = append(retrieved, RetrievedSnippet{
+			ContextSnippet: ContextSnippet{Source: SourceDefinition, FilePath: item.FilePath},
+			Content:        item.Content,
+		})
 	}
-
-	// 合并语义检索结果
 	for _, item := range semanticCodes {
-		allCodes = append(allCodes, item.FilePath, item.Content)
-		// if len(item) >= 2 {
-		// 	allCodes = append(allCodes, item[:2]...)
-		// }
+		retrieved = append(retrieved, RetrievedSnippet{
+			ContextSnippet: ContextSnippet{Source: SourceSemantic, FilePath: item.FilePath, Score: item.Score},
+			Content:        item.Content,
+		})
 	}
-
-	// 合并关系检索结果
 	for _, item := range relationCodes {
-		allCodes = append(allCodes, item.FilePath, item.Content)
-		// if len(item) > 1 {
-		// 	allCodes = append(allCodes, item[1:]...)
-		// }
+		retrieved = append(retrieved, RetrievedSnippet{
+			ContextSnippet: ContextSnippet{Source: SourceRelation, FilePath: item.FilePath, Score: item.Score},
+			Content:        item.Content,
+		})
 	}
 
-	// 合并所有结果
-	semanticResult := strings.Join(allCodes, "\n")
+	// 丢弃当前文件中已有的代码，再排序、去重并按预算合并所有结果
+	retrieved = DropOverlapping(retrieved, prefix, suffix)
+	comment := func(code string) string { return getComment(fullFilePath, code) }
+	merged, snippets := mergeSnippets(retrieved, budget, comment)
 
 	// 添加注释
-	return getComment(fullFilePath, semanticResult)
+	return comment(merged), snippets, searchResult.Skipped
 }
 
 /**
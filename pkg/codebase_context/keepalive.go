@@ -0,0 +1,111 @@
+package codebase_context
+
+import (
+	"completion-agent/pkg/config"
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// contextService describes a context service that can be pinged
+type contextService struct {
+	name string
+	url  string
+}
+
+/**
+ * List the enabled context services
+ * @returns {[]contextService} Returns name and URL of every enabled service with a URL configured
+ */
+func enabledServices() []contextService {
+	var services []contextService
+	if config.Context == nil {
+		return services
+	}
+	if !config.Context.Definition.Disabled && config.Context.Definition.Url != "" {
+		services = append(services, contextService{"definition", config.Context.Definition.Url})
+	}
+	if !config.Context.Semantic.Disabled && config.Context.Semantic.Url != "" {
+		services = append(services, contextService{"semantic", config.Context.Semantic.Url})
+	}
+	if !config.Context.Relation.Disabled && config.Context.Relation.Url != "" {
+		services = append(services, contextService{"relation", config.Context.Relation.Url})
+	}
+	return services
+}
+
+/**
+ * Start periodic keepalive pings to the enabled context services
+ * @param {context.Context} ctx - Stops the keepalive loop when done
+ * @param {time.Duration} interval - Interval between two rounds of pings, non-positive disables keepalive
+ * @description
+ * - Pings each enabled context service (definition/semantic/relation) once per interval
+ * - Keeps pooled connections to the services warm between completion requests
+ * - Failures are logged as warnings only, so outages surface before a real request
+ *   without affecting the agent
+ * - The enabled services are re-read on every round
+ * @example
+ * StartKeepalive(context.Background(), 30*time.Second)
+ */
+func StartKeepalive(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	client := NewAPIClient()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				pingServices(ctx, client)
+			}
+		}
+	}()
+}
+
+/**
+ * Ping every enabled context service once
+ * @param {context.Context} ctx - Context for request cancellation
+ * @param {*APIClient} client - Client used to send the pings
+ */
+func pingServices(ctx context.Context, client *APIClient) {
+	for _, s := range checkServices(ctx, client) {
+		if s.Err != nil {
+			zap.L().Warn("Context service keepalive failed",
+				zap.String("service", s.Name),
+				zap.String("url", s.Url),
+				zap.Error(s.Err))
+		}
+	}
+}
+
+// ServiceCheck result of pinging one context service
+type ServiceCheck struct {
+	Name string // definition/semantic/relation
+	Url  string
+	Err  error // nil when the service answered
+}
+
+/**
+ * Check reachability of every enabled context service
+ * @param {context.Context} ctx - Context for request cancellation and timeout
+ * @returns {[]ServiceCheck} Returns one result per enabled service, empty when none is enabled
+ * @description
+ * - Sends the same HEAD ping as the keepalive loop
+ * - Used by the startup self-test
+ */
+func CheckServices(ctx context.Context) []ServiceCheck {
+	return checkServices(ctx, NewAPIClient())
+}
+
+func checkServices(ctx context.Context, client *APIClient) []ServiceCheck {
+	var checks []ServiceCheck
+	for _, s := range enabledServices() {
+		checks = append(checks, ServiceCheck{Name: s.name, Url: s.url, Err: client.Ping(ctx, s.url)})
+	}
+	return checks
+}
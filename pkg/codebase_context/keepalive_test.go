@@ -0,0 +1,57 @@
+package codebase_context
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"completion-agent/pkg/config"
+)
+
+func Test_StartKeepalive(t *testing.T) {
+	var mu sync.Mutex
+	pings := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			t.Errorf("unexpected method %s", r.Method)
+		}
+		mu.Lock()
+		pings[r.URL.Path]++
+		mu.Unlock()
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}))
+	defer srv.Close()
+
+	withConfig(t, &config.ContextConfig{
+		Definition: config.DefinitionConfig{Url: srv.URL + "/definition"},
+		Semantic:   config.SemanticConfig{Url: srv.URL + "/semantic"},
+		Relation:   config.RelationConfig{Disabled: true, Url: srv.URL + "/relation"},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	StartKeepalive(ctx, 20*time.Millisecond)
+	time.Sleep(110 * time.Millisecond)
+	cancel()
+	time.Sleep(40 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, path := range []string{"/definition", "/semantic"} {
+		if pings[path] < 3 || pings[path] > 6 {
+			t.Errorf("%s pinged %d times in 110ms with a 20ms interval", path, pings[path])
+		}
+	}
+	if pings["/relation"] != 0 {
+		t.Errorf("disabled service was pinged %d times", pings["/relation"])
+	}
+	stopped := pings["/definition"]
+	mu.Unlock()
+	time.Sleep(60 * time.Millisecond)
+	mu.Lock()
+	if pings["/definition"] != stopped {
+		t.Errorf("keepalive continued after cancel")
+	}
+}
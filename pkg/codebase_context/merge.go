@@ -0,0 +1,243 @@
+package codebase_context
+
+import (
+	"completion-agent/pkg/config"
+	"completion-agent/pkg/tokenizers"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Defaults used when the merge config leaves a field unset
+const (
+	defaultBudgetRatio = 0.5
+	defaultPathFormat  = "Path: %s"
+	defaultSeparator   = "\n"
+	defaultOverlap     = 0.8
+	minOverlapChars    = 3 // lines with fewer letters and digits don't count towards overlap
+)
+
+// RetrievedSnippet 检索服务返回的一个代码片段
+type RetrievedSnippet struct {
+	ContextSnippet
+	Content string
+}
+
+// sourceRank 来源优先级，定义检索命中的是前缀里实际引用的符号，最相关
+var sourceRank = map[string]int{
+	SourceDefinition: 0,
+	SourceSemantic:   1,
+	SourceRelation:   2,
+}
+
+/**
+ * Compute the context token budget for a model
+ * @param {int} maxPrefix - Model's prefix token limit (maxPrefix)
+ * @returns {int} Returns the token budget for merged context, 0 means unlimited
+ * @description
+ * - Budget is maxPrefix * context.merge.budgetRatio (0.5 when unset)
+ * - Capped by context.merge.maxTokens when configured
+ * - Without maxPrefix only maxTokens applies
+ * @example
+ * budget := ContextBudget(2048) // 1024 with default config
+ */
+func ContextBudget(maxPrefix int) int {
+	cfg := mergeConfig()
+	budget := 0
+	if maxPrefix > 0 {
+		ratio := cfg.BudgetRatio
+		if ratio <= 0 {
+			ratio = defaultBudgetRatio
+		}
+		budget = int(float64(maxPrefix) * ratio)
+	}
+	if cfg.MaxTokens > 0 && (budget <= 0 || budget > cfg.MaxTokens) {
+		budget = cfg.MaxTokens
+	}
+	return budget
+}
+
+/**
+ * Rank, deduplicate and concatenate retrieved snippets within a token budget
+ * @param {[]RetrievedSnippet} snippets - Snippets returned by the retrieval services
+ * @param {int} budget - Token budget for the merged text, 0 means unlimited
+ * @returns {string, []ContextSnippet} Returns merged text and the snippets it contains, in output order
+ * @description
+ * - Ranks by source (definition, semantic, relation) and then by score, highest first
+ * - Drops empty snippets and snippets whose content repeats a higher ranked one
+ * - Picks snippets in rank order while they fit in the budget; snippets that don't fit are skipped
+ * - Emits the picked snippets in reverse rank order, so the most relevant one ends up closest to the cursor
+ * - Prefixes each snippet with a file path line formatted by context.merge.pathFormat
+ * - Tokens are counted with the global tokenizer, or estimated from length when it isn't loaded
+ * @example
+ * text, used := MergeSnippets(snippets, ContextBudget(cfg.MaxPrefix))
+ */
+func MergeSnippets(snippets []RetrievedSnippet, budget int) (string, []ContextSnippet) {
+	return mergeSnippets(snippets, budget, nil)
+}
+
+/**
+ * Merge snippets like MergeSnippets, keeping the rendered text within the budget
+ * @param {[]RetrievedSnippet} snippets - Snippets returned by the retrieval services
+ * @param {int} budget - Token budget for the rendered text, 0 means unlimited
+ * @param {func(string) string} render - Turns the merged text into what is sent to the model, nil keeps it as is
+ * @returns {string, []ContextSnippet} Returns merged (not rendered) text and the snippets it contains, in output order
+ * @description
+ * - Rendering (e.g. commenting every line) adds tokens the per-snippet budget doesn't see;
+ *   while the rendered text exceeds the budget the lowest ranked snippet is dropped
+ */
+func mergeSnippets(snippets []RetrievedSnippet, budget int, render func(string) string) (string, []ContextSnippet) {
+	cfg := mergeConfig()
+	pathFormat := cfg.PathFormat
+	if pathFormat == "" {
+		pathFormat = defaultPathFormat
+	}
+	separator := cfg.Separator
+	if separator == "" {
+		separator = defaultSeparator
+	}
+
+	ranked := make([]RetrievedSnippet, 0, len(snippets))
+	for _, s := range snippets {
+		if strings.TrimSpace(s.Content) != "" {
+			ranked = append(ranked, s)
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		ri, rj := sourceRank[ranked[i].Source], sourceRank[ranked[j].Source]
+		if ri != rj {
+			return ri < rj
+		}
+		return ranked[i].Score > ranked[j].Score
+	})
+
+	var blocks []string
+	var picked []ContextSnippet
+	seen := make(map[string]bool)
+	used := 0
+	for _, s := range ranked {
+		key := strings.TrimSpace(s.Content)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		block := s.Content
+		if s.FilePath != "" {
+			block = fmt.Sprintf(pathFormat, s.FilePath) + "\n" + s.Content
+		}
+		tokens := CountTokens(block + separator)
+		if budget > 0 && used+tokens > budget {
+			continue
+		}
+		used += tokens
+		s.Length = len(s.Content)
+		blocks = append(blocks, block)
+		picked = append(picked, s.ContextSnippet)
+	}
+
+	// 最相关的片段放在最后，紧挨着光标前的代码
+	for i, j := 0, len(blocks)-1; i < j; i, j = i+1, j-1 {
+		blocks[i], blocks[j] = blocks[j], blocks[i]
+		picked[i], picked[j] = picked[j], picked[i]
+	}
+	// 渲染后超出预算时，从最前面(优先级最低)的片段开始丢弃
+	for render != nil && budget > 0 && len(blocks) > 0 && CountTokens(render(strings.Join(blocks, separator))) > budget {
+		blocks, picked = blocks[1:], picked[1:]
+	}
+	return strings.Join(blocks, separator), picked
+}
+
+/**
+ * Drop retrieved snippets that repeat code already in the current file
+ * @param {[]RetrievedSnippet} snippets - Snippets returned by the retrieval services
+ * @param {string} prefix - Code content before cursor position
+ * @param {string} suffix - Code content after cursor position
+ * @returns {[]RetrievedSnippet} Returns the snippets that don't overlap the file, in the original order
+ * @description
+ * - Lines are compared with whitespace collapsed, so reindented copies still match
+ * - Overlap is the share of a snippet's significant lines that also appear in the prefix or suffix;
+ *   punctuation-only and very short lines (braces, "fi", "});") are ignored on both sides,
+ *   so boilerplate shared by any code doesn't count as overlap
+ * - Snippets whose overlap reaches context.overlapThreshold (0.8 when unset) are dropped
+ * - A threshold above 1 disables the check
+ * @example
+ * retrieved = DropOverlapping(retrieved, prefix, suffix)
+ */
+func DropOverlapping(snippets []RetrievedSnippet, prefix, suffix string) []RetrievedSnippet {
+	threshold := defaultOverlap
+	if config.Context != nil && config.Context.OverlapThreshold > 0 {
+		threshold = config.Context.OverlapThreshold
+	}
+	if threshold > 1 || len(snippets) == 0 {
+		return snippets
+	}
+	fileLines := make(map[string]bool)
+	for _, line := range significantLines(prefix + "\n" + suffix) {
+		fileLines[line] = true
+	}
+	kept := snippets[:0:0]
+	for _, s := range snippets {
+		lines := significantLines(s.Content)
+		matched := 0
+		for _, line := range lines {
+			if fileLines[line] {
+				matched++
+			}
+		}
+		if len(lines) > 0 && float64(matched)/float64(len(lines)) >= threshold {
+			continue
+		}
+		kept = append(kept, s)
+	}
+	return kept
+}
+
+// normalizedLines splits text into non-blank lines with runs of whitespace collapsed to one space
+func normalizedLines(text string) []string {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			lines = append(lines, strings.Join(fields, " "))
+		}
+	}
+	return lines
+}
+
+// significantLines returns the normalized lines with at least minOverlapChars letters or digits
+func significantLines(text string) []string {
+	var lines []string
+	for _, line := range normalizedLines(text) {
+		chars := 0
+		for _, r := range line {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) {
+				chars++
+			}
+		}
+		if chars >= minOverlapChars {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func mergeConfig() config.MergeConfig {
+	if config.Context == nil {
+		return config.MergeConfig{}
+	}
+	return config.Context.Merge
+}
+
+/**
+ * Count tokens of a context text
+ * @param {string} text - Text to count
+ * @returns {int} Returns the token count by the global tokenizer, or the rune-based estimate
+ * (wrapper.tokenizer.charsPerToken) when it isn't loaded
+ */
+func CountTokens(text string) int {
+	if t := tokenizers.GetTokenizer(); t != nil {
+		return t.GetTokenCount(text)
+	}
+	return tokenizers.EstimateTokens(text)
+}
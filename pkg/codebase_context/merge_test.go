@@ -0,0 +1,164 @@
+package codebase_context
+
+import (
+	"strings"
+	"testing"
+
+	"completion-agent/pkg/config"
+)
+
+// withConfig sets the context config for a test and restores the global config when it finishes;
+// nil stands for an empty config. The wrapper config is reset to an empty one as well
+func withConfig(t *testing.T, cfg *config.ContextConfig) {
+	t.Helper()
+	savedContext, savedWrapper := config.Context, config.Wrapper
+	t.Cleanup(func() { config.Context, config.Wrapper = savedContext, savedWrapper })
+	if cfg == nil {
+		cfg = &config.ContextConfig{}
+	}
+	config.Context, config.Wrapper = cfg, &config.WrapperConfig{}
+}
+
+func Test_MergeSnippets(t *testing.T) {
+	withConfig(t, nil)
+
+	snippets := []RetrievedSnippet{
+		{ContextSnippet{Source: SourceRelation, FilePath: "rel.go", Score: 0.9}, "func caller() {}"},
+		{ContextSnippet{Source: SourceSemantic, FilePath: "low.go", Score: 0.3}, "func low() {}"},
+		{ContextSnippet{Source: SourceSemantic, FilePath: "high.go", Score: 0.8}, "func high() {}"},
+		{ContextSnippet{Source: SourceDefinition, FilePath: "def.go"}, "type Item struct{}"},
+		{ContextSnippet{Source: SourceSemantic, FilePath: "copy.go", Score: 0.7}, "type Item struct{}\n"},
+		{ContextSnippet{Source: SourceSemantic, FilePath: "empty.go", Score: 1}, "  \n"},
+	}
+
+	text, used := MergeSnippets(snippets, 0)
+	want := strings.Join([]string{
+		"Path: rel.go", "func caller() {}",
+		"Path: low.go", "func low() {}",
+		"Path: high.go", "func high() {}",
+		"Path: def.go", "type Item struct{}",
+	}, "\n")
+	if text != want {
+		t.Errorf("merged text:\n%s\nwant:\n%s", text, want)
+	}
+	var paths []string
+	for _, s := range used {
+		paths = append(paths, s.FilePath)
+	}
+	if got := strings.Join(paths, ","); got != "rel.go,low.go,high.go,def.go" {
+		t.Errorf("snippets = %s", got)
+	}
+	if used[3].Length != len("type Item struct{}") {
+		t.Errorf("length = %d", used[3].Length)
+	}
+
+	// 预算只够两个片段时保留最相关的定义和高分语义片段，放不下的片段跳过
+	budget := CountTokens("Path: def.go\ntype Item struct{}\n") + CountTokens("Path: high.go\nfunc high() {}\n")
+	text, used = MergeSnippets(snippets, budget)
+	if text != "Path: high.go\nfunc high() {}\nPath: def.go\ntype Item struct{}" || len(used) != 2 {
+		t.Errorf("budgeted text:\n%s", text)
+	}
+
+	config.Context.Merge = config.MergeConfig{PathFormat: "File: %s", Separator: "\n\n"}
+	text, _ = MergeSnippets(snippets[2:4], 0)
+	if text != "File: high.go\nfunc high() {}\n\nFile: def.go\ntype Item struct{}" {
+		t.Errorf("formatted text:\n%s", text)
+	}
+}
+
+func Test_ContextBudget(t *testing.T) {
+	withConfig(t, nil)
+
+	if got := ContextBudget(2000); got != 1000 {
+		t.Errorf("default ratio: %d", got)
+	}
+	config.Context.Merge = config.MergeConfig{BudgetRatio: 0.25, MaxTokens: 300}
+	if got := ContextBudget(2000); got != 300 {
+		t.Errorf("capped: %d", got)
+	}
+	if got := ContextBudget(0); got != 300 {
+		t.Errorf("without maxPrefix: %d", got)
+	}
+	config.Context.Merge.MaxTokens = 0
+	if got := ContextBudget(800); got != 200 {
+		t.Errorf("ratio: %d", got)
+	}
+}
+
+func Test_DropOverlapping(t *testing.T) {
+	withConfig(t, nil)
+
+	prefix := "package item\n\ntype Item struct {\n\tName string\n}\n\nfunc use() {\n\tit := "
+	suffix := "\n}\n"
+	snippets := []RetrievedSnippet{
+		{ContextSnippet{Source: SourceDefinition, FilePath: "item.go"}, "type Item struct {\n\tName string\n}"},
+		{ContextSnippet{Source: SourceDefinition, FilePath: "indent.go"}, "type  Item struct {\n    Name   string\n}\n"},
+		{ContextSnippet{Source: SourceSemantic, FilePath: "other.go", Score: 0.9}, "type Other struct {\n\tName string\n}"},
+	}
+
+	kept := DropOverlapping(snippets, prefix, suffix)
+	if len(kept) != 1 || kept[0].FilePath != "other.go" {
+		t.Fatalf("kept = %+v, want only other.go", kept)
+	}
+
+	// 阈值大于1时不去重
+	config.Context.OverlapThreshold = 1.1
+	if kept := DropOverlapping(snippets, prefix, suffix); len(kept) != 3 {
+		t.Errorf("kept %d snippets with check disabled, want 3", len(kept))
+	}
+	// 较低的阈值同样丢弃部分重合的片段，只含括号的行不参与计算
+	config.Context.OverlapThreshold = 0.5
+	if kept := DropOverlapping(snippets, prefix, suffix); len(kept) != 0 {
+		t.Errorf("kept %d snippets with threshold 0.5, want 0", len(kept))
+	}
+}
+
+func Test_DropOverlappingTrivialLines(t *testing.T) {
+	withConfig(t, &config.ContextConfig{OverlapThreshold: 0.6})
+
+	prefix := "func open() error {\n\tif err := check(); err != nil {\n\t\treturn nil\n\t}\n\treturn nil\n}\n\nfunc use() {\n\t"
+	snippets := []RetrievedSnippet{
+		{ContextSnippet{Source: SourceDefinition, FilePath: "store.go"}, "func (s *Store) Close() error {\n\treturn nil\n}"},
+		{ContextSnippet{Source: SourceSemantic, FilePath: "braces.go", Score: 0.5}, "}\n})\n{"},
+	}
+
+	// 与前缀只有括号和return nil相同的定义不算重复
+	kept := DropOverlapping(snippets, prefix, "\n}\n")
+	if len(kept) != 2 || kept[0].FilePath != "store.go" {
+		t.Errorf("kept = %+v, want both snippets", kept)
+	}
+}
+
+func Test_CountTokensEstimate(t *testing.T) {
+	withConfig(t, nil)
+
+	// Without a global tokenizer the count is estimated from runes, not bytes
+	if got := CountTokens("中文字符"); got != 1 {
+		t.Errorf("default estimate: got %d, want 1", got)
+	}
+	config.Wrapper.Tokenizer.CharsPerToken = 2
+	if got := CountTokens("中文字符串"); got != 3 {
+		t.Errorf("configured estimate: got %d, want 3", got)
+	}
+}
+
+func Test_MergeSnippetsRendered(t *testing.T) {
+	withConfig(t, nil)
+
+	snippets := []RetrievedSnippet{
+		{ContextSnippet{Source: SourceSemantic, FilePath: "low.go", Score: 0.3}, "func low() {}"},
+		{ContextSnippet{Source: SourceDefinition, FilePath: "def.go"}, "type Item struct{}"},
+	}
+	comment := func(code string) string { return CommentCode("main.go", code) }
+	merged, _ := MergeSnippets(snippets, 0)
+	budget := CountTokens(merged)
+
+	// 两个片段合并后刚好在预算内，加注释后超出，丢弃优先级最低的片段
+	text, used := mergeSnippets(snippets, budget, comment)
+	if len(used) != 1 || used[0].FilePath != "def.go" {
+		t.Fatalf("used = %+v, want only def.go", used)
+	}
+	if n := CountTokens(comment(text)); n > budget {
+		t.Errorf("rendered context has %d tokens, budget %d", n, budget)
+	}
+}
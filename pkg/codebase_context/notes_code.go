@@ -269,6 +269,11 @@ var extMap = map[string]CommentFunc{
 	".md":   commentWithMarkdown,
 }
 
+// CommentCode 按文件扩展名将参考代码转为注释，以便拼入该文件的补全上下文
+func CommentCode(filePath string, code string) string {
+	return getComment(filePath, code)
+}
+
 // getComment 根据文件扩展名选择合适的注释函数，并返回注释后的代码
 func getComment(filePath string, code string) string {
 	if code == "" {
@@ -2,13 +2,17 @@ package completions
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
 
+	"completion-agent/pkg/codebase_context"
 	"completion-agent/pkg/config"
 	"completion-agent/pkg/env"
+	"completion-agent/pkg/metrics"
 	"completion-agent/pkg/model"
+	"completion-agent/pkg/parser"
 
 	"go.uber.org/zap"
 )
@@ -26,6 +30,9 @@ type CompletionHandler struct {
 	llm model.LLM           // 模型
 }
 
+// 请求extra.dry_run为true时，不调用模型的原因
+var errDryRun = errors.New("dry run: model not called")
+
 /**
  * 补全上下文结构体
  * @description
@@ -38,8 +45,11 @@ type CompletionHandler struct {
  * ctx := NewCompletionContext(context.Background(), perf)
  */
 type CompletionContext struct {
-	Ctx  context.Context
-	Perf *CompletionPerformance
+	Ctx   context.Context
+	Perf  *CompletionPerformance
+	Input *CompletionInput             // 补全输入，供后置处理读取请求级的选项
+	Batch bool                         // 批量请求中的一项，不取代同一客户端正在处理的请求
+	diag  *model.CompletionDiagnostics // verbose请求的诊断信息，非verbose请求为nil
 }
 
 /**
@@ -65,34 +75,56 @@ func NewCompletionContext(ctx context.Context, perf *CompletionPerformance) *Com
 
 /**
  * 创建新的补全处理器
- * @param {model.LLM} m - 大语言模型实例，如果为nil则使用自动选择的模型
+ * @param {model.LLM} m - 大语言模型实例，不能为nil
  * @returns {*CompletionHandler} 返回初始化好的补全处理器对象指针
  * @description
  * - 创建并初始化补全处理器实例
- * - 如果传入的模型为nil，使用自动选择的模型
  * - 获取模型配置信息并保存到处理器中
  * - 返回可用于处理补全请求的处理器
+ * - 自动选择模型时使用NewAutoCompletionHandler
  * @example
- * handler := NewCompletionHandler(nil)
- * // 使用自动选择的模型
- *
- * customModel := model.GetAutoModel()
+ * customModel, _ := model.GetModel(0)
  * handler := NewCompletionHandler(customModel)
  * // 使用指定的模型
  */
 func NewCompletionHandler(m model.LLM) *CompletionHandler {
-	if m == nil {
-		m = model.GetAutoModel()
-	}
 	return &CompletionHandler{
 		llm: m,
 		cfg: m.Config(),
 	}
 }
 
-func (h *CompletionHandler) Adapt(input *CompletionInput) *model.CompletionParameter {
+/**
+ * 使用自动选择的模型创建补全处理器
+ * @returns {*CompletionHandler, error} 返回补全处理器，没有可用的模型时返回model.ErrNoModels
+ * @description
+ * - 按model.GetAutoModel轮询选择模型
+ * @example
+ * handler, err := NewAutoCompletionHandler()
+ * if err != nil {
+ *     // 返回503
+ * }
+ */
+func NewAutoCompletionHandler() (*CompletionHandler, error) {
+	m, err := model.GetAutoModel()
+	if err != nil {
+		return nil, err
+	}
+	return NewCompletionHandler(m), nil
+}
+
+func (h *CompletionHandler) Adapt(c *CompletionContext, input *CompletionInput) *model.CompletionParameter {
 	// 3. 补全模型相关的前置处理 （拼接prompt策略，单行/多行补全策略，裁剪过长上下文）
-	h.truncatePrompt(h.cfg, input.Prompts)
+	normalizePrompt(input.Prompts, input.LanguageID)
+	start := time.Now()
+	if c.diag != nil {
+		before := *input.Prompts
+		h.truncatePrompt(c.Ctx, h.cfg, input.Prompts)
+		c.diag.Truncation = h.truncationStats(&before, input.Prompts)
+	} else {
+		h.truncatePrompt(c.Ctx, h.cfg, input.Prompts)
+	}
+	c.recordStage("truncate", start)
 
 	// 4. 准备停用词，根据是否单行补全调整停用词
 	stopWords := h.prepareStopWords(input)
@@ -108,14 +140,76 @@ func (h *CompletionHandler) Adapt(input *CompletionInput) *model.CompletionParam
 	para.CodeContext = input.Prompts.CodeContext
 	para.Stop = stopWords
 	para.MaxTokens = h.cfg.MaxOutput
-	para.Temperature = float32(input.Temperature)
+	if input.MaxTokens > 0 {
+		para.MaxTokens = min(para.MaxTokens, input.MaxTokens)
+	}
+	if policy := triggerPolicy(input.TriggerMode); policy != nil && policy.MaxOutput > 0 {
+		para.MaxTokens = min(para.MaxTokens, policy.MaxOutput)
+	}
+	para.Temperature = h.requestTemperature(input)
+	para.TopP = float32(h.cfg.TopP)
 	para.Verbose = input.Verbose
+	para.Extra = input.ExtraOptions().Passthrough
+	if model.SupportsSeed(h.llm) {
+		para.Seed = input.Seed
+	}
 	if h.cfg.ModelName != "" {
 		para.Model = h.cfg.ModelName
 	}
+	if c.diag != nil {
+		c.diag.Prompt = model.BuildPrompt(h.cfg, &para)
+	}
 	return &para
 }
 
+/**
+ * 获取整个补全请求的处理时限
+ * @returns {time.Duration} 返回context.totalTimeout与模型timeout之和，模型未配置timeout时返回0表示不限制
+ * @description
+ * - 模型服务停滞而HTTP客户端的超时尚未到达时，避免请求无限期挂起
+ * - 排队时间同样计入时限
+ */
+func (h *CompletionHandler) requestBudget() time.Duration {
+	budget := h.cfg.Timeout.Duration()
+	if budget <= 0 {
+		return 0
+	}
+	if config.Context != nil {
+		budget += max(config.Context.TotalTimeout.Duration(), 0)
+	}
+	return budget
+}
+
+// 模型未配置maxTemperature时允许的最大温度
+const defaultMaxTemperature = 2.0
+
+/**
+ * 获取发给模型的温度
+ * @param {*CompletionInput} input - 补全输入
+ * @returns {float32} 返回限制在[0, maxTemperature]之间的温度
+ * @description
+ * - 请求未指定temperature时使用模型配置的defaultTemperature，明确指定为0时仍使用0
+ * - 超出范围时截断到边界，并记录debug日志，防止异常客户端的参数导致补全质量下降或模型报错
+ */
+func (h *CompletionHandler) requestTemperature(input *CompletionInput) float32 {
+	temperature := h.cfg.DefaultTemperature
+	if input.Temperature != nil {
+		temperature = *input.Temperature
+	}
+	maxTemperature := h.cfg.MaxTemperature
+	if maxTemperature <= 0 {
+		maxTemperature = defaultMaxTemperature
+	}
+	clamped := max(0, min(maxTemperature, temperature))
+	if clamped != temperature {
+		zap.L().Debug("temperature clamped",
+			zap.String("completionID", input.CompletionID),
+			zap.Float64("temperature", temperature),
+			zap.Float64("clamped", clamped))
+	}
+	return float32(clamped)
+}
+
 /**
  * 调用大模型，处理补全请求
  * @param {*CompletionContext} c - 补全上下文，包含请求上下文和性能统计信息
@@ -126,9 +220,13 @@ func (h *CompletionHandler) Adapt(input *CompletionInput) *model.CompletionParam
  * - 对输入进行截断处理，确保不超过模型最大长度
  * - 准备停用词列表，控制补全生成
  * - 调用LLM模型进行补全生成
- * - 记录模型处理时间和token使用情况
+ * - 记录模型处理时间和token使用情况，总token数优先使用后端给出的值
+ * - 后端没有给出prompt或补全的token数时，用分词器按实际发送的prompt和模型返回的文本计算
  * - 对生成的补全结果进行后处理和修剪
- * - 构建并返回最终的补全响应
+ * - 光标位置适合单行补全时(手动触发除外)，只保留补全的第一行
+ * - 配置了wrapper.prune.maxTokens时，修剪后把补全结果截断到该token数以内
+ * - 提示词按\r\n换行时，补全结果同样转换为\r\n换行
+ * - 构建并返回最终的补全响应，补全包含光标前未写完的单词时给出建议替换的范围
  * @throws
  * - 模型响应失败时返回错误响应
  * - 补全结果为空时返回空状态响应
@@ -142,36 +240,99 @@ func (h *CompletionHandler) CallLLM(c *CompletionContext, para *model.Completion
 	rsp, completionStatus, err := h.llm.Completions(c.Ctx, para)
 	modelEndTime := time.Now().Local()
 	c.Perf.LLMDuration = modelEndTime.Sub(modelStartTime).Milliseconds()
+	model.RecordResult(h.llm, completionStatus)
 
 	var verbose *model.CompletionVerbose
 	if rsp != nil {
 		verbose = rsp.Verbose
 	}
+	if completionStatus == model.StatusCanceled || completionStatus == model.StatusTimeout {
+		// 被同一客户端的新请求取代时，说明取消原因
+		if cause := context.Cause(c.Ctx); errors.Is(cause, errSuperseded) {
+			err = cause
+		}
+		return CancelRequest(para.CompletionID, para.Model, c.Perf, completionStatus, err)
+	}
 	if completionStatus != model.StatusSuccess {
-		c.Perf.PromptTokens = h.getTokensCount(para.Prefix) + h.getTokensCount(para.CodeContext)
-		return ErrorResponse(para.CompletionID, para.Model, completionStatus, c.Perf, verbose, err)
+		// 模型没有返回用量时，按实际发送的prompt估算
+		c.Perf.PromptTokens = h.getTokensCount(model.BuildPrompt(h.cfg, para))
+		return ErrorResponse(para.CompletionID, para.Model, completionStatus, c.Perf, withExplain(c, para, verbose), err)
 	}
 
-	// 6. 补全后置处理
-	var completionText string
-	if len(rsp.Choices) > 0 {
-		completionText = rsp.Choices[0].Text
-	}
-	if completionText != "" && !config.Wrapper.Prune.Disabled {
-		completionText = h.pruneCompletionCode(completionText, para.Prefix, para.Suffix, para.Language)
-	}
 	c.Perf.PromptTokens = rsp.Usage.PromptTokens
 	c.Perf.CompletionTokens = rsp.Usage.CompletionTokens
+	// 部分模型服务不返回用量，此时用分词器按实际发送的prompt和返回的文本计算
+	if c.Perf.PromptTokens == 0 {
+		c.Perf.PromptTokens = h.getTokensCount(model.BuildPrompt(h.cfg, para))
+		zap.L().Debug("prompt tokens not reported by model, counted by tokenizer",
+			zap.String("completionID", para.CompletionID),
+			zap.Int("promptTokens", c.Perf.PromptTokens))
+	}
+	if c.Perf.CompletionTokens == 0 && len(rsp.Choices) > 0 && rsp.Choices[0].Text != "" {
+		c.Perf.CompletionTokens = h.getTokensCount(rsp.Choices[0].Text)
+		zap.L().Debug("completion tokens not reported by model, counted by tokenizer",
+			zap.String("completionID", para.CompletionID),
+			zap.Int("completionTokens", c.Perf.CompletionTokens))
+	}
 	c.Perf.TotalTokens = c.Perf.CompletionTokens + c.Perf.PromptTokens
+	// 后端给出了总token数时以后端为准(可能包含特殊token)，否则按输入输出之和计算
+	if rsp.Usage.TotalTokens > 0 {
+		if rsp.Usage.TotalTokens != c.Perf.TotalTokens {
+			zap.L().Debug("total tokens reported by model differ from prompt + completion tokens",
+				zap.String("completionID", para.CompletionID),
+				zap.Int("totalTokens", rsp.Usage.TotalTokens),
+				zap.Int("promptTokens", c.Perf.PromptTokens),
+				zap.Int("completionTokens", c.Perf.CompletionTokens))
+		}
+		c.Perf.TotalTokens = rsp.Usage.TotalTokens
+	}
+	// 模型正常响应但choices为空，表示模型有意不给出建议，与补全内容为空区分开
+	if len(rsp.Choices) == 0 {
+		return ErrorResponse(para.CompletionID, para.Model, model.StatusNoSuggestion, c.Perf, withExplain(c, para, verbose), fmt.Errorf("no suggestion"))
+	}
 
+	// 6. 补全后置处理
+	postStart := time.Now()
+	completionText := rsp.Choices[0].Text
+	if completionText != "" && c.Input != nil && c.Input.ExtraOptions().CompletionMode == CompletionModeBlock {
+		completionText = parser.CutScopeEnd(completionText, para.Prefix, para.Language)
+	}
+	if completionText != "" && !config.Wrapper.Prune.Disabled {
+		var pruners []string
+		if c.Input != nil {
+			pruners = c.Input.ExtraOptions().Pruners
+		}
+		completionText = h.pruneCompletionCode(completionText, para.Prefix, para.Suffix, para.Language, pruners)
+	}
+	if completionText != "" && c.Input != nil && needSingleLine(c.Input) {
+		completionText = firstCompletionLine(completionText)
+	}
+	if maxLines := h.maxLines(c.Input); completionText != "" && maxLines > 0 {
+		completionText = parser.CutMaxLines(completionText, para.Prefix, para.Language, maxLines)
+	}
+	if completionText != "" && config.Wrapper.Prune.MaxTokens > 0 {
+		completionText = h.limitCompletionTokens(completionText, para.Model, config.Wrapper.Prune.MaxTokens)
+	}
+	if c.Input != nil {
+		completionText = normalizeTrailingNewline(completionText, c.Input.ExtraOptions().TrailingNewline)
+		completionText = restoreLineEnding(completionText, c.Input.lineEnding)
+	}
+	c.recordStage("postprocess", postStart)
 	if completionText == "" {
-		return ErrorResponse(para.CompletionID, para.Model, model.StatusEmpty, c.Perf, verbose, fmt.Errorf("empty"))
+		if rsp.Choices[0].Text == "" {
+			return ErrorResponse(para.CompletionID, para.Model, model.StatusEmpty, c.Perf, withExplain(c, para, verbose), fmt.Errorf("empty"))
+		}
+		// 模型给出了补全但被后置处理全部去掉，单独计数，用于发现过于激进的修剪规则
+		metrics.IncrementCompletionPrunedEmpty(para.Model)
+		return ErrorResponse(para.CompletionID, para.Model, model.StatusEmpty, c.Perf, withExplain(c, para, verbose), fmt.Errorf("empty after post-processing"))
 	}
 	// 7. 构建响应
 	if !para.Verbose {
 		verbose = nil
 	}
-	return SuccessResponse(para.CompletionID, para.Model, completionText, c.Perf, verbose)
+	result := SuccessResponse(para.CompletionID, para.Model, completionText, c.Perf, withExplain(c, para, verbose))
+	result.Choices[0].ReplaceRange = completionReplaceRange(para.Prefix, completionText)
+	return result
 }
 
 /**
@@ -181,9 +342,16 @@ func (h *CompletionHandler) CallLLM(c *CompletionContext, para *model.Completion
  * @returns {*CompletionResponse} 返回补全响应对象，包含补全结果或错误信息
  * @description
  * - 提供补全请求的完整处理入口
- * - 首先调用输入的预处理方法进行前置处理
- * - 如果预处理返回响应（如错误或拒绝），直接返回
- * - 否则调用CallLLM方法进行实际的补全处理
+ * - 首先解析提示词并执行拒绝规则，如果返回响应（如错误或拒绝），直接返回
+ * - 前缀短于模型的minPrefix时拒绝补全，拒绝原因为too_short
+ * - 获取上下文的同时预先对前后缀分词，截断提示词时复用分词结果，两者都遵循请求的取消
+ * - 否则按模型的并发限制和请求优先级排队，再调用CallLLM方法进行实际的补全处理
+ * - 补全结果为空时按wrapper.negativeCache缓存，相同上下文的请求直接返回
+ * - 同一客户端有更新的请求到达时，取消本请求并返回StatusCanceled；批量请求中的各项互不取代
+ * - 整个请求的处理时间不超过requestBudget，trigger_mode对应的wrapper.trigger策略可进一步收紧；
+ *   到达时限时返回StatusTimeout，verbose请求在诊断信息的budget中给出实际生效的时限
+ * - 调试模式下按wrapper.shadow抽样把同一请求发给影子模型，只返回主模型的结果
+ * - 请求extra.dry_run为true时完成前置处理后直接返回StatusEmpty，不调用模型，verbose请求可查看组装的提示词
  * - 是补全处理的主要入口点
  * @example
  * ctx := NewCompletionContext(context.Background(), &CompletionPerformance{})
@@ -191,24 +359,64 @@ func (h *CompletionHandler) CallLLM(c *CompletionContext, para *model.Completion
  * response := handler.HandleCompletion(ctx, input)
  */
 func (h *CompletionHandler) HandleCompletion(c *CompletionContext, input *CompletionInput) *CompletionResponse {
-	rsp := input.Preprocess(c)
+	c.Input = input
+	if input.Verbose {
+		c.diag = newDiagnostics()
+	}
+	clientID := input.ClientID
+	if c.Batch {
+		clientID = ""
+	}
+	ctx, done := trackRequest(c.Ctx, clientID, input.CompletionID)
+	defer done()
+	c.Ctx = ctx
+	if budget := h.requestBudget(); budget > 0 {
+		var cancel context.CancelFunc
+		c.Ctx, cancel = context.WithTimeout(c.Ctx, budget)
+		defer cancel()
+	}
+	if policy := triggerPolicy(input.TriggerMode); policy != nil && policy.Timeout.Duration() > 0 {
+		var cancel context.CancelFunc
+		c.Ctx, cancel = context.WithTimeout(c.Ctx, policy.Timeout.Duration())
+		defer cancel()
+	}
+	if deadline, ok := c.Ctx.Deadline(); ok && c.diag != nil {
+		c.diag.Budget = time.Until(deadline).Milliseconds()
+	}
+	input.contextBudget = codebase_context.ContextBudget(h.cfg.MaxPrefix)
+	rsp := input.screen(c)
 	if rsp != nil {
 		return rsp
 	}
-	para := h.Adapt(input)
-	rsp = h.CallLLM(c, para)
-	if env.DebugMode {
-		zap.L().Debug("completion input", zap.Any("input", input))
+	if err := h.checkMinPrefix(input); err != nil {
+		logRejected(input, err)
+		rsp := CancelRequest(input.CompletionID, input.Model, c.Perf, model.StatusRejected, err)
+		if c.diag != nil {
+			c.diag.Filters = append(c.diag.Filters, model.FilterOutcome{Filter: "min_prefix", Result: ReasonTooShort})
+			rsp.Verbose = &model.CompletionVerbose{Id: input.CompletionID, Diagnostics: c.diagnostics()}
+		}
+		return rsp
 	}
-	if rsp.Status != model.StatusSuccess {
-		zap.L().Warn("completion failed",
-			zap.String("status", string(rsp.Status)),
-			zap.Any("request", para),
-			zap.Any("response", rsp))
-	} else {
-		zap.L().Info("completion succeeded",
-			zap.Any("request", para),
-			zap.Any("response", rsp))
+	h.prepareContext(c, input)
+	para := h.Adapt(c, input)
+	if input.ExtraOptions().DryRun {
+		return ErrorResponse(para.CompletionID, para.Model, model.StatusEmpty, c.Perf, withExplain(c, para, nil), errDryRun)
+	}
+	shadow := h.startShadow(c, para)
+	start := time.Now()
+	rsp = h.callQueued(c, para)
+	if rsp.Status == model.StatusEmpty {
+		storeNegative(input, rsp.Model, rsp.Status, errors.New(rsp.Error))
+	}
+	if shadow != nil {
+		shadow <- shadowResult{text: rsp.Choices[0].Text, status: rsp.Status, duration: time.Since(start)}
+	}
+	// 完整的请求和补全内容只在调试模式下记录，访问日志由接口层负责
+	if env.DebugMode {
+		zap.L().Debug("completion detail",
+			zap.Any("input", sanitizeRequest(&input.CompletionRequest)),
+			zap.Any("request", sanitizeParameter(para)),
+			zap.Any("response", sanitizeResponse(rsp)))
 	}
 	return rsp
 }
@@ -0,0 +1,325 @@
+package completions
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"completion-agent/pkg/config"
+	"completion-agent/pkg/model"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func Test_TotalTokens(t *testing.T) {
+	withConfig(t, &config.WrapperConfig{Prune: config.PruneConfig{Disabled: true}})
+
+	core, logs := observer.New(zap.DebugLevel)
+	defer zap.ReplaceGlobals(zap.New(core))()
+
+	cases := []struct {
+		name     string
+		usage    model.CompletionUsage
+		want     int
+		mismatch bool
+	}{
+		{"computed when missing", model.CompletionUsage{PromptTokens: 10, CompletionTokens: 5}, 15, false},
+		{"backend total trusted", model.CompletionUsage{PromptTokens: 10, CompletionTokens: 5, TotalTokens: 17}, 17, true},
+		{"backend total consistent", model.CompletionUsage{PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15}, 15, false},
+	}
+	for _, c := range cases {
+		logs.TakeAll()
+		llm := &fakeLLM{cfg: &config.ModelConfig{}, status: model.StatusSuccess, rsp: &model.CompletionResponse{
+			Choices: []model.CompletionChoice{{Text: "x"}},
+			Usage:   c.usage,
+		}}
+		ctx := NewCompletionContext(context.Background(), &CompletionPerformance{ReceiveTime: time.Now()})
+		rsp := NewCompletionHandler(llm).CallLLM(ctx, &model.CompletionParameter{})
+		if rsp.Usage.TotalTokens != c.want {
+			t.Errorf("%s: total tokens %d, want %d", c.name, rsp.Usage.TotalTokens, c.want)
+		}
+		mismatch := logs.FilterMessageSnippet("total tokens reported by model").Len() > 0
+		if mismatch != c.mismatch {
+			t.Errorf("%s: mismatch logged %v, want %v", c.name, mismatch, c.mismatch)
+		}
+	}
+}
+
+func float64Ptr(v float64) *float64 { return &v }
+
+func Test_RequestTemperature(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	defer zap.ReplaceGlobals(zap.New(core))()
+
+	cases := []struct {
+		name        string
+		cfg         config.ModelConfig
+		temperature *float64
+		want        float32
+		clamped     bool
+	}{
+		{"within range", config.ModelConfig{}, float64Ptr(0.5), 0.5, false},
+		{"too high", config.ModelConfig{}, float64Ptr(5), 2, true},
+		{"negative", config.ModelConfig{}, float64Ptr(-1), 0, true},
+		{"model max", config.ModelConfig{MaxTemperature: 1}, float64Ptr(1.5), 1, true},
+		{"model default", config.ModelConfig{DefaultTemperature: 0.2}, nil, 0.2, false},
+		{"explicit zero", config.ModelConfig{DefaultTemperature: 0.2}, float64Ptr(0), 0, false},
+		{"default clamped", config.ModelConfig{DefaultTemperature: 3}, nil, 2, true},
+	}
+	for _, c := range cases {
+		logs.TakeAll()
+		h := NewCompletionHandler(&fakeLLM{cfg: &c.cfg})
+		input := &CompletionInput{CompletionRequest: CompletionRequest{Temperature: c.temperature}}
+		if got := h.requestTemperature(input); got != c.want {
+			t.Errorf("%s: temperature = %v, want %v", c.name, got, c.want)
+		}
+		if got := logs.FilterMessage("temperature clamped").Len() > 0; got != c.clamped {
+			t.Errorf("%s: clamp logged = %v, want %v", c.name, got, c.clamped)
+		}
+	}
+}
+
+func Test_TemperatureUnsetVsZero(t *testing.T) {
+	h := NewCompletionHandler(&fakeLLM{cfg: &config.ModelConfig{DefaultTemperature: 0.3}})
+	cases := []struct {
+		body string
+		want float32
+	}{
+		{`{"completion_id": "omitted"}`, 0.3},
+		{`{"completion_id": "null", "temperature": null}`, 0.3},
+		{`{"completion_id": "zero", "temperature": 0}`, 0},
+		{`{"completion_id": "set", "temperature": 0.8}`, 0.8},
+	}
+	for _, c := range cases {
+		var input CompletionInput
+		if err := json.Unmarshal([]byte(c.body), &input.CompletionRequest); err != nil {
+			t.Fatal(err)
+		}
+		if got := h.requestTemperature(&input); got != c.want {
+			t.Errorf("%s: temperature = %v, want %v", input.CompletionID, got, c.want)
+		}
+	}
+}
+
+func prunedEmptyCount(t *testing.T, modelName string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range families {
+		if mf.GetName() != "completion_pruned_empty_total" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, lp := range m.GetLabel() {
+				if lp.GetName() == "model" && lp.GetValue() == modelName {
+					return m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func Test_PrunedToEmpty(t *testing.T) {
+	withConfig(t, &config.WrapperConfig{Prune: config.PruneConfig{Pruners: []string{CutSuffixOverlap}}})
+
+	call := func(text string) *CompletionResponse {
+		llm := &fakeLLM{cfg: &config.ModelConfig{}, status: model.StatusSuccess, rsp: &model.CompletionResponse{
+			Choices: []model.CompletionChoice{{Text: text}},
+		}}
+		ctx := NewCompletionContext(context.Background(), &CompletionPerformance{ReceiveTime: time.Now()})
+		return NewCompletionHandler(llm).CallLLM(ctx, &model.CompletionParameter{
+			Model:  "pruned-empty-test",
+			Prefix: "func f() int {\n\t",
+			Suffix: "return 1\n}",
+		})
+	}
+	before := prunedEmptyCount(t, "pruned-empty-test")
+
+	// 模型本身没有输出，不计入
+	if rsp := call(""); rsp.Status != model.StatusEmpty {
+		t.Fatalf("status = %s, want empty", rsp.Status)
+	}
+	if n := prunedEmptyCount(t, "pruned-empty-test") - before; n != 0 {
+		t.Errorf("empty model output counted as pruned: %v", n)
+	}
+
+	// 补全与后缀完全重复，被修剪为空
+	rsp := call("return 1\n}")
+	if rsp.Status != model.StatusEmpty || rsp.Error != "empty after post-processing" {
+		t.Fatalf("unexpected response: status %s, error %q", rsp.Status, rsp.Error)
+	}
+	if n := prunedEmptyCount(t, "pruned-empty-test") - before; n != 1 {
+		t.Errorf("pruned to empty counted %v times, want 1", n)
+	}
+}
+
+func Test_TokensFallbackToTokenizer(t *testing.T) {
+	withConfig(t, &config.WrapperConfig{Prune: config.PruneConfig{Disabled: true}})
+
+	core, logs := observer.New(zap.DebugLevel)
+	defer zap.ReplaceGlobals(zap.New(core))()
+
+	tk := loadTestTokenizer(t)
+	cfg := &config.ModelConfig{FimMode: true, FimBegin: "<fim_begin>", FimHole: "<fim_hole>", FimEnd: "<fim_end>"}
+	para := &model.CompletionParameter{Prefix: "func add(a, b int) int {\n\t", Suffix: "\n}"}
+	wantPrompt := tk.GetTokenCount(model.BuildPrompt(cfg, para))
+	wantCompletion := tk.GetTokenCount("return a + b")
+
+	call := func(usage model.CompletionUsage) *CompletionResponse {
+		llm := &fakeLLM{cfg: cfg, tokenizer: tk, status: model.StatusSuccess, rsp: &model.CompletionResponse{
+			Choices: []model.CompletionChoice{{Text: "return a + b"}},
+			Usage:   usage,
+		}}
+		ctx := NewCompletionContext(context.Background(), &CompletionPerformance{ReceiveTime: time.Now()})
+		return NewCompletionHandler(llm).CallLLM(ctx, para)
+	}
+
+	// 模型没有返回用量时按分词器计算
+	rsp := call(model.CompletionUsage{})
+	if rsp.Usage.PromptTokens != wantPrompt || rsp.Usage.CompletionTokens != wantCompletion {
+		t.Errorf("tokens = %d/%d, want %d/%d", rsp.Usage.PromptTokens, rsp.Usage.CompletionTokens, wantPrompt, wantCompletion)
+	}
+	if rsp.Usage.TotalTokens != wantPrompt+wantCompletion {
+		t.Errorf("total tokens = %d, want %d", rsp.Usage.TotalTokens, wantPrompt+wantCompletion)
+	}
+	if n := logs.FilterMessageSnippet("counted by tokenizer").Len(); n != 2 {
+		t.Errorf("fallback logged %d times, want 2", n)
+	}
+
+	// 模型返回的用量优先
+	logs.TakeAll()
+	rsp = call(model.CompletionUsage{PromptTokens: 100, CompletionTokens: 7})
+	if rsp.Usage.PromptTokens != 100 || rsp.Usage.CompletionTokens != 7 {
+		t.Errorf("reported usage overridden: %+v", rsp.Usage)
+	}
+	if logs.FilterMessageSnippet("counted by tokenizer").Len() != 0 {
+		t.Error("fallback logged with reported usage")
+	}
+}
+
+func Test_RequestMaxTokens(t *testing.T) {
+	withConfig(t, nil)
+	config.Wrapper.Trigger.Automatic.MaxOutput = 16
+	h := NewCompletionHandler(&fakeLLM{cfg: &config.ModelConfig{MaxPrefix: 100, MaxSuffix: 100, MaxOutput: 64}})
+
+	cases := []struct {
+		mode      string
+		maxTokens int
+		want      int
+	}{
+		{"", 0, 64},
+		{"", 8, 8},
+		{"", 200, 64},
+		{TriggerModeAutomatic, 32, 16},
+		{TriggerModeAutomatic, 4, 4},
+	}
+	for _, c := range cases {
+		input := &CompletionInput{CompletionRequest: CompletionRequest{
+			TriggerMode: c.mode,
+			MaxTokens:   c.maxTokens,
+			Prompts:     &PromptOptions{Prefix: "x = ", Suffix: "\n"},
+		}}
+		ctx := NewCompletionContext(context.Background(), &CompletionPerformance{ReceiveTime: time.Now()})
+		if got := h.Adapt(ctx, input).MaxTokens; got != c.want {
+			t.Errorf("mode %q, max_tokens %d: got %d, want %d", c.mode, c.maxTokens, got, c.want)
+		}
+	}
+
+	input := &CompletionInput{CompletionRequest: CompletionRequest{MaxTokens: -1, Prompts: &PromptOptions{}}}
+	if err := input.GetPrompts(); err == nil {
+		t.Error("negative max_tokens accepted")
+	}
+}
+
+func Test_PromptTooLarge(t *testing.T) {
+	withConfig(t, &config.WrapperConfig{MaxPromptBytes: 16})
+	llm := &fakeLLM{cfg: &config.ModelConfig{MaxPrefix: 100, MaxSuffix: 100, MaxOutput: 16}, status: model.StatusSuccess,
+		rsp: &model.CompletionResponse{Choices: []model.CompletionChoice{{Text: "x"}}}}
+	h := NewCompletionHandler(llm)
+
+	input := &CompletionInput{CompletionRequest: CompletionRequest{Prompts: &PromptOptions{
+		Prefix:           "0123456789",
+		Suffix:           "abc",
+		ClipboardContent: []Snippet{{Type: "clipboard", Content: "0123"}},
+	}}}
+	ctx := NewCompletionContext(context.Background(), &CompletionPerformance{ReceiveTime: time.Now()})
+	rsp := h.HandleCompletion(ctx, input)
+	if rsp.Status != model.StatusReqError {
+		t.Fatalf("status = %s, want %s", rsp.Status, model.StatusReqError)
+	}
+	if input.Prompts.Prefix != "0123456789" {
+		t.Errorf("prompt truncated: %q", input.Prompts.Prefix)
+	}
+
+	input.Prompts.ClipboardContent = nil
+	if err := input.checkPromptSize(); err != nil {
+		t.Errorf("prompt within limit rejected: %v", err)
+	}
+	config.Wrapper.MaxPromptBytes = -1
+	input.Prompts.Prefix = strings.Repeat("x", defaultMaxPromptBytes+1)
+	if err := input.checkPromptSize(); err != nil {
+		t.Errorf("unlimited prompt rejected: %v", err)
+	}
+	config.Wrapper.MaxPromptBytes = 0
+	if err := input.checkPromptSize(); err == nil {
+		t.Error("prompt over default limit accepted")
+	}
+}
+
+func Test_RequestBudget(t *testing.T) {
+	withConfig(t, &config.WrapperConfig{
+		Score:  config.ScoreFilterConfig{Disabled: true},
+		Syntax: config.SyntaxFilterConfig{Disabled: true},
+		Prune:  config.PruneConfig{Disabled: true},
+	})
+	cfg := &config.ModelConfig{ModelName: "test", MaxPrefix: 100, MaxSuffix: 100, MaxOutput: 16}
+	if got := NewCompletionHandler(&fakeLLM{cfg: cfg}).requestBudget(); got != 0 {
+		t.Errorf("budget without model timeout = %v, want 0", got)
+	}
+	if err := json.Unmarshal([]byte(`{"timeout": "60ms"}`), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(`{"totalTimeout": "40ms"}`), config.Context); err != nil {
+		t.Fatal(err)
+	}
+	if got := NewCompletionHandler(&fakeLLM{cfg: cfg}).requestBudget(); got != 100*time.Millisecond {
+		t.Errorf("budget = %v, want 100ms", got)
+	}
+
+	newInput := func() *CompletionInput {
+		return &CompletionInput{CompletionRequest: CompletionRequest{
+			Verbose: true,
+			Prompts: &PromptOptions{Prefix: "func f() {\n\t", Suffix: "\n}"},
+		}}
+	}
+	newContext := func() *CompletionContext {
+		return NewCompletionContext(context.Background(), &CompletionPerformance{ReceiveTime: time.Now()})
+	}
+	// 模型停滞时在时限到达后返回超时
+	slow := &blockingLLM{fakeLLM: fakeLLM{cfg: cfg}, entered: make(chan struct{}, 1)}
+	start := time.Now()
+	rsp := NewCompletionHandler(slow).HandleCompletion(newContext(), newInput())
+	if rsp.Status != model.StatusTimeout {
+		t.Errorf("status = %s, want %s", rsp.Status, model.StatusTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("request took %v, budget not applied", elapsed)
+	}
+
+	// verbose诊断信息中给出生效的时限
+	llm := &fakeLLM{cfg: cfg, status: model.StatusSuccess,
+		rsp: &model.CompletionResponse{Choices: []model.CompletionChoice{{Text: "return"}}}}
+	rsp = NewCompletionHandler(llm).HandleCompletion(newContext(), newInput())
+	if rsp.Verbose == nil || rsp.Verbose.Diagnostics == nil {
+		t.Fatalf("missing diagnostics: status %s", rsp.Status)
+	}
+	if budget := rsp.Verbose.Diagnostics.Budget; budget <= 0 || budget > 100 {
+		t.Errorf("diagnostics budget = %d, want (0, 100]", budget)
+	}
+}
@@ -0,0 +1,77 @@
+package completions
+
+import (
+	"fmt"
+	"time"
+
+	"completion-agent/pkg/model"
+)
+
+/**
+ * 创建verbose请求的诊断信息
+ * @returns {*model.CompletionDiagnostics} 返回空的诊断信息，由处理流程各阶段填充
+ */
+func newDiagnostics() *model.CompletionDiagnostics {
+	return &model.CompletionDiagnostics{
+		Filters: []model.FilterOutcome{},
+		Timings: make(map[string]int64),
+	}
+}
+
+// 记录一个阶段的耗时，非verbose请求不记录
+func (c *CompletionContext) recordStage(stage string, start time.Time) {
+	if c.diag != nil {
+		c.diag.Timings[stage] = time.Since(start).Milliseconds()
+	}
+}
+
+/**
+ * 获取诊断信息，补充排队、获取上下文和调用模型的耗时，以及本次请求被熔断跳过的上下文来源
+ * @returns {*model.CompletionDiagnostics} 非verbose请求返回nil
+ */
+func (c *CompletionContext) diagnostics() *model.CompletionDiagnostics {
+	if c.diag == nil {
+		return nil
+	}
+	if c.Perf != nil {
+		c.diag.Timings["context"] = c.Perf.ContextDuration
+		c.diag.Timings["queue"] = c.Perf.QueueDuration
+		c.diag.Timings["llm"] = c.Perf.LLMDuration
+	}
+	if c.Input != nil {
+		c.diag.Degraded = c.Input.degradedSources
+	}
+	return c.diag
+}
+
+// 过滤器在诊断信息中的名称
+func filterName(f Filter) string {
+	switch f.(type) {
+	case *HiddenScoreFilter:
+		return "score"
+	case *CodeFilters:
+		return "syntax"
+	default:
+		return fmt.Sprintf("%T", f)
+	}
+}
+
+/**
+ * 统计提示词截断掉的token数
+ * @param {*PromptOptions} before - 截断前的提示词
+ * @param {*PromptOptions} after - 截断后的提示词
+ * @returns {*model.TruncationStats} 返回截断前各部分的token数及被截掉的token数
+ * @description
+ * - 重新分词统计，只在verbose请求时调用
+ */
+func (h *CompletionHandler) truncationStats(before, after *PromptOptions) *model.TruncationStats {
+	stats := &model.TruncationStats{
+		PrefixTokens:  h.getTokensCount(before.Prefix),
+		SuffixTokens:  h.getTokensCount(before.Suffix),
+		ContextTokens: h.getTokensCount(before.CodeContext),
+	}
+	stats.PrefixDropped = max(0, stats.PrefixTokens-h.getTokensCount(after.Prefix))
+	stats.SuffixDropped = max(0, stats.SuffixTokens-h.getTokensCount(after.Suffix))
+	stats.ContextDropped = max(0, stats.ContextTokens-h.getTokensCount(after.CodeContext))
+	return stats
+}
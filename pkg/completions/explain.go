@@ -0,0 +1,83 @@
+package completions
+
+import (
+	"strings"
+
+	"completion-agent/pkg/model"
+)
+
+// 客户端直接在prompt_options.code_context中提供的上下文
+const explainSourceClient = "client"
+
+/**
+ * 生成补全依据说明
+ * @param {*CompletionInput} input - 补全输入，包含检索得到的上下文片段，可为nil
+ * @param {*model.CompletionParameter} para - 实际调用模型的参数(截断之后)
+ * @returns {*model.CompletionExplain} 返回补全依据说明
+ * @description
+ * - 记录实际调用的模型和主要参数(max_tokens, temperature, stop，指定了seed时包括seed)
+ * - 请求指定了seed但模型不支持时，在notes中说明seed被忽略
+ * - 列出最终拼入prompt的上下文片段，按拼接顺序
+ * - 上下文按长度截断时从头部裁剪，文件路径仍保留在上下文中的片段视为已拼入
+ * - 上下文整体被丢弃时片段列表为空
+ * - 客户端自带code_context时记为一个client来源的片段
+ * - 当前模型后端不提供注意力/归因信息，因此不给出各片段的影响程度
+ */
+func buildExplain(input *CompletionInput, para *model.CompletionParameter) *model.CompletionExplain {
+	explain := &model.CompletionExplain{
+		Model: para.Model,
+		Parameters: map[string]interface{}{
+			"max_tokens":  para.MaxTokens,
+			"temperature": para.Temperature,
+			"top_p":       para.TopP,
+			"stop":        para.Stop,
+		},
+		Snippets: []model.ExplainSnippet{},
+	}
+	if para.Seed != nil {
+		explain.Parameters["seed"] = *para.Seed
+	} else if input != nil && input.Seed != nil {
+		explain.Notes = append(explain.Notes, "seed is not supported by the model provider, ignored")
+	}
+	if para.CodeContext == "" {
+		return explain
+	}
+	if input == nil || len(input.contextSnippets) == 0 {
+		explain.Snippets = append(explain.Snippets, model.ExplainSnippet{
+			Source: explainSourceClient,
+			Length: len(para.CodeContext),
+		})
+		return explain
+	}
+	for _, s := range input.contextSnippets {
+		if s.FilePath != "" && !strings.Contains(para.CodeContext, s.FilePath) {
+			continue
+		}
+		explain.Snippets = append(explain.Snippets, model.ExplainSnippet{
+			Source:   s.Source,
+			FilePath: s.FilePath,
+			Score:    s.Score,
+			Length:   s.Length,
+		})
+	}
+	return explain
+}
+
+/**
+ * 为verbose请求附加补全依据说明
+ * @param {*CompletionContext} c - 补全上下文
+ * @param {*model.CompletionParameter} para - 实际调用模型的参数
+ * @param {*model.CompletionVerbose} verbose - 模型返回的详细信息，可为nil
+ * @returns {*model.CompletionVerbose} 返回附加了说明和诊断信息的详细信息，非verbose请求原样返回
+ */
+func withExplain(c *CompletionContext, para *model.CompletionParameter, verbose *model.CompletionVerbose) *model.CompletionVerbose {
+	if !para.Verbose {
+		return verbose
+	}
+	if verbose == nil {
+		verbose = &model.CompletionVerbose{Id: para.CompletionID}
+	}
+	verbose.Explain = buildExplain(c.Input, para)
+	verbose.Diagnostics = c.diagnostics()
+	return verbose
+}
@@ -0,0 +1,156 @@
+package completions
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"completion-agent/pkg/codebase_context"
+	"completion-agent/pkg/config"
+	"completion-agent/pkg/model"
+)
+
+func Test_VerboseExplainSnippets(t *testing.T) {
+	withConfig(t, &config.WrapperConfig{Prune: config.PruneConfig{Disabled: true}})
+
+	llm := &fakeLLM{
+		cfg: &config.ModelConfig{},
+		rsp: &model.CompletionResponse{
+			Choices: []model.CompletionChoice{{Text: "return a + b"}},
+		},
+		status: model.StatusSuccess,
+	}
+	h := NewCompletionHandler(llm)
+	c := NewCompletionContext(context.Background(), &CompletionPerformance{})
+	c.Input = &CompletionInput{
+		contextSnippets: []codebase_context.ContextSnippet{
+			{Source: codebase_context.SourceDefinition, FilePath: "src/dropped.go", Length: 20},
+			{Source: codebase_context.SourceSemantic, FilePath: "src/math.go", Score: 0.8, Length: 30},
+			{Source: codebase_context.SourceRelation, FilePath: "src/caller.go", Score: 0.5, Length: 40},
+		},
+	}
+	// 截断后上下文只保留了后两个片段
+	para := &model.CompletionParameter{
+		CompletionID: "cmpl-1",
+		Model:        "test-model",
+		MaxTokens:    64,
+		Prefix:       "func add(a, b int) int {\n",
+		CodeContext:  "// src/math.go\n// func sub()\n// src/caller.go\n// add(1, 2)\n",
+		Verbose:      true,
+	}
+
+	rsp := h.CallLLM(c, para)
+	if rsp.Verbose == nil || rsp.Verbose.Explain == nil {
+		t.Fatalf("expected explain metadata in verbose, got %+v", rsp.Verbose)
+	}
+	explain := rsp.Verbose.Explain
+	if explain.Model != "test-model" {
+		t.Errorf("expected model test-model, got %q", explain.Model)
+	}
+	if explain.Parameters["max_tokens"] != 64 {
+		t.Errorf("expected max_tokens 64, got %v", explain.Parameters["max_tokens"])
+	}
+	want := []string{"src/math.go", "src/caller.go"}
+	if len(explain.Snippets) != len(want) {
+		t.Fatalf("expected %d snippets, got %+v", len(want), explain.Snippets)
+	}
+	for i, s := range explain.Snippets {
+		if s.FilePath != want[i] {
+			t.Errorf("snippet %d: expected %q, got %q", i, want[i], s.FilePath)
+		}
+	}
+	if explain.Snippets[0].Source != codebase_context.SourceSemantic || explain.Snippets[0].Score != 0.8 {
+		t.Errorf("unexpected snippet metadata %+v", explain.Snippets[0])
+	}
+
+	// 非verbose请求不返回说明
+	para.Verbose = false
+	if rsp := h.CallLLM(c, para); rsp.Verbose != nil {
+		t.Errorf("expected no verbose without verbose flag, got %+v", rsp.Verbose)
+	}
+}
+
+// 总是接受的过滤器
+type acceptAllFilter struct{}
+
+func (acceptAllFilter) Judge(in *CompletionInput) RejectCode { return Accepted }
+
+func Test_VerboseDiagnostics(t *testing.T) {
+	withConfig(t, &config.WrapperConfig{Prune: config.PruneConfig{Disabled: true}})
+
+	llm := &fakeLLM{
+		cfg:    &config.ModelConfig{ModelName: "diag-model", MaxPrefix: 100, MaxSuffix: 100, MaxOutput: 16},
+		rsp:    &model.CompletionResponse{Choices: []model.CompletionChoice{{Text: "return a + b"}}},
+		status: model.StatusSuccess,
+	}
+	handle := func(verbose bool) *CompletionResponse {
+		input := &CompletionInput{CompletionRequest: CompletionRequest{
+			CompletionID: "cmpl-diag",
+			Verbose:      verbose,
+			Prompts:      &PromptOptions{Prefix: "func add(a, b int) int {\n\t", Suffix: "\n}"},
+		}}
+		c := NewCompletionContext(context.Background(), &CompletionPerformance{ReceiveTime: time.Now()})
+		return NewCompletionHandler(llm).HandleCompletion(c, input)
+	}
+
+	filterChain = &FilterChain{filters: []Filter{acceptAllFilter{}}}
+	rsp := handle(true)
+	if rsp.Status != model.StatusSuccess || rsp.Verbose == nil || rsp.Verbose.Diagnostics == nil {
+		t.Fatalf("expected diagnostics, got status %s, verbose %+v", rsp.Status, rsp.Verbose)
+	}
+	diag := rsp.Verbose.Diagnostics
+	if diag.Prompt != "func add(a, b int) int {\n\t" {
+		t.Errorf("prompt = %q", diag.Prompt)
+	}
+	if len(diag.Filters) != 1 || diag.Filters[0].Result != string(Accepted) {
+		t.Errorf("filters = %+v", diag.Filters)
+	}
+	if diag.Truncation == nil {
+		t.Error("missing truncation stats")
+	}
+	for _, stage := range []string{"filter", "context", "truncate", "queue", "llm", "postprocess"} {
+		if _, ok := diag.Timings[stage]; !ok {
+			t.Errorf("missing timing of %s: %v", stage, diag.Timings)
+		}
+	}
+
+	// 被拒绝的请求同样说明原因
+	filterChain = &FilterChain{filters: []Filter{acceptAllFilter{}, rejectAllFilter{}, acceptAllFilter{}}}
+	rsp = handle(true)
+	if rsp.Status != model.StatusRejected || rsp.Verbose == nil || rsp.Verbose.Diagnostics == nil {
+		t.Fatalf("expected diagnostics for rejected request, got status %s, verbose %+v", rsp.Status, rsp.Verbose)
+	}
+	if f := rsp.Verbose.Diagnostics.Filters; len(f) != 2 || f[1].Result != string(LowHiddenScore) {
+		t.Errorf("filters = %+v", f)
+	}
+
+	// 非verbose请求不返回诊断信息
+	if rsp := handle(false); rsp.Verbose != nil {
+		t.Errorf("expected no verbose without verbose flag, got %+v", rsp.Verbose)
+	}
+}
+
+func Test_ExplainSeed(t *testing.T) {
+	seed := 7
+	input := &CompletionInput{CompletionRequest: CompletionRequest{
+		Seed:    &seed,
+		Prompts: &PromptOptions{Prefix: "x := "},
+	}}
+
+	// 测试用的模型不支持seed，请求中的seed被忽略并在说明中注明
+	h := NewCompletionHandler(&fakeLLM{cfg: &config.ModelConfig{}})
+	para := h.Adapt(NewCompletionContext(context.Background(), &CompletionPerformance{}), input)
+	if para.Seed != nil {
+		t.Fatalf("seed passed to a model without seed support: %d", *para.Seed)
+	}
+	explain := buildExplain(input, para)
+	if _, ok := explain.Parameters["seed"]; ok || len(explain.Notes) != 1 {
+		t.Errorf("unexpected explain for unsupported seed: %+v", explain)
+	}
+
+	para.Seed = &seed
+	explain = buildExplain(input, para)
+	if explain.Parameters["seed"] != 7 || len(explain.Notes) != 0 {
+		t.Errorf("unexpected explain for supported seed: %+v", explain)
+	}
+}
@@ -0,0 +1,195 @@
+package completions
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"completion-agent/pkg/config"
+
+	"go.uber.org/zap"
+)
+
+// 请求extra字段中约定的键
+const (
+	ExtraTrailingNewline = "trailing_newline" // string, 补全结果结尾换行的处理方式，取值见TrailingNewline*常量
+	ExtraPruners         = "pruners"          // []string, 指定本次请求使用的修剪器名称，替代wrapper.prune.pruners
+	ExtraDryRun          = "dry_run"          // bool, 只执行前置处理，不调用模型
+	ExtraCompletionMode  = "completion_mode"  // string, 单行/多行补全方式，取值见CompletionMode*常量
+	ExtraScore           = "score"            // number, 服务端写入的隐藏分，客户端无需设置
+	ExtraMaxLines        = "max_lines"        // number, 补全结果的最大行数，正整数
+)
+
+// 已预留但尚未支持的extra键，设置时产生告警并被忽略
+const (
+	ExtraProfile = "profile" // string, 客户端指定的补全策略档位
+	ExtraFast    = "fast"    // bool, 优先低延迟，允许牺牲部分补全质量
+)
+
+// 单行/多行补全方式(extra.completion_mode)
+const (
+	CompletionModeAuto   = "auto"   // 由服务端根据触发方式和光标位置判断，默认方式
+	CompletionModeSingle = "single" // 只补全单行，不论触发方式
+	CompletionModeMulti  = "multi"  // 允许补全多行，不论光标位置
+	CompletionModeBlock  = "block"  // 补全到光标所在作用域结束为止
+)
+
+/**
+ * 解析后的extra选项
+ * @description
+ * - 对应请求extra字段中约定的键，字段零值表示客户端未设置
+ * - 由ParseExtra统一解析和校验，业务代码只读取本结构，不直接访问Extra
+ * - 新增约定键时，同时在上面的常量、本结构和ParseExtra中登记
+ */
+type ExtraOptions struct {
+	TrailingNewline string                 // 结尾换行的处理方式
+	Pruners         []string               // 指定的修剪器名称
+	DryRun          bool                   // 是否只执行前置处理
+	CompletionMode  string                 // 单行/多行补全方式
+	MaxLines        int                    // 补全结果的最大行数
+	Passthrough     map[string]interface{} // 透传给模型的请求体字段
+}
+
+/**
+ * 解析并校验请求的extra字段
+ * @param {map[string]interface{}} extra - 请求中的extra字段，可为nil
+ * @returns {ExtraOptions, []string} 返回解析后的选项，以及解析过程中产生的告警
+ * @description
+ * - 按约定键读取并校验值的类型和取值范围
+ * - 类型或取值不合法的键被忽略，并产生一条告警
+ * - 已预留但尚未支持的键(profile、fast)被忽略，并产生一条告警，避免客户端误以为已生效
+ * - 未约定的键在wrapper.passthrough白名单中时作为透传字段，原样转发给模型
+ * - 其他未约定的键被忽略，并产生一条告警，保证客户端拼错键名时可以被发现
+ * - 告警按键名排序，便于日志比对
+ * @example
+ * opts, warnings := ParseExtra(map[string]interface{}{"dry_run": true, "unknown": 1})
+ * // opts.DryRun = true
+ * // warnings = ["unknown extra key \"unknown\""]
+ */
+func ParseExtra(extra map[string]interface{}) (ExtraOptions, []string) {
+	var opts ExtraOptions
+	var warnings []string
+	keys := make([]string, 0, len(extra))
+	for k := range extra {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := extra[key]
+		var err error
+		switch key {
+		case ExtraTrailingNewline:
+			opts.TrailingNewline, err = extraEnum(value, TrailingNewlinePreserve, TrailingNewlineNone, TrailingNewlineSingle)
+		case ExtraPruners:
+			opts.Pruners, err = extraPruners(value)
+		case ExtraProfile, ExtraFast:
+			err = fmt.Errorf("unsupported extra key")
+		case ExtraDryRun:
+			opts.DryRun, err = extraBool(value)
+		case ExtraCompletionMode:
+			opts.CompletionMode, err = extraEnum(value, CompletionModeAuto, CompletionModeSingle, CompletionModeMulti, CompletionModeBlock)
+		case ExtraMaxLines:
+			opts.MaxLines, err = extraPositiveInt(value)
+		case ExtraScore:
+			// 服务端内部使用，不作为客户端选项
+		default:
+			if !passthroughAllowed(key) {
+				err = fmt.Errorf("unknown extra key")
+				break
+			}
+			if opts.Passthrough == nil {
+				opts.Passthrough = make(map[string]interface{})
+			}
+			opts.Passthrough[key] = value
+		}
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s %q", err.Error(), key))
+		}
+	}
+	return opts, warnings
+}
+
+// 判断未约定的键是否允许透传给模型
+func passthroughAllowed(key string) bool {
+	if config.Wrapper == nil {
+		return false
+	}
+	for _, k := range config.Wrapper.Passthrough {
+		if k == key || k == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// 读取字符串值，取值限定在allowed之中
+func extraEnum(value interface{}, allowed ...string) (string, error) {
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("expect string for extra key")
+	}
+	for _, a := range allowed {
+		if s == a {
+			return s, nil
+		}
+	}
+	return "", fmt.Errorf("invalid value %q for extra key", s)
+}
+
+// 读取布尔值
+func extraBool(value interface{}) (bool, error) {
+	b, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("expect bool for extra key")
+	}
+	return b, nil
+}
+
+// 读取正整数，JSON数字解码为float64
+func extraPositiveInt(value interface{}) (int, error) {
+	f, ok := value.(float64)
+	if !ok || f != math.Trunc(f) || f < 1 || f > math.MaxInt32 {
+		return 0, fmt.Errorf("expect positive integer for extra key")
+	}
+	return int(f), nil
+}
+
+// 读取修剪器名称列表，名称必须是已注册的修剪器
+func extraPruners(value interface{}) ([]string, error) {
+	items, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expect string array for extra key")
+	}
+	names := make([]string, 0, len(items))
+	for _, item := range items {
+		name, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("expect string array for extra key")
+		}
+		if _, exists := prunerDefs[name]; !exists {
+			return nil, fmt.Errorf("unknown pruner %q in extra key", name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+/**
+ * 获取解析后的extra选项
+ * @returns {*ExtraOptions} 返回解析后的选项，首次调用时解析并缓存
+ * @description
+ * - 首次调用时解析Extra，并将告警记录到日志
+ * - 之后的调用直接返回缓存结果
+ */
+func (in *CompletionInput) ExtraOptions() *ExtraOptions {
+	if in.extraOptions != nil {
+		return in.extraOptions
+	}
+	opts, warnings := ParseExtra(in.Extra)
+	for _, w := range warnings {
+		zap.L().Warn("ignore extra option", zap.String("completionID", in.CompletionID), zap.String("reason", w))
+	}
+	in.extraOptions = &opts
+	return in.extraOptions
+}
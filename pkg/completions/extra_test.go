@@ -0,0 +1,152 @@
+package completions
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"completion-agent/pkg/config"
+	"completion-agent/pkg/model"
+)
+
+func Test_ParseExtraValid(t *testing.T) {
+	opts, warnings := ParseExtra(map[string]interface{}{
+		ExtraTrailingNewline: TrailingNewlineSingle,
+		ExtraPruners:         []interface{}{DiscardExtremeRepetition, CutSuffixOverlap},
+		ExtraDryRun:          false,
+		ExtraCompletionMode:  CompletionModeSingle,
+		ExtraMaxLines:        float64(8),
+		ExtraScore:           0.42,
+	})
+	if len(warnings) != 0 {
+		t.Errorf("expected no warnings, got %v", warnings)
+	}
+	want := ExtraOptions{
+		TrailingNewline: TrailingNewlineSingle,
+		Pruners:         []string{DiscardExtremeRepetition, CutSuffixOverlap},
+		CompletionMode:  CompletionModeSingle,
+		MaxLines:        8,
+	}
+	if !reflect.DeepEqual(opts, want) {
+		t.Errorf("expected %+v, got %+v", want, opts)
+	}
+
+	opts, warnings = ParseExtra(nil)
+	if len(warnings) != 0 || !reflect.DeepEqual(opts, ExtraOptions{}) {
+		t.Errorf("expected empty options for nil extra, got %+v %v", opts, warnings)
+	}
+}
+
+func Test_ParseExtraInvalid(t *testing.T) {
+	opts, warnings := ParseExtra(map[string]interface{}{
+		"trailing_newlines":  "none",
+		ExtraTrailingNewline: "double",
+		ExtraCompletionMode:  1.0,
+		ExtraPruners:         []interface{}{"no-such-pruner"},
+		ExtraMaxLines:        2.5,
+		ExtraDryRun:          true,
+		ExtraFast:            true,
+		ExtraProfile:         "quality",
+	})
+	if !opts.DryRun {
+		t.Errorf("valid keys should still be parsed, got %+v", opts)
+	}
+	if opts.TrailingNewline != "" || opts.CompletionMode != "" || opts.Pruners != nil || opts.MaxLines != 0 {
+		t.Errorf("invalid values should be ignored, got %+v", opts)
+	}
+	if len(warnings) != 7 {
+		t.Fatalf("expected 7 warnings, got %v", warnings)
+	}
+	// 告警按键名排序
+	for i, key := range []string{ExtraCompletionMode, ExtraFast, ExtraMaxLines, ExtraProfile, ExtraPruners, ExtraTrailingNewline, "trailing_newlines"} {
+		if !strings.HasSuffix(warnings[i], `"`+key+`"`) {
+			t.Errorf("warning %d should mention %q, got %q", i, key, warnings[i])
+		}
+	}
+	// 预留的键不能被当作已生效
+	for _, i := range []int{1, 3} {
+		if !strings.HasPrefix(warnings[i], "unsupported extra key") {
+			t.Errorf("expected unsupported key warning, got %q", warnings[i])
+		}
+	}
+	if !strings.HasPrefix(warnings[6], "unknown extra key") {
+		t.Errorf("expected unknown key warning, got %q", warnings[6])
+	}
+}
+
+func Test_ExtraOptionsApplied(t *testing.T) {
+	withConfig(t, &config.WrapperConfig{
+		Score:  config.ScoreFilterConfig{Disabled: true},
+		Syntax: config.SyntaxFilterConfig{Disabled: true},
+	})
+	cfg := &config.ModelConfig{ModelName: "extra-test", MaxPrefix: 100, MaxSuffix: 100, MaxOutput: 64}
+	complete := func(mode, text string, extra map[string]interface{}) (*CompletionResponse, int) {
+		llm := &countingLLM{fakeLLM: fakeLLM{cfg: cfg, status: model.StatusSuccess, rsp: &model.CompletionResponse{
+			Choices: []model.CompletionChoice{{Text: text}},
+		}}}
+		input := &CompletionInput{CompletionRequest: CompletionRequest{
+			TriggerMode: mode,
+			LanguageID:  "go",
+			Prompts:     &PromptOptions{Prefix: "func f() {\n\t", Suffix: "\n}"},
+			Extra:       extra,
+		}}
+		ctx := NewCompletionContext(context.Background(), &CompletionPerformance{ReceiveTime: time.Now()})
+		return NewCompletionHandler(llm).HandleCompletion(ctx, input), llm.calls
+	}
+	text := "a := 1\n\tb := 2"
+
+	// completion_mode覆盖按触发方式和光标位置的判断：光标在空行时自动触发本应允许多行
+	if rsp, _ := complete(TriggerModeAutomatic, text, nil); rsp.Choices[0].Text != text {
+		t.Errorf("auto: got %q", rsp.Choices[0].Text)
+	}
+	if rsp, _ := complete(TriggerModeAutomatic, text, map[string]interface{}{ExtraCompletionMode: CompletionModeSingle}); rsp.Choices[0].Text != "a := 1" {
+		t.Errorf("single: got %q", rsp.Choices[0].Text)
+	}
+	if rsp, _ := complete(TriggerModeManual, text, map[string]interface{}{ExtraCompletionMode: CompletionModeMulti}); rsp.Choices[0].Text != text {
+		t.Errorf("multi: got %q", rsp.Choices[0].Text)
+	}
+
+	// pruners替代默认的修剪器链：默认链清除控制字符，只指定重复文本裁剪时保留
+	if rsp, _ := complete(TriggerModeManual, "a := 1\x07", nil); rsp.Choices[0].Text != "a := 1" {
+		t.Errorf("default pruners: got %q", rsp.Choices[0].Text)
+	}
+	rsp, _ := complete(TriggerModeManual, "a := 1\x07", map[string]interface{}{ExtraPruners: []interface{}{CutRepetitiveText}})
+	if rsp.Choices[0].Text != "a := 1\x07" {
+		t.Errorf("request pruners: got %q", rsp.Choices[0].Text)
+	}
+
+	// dry_run不调用模型
+	rsp, calls := complete(TriggerModeManual, text, map[string]interface{}{ExtraDryRun: true})
+	if calls != 0 || rsp.Status != model.StatusEmpty || rsp.Error != errDryRun.Error() {
+		t.Errorf("dry run: calls = %d, response %+v", calls, rsp)
+	}
+}
+
+func Test_ParseExtraPassthrough(t *testing.T) {
+	withConfig(t, nil)
+	extra := map[string]interface{}{"seed": 42.0, "logit_bias": map[string]interface{}{"50256": -100.0}, ExtraDryRun: true}
+
+	// 未配置白名单时不透传
+	config.Wrapper = &config.WrapperConfig{}
+	opts, warnings := ParseExtra(extra)
+	if opts.Passthrough != nil || len(warnings) != 2 {
+		t.Errorf("unexpected passthrough %v, warnings %v", opts.Passthrough, warnings)
+	}
+
+	config.Wrapper = &config.WrapperConfig{Passthrough: []string{"seed"}}
+	opts, warnings = ParseExtra(extra)
+	if !reflect.DeepEqual(opts.Passthrough, map[string]interface{}{"seed": 42.0}) || !opts.DryRun {
+		t.Errorf("unexpected options %+v", opts)
+	}
+	if len(warnings) != 1 || !strings.HasSuffix(warnings[0], `"logit_bias"`) {
+		t.Errorf("expected warning for keys outside allowlist, got %v", warnings)
+	}
+
+	config.Wrapper = &config.WrapperConfig{Passthrough: []string{"*"}}
+	opts, warnings = ParseExtra(extra)
+	if len(opts.Passthrough) != 2 || len(warnings) != 0 {
+		t.Errorf("unexpected passthrough %v, warnings %v", opts.Passthrough, warnings)
+	}
+}
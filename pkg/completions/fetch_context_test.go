@@ -0,0 +1,73 @@
+package completions
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"completion-agent/pkg/config"
+)
+
+func Test_FetchContextPartial(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/definition":
+			w.Write([]byte(`{"data": {"list": [{"filePath": "pkg/math/add.go", "name": "Add",
+				"type": "definition.function", "content": "func Add(a, b int) int"}]}}`))
+		case "/semantic":
+			// 语义检索超过总超时才返回
+			select {
+			case <-r.Context().Done():
+			case <-release:
+			}
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	withConfig(t, nil)
+	var cfg config.ContextConfig
+	err := json.Unmarshal([]byte(`{
+		"definition": {"url": "`+srv.URL+`/definition"},
+		"semantic": {"url": "`+srv.URL+`/semantic"},
+		"relation": {"disabled": true},
+		"requestTimeout": "1s",
+		"totalTimeout": "200ms"
+	}`), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Context = &cfg
+
+	in := &CompletionInput{CompletionRequest: CompletionRequest{
+		ClientID: "client",
+		Prompts: &PromptOptions{
+			ProjectPath:     "/project",
+			FileProjectPath: "main.go",
+			Prefix:          "func main() {\n\tx := ",
+		},
+	}}
+	c := NewCompletionContext(context.Background(), &CompletionPerformance{ReceiveTime: time.Now().Add(-time.Second)})
+	start := time.Now()
+	in.GetContext(c)
+	elapsed := time.Since(start)
+
+	if elapsed > time.Second {
+		t.Errorf("context fetching should stop at the total timeout, took %v", elapsed)
+	}
+	if !strings.Contains(in.Prompts.CodeContext, "func Add(a, b int) int") {
+		t.Errorf("expected definition result in context, got %q", in.Prompts.CodeContext)
+	}
+	if len(in.contextSnippets) != 1 || in.contextSnippets[0].FilePath != "pkg/math/add.go" {
+		t.Errorf("expected only the definition snippet, got %+v", in.contextSnippets)
+	}
+	// 耗时只统计获取上下文本身，不包含请求接收之后的其他阶段
+	if c.Perf.ContextDuration < 150 || c.Perf.ContextDuration > elapsed.Milliseconds() {
+		t.Errorf("unexpected context duration %dms, fetch took %v", c.Perf.ContextDuration, elapsed)
+	}
+}
@@ -6,11 +6,14 @@ import (
 	"math"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
 
 	"completion-agent/pkg/config"
 	"completion-agent/pkg/logger"
+	"completion-agent/pkg/model"
+	"completion-agent/pkg/parser"
 
 	"go.uber.org/zap"
 )
@@ -25,33 +28,65 @@ const (
 	FeatureNotSupport RejectCode = "FEATURE_NOT_SUPPORT"
 )
 
+// 语法过滤器细分的拒绝原因，用于响应的reject_reason和completion_rejections_total指标
+const (
+	ReasonTooFewLines     = "too_few_lines"     // 前缀的非空行数不足minPromptLine
+	ReasonStrPattern      = "str_pattern"       // 光标行匹配strPattern，如import语句
+	ReasonCursorAtEnd     = "cursor_at_end"     // 光标位于以结束标记收尾的行末
+	ReasonBeforeEndTag    = "before_end_tag"    // 光标紧挨在结束标记之前
+	ReasonWordAfterCursor = "word_after_cursor" // 光标后紧跟单词字符
+)
+
 // 补全过滤器接口
 type Filter interface {
 	Judge(in *CompletionInput) RejectCode
 }
 
+// 能给出细分拒绝原因的过滤器，未实现时以拒绝原因枚举的小写形式作为原因
+type reasonFilter interface {
+	JudgeReason(in *CompletionInput) (RejectCode, string)
+}
+
+/**
+ * 过滤器拒绝请求的错误
+ * @description
+ * - Error()返回拒绝原因枚举，与响应的error字段保持不变
+ * - Reason为细分的拒绝原因，如too_few_lines
+ */
+type RejectError struct {
+	Code   RejectCode
+	Reason string
+}
+
+func (e *RejectError) Error() string {
+	return string(e.Code)
+}
+
 // 补全拒绝规则链
 type FilterChain struct {
 	filters []Filter
 }
 
+// 启动时创建的补全拒绝规则链，所有请求共用
+var filterChain *FilterChain
+
 /**
  * Create new filter chain for completion request processing
  * @param {config.CompletionWrapperConfig} cfg - Configuration wrapper containing filter settings
- * @returns {FilterChain} Returns configured filter chain instance
+ * @returns {FilterChain, error} Returns configured filter chain instance, or error if a filter is misconfigured
  * @description
  * - Creates a chain of filters to evaluate completion requests
  * - Adds hidden score filter if not disabled in configuration
  * - Adds language feature filter if not disabled in configuration
  * - Filters are executed in the order they are added
  * @example
- * chain := NewFilterChain(config)
- * err := chain.Handle(request)
+ * chain, err := NewFilterChain(config)
+ * err = chain.Handle(request)
  * if err != nil {
  *     // Handle rejection
  * }
  */
-func NewFilterChain(cfg *config.WrapperConfig) *FilterChain {
+func NewFilterChain(cfg *config.WrapperConfig) (*FilterChain, error) {
 	handlers := make([]Filter, 0)
 
 	if !cfg.Score.Disabled {
@@ -59,12 +94,44 @@ func NewFilterChain(cfg *config.WrapperConfig) *FilterChain {
 	}
 
 	if !cfg.Syntax.Disabled {
-		handlers = append(handlers, NewSyntaxFilter(&cfg.Syntax))
+		syntax, err := NewSyntaxFilter(&cfg.Syntax)
+		if err != nil {
+			return nil, err
+		}
+		handlers = append(handlers, syntax)
 	}
 
 	return &FilterChain{
 		filters: handlers,
+	}, nil
+}
+
+/**
+ * Initialize the shared filter chain at startup
+ * @param {config.WrapperConfig} cfg - Configuration wrapper containing filter settings
+ * @returns {error} Returns error if a filter is misconfigured, e.g. an invalid regular expression
+ * @description
+ * - Builds the filter chain once so patterns are compiled a single time
+ * - Preprocess uses the shared chain for every request
+ */
+func InitFilterChain(cfg *config.WrapperConfig) error {
+	chain, err := NewFilterChain(cfg)
+	if err != nil {
+		return err
 	}
+	filterChain = chain
+	return nil
+}
+
+/**
+ * Get the filter chain used for requests
+ * @returns {FilterChain, error} Returns the shared chain, or a chain built from the current config when it isn't initialized
+ */
+func currentFilterChain() (*FilterChain, error) {
+	if filterChain != nil {
+		return filterChain, nil
+	}
+	return NewFilterChain(config.Wrapper)
 }
 
 /**
@@ -83,12 +150,38 @@ func NewFilterChain(cfg *config.WrapperConfig) *FilterChain {
  * }
  */
 func (c *FilterChain) Handle(in *CompletionInput) error {
+	_, err := c.HandleWithOutcomes(in)
+	return err
+}
+
+/**
+ * Handle completion request through filter chain and report each filter's result
+ * @param {CompletionInput} in - Completion request data to be evaluated
+ * @returns {[]model.FilterOutcome, error} Returns the results of the filters that ran, in order, and the rejection error if any
+ * @description
+ * - Same as Handle, used to explain verbose requests
+ * - Filters after the rejecting one are not run and not reported
+ * - The rejection error is a *RejectError carrying the detailed reason of the rejecting filter
+ */
+func (c *FilterChain) HandleWithOutcomes(in *CompletionInput) ([]model.FilterOutcome, error) {
+	outcomes := make([]model.FilterOutcome, 0, len(c.filters))
 	for _, handler := range c.filters {
-		if rejectCode := handler.Judge(in); rejectCode != Accepted {
-			return fmt.Errorf("%s", rejectCode)
+		var rejectCode RejectCode
+		var reason string
+		if f, ok := handler.(reasonFilter); ok {
+			rejectCode, reason = f.JudgeReason(in)
+		} else {
+			rejectCode = handler.Judge(in)
+		}
+		outcomes = append(outcomes, model.FilterOutcome{Filter: filterName(handler), Result: string(rejectCode)})
+		if rejectCode != Accepted {
+			if reason == "" {
+				reason = strings.ToLower(string(rejectCode))
+			}
+			return outcomes, &RejectError{Code: rejectCode, Reason: reason}
 		}
 	}
-	return nil
+	return outcomes, nil
 }
 
 //------------------------------------------------------------------------------
@@ -99,27 +192,28 @@ func (c *FilterChain) Handle(in *CompletionInput) error {
 type CodeFilters struct {
 	StrPattern    string
 	TreePattern   string
-	FIMIndicator  string
 	EndTag        string
 	MinPromptLine int
+	strRegexp     *regexp.Regexp // 编译后的StrPattern，匹配光标所在行
+	endTags       []string       // 解析后的EndTag
 }
 
 /**
  * Create language feature filter for completion requests
  * @param {config.SyntaxFilterConfig} cfg - Configuration wrapper containing filter settings
- * @returns {CodeFilters} Returns configured language feature filter instance
+ * @returns {CodeFilters, error} Returns configured language feature filter instance, or error if a pattern is invalid
  * @description
  * - Creates a language feature filter to determine if code completion should be triggered
  * - Sets up threshold score, string pattern, tree pattern, line count threshold and end tag
  * - Uses default values if not provided in configuration
  * @example
- * filter := NewSyntaxFilter(config)
+ * filter, err := NewSyntaxFilter(config)
  * rejectCode := filter.Judge(request)
  * if rejectCode == Accepted {
  *     // Process completion
  * }
  */
-func NewSyntaxFilter(cfg *config.SyntaxFilterConfig) *CodeFilters {
+func NewSyntaxFilter(cfg *config.SyntaxFilterConfig) (*CodeFilters, error) {
 	strPattern := cfg.StrPattern
 	if strPattern == "" {
 		strPattern = `import +.*|from +.*|from +.* import *.*`
@@ -148,138 +242,130 @@ func NewSyntaxFilter(cfg *config.SyntaxFilterConfig) *CodeFilters {
  * @param {string} strPattern - String pattern for code analysis
  * @param {string} treePattern - Tree pattern for code analysis
  * @param {string} endTag - End tag pattern for cursor position detection
- * @returns {CodeFilters} Returns configured code filters instance
+ * @returns {CodeFilters, error} Returns configured code filters instance, or error if a pattern is invalid
  * @description
  * - Creates code filters with specified configuration parameters
- * - Sets up patterns and thresholds for code completion evaluation
- * - Initializes FIM indicator for fill-in-middle completion detection
+ * - Compiles the string pattern once and validates the tree pattern, so bad regular expressions are reported at startup
+ * - String pattern is anchored to the start of the cursor line (leading whitespace ignored)
+ * - Parses end tags once
  * @example
- * filters := NewCodeFilters(0.3, 5, "import.*", ".*", "';','}'")
- * needCode := filters.NeedCode(request)
+ * filters, err := NewCodeFilters(5, "import.*", ".*", "(';','}')")
+ * rejectCode := filters.Judge(request)
  */
-func NewCodeFilters(minPromptLine int, strPattern, treePattern, endTag string) *CodeFilters {
-	return &CodeFilters{
+func NewCodeFilters(minPromptLine int, strPattern, treePattern, endTag string) (*CodeFilters, error) {
+	strRegexp, err := regexp.Compile(`^(?:` + strPattern + `)`)
+	if err != nil {
+		return nil, fmt.Errorf("invalid syntax filter strPattern %q: %v", strPattern, err)
+	}
+	if _, err := regexp.Compile(treePattern); err != nil {
+		return nil, fmt.Errorf("invalid syntax filter treePattern %q: %v", treePattern, err)
+	}
+	c := &CodeFilters{
 		StrPattern:    strPattern,
 		TreePattern:   treePattern,
-		FIMIndicator:  "<FILL_HERE>",
 		EndTag:        endTag,
 		MinPromptLine: minPromptLine,
+		strRegexp:     strRegexp,
 	}
+	c.endTags = c.parseEndTag()
+	return c, nil
 }
 
 /**
- * Determine if code completion is needed for the request
+ * Judge if completion should be triggered for the request
  * @param {CompletionInput} in - Completion request data containing code context
- * @returns {bool} Returns true if code completion is needed, false otherwise
+ * @returns {RejectCode} Returns Accepted if completion is needed, FeatureNotSupport otherwise
  * @description
- * - Checks if cursor is at the end of line (no completion needed)
- * - Checks if text after fill position starts with a word (no completion needed)
- * - Returns true if none of the rejection conditions are met
- * - Simplified implementation with basic filtering logic
+ * - Skips filtering for manual and continue trigger modes (always accepts)
+ * - Rejects when the prefix has fewer than MinPromptLine non-empty lines
+ * - Rejects when the cursor line matches StrPattern (e.g. inside an import statement)
+ * - Rejects when the cursor is at the end of a line closed by an end tag
+ * - Rejects when the cursor is right before a closing end tag
+ * - Rejects when text after the cursor starts with a word character
  * @example
- * if filters.NeedCode(request) {
- *     // Process code completion
+ * if filters.Judge(request) != Accepted {
+ *     // Skip completion
  * }
  */
 func (c *CodeFilters) Judge(in *CompletionInput) RejectCode {
+	rejectCode, _ := c.JudgeReason(in)
+	return rejectCode
+}
+
+/**
+ * Judge if completion should be triggered and report which rule rejected the request
+ * @param {CompletionInput} in - Completion request data containing code context
+ * @returns {RejectCode, string} Returns the same code as Judge, and the detailed reason (e.g. ReasonTooFewLines) on rejection
+ */
+func (c *CodeFilters) JudgeReason(in *CompletionInput) (RejectCode, string) {
 	// 跳过手动触发模式
 	mode := strings.ToUpper(in.TriggerMode)
 	if mode == "MANUAL" || mode == "CONTINUE" {
-		return Accepted
+		return Accepted, ""
 	}
-	if c.cursorIsAtTheEnd(in) {
-		return FeatureNotSupport
+	if c.tooFewLines(in) {
+		return FeatureNotSupport, ReasonTooFewLines
 	}
-
-	if c.textAfterFillHereStartWithWord(in) {
-		return FeatureNotSupport
+	linePrefix, lineSuffix := parser.CursorLine(in.Prompts.Prefix, in.Prompts.Suffix)
+	if c.strRegexp.MatchString(strings.TrimLeft(linePrefix+lineSuffix, " \t")) {
+		return FeatureNotSupport, ReasonStrPattern
 	}
-	// 简化实现，其他复杂的过滤逻辑暂时关闭
-	// 可以根据需要逐步启用其他过滤条件
-
-	return Accepted
-}
-
-func (c *CodeFilters) NeedCode(in *CompletionInput) bool {
-	// 是否需要触发模型进行自动补全编码
-
-	// 暂时关闭，参考相关文档
-	// if c.tooFewLines(in) {
-	//     return false
-	// }
-
-	if c.cursorIsAtTheEnd(in) {
-		return false
+	if c.cursorIsAtTheEnd(linePrefix, lineSuffix) {
+		return FeatureNotSupport, ReasonCursorAtEnd
 	}
-
-	if c.textAfterFillHereStartWithWord(in) {
-		return false
+	if c.cursorIsBeforeEndTag(lineSuffix) {
+		return FeatureNotSupport, ReasonBeforeEndTag
 	}
-
-	// 简化实现，其他复杂的过滤逻辑暂时关闭
-	// 可以根据需要逐步启用其他过滤条件
-
-	return true
+	if c.textAfterCursorStartWithWord(lineSuffix) {
+		return FeatureNotSupport, ReasonWordAfterCursor
+	}
+	return Accepted, ""
 }
 
 /**
- * Split prompt into text before and after cursor position
- * @param {string} prompt - Complete prompt text containing FIM indicator
- * @returns {string, string} Returns text before cursor and text after cursor
+ * Check if cursor is at the end of a line closed by an end tag
+ * @param {string} linePrefix - Cursor line text before the cursor
+ * @param {string} lineSuffix - Cursor line text after the cursor
+ * @returns {bool} Returns true if cursor is at line end, false otherwise
  * @description
- * - Splits prompt text at FIM indicator position
- * - Returns empty strings if FIM indicator is not found
- * - Handles cases where FIM indicator appears multiple times
+ * - Checks if text before cursor ends with any configured end tag
+ * - Verifies that the rest of the cursor line is empty
  * @example
- * before, after := filters.splitPrompt("code before <FILL_HERE> code after")
+ * if filters.cursorIsAtTheEnd("foo();", "") {
+ *     // Skip completion
+ * }
  */
-func (c *CodeFilters) splitPrompt(prompt string) (string, string) {
-	textBeforeCursor, textAfterCursor := "", ""
-	if strings.Contains(prompt, c.FIMIndicator) {
-		parts := strings.Split(prompt, c.FIMIndicator)
-		if len(parts) >= 2 {
-			textBeforeCursor = parts[len(parts)-2]
-			textAfterCursor = parts[len(parts)-1]
-		} else {
-			textBeforeCursor = prompt
-			textAfterCursor = ""
+func (c *CodeFilters) cursorIsAtTheEnd(linePrefix, lineSuffix string) bool {
+	// 光标位于有效行行尾的直接不触发补全
+	// 行尾定义：光标左侧是'>'、';'、'}'、')'，右侧是换行符号
+	if strings.TrimSpace(lineSuffix) != "" {
+		return false
+	}
+	trimmed := strings.ReplaceAll(linePrefix, " ", "")
+	if trimmed == "" {
+		return false
+	}
+	for _, tag := range c.endTags {
+		if strings.HasSuffix(trimmed, tag) {
+			return true
 		}
 	}
-	return textBeforeCursor, textAfterCursor
+	return false
 }
 
 /**
- * Check if cursor is at the end of a line
- * @param {CompletionInput} in - Completion request data containing prompt
- * @returns {bool} Returns true if cursor is at line end, false otherwise
- * @description
- * - Splits prompt into text before and after cursor
- * - Parses end tags from configuration
- * - Checks if text before cursor ends with any configured end tag
- * - Verifies that text after cursor starts with empty line
- * - Returns true if all conditions indicate cursor is at line end
+ * Check if cursor is right before a closing end tag
+ * @param {string} lineSuffix - Cursor line text after the cursor
+ * @returns {bool} Returns true if text after cursor starts with an end tag
  * @example
- * if filters.cursorIsAtTheEnd(request) {
+ * if filters.cursorIsBeforeEndTag(");") {
  *     // Skip completion
  * }
  */
-func (c *CodeFilters) cursorIsAtTheEnd(in *CompletionInput) bool {
-	// 光标位于有效行行尾的直接不触发补全
-	// 行尾定义：光标左侧是'>'、';'、'}'、')'，右侧是换行符号
-
-	textBeforeCursor, textAfterCursor := c.splitPrompt(in.Prompts.Prefix)
-	if textBeforeCursor != "" && textAfterCursor != "" {
-		// 解析endTag
-		endTags := c.parseEndTag()
-		for _, tag := range endTags {
-			if strings.HasSuffix(strings.ReplaceAll(textBeforeCursor, " ", ""), tag) {
-				// 检查右侧是否是空行
-				lines := strings.Split(textAfterCursor, "\n")
-				if len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
-					// fmt.Printf("光标位于行尾，跳过自动补全\n")
-					return true
-				}
-			}
+func (c *CodeFilters) cursorIsBeforeEndTag(lineSuffix string) bool {
+	for _, tag := range c.endTags {
+		if strings.HasPrefix(lineSuffix, tag) {
+			return true
 		}
 	}
 	return false
@@ -317,26 +403,22 @@ func (c *CodeFilters) parseEndTag() []string {
 }
 
 /**
- * Check if text after fill position starts with a word character
- * @param {CompletionInput} in - Completion request data containing prompt
- * @returns {bool} Returns true if text after fill starts with word character, false otherwise
+ * Check if text after the cursor starts with a word character
+ * @param {string} lineSuffix - Cursor line text after the cursor
+ * @returns {bool} Returns true if text after cursor starts with word character, false otherwise
  * @description
- * - Extracts text after cursor position from prompt
  * - Checks if first character is letter (a-z, A-Z) or digit (0-9)
- * - Returns true if text after cursor starts with word character
  * - Used to skip completion when modifying variable names
  * @example
- * if filters.textAfterFillHereStartWithWord(request) {
+ * if filters.textAfterCursorStartWithWord("name = 1") {
  *     // Skip completion (likely variable name modification)
  * }
  */
-func (c *CodeFilters) textAfterFillHereStartWithWord(in *CompletionInput) bool {
+func (c *CodeFilters) textAfterCursorStartWithWord(lineSuffix string) bool {
 	// 补全后面直接是英文字母开头或数字的不补全，比如修改变量名称的场景
-	_, textAfterCursor := c.splitPrompt(in.Prompts.Prefix)
-	if textAfterCursor != "" {
-		firstChar := textAfterCursor[0]
+	if lineSuffix != "" {
+		firstChar := lineSuffix[0]
 		if (firstChar >= 'a' && firstChar <= 'z') || (firstChar >= 'A' && firstChar <= 'Z') || (firstChar >= '0' && firstChar <= '9') {
-			// fmt.Printf("光标后面是字符`%c`，跳过自动补全\n", firstChar)
 			return true
 		}
 	}
@@ -352,7 +434,6 @@ func (c *CodeFilters) textAfterFillHereStartWithWord(in *CompletionInput) bool {
  * - Filters out empty lines from line count
  * - Compares non-empty line count with configured threshold
  * - Returns true if line count is below threshold
- * - Currently disabled implementation (always returns false)
  * @example
  * if filters.tooFewLines(request) {
  *     // Skip completion (insufficient context)
@@ -367,12 +448,7 @@ func (c *CodeFilters) tooFewLines(in *CompletionInput) bool {
 			nonEmptyLines = append(nonEmptyLines, line)
 		}
 	}
-	lineCount := len(nonEmptyLines)
-	if lineCount < c.MinPromptLine {
-		// fmt.Printf("prompt行数%d小于阈值%d，跳过自动补全\n", lineCount, c.MinPromptLine)
-		return true
-	}
-	return false
+	return len(nonEmptyLines) < c.MinPromptLine
 }
 
 //------------------------------------------------------------------------------
@@ -397,6 +473,7 @@ type HiddenScoreFilter struct {
  * - Creates a hidden score filter to evaluate completion request quality
  * - Sets up threshold score for filtering low-quality completions
  * - Initializes hide score configuration with default threshold if not provided
+ * - Intercept and weights from configuration override hidden-scores.json and defaults
  * @example
  * filter := NewScoreFilter(config)
  * rejectCode := filter.Judge(request)
@@ -410,7 +487,14 @@ func NewScoreFilter(cfg *config.ScoreFilterConfig) *HiddenScoreFilter {
 		thresholdScore = 0.3
 	}
 	fpath := filepath.Join(config.CostrictDir, "config", "hidden-scores.json")
-	return NewHiddenScoreFilter(fpath, thresholdScore)
+	filter := NewHiddenScoreFilter(fpath, thresholdScore)
+	if cfg.Intercept != nil {
+		filter.ContextualFilterIntercept = *cfg.Intercept
+	}
+	if len(cfg.Weights) > 0 {
+		filter.ContextualFilterWeights = cfg.Weights
+	}
+	return filter
 }
 
 /**
@@ -544,6 +628,7 @@ func NewHiddenScoreFilter(configPath string, thresholdScore float64) *HiddenScor
  * - Analyzes prefix and suffix lengths, document length, and cursor position
  * - Applies language-specific weights and character-specific weights
  * - Uses logistic function to convert weighted sum to probability
+ * - See config.ScoreFilterConfig for the full formula and weight layout
  * @example
  * score := filter.CalculateHideScore(request, prefix, "python")
  * if score < 0.3 {
@@ -0,0 +1,162 @@
+package completions
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"completion-agent/pkg/config"
+	"completion-agent/pkg/model"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func Test_ScoreFilterWeights(t *testing.T) {
+	newInput := func() *CompletionInput {
+		return &CompletionInput{
+			CompletionRequest: CompletionRequest{
+				CompletionID: "cmpl-1",
+				LanguageID:   "go",
+				Prompts:      &PromptOptions{Prefix: "func main() {\n\t"},
+				HideScores: &HiddenScoreOptions{
+					IsWhitespaceAfterCursor: true,
+					DocumentLength:          100,
+					PromptEndPos:            50,
+					PreviousLabel:           1,
+					PreviousLabelTimestamp:  time.Now().UnixMilli(),
+				},
+			},
+		}
+	}
+
+	// 只有截距参与计算时，分数为sigmoid(intercept)
+	intercept := 2.0
+	filter := NewScoreFilter(&config.ScoreFilterConfig{Threshold: 0.5, Intercept: &intercept, Weights: []float64{0}})
+	in := newInput()
+	if code := filter.Judge(in); code != Accepted {
+		t.Errorf("expected accepted, got %s", code)
+	}
+	score, _ := in.Extra[ExtraScore].(float64)
+	if score < 0.88 || score > 0.881 {
+		t.Errorf("expected score sigmoid(2)=0.8808, got %v", score)
+	}
+
+	// 上次补全被接受的权重为负时，分数低于阈值而被拒绝
+	intercept = 0
+	cfg := &config.ScoreFilterConfig{Threshold: 0.5, Intercept: &intercept, Weights: []float64{-3}}
+	if code := NewScoreFilter(cfg).Judge(newInput()); code != LowHiddenScore {
+		t.Errorf("expected %s, got %s", LowHiddenScore, code)
+	}
+	chain, err := NewFilterChain(&config.WrapperConfig{Score: *cfg, Syntax: config.SyntaxFilterConfig{Disabled: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.Handle(newInput()); err == nil {
+		t.Errorf("expected filter chain to reject low score request")
+	}
+}
+
+func Test_SyntaxFilter(t *testing.T) {
+	filter, err := NewSyntaxFilter(&config.SyntaxFilterConfig{MinPromptLine: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := "package main\n\nfunc main() {\n\tx := 1\n"
+	cases := []struct {
+		name   string
+		prefix string
+		suffix string
+		want   RejectCode
+		reason string
+	}{
+		{"normal", body + "\t", "\n}\n", Accepted, ""},
+		{"too few lines", "func main() {\n\t", "\n}\n", FeatureNotSupport, ReasonTooFewLines},
+		{"import line", body + "import ", "\n", FeatureNotSupport, ReasonStrPattern},
+		{"indented from line", body + "\tfrom os ", "\r\n", FeatureNotSupport, ReasonStrPattern},
+		{"line closed by end tag", body + "\tfoo();", "\n}\n", FeatureNotSupport, ReasonCursorAtEnd},
+		{"before end tag", body + "\tfoo(", ");\n}\n", FeatureNotSupport, ReasonBeforeEndTag},
+		{"before word", body + "\tx = ", "value\n}\n", FeatureNotSupport, ReasonWordAfterCursor},
+	}
+	for _, c := range cases {
+		in := &CompletionInput{CompletionRequest: CompletionRequest{
+			Prompts: &PromptOptions{Prefix: c.prefix, Suffix: c.suffix},
+		}}
+		if got := filter.Judge(in); got != c.want {
+			t.Errorf("%s: expected %s, got %s", c.name, c.want, got)
+		}
+		if _, reason := filter.JudgeReason(in); reason != c.reason {
+			t.Errorf("%s: expected reason %q, got %q", c.name, c.reason, reason)
+		}
+		// 手动触发不过滤
+		in.TriggerMode = "manual"
+		if got := filter.Judge(in); got != Accepted {
+			t.Errorf("%s: expected manual trigger accepted, got %s", c.name, got)
+		}
+	}
+
+	if _, err := NewSyntaxFilter(&config.SyntaxFilterConfig{StrPattern: "import ("}); err == nil {
+		t.Errorf("expected error for invalid strPattern")
+	}
+	if _, err := NewFilterChain(&config.WrapperConfig{Syntax: config.SyntaxFilterConfig{TreePattern: "[a-"}}); err == nil {
+		t.Errorf("expected error for invalid treePattern")
+	}
+}
+
+func rejectionsCount(t *testing.T, reason string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range families {
+		if mf.GetName() != "completion_rejections_total" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, lp := range m.GetLabel() {
+				if lp.GetName() == "reason" && lp.GetValue() == reason {
+					return m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func Test_RejectReason(t *testing.T) {
+	withConfig(t, nil)
+	syntax, err := NewSyntaxFilter(&config.SyntaxFilterConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	preprocess := func(filters ...Filter) *CompletionResponse {
+		filterChain = &FilterChain{filters: filters}
+		in := &CompletionInput{CompletionRequest: CompletionRequest{
+			CompletionID: "cmpl-reason",
+			Prompts:      &PromptOptions{Prefix: "func main() {\n\t", Suffix: "\n}"},
+		}}
+		return in.Preprocess(NewCompletionContext(context.Background(), &CompletionPerformance{}))
+	}
+
+	before := rejectionsCount(t, ReasonTooFewLines)
+	rsp := preprocess(syntax)
+	if rsp == nil || rsp.Status != model.StatusRejected {
+		t.Fatalf("expected rejected response, got %+v", rsp)
+	}
+	// error保持原有的拒绝原因枚举
+	if rsp.Error != string(FeatureNotSupport) || rsp.RejectReason != ReasonTooFewLines {
+		t.Fatalf("error = %q, reject_reason = %q", rsp.Error, rsp.RejectReason)
+	}
+	if got := rejectionsCount(t, ReasonTooFewLines) - before; got != 1 {
+		t.Fatalf("rejections{too_few_lines} = %v, want 1", got)
+	}
+
+	// 未细分原因的过滤器使用拒绝原因枚举的小写形式
+	before = rejectionsCount(t, "low_hidden_score")
+	rsp = preprocess(rejectAllFilter{}, syntax)
+	if rsp == nil || rsp.RejectReason != "low_hidden_score" {
+		t.Fatalf("expected low_hidden_score, got %+v", rsp)
+	}
+	if got := rejectionsCount(t, "low_hidden_score") - before; got != 1 {
+		t.Fatalf("rejections{low_hidden_score} = %v, want 1", got)
+	}
+}
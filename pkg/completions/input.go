@@ -4,8 +4,10 @@ import (
 	"completion-agent/pkg/codebase_context"
 	"completion-agent/pkg/config"
 	"completion-agent/pkg/model"
+	"context"
 	"fmt"
 	"net/http"
+	"sync"
 	"time"
 )
 
@@ -25,19 +27,29 @@ import (
  * response := input.Preprocess(ctx)
  */
 type CompletionInput struct {
-	CompletionRequest             //原始请求中的BODY
-	Headers           http.Header //原始请求中的头部
+	CompletionRequest                                   //原始请求中的BODY
+	Headers           http.Header                       //原始请求中的头部
+	contextSnippets   []codebase_context.ContextSnippet //拼入上下文的检索片段，用于verbose说明
+	extraOptions      *ExtraOptions                     //解析后的extra选项，见ExtraOptions()
+	contextBudget     int                               //检索上下文的token预算，由处理器按模型maxPrefix设置
+	lineEnding        string                            //文档的主要换行符，补全结果按此还原，见normalizeLineEndings
+	negativeCacheSlot string                            //负结果缓存中的位置，见negativeKeys
+	negativeCacheKey  string                            //负结果缓存的上下文摘要，见negativeKeys
+	degradedSources   []string                          //本次请求因熔断被跳过的上下文来源，用于verbose诊断
 }
 
 /**
  * 代码上下文客户端实例
  * @description
  * - 全局单例，用于获取代码上下文信息
- * - 在GetContext方法中延迟初始化
+ * - 在FetchContext方法中延迟初始化
  * - 提供代码库上下文查询功能
  * - 用于增强补全请求的上下文信息
  */
-var contextClient *codebase_context.ContextClient
+var (
+	contextClient     *codebase_context.ContextClient
+	contextClientOnce sync.Once
+)
 
 /**
  * 处理补全请求
@@ -45,8 +57,9 @@ var contextClient *codebase_context.ContextClient
  * @returns {*CompletionResponse} 返回补全响应对象，如果预处理失败则返回错误响应
  * @description
  * - 执行补全请求的预处理流程
+ * - 相同上下文缓存了负结果(拒绝或为空)时直接返回缓存的结果，不再执行过滤器
  * - 首先通过过滤器链处理补全拒绝规则
- * - 如果拒绝规则匹配，返回拒绝响应
+ * - 如果拒绝规则匹配，按抽样记录拒绝样本后返回拒绝响应；verbose请求在响应中附带各规则的判断结果
  * - 解析请求参数获取提示词
  * - 获取代码上下文信息
  * - 是补全处理的第一步
@@ -61,16 +74,55 @@ var contextClient *codebase_context.ContextClient
  * }
  */
 func (in *CompletionInput) Preprocess(c *CompletionContext) *CompletionResponse {
+	if rsp := in.screen(c); rsp != nil {
+		return rsp
+	}
+	// 2. 获取上下文信息
+	in.GetContext(c)
+	return nil
+}
+
+/**
+ * 解析提示词并执行补全拒绝规则，不获取上下文
+ * @param {*CompletionContext} c - 补全上下文
+ * @returns {*CompletionResponse} 请求缺少提示词、命中负结果缓存或被拒绝时返回响应，否则返回nil
+ * @description
+ * - Preprocess中获取上下文之前的部分，HandleCompletion在此之后并行获取上下文和预先分词
+ * - 提示词超出wrapper.maxPromptBytes时返回StatusReqError，不截断
+ * - 记录文档的主要换行符，并把提示词统一为\n换行，见normalizeLineEndings
+ */
+func (in *CompletionInput) screen(c *CompletionContext) *CompletionResponse {
 	if err := in.GetPrompts(); err != nil {
 		return CancelRequest(in.CompletionID, in.Model, c.Perf, model.StatusRejected, err)
 	}
+	if err := in.checkPromptSize(); err != nil {
+		return ErrorResponse(in.CompletionID, in.Model, model.StatusReqError, c.Perf, nil, err)
+	}
+	in.normalizeLineEndings()
+	in.ExtraOptions()
+	if e := lookupNegative(in); e != nil {
+		return CancelRequest(in.CompletionID, e.model, c.Perf, e.status, e.err)
+	}
 	// 1. 补全拒绝规则链处理
-	err := NewFilterChain(config.Wrapper).Handle(in)
+	chain, err := currentFilterChain()
 	if err != nil {
-		return CancelRequest(in.CompletionID, in.Model, c.Perf, model.StatusRejected, err)
+		return ErrorResponse(in.CompletionID, in.Model, model.StatusServerError, c.Perf, nil, err)
+	}
+	start := time.Now()
+	outcomes, err := chain.HandleWithOutcomes(in)
+	if c.diag != nil {
+		c.diag.Filters = outcomes
+	}
+	c.recordStage("filter", start)
+	if err != nil {
+		logRejected(in, err)
+		rsp := CancelRequest(in.CompletionID, in.Model, c.Perf, model.StatusRejected, err)
+		storeNegative(in, rsp.Model, model.StatusRejected, err)
+		if diag := c.diagnostics(); diag != nil {
+			rsp.Verbose = &model.CompletionVerbose{Id: in.CompletionID, Diagnostics: diag}
+		}
+		return rsp
 	}
-	// 2. 获取上下文信息
-	in.GetContext(c)
 	return nil
 }
 
@@ -79,20 +131,68 @@ func (in *CompletionInput) Preprocess(c *CompletionContext) *CompletionResponse
  * @param {*CompletionContext} c - 补全上下文，包含请求上下文和性能统计信息
  * @description
  * - 如果代码上下文已存在，直接返回
- * - 延迟初始化上下文客户端
- * - 调用上下文客户端获取代码上下文
- * - 记录获取上下文的耗时
+ * - 调用FetchContext获取代码上下文
+ * - 追加请求携带的最近编辑、剪贴板等客户端片段，放在检索上下文之后
+ * - 配置了context.maxTotalTokens时，客户端片段优先占用合计预算，检索上下文只使用剩余的预算；
+ *   预算已用完时不再请求代码库服务；检索上下文从优先级最低的片段开始丢弃，直到合计不超过上限
+ * - 记录获取上下文本身的耗时，以及本次请求因熔断被跳过的上下文来源
  * - 用于增强补全请求的上下文信息
  */
 func (in *CompletionInput) GetContext(c *CompletionContext) {
 	if in.Prompts.CodeContext != "" {
 		return
 	}
-	if contextClient == nil {
-		contextClient = codebase_context.NewContextClient()
+	start := time.Now()
+	total := 0
+	if config.Context != nil {
+		total = config.Context.MaxTotalTokens
+	}
+	clientContext, clientSnippets := buildClientContext(in.Prompts, total)
+	var codeContext string
+	var snippets []codebase_context.ContextSnippet
+	if total <= 0 {
+		codeContext, snippets, in.degradedSources = FetchContext(c.Ctx, in)
+	} else if remaining := total - clientContextTokens(clientContext); remaining > 0 {
+		if in.contextBudget <= 0 || in.contextBudget > remaining {
+			in.contextBudget = remaining
+		}
+		codeContext, snippets, in.degradedSources = FetchContext(c.Ctx, in)
+	}
+	if codeContext != "" && clientContext != "" {
+		codeContext += "\n"
 	}
-	in.Prompts.CodeContext = contextClient.GetContext(
-		c.Ctx,
+	in.Prompts.CodeContext = codeContext + clientContext
+	in.contextSnippets = append(snippets, clientSnippets...)
+	c.Perf.ContextDuration = time.Since(start).Milliseconds()
+}
+
+// 客户端片段占用的合计预算，包括与检索上下文之间的换行
+func clientContextTokens(clientContext string) int {
+	if clientContext == "" {
+		return 0
+	}
+	return codebase_context.CountTokens("\n" + clientContext)
+}
+
+/**
+ * 从代码库服务获取补全所需的上下文
+ * @param {context.Context} ctx - 请求上下文
+ * @param {*CompletionInput} in - 补全输入，提供项目路径、文件路径、前后缀和请求头部
+ * @returns {string, []codebase_context.ContextSnippet, []string} 返回拼接好的上下文、其包含的片段，
+ *   以及本次请求因熔断被跳过的检索来源
+ * @description
+ * - 并发请求定义、语义、关系三个检索服务，已禁用的服务不请求
+ * - 每个检索受context.requestTimeout限制，全部检索受context.totalTimeout限制
+ * - 总超时到达时使用已返回的结果，不因个别服务缓慢而放弃全部上下文
+ * - 检索片段按in.contextBudget合并，未设置时只受context.merge.maxTokens限制
+ * - 延迟初始化上下文客户端
+ */
+func FetchContext(ctx context.Context, in *CompletionInput) (string, []codebase_context.ContextSnippet, []string) {
+	contextClientOnce.Do(func() {
+		contextClient = codebase_context.NewContextClient()
+	})
+	return contextClient.GetContextWithSnippets(
+		ctx,
 		in.ClientID,
 		in.Prompts.ProjectPath,
 		in.Prompts.FileProjectPath,
@@ -100,8 +200,8 @@ func (in *CompletionInput) GetContext(c *CompletionContext) {
 		in.Prompts.Suffix,
 		in.Prompts.ImportContent,
 		in.Headers,
+		in.contextBudget,
 	)
-	c.Perf.ContextDuration = time.Since(c.Perf.ReceiveTime).Milliseconds()
 }
 
 /**
@@ -113,10 +213,45 @@ func (in *CompletionInput) GetContext(c *CompletionContext) {
  * - 如果行前缀为空，从前缀中提取最后一行
  * - 如果行后缀为空，从后缀中提取第一行
  * - 用于预处理补全请求的提示词
+ * - 同时校验max_tokens，负数时返回错误
  */
 func (in *CompletionInput) GetPrompts() error {
 	if in.Prompts == nil {
 		return fmt.Errorf("missing 'prompt_options'")
 	}
+	if in.MaxTokens < 0 {
+		return fmt.Errorf("invalid 'max_tokens': %d", in.MaxTokens)
+	}
+	return nil
+}
+
+// 未配置maxPromptBytes时提示词的最大字节数
+const defaultMaxPromptBytes = 1 << 20
+
+/**
+ * 检查提示词的大小
+ * @returns {error} 前后缀、上下文和客户端片段的合计字节数超出wrapper.maxPromptBytes时返回错误
+ * @description
+ * - 在分词之前执行，避免过大的提示词耗费分词的时间和内存
+ * - maxPromptBytes为0时使用默认的1MiB，负数表示不限制
+ */
+func (in *CompletionInput) checkPromptSize() error {
+	limit := defaultMaxPromptBytes
+	if config.Wrapper != nil && config.Wrapper.MaxPromptBytes != 0 {
+		limit = config.Wrapper.MaxPromptBytes
+	}
+	if limit < 0 {
+		return nil
+	}
+	p := in.Prompts
+	size := len(p.Prefix) + len(p.Suffix) + len(p.CodeContext) + len(p.ImportContent)
+	for _, snippets := range p.clientSnippets() {
+		for _, s := range snippets {
+			size += len(s.Content)
+		}
+	}
+	if size > limit {
+		return fmt.Errorf("prompt too large: %d bytes exceeds limit of %d bytes", size, limit)
+	}
 	return nil
 }
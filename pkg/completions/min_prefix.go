@@ -0,0 +1,58 @@
+package completions
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"completion-agent/pkg/config"
+)
+
+// 前缀短于最短前缀时的拒绝原因
+const ReasonTooShort = "too_short"
+
+/**
+ * 获取模型生效的最短前缀配置
+ * @param {*config.ModelConfig} cfg - 模型配置
+ * @returns {config.MinPrefixConfig} 返回wrapper.minPrefix被模型minPrefix中非0字段覆盖后的配置
+ */
+func minPrefixConfig(cfg *config.ModelConfig) config.MinPrefixConfig {
+	var result config.MinPrefixConfig
+	if config.Wrapper != nil {
+		result = config.Wrapper.MinPrefix
+	}
+	if cfg.MinPrefix.Chars != 0 {
+		result.Chars = cfg.MinPrefix.Chars
+	}
+	if cfg.MinPrefix.Tokens != 0 {
+		result.Tokens = cfg.MinPrefix.Tokens
+	}
+	return result
+}
+
+/**
+ * 检查前缀是否达到触发补全的最短长度
+ * @param {*CompletionInput} in - 补全输入，已完成GetPrompts
+ * @returns {error} 前缀过短时返回拒绝原因为too_short的*RejectError，否则返回nil
+ * @description
+ * - 手动触发(manual)的请求不检查
+ * - 字符数按去除首尾空白后的前缀计算
+ * - token数使用模型的分词器计算，没有分词器时按字符数估算
+ * @example
+ * if err := h.checkMinPrefix(input); err != nil {
+ *     // 拒绝补全
+ * }
+ */
+func (h *CompletionHandler) checkMinPrefix(in *CompletionInput) error {
+	if in.TriggerMode == TriggerModeManual {
+		return nil
+	}
+	limit := minPrefixConfig(h.cfg)
+	prefix := strings.TrimSpace(in.Prompts.Prefix)
+	if limit.Chars > 0 && utf8.RuneCountInString(prefix) < limit.Chars {
+		return &RejectError{Code: FeatureNotSupport, Reason: ReasonTooShort}
+	}
+	if limit.Tokens > 0 && h.getTokensCount(prefix) < limit.Tokens {
+		return &RejectError{Code: FeatureNotSupport, Reason: ReasonTooShort}
+	}
+	return nil
+}
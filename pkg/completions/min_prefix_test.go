@@ -0,0 +1,63 @@
+package completions
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"completion-agent/pkg/config"
+	"completion-agent/pkg/model"
+)
+
+func Test_MinPrefix(t *testing.T) {
+	withConfig(t, &config.WrapperConfig{
+		Prune:     config.PruneConfig{Disabled: true},
+		MinPrefix: config.MinPrefixConfig{Chars: 3},
+	})
+	filterChain = &FilterChain{filters: []Filter{acceptAllFilter{}}}
+
+	cfg := &config.ModelConfig{ModelName: "min-prefix", MaxPrefix: 100, MaxSuffix: 100, MaxOutput: 16}
+	llm := &fakeLLM{
+		cfg:    cfg,
+		rsp:    &model.CompletionResponse{Choices: []model.CompletionChoice{{Text: "value"}}},
+		status: model.StatusSuccess,
+	}
+	handle := func(prefix, mode string) *CompletionResponse {
+		input := &CompletionInput{CompletionRequest: CompletionRequest{
+			CompletionID: "cmpl-min-prefix",
+			TriggerMode:  mode,
+			Verbose:      true,
+			Prompts:      &PromptOptions{Prefix: prefix},
+		}}
+		c := NewCompletionContext(context.Background(), &CompletionPerformance{ReceiveTime: time.Now()})
+		return NewCompletionHandler(llm).HandleCompletion(c, input)
+	}
+
+	before := rejectionsCount(t, ReasonTooShort)
+	rsp := handle("  ab\n", TriggerModeAutomatic)
+	if rsp.Status != model.StatusRejected || rsp.RejectReason != ReasonTooShort {
+		t.Fatalf("expected too_short rejection, got status %s, reason %q", rsp.Status, rsp.RejectReason)
+	}
+	if f := rsp.Verbose.Diagnostics.Filters; len(f) != 2 || f[1].Filter != "min_prefix" {
+		t.Errorf("filters = %+v", f)
+	}
+	if got := rejectionsCount(t, ReasonTooShort) - before; got != 1 {
+		t.Errorf("rejections{too_short} = %v, want 1", got)
+	}
+	if rsp := handle("abc", TriggerModeAutomatic); rsp.Status != model.StatusSuccess {
+		t.Errorf("prefix at the limit: status = %s", rsp.Status)
+	}
+	// 手动触发不检查
+	if rsp := handle("ab", TriggerModeManual); rsp.Status != model.StatusSuccess {
+		t.Errorf("manual trigger: status = %s", rsp.Status)
+	}
+
+	// 模型配置覆盖全局配置，token数没有分词器时按字符估算
+	cfg.MinPrefix = config.MinPrefixConfig{Chars: 1, Tokens: 2}
+	if rsp := handle("abcdefgh", TriggerModeAutomatic); rsp.Status != model.StatusSuccess {
+		t.Errorf("model override: status = %s", rsp.Status)
+	}
+	if rsp := handle("ab", TriggerModeAutomatic); rsp.RejectReason != ReasonTooShort {
+		t.Errorf("token limit: reject_reason = %q", rsp.RejectReason)
+	}
+}
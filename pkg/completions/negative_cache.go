@@ -0,0 +1,154 @@
+package completions
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"completion-agent/pkg/config"
+	"completion-agent/pkg/model"
+)
+
+// 未配置maxEntries时最多缓存的条目数
+const defaultNegativeCacheEntries = 1024
+
+// 缓存的负结果
+type negativeEntry struct {
+	key     string                 // 请求上下文的摘要
+	model   string                 // 响应中的模型名称
+	status  model.CompletionStatus // StatusRejected或StatusEmpty
+	err     error                  // 拒绝或为空的原因
+	expires time.Time              // 过期时间
+}
+
+/**
+ * 负结果缓存
+ * @description
+ * - 按client_id和文件路径索引，每个文件只保留最近一次的负结果
+ * - 同一文件的上下文发生变化时，旧的负结果随即失效
+ */
+var negativeCache = struct {
+	entries map[string]*negativeEntry
+	now     func() time.Time
+	mutex   sync.Mutex
+}{entries: make(map[string]*negativeEntry), now: time.Now}
+
+// 负结果的缓存时长，未启用时返回0
+func negativeCacheTTL() time.Duration {
+	if config.Wrapper == nil {
+		return 0
+	}
+	return config.Wrapper.NegativeCache.TTL.Duration()
+}
+
+/**
+ * 计算请求在负结果缓存中的位置和上下文摘要
+ * @param {*CompletionInput} in - 补全输入，已完成GetPrompts
+ * @returns {string, string} 返回按client_id和文件路径区分的缓存位置，以及决定补全结果的请求内容的摘要
+ * @description
+ * - 摘要覆盖模型、语言、触发方式、停用词、温度、随机种子、最大输出token数、扩展参数、提示词选项和隐藏分参数
+ * - completion_id、parent_id等每次请求都会变化的字段不参与摘要
+ */
+func negativeKey(in *CompletionInput) (string, string) {
+	data, _ := json.Marshal(struct {
+		Model       string
+		LanguageID  string
+		TriggerMode string
+		Temperature *float64
+		Seed        *int
+		MaxTokens   int
+		Stop        []string
+		Extra       map[string]interface{}
+		Prompts     *PromptOptions
+		HideScores  *HiddenScoreOptions
+	}{in.Model, in.LanguageID, in.TriggerMode, in.Temperature, in.Seed, in.MaxTokens, in.Stop, in.Extra, in.Prompts, in.HideScores})
+	sum := sha256.Sum256(data)
+	return in.ClientID + "\x00" + in.Prompts.FileProjectPath, hex.EncodeToString(sum[:])
+}
+
+/**
+ * 获取请求在负结果缓存中的位置和上下文摘要
+ * @param {*CompletionInput} in - 补全输入，已完成GetPrompts
+ * @returns {string, string} 同negativeKey
+ * @description
+ * - 第一次调用时(screen中查找缓存时)计算并保存在请求上，之后获取上下文、截断和规范化修改了提示词，
+ *   存储负结果时仍使用相同的摘要，保证查找和存储一致
+ */
+func (in *CompletionInput) negativeKeys() (string, string) {
+	if in.negativeCacheSlot == "" {
+		in.negativeCacheSlot, in.negativeCacheKey = negativeKey(in)
+	}
+	return in.negativeCacheSlot, in.negativeCacheKey
+}
+
+/**
+ * 查找相同上下文缓存的负结果
+ * @param {*CompletionInput} in - 补全输入，已完成GetPrompts
+ * @returns {*negativeEntry} 命中时返回缓存的负结果，未启用、未命中或已过期时返回nil
+ * @description
+ * - 同一文件的上下文已变化或负结果已过期时删除缓存的条目
+ */
+func lookupNegative(in *CompletionInput) *negativeEntry {
+	if negativeCacheTTL() <= 0 {
+		return nil
+	}
+	slot, key := in.negativeKeys()
+	negativeCache.mutex.Lock()
+	defer negativeCache.mutex.Unlock()
+	e, ok := negativeCache.entries[slot]
+	if !ok {
+		return nil
+	}
+	if e.key != key || !negativeCache.now().Before(e.expires) {
+		delete(negativeCache.entries, slot)
+		return nil
+	}
+	return e
+}
+
+/**
+ * 缓存请求的负结果
+ * @param {*CompletionInput} in - 补全输入，已完成GetPrompts
+ * @param {string} modelName - 响应中的模型名称，命中缓存时原样返回
+ * @param {model.CompletionStatus} status - StatusRejected或StatusEmpty
+ * @param {error} err - 拒绝或为空的原因，过滤器拒绝时为*RejectError
+ * @description
+ * - 未启用wrapper.negativeCache时不缓存
+ * - 条目数达到上限时先清理过期的条目，仍然不足时任意淘汰一条
+ */
+func storeNegative(in *CompletionInput, modelName string, status model.CompletionStatus, err error) {
+	ttl := negativeCacheTTL()
+	if ttl <= 0 {
+		return
+	}
+	limit := config.Wrapper.NegativeCache.MaxEntries
+	if limit <= 0 {
+		limit = defaultNegativeCacheEntries
+	}
+	slot, key := in.negativeKeys()
+	negativeCache.mutex.Lock()
+	defer negativeCache.mutex.Unlock()
+	now := negativeCache.now()
+	if _, ok := negativeCache.entries[slot]; !ok && len(negativeCache.entries) >= limit {
+		for k, e := range negativeCache.entries {
+			if !now.Before(e.expires) {
+				delete(negativeCache.entries, k)
+			}
+		}
+		for k := range negativeCache.entries {
+			if len(negativeCache.entries) < limit {
+				break
+			}
+			delete(negativeCache.entries, k)
+		}
+	}
+	negativeCache.entries[slot] = &negativeEntry{
+		key:     key,
+		model:   modelName,
+		status:  status,
+		err:     err,
+		expires: now.Add(ttl),
+	}
+}
@@ -0,0 +1,128 @@
+package completions
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"completion-agent/pkg/config"
+	"completion-agent/pkg/model"
+)
+
+// 记录调用次数并总是拒绝的过滤器
+type countingRejectFilter struct{ calls *int }
+
+func (f countingRejectFilter) Judge(in *CompletionInput) RejectCode {
+	*f.calls++
+	return LowHiddenScore
+}
+
+func Test_NegativeCacheRejected(t *testing.T) {
+	savedNow := negativeCache.now
+	defer func() { negativeCache.now = savedNow }()
+	withConfig(t, nil)
+	now := time.Unix(1000, 0)
+	negativeCache.now = func() time.Time { return now }
+	calls := 0
+	filterChain = &FilterChain{filters: []Filter{countingRejectFilter{&calls}}}
+
+	preprocess := func(id, prefix string) *CompletionResponse {
+		in := &CompletionInput{CompletionRequest: CompletionRequest{
+			CompletionID: id,
+			ClientID:     "client-neg",
+			Prompts:      &PromptOptions{Prefix: prefix, Suffix: "\n}", FileProjectPath: "main.go"},
+		}}
+		return in.Preprocess(NewCompletionContext(context.Background(), &CompletionPerformance{}))
+	}
+
+	// 未启用时每次都执行过滤器
+	config.Wrapper = &config.WrapperConfig{}
+	preprocess("c1", "func main() {")
+	preprocess("c2", "func main() {")
+	if calls != 2 {
+		t.Fatalf("filter calls without cache = %d, want 2", calls)
+	}
+
+	var wrapper config.WrapperConfig
+	if err := json.Unmarshal([]byte(`{"negativeCache": {"ttl": "2s"}}`), &wrapper); err != nil {
+		t.Fatal(err)
+	}
+	config.Wrapper = &wrapper
+	calls = 0
+	first := preprocess("c3", "func main() {")
+	rsp := preprocess("c4", "func main() {")
+	if calls != 1 {
+		t.Fatalf("filter calls = %d, want repeated context served from cache", calls)
+	}
+	if rsp == nil || rsp.Status != model.StatusRejected || rsp.Error != first.Error || rsp.ID != "c4" ||
+		rsp.RejectReason != "low_hidden_score" {
+		t.Fatalf("unexpected cached response: %+v", rsp)
+	}
+
+	// 编辑后上下文变化，缓存失效
+	preprocess("c5", "func main() {\n")
+	preprocess("c6", "func main() {")
+	if calls != 3 {
+		t.Fatalf("filter calls after edit = %d, want 3", calls)
+	}
+
+	// 过期后重新执行过滤器
+	now = now.Add(3 * time.Second)
+	preprocess("c7", "func main() {")
+	if calls != 4 {
+		t.Fatalf("filter calls after expiry = %d, want 4", calls)
+	}
+}
+
+// 记录调用次数的模型
+type countingLLM struct {
+	fakeLLM
+	calls int
+}
+
+func (m *countingLLM) Completions(ctx context.Context, param *model.CompletionParameter) (*model.CompletionResponse, model.CompletionStatus, error) {
+	m.calls++
+	return m.fakeLLM.Completions(ctx, param)
+}
+
+func Test_NegativeCacheEmpty(t *testing.T) {
+	withConfig(t, nil)
+	filterChain = &FilterChain{filters: []Filter{acceptAllFilter{}}}
+	var wrapper config.WrapperConfig
+	if err := json.Unmarshal([]byte(`{"negativeCache": {"ttl": "2s"}, "prune": {"disabled": true}}`), &wrapper); err != nil {
+		t.Fatal(err)
+	}
+	config.Wrapper = &wrapper
+
+	llm := &countingLLM{fakeLLM: fakeLLM{
+		cfg:    &config.ModelConfig{ModelName: "neg-model", MaxPrefix: 100, MaxSuffix: 100, MaxOutput: 16},
+		rsp:    &model.CompletionResponse{Choices: []model.CompletionChoice{{Text: ""}}},
+		status: model.StatusSuccess,
+	}}
+	handle := func(id string) *CompletionResponse {
+		// 客户端片段在获取上下文时拼入CodeContext，提示词随后还会被截断和规范化
+		in := &CompletionInput{CompletionRequest: CompletionRequest{
+			CompletionID: id,
+			ClientID:     "client-neg-empty",
+			Prompts: &PromptOptions{
+				Prefix:           "func main() {\n\t",
+				Suffix:           "\n}",
+				FileProjectPath:  "main.go",
+				ClipboardContent: []Snippet{{Type: "clipboard", Content: "fmt.Println(x)"}},
+			},
+		}}
+		c := NewCompletionContext(context.Background(), &CompletionPerformance{ReceiveTime: time.Now()})
+		return NewCompletionHandler(llm).HandleCompletion(c, in)
+	}
+	if rsp := handle("e1"); rsp.Status != model.StatusEmpty {
+		t.Fatalf("first status = %s, want %s", rsp.Status, model.StatusEmpty)
+	}
+	rsp := handle("e2")
+	if llm.calls != 1 {
+		t.Errorf("model calls = %d, want empty result served from cache", llm.calls)
+	}
+	if rsp.Status != model.StatusEmpty || rsp.ID != "e2" || rsp.Model != "neg-model" {
+		t.Errorf("unexpected cached response: %+v", rsp)
+	}
+}
@@ -0,0 +1,115 @@
+package completions
+
+import (
+	"strings"
+
+	"completion-agent/pkg/config"
+)
+
+// unicode标点到ASCII的替换表
+var punctuationReplacer = strings.NewReplacer(
+	"\u2018", "'", // ‘
+	"\u2019", "'", // ’
+	"\u201a", "'", // ‚
+	"\u201b", "'", // ‛
+	"\u2032", "'", // ′
+	"\u201c", "\"", // “
+	"\u201d", "\"", // ”
+	"\u201e", "\"", // „
+	"\u201f", "\"", // ‟
+	"\u2033", "\"", // ″
+	"\u00a0", " ", // 不间断空格
+	"\u2007", " ", // 数字空格
+	"\u202f", " ", // 窄不间断空格
+	"\u2013", "-", // –
+	"\u2014", "-", // —
+	"\u2212", "-", // −
+	"\u2026", "...", // …
+	"\u200b", "", // 零宽空格
+	"\ufeff", "", // BOM
+)
+
+/**
+ * 规范化提示词中的unicode标点
+ * @param {*PromptOptions} ppt - 提示词选项，前缀和后缀会被原地修改
+ * @param {string} language - 补全的语言
+ * @description
+ * - wrapper.normalize未开启或语言不在wrapper.normalize.languages中时不处理
+ * - 把弯引号、不间断空格、破折号、省略号等转换为ASCII等价字符，删除零宽空格
+ * @example
+ * ppt := &PromptOptions{Prefix: "print(“hello”)"}
+ * normalizePrompt(ppt, "python")
+ * // ppt.Prefix = "print(\"hello\")"
+ */
+func normalizePrompt(ppt *PromptOptions, language string) {
+	if config.Wrapper == nil || !config.Wrapper.Normalize.Enabled {
+		return
+	}
+	if langs := config.Wrapper.Normalize.Languages; len(langs) > 0 {
+		matched := false
+		for _, lang := range langs {
+			if strings.EqualFold(lang, language) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return
+		}
+	}
+	ppt.Prefix = punctuationReplacer.Replace(ppt.Prefix)
+	ppt.Suffix = punctuationReplacer.Replace(ppt.Suffix)
+}
+
+// Windows换行符，其他情况按\n处理
+const lineEndingCRLF = "\r\n"
+
+/**
+ * 统一提示词的换行符
+ * @description
+ * - 按前后缀中\r\n与单独\n的数量记录文档的主要换行符，供后置处理还原
+ * - 把前后缀、代码上下文、导入内容和客户端片段中的\r\n转换为\n，后续处理只需考虑\n
+ * - wrapper.normalize.keepLineEndings开启时不处理
+ * @example
+ * in.Prompts.Prefix = "if x {\r\n\t"
+ * in.normalizeLineEndings()
+ * // in.Prompts.Prefix = "if x {\n\t", in.lineEnding = "\r\n"
+ */
+func (in *CompletionInput) normalizeLineEndings() {
+	if config.Wrapper != nil && config.Wrapper.Normalize.KeepLineEndings {
+		return
+	}
+	p := in.Prompts
+	crlf := strings.Count(p.Prefix, lineEndingCRLF) + strings.Count(p.Suffix, lineEndingCRLF)
+	lf := strings.Count(p.Prefix, "\n") + strings.Count(p.Suffix, "\n") - crlf
+	if crlf > lf {
+		in.lineEnding = lineEndingCRLF
+	}
+	p.Prefix = toLF(p.Prefix)
+	p.Suffix = toLF(p.Suffix)
+	p.CodeContext = toLF(p.CodeContext)
+	p.ImportContent = toLF(p.ImportContent)
+	for _, snippets := range p.clientSnippets() {
+		for i := range snippets {
+			snippets[i].Content = toLF(snippets[i].Content)
+		}
+	}
+}
+
+// 把\r\n转换为\n
+func toLF(text string) string {
+	return strings.ReplaceAll(text, lineEndingCRLF, "\n")
+}
+
+/**
+ * 把补全结果还原为文档的换行符
+ * @param {string} text - 补全结果
+ * @param {string} lineEnding - normalizeLineEndings记录的换行符
+ * @returns {string} 文档按\r\n换行时返回统一为\r\n换行的结果，否则原样返回
+ */
+func restoreLineEnding(text, lineEnding string) string {
+	if lineEnding != lineEndingCRLF {
+		return text
+	}
+	return strings.ReplaceAll(toLF(text), "\n", lineEndingCRLF)
+}
@@ -0,0 +1,99 @@
+package completions
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"completion-agent/pkg/config"
+	"completion-agent/pkg/model"
+)
+
+func Test_NormalizePrompt(t *testing.T) {
+	withConfig(t, &config.WrapperConfig{
+		Normalize: config.NormalizeConfig{Enabled: true, Languages: []string{"python"}},
+	})
+
+	ppt := &PromptOptions{
+		Prefix: "msg = “it’s done” \nprint(‘x’, ",
+		Suffix: ")  # wait…",
+	}
+	normalizePrompt(ppt, "Python")
+	if want := "msg = \"it's done\" \nprint('x', "; ppt.Prefix != want {
+		t.Errorf("prefix = %q, want %q", ppt.Prefix, want)
+	}
+	if want := ")  # wait..."; ppt.Suffix != want {
+		t.Errorf("suffix = %q, want %q", ppt.Suffix, want)
+	}
+
+	// 未列出的语言保持原样，避免破坏其中的非英文字符串
+	ppt = &PromptOptions{Prefix: "s := “你好”"}
+	normalizePrompt(ppt, "go")
+	if ppt.Prefix != "s := “你好”" {
+		t.Errorf("go prefix changed: %q", ppt.Prefix)
+	}
+
+	config.Wrapper.Normalize.Enabled = false
+	ppt = &PromptOptions{Prefix: "“x”"}
+	normalizePrompt(ppt, "python")
+	if ppt.Prefix != "“x”" {
+		t.Errorf("disabled normalizer changed prefix: %q", ppt.Prefix)
+	}
+}
+
+func Test_LineEndings(t *testing.T) {
+	withConfig(t, &config.WrapperConfig{Prune: config.PruneConfig{Disabled: true}})
+	filterChain = &FilterChain{filters: []Filter{acceptAllFilter{}}}
+
+	newInput := func(prefix, suffix string) *CompletionInput {
+		return &CompletionInput{CompletionRequest: CompletionRequest{
+			TriggerMode: TriggerModeManual,
+			Prompts: &PromptOptions{Prefix: prefix, Suffix: suffix,
+				ClipboardContent: []Snippet{{Type: "clipboard", Content: "x := 1\r\ny := 2"}}},
+		}}
+	}
+	in := newInput("func f() {\r\n\tif x {\r\n\t\t", "\r\n\t}\n}")
+	in.normalizeLineEndings()
+	if in.lineEnding != lineEndingCRLF {
+		t.Errorf("line ending = %q, want CRLF", in.lineEnding)
+	}
+	if in.Prompts.Prefix != "func f() {\n\tif x {\n\t\t" || in.Prompts.Suffix != "\n\t}\n}" {
+		t.Errorf("prompt not normalized: %q, %q", in.Prompts.Prefix, in.Prompts.Suffix)
+	}
+	if got := in.Prompts.ClipboardContent[0].Content; got != "x := 1\ny := 2" {
+		t.Errorf("snippet not normalized: %q", got)
+	}
+	in = newInput("a\nb\r\nc\n", "")
+	in.normalizeLineEndings()
+	if in.lineEnding != "" {
+		t.Errorf("LF document detected as %q", in.lineEnding)
+	}
+
+	// 模型按\n换行给出的补全还原为文档的\r\n
+	llm := &fakeLLM{
+		cfg:    &config.ModelConfig{MaxPrefix: 100, MaxSuffix: 100, MaxOutput: 16},
+		rsp:    &model.CompletionResponse{Choices: []model.CompletionChoice{{Text: "call()\n\t\treturn\r\n"}}},
+		status: model.StatusSuccess,
+	}
+	handle := func(in *CompletionInput) string {
+		c := NewCompletionContext(context.Background(), &CompletionPerformance{ReceiveTime: time.Now()})
+		rsp := NewCompletionHandler(llm).HandleCompletion(c, in)
+		if rsp.Status != model.StatusSuccess {
+			t.Fatalf("status = %s", rsp.Status)
+		}
+		return rsp.Choices[0].Text
+	}
+	if got := handle(newInput("func f() {\r\n\tif x {\r\n\t\t", "\r\n\t}\r\n}")); got != "call()\r\n\t\treturn\r\n" {
+		t.Errorf("CRLF document: completion = %q", got)
+	}
+	if got := handle(newInput("func f() {\n\t", "\n}")); got != "call()\n\t\treturn\r\n" {
+		t.Errorf("LF document: completion = %q", got)
+	}
+
+	config.Wrapper.Normalize.KeepLineEndings = true
+	in = newInput("a\r\nb\r\n", "")
+	in.normalizeLineEndings()
+	if in.lineEnding != "" || in.Prompts.Prefix != "a\r\nb\r\n" {
+		t.Errorf("keepLineEndings ignored: %q, %q", in.lineEnding, in.Prompts.Prefix)
+	}
+}
@@ -2,20 +2,35 @@ package completions
 
 import (
 	"completion-agent/pkg/config"
+	"completion-agent/pkg/logger"
+	"completion-agent/pkg/metrics"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
 
 	"go.uber.org/zap"
 )
 
+// 补全结果结尾换行的处理方式(extra.trailing_newline)
+const (
+	TrailingNewlinePreserve = "preserve" // 保持模型输出，默认方式
+	TrailingNewlineNone     = "none"     // 去除所有结尾换行
+	TrailingNewlineSingle   = "single"   // 保证有且只有一个结尾换行
+)
+
 /**
  * 修剪补全结果
  * @param {string} completionText - 原始补全文本内容
  * @param {string} prefix - 代码前缀文本
  * @param {string} suffix - 代码后缀文本
  * @param {string} lang - 编程语言标识符
+ * @param {[]string} pruners - 请求extra.pruners指定的修剪器名称，为空时按配置
  * @returns {string} 返回修剪后的补全文本
  * @description
  * - 使用后置处理器链修剪补全结果
- * - 如果配置了自定义修剪器，使用自定义链
+ * - 请求指定了修剪器时只使用指定的修剪器
+ * - 否则如果配置了自定义修剪器，使用自定义链
  * - 否则使用默认的后置处理器链
  * - 记录修剪过程的调试信息
  * - 用于优化补全结果的质量和格式
@@ -24,11 +39,12 @@ import (
  *     "function test() {\n    return;\n}\nfunction test2() {}",
  *     "function test() {",
  *     "}",
- *     "javascript"
+ *     "javascript",
+ *     nil
  * )
  * // 结果可能移除重复的函数定义
  */
-func (h *CompletionHandler) pruneCompletionCode(completionText, prefix, suffix, lang string) string {
+func (h *CompletionHandler) pruneCompletionCode(completionText, prefix, suffix, lang string, pruners []string) string {
 	prunerContext := &PrunerContext{
 		Language:       lang,
 		CompletionCode: completionText,
@@ -37,7 +53,10 @@ func (h *CompletionHandler) pruneCompletionCode(completionText, prefix, suffix,
 	}
 	var chain *PrunerChain
 	var err error
-	if len(config.Wrapper.Prune.Pruners) > 0 {
+	if len(pruners) > 0 {
+		// 名称已由ParseExtra校验
+		chain, _ = NewPrunerChainByNames(pruners)
+	} else if len(config.Wrapper.Prune.Pruners) > 0 {
 		chain, err = NewPrunerChainByNames(config.Wrapper.Prune.Pruners)
 		if err != nil {
 			zap.L().Error("Invalid config: 'wrapper.prune.pruners' contains invalid pruner names",
@@ -49,9 +68,150 @@ func (h *CompletionHandler) pruneCompletionCode(completionText, prefix, suffix,
 	}
 	if chain.Process(prunerContext) {
 		zap.L().Info("Prune by Pruners",
-			zap.String("pre", completionText),
-			zap.String("post", prunerContext.CompletionCode),
+			logger.Sensitive("pre", completionText),
+			logger.Sensitive("post", prunerContext.CompletionCode),
 			zap.Any("hits", chain.GetHitProcessors()))
 	}
 	return prunerContext.CompletionCode
 }
+
+/**
+ * 限制补全结果的token数
+ * @param {string} completionText - 修剪后的补全文本
+ * @param {string} modelName - 模型名称，用于记录截断指标
+ * @param {int} maxTokens - 补全结果的最大token数
+ * @returns {string} 返回截断后的补全文本，未超出上限时原样返回
+ * @description
+ * - 使用模型的分词器计算token数，没有分词器时按每个token约charsPerToken()个字符估算
+ * - 超出上限时先截取前maxTokens个token，再回退到干净的边界：
+ *   有完整的行时保留到最后一个完整行，否则保留到最后一个完整的单词
+ * - 截断后去掉结尾多余的空白
+ * - 截断时记录日志和completion_truncated_total指标
+ * @example
+ * text := handler.limitCompletionTokens("a := 1\nb := 2\nc := 3", "model", 6)
+ * // text = "a := 1\nb := 2" (实际结果取决于分词器)
+ */
+func (h *CompletionHandler) limitCompletionTokens(completionText, modelName string, maxTokens int) string {
+	var cut string
+	if tokenizer := h.llm.Tokenizer(); tokenizer != nil {
+		ids := tokenizer.Encode(completionText)
+		if len(ids) <= maxTokens {
+			return completionText
+		}
+		cut = tokenizer.Decode(ids[:maxTokens])
+		// 解码结果不一定是原文的前缀(如多字节字符被拆分)，只保留相同的部分
+		cut = completionText[:commonPrefixLen(completionText, cut)]
+	} else {
+		runes := []rune(completionText)
+		limit := tokensToChars(maxTokens)
+		if len(runes) <= limit {
+			return completionText
+		}
+		cut = string(runes[:limit])
+	}
+	truncated := strings.TrimRight(cleanBoundary(completionText, cut), " \t\r\n")
+	zap.L().Info("Truncate completion by max tokens",
+		zap.Int("maxTokens", maxTokens),
+		logger.Sensitive("pre", completionText),
+		logger.Sensitive("post", truncated))
+	metrics.IncrementCompletionTruncated(modelName)
+	return truncated
+}
+
+// 返回a、b相同前缀的字节数，不拆分多字节字符
+func commonPrefixLen(a, b string) int {
+	n := 0
+	for i, r := range a {
+		if i >= len(b) || !strings.HasPrefix(b[i:], string(r)) {
+			break
+		}
+		n = i + len(string(r))
+	}
+	return n
+}
+
+/**
+ * 把截断位置回退到干净的边界
+ * @param {string} text - 截断前的完整文本
+ * @param {string} cut - text的前缀，即按token截断的结果
+ * @returns {string} 返回回退后的前缀
+ * @description
+ * - cut包含换行时，保留到最后一个换行之前，丢弃不完整的行
+ * - 否则截断位置正处于单词中间时(后面紧跟的不是空白)，回退到该单词之前
+ * - 找不到更早的边界时，保留按token截断的结果
+ */
+func cleanBoundary(text, cut string) string {
+	if len(cut) == len(text) {
+		return cut
+	}
+	if idx := strings.LastIndex(cut, "\n"); idx > 0 {
+		return cut[:idx]
+	}
+	if next := []rune(text[len(cut):])[0]; unicode.IsSpace(next) {
+		return cut
+	}
+	if idx := strings.LastIndexFunc(cut, unicode.IsSpace); idx > 0 && strings.TrimSpace(cut[:idx]) != "" {
+		return cut[:idx]
+	}
+	return cut
+}
+
+/**
+ * 计算补全建议替换的范围
+ * @param {string} prefix - 光标之前的文本
+ * @param {string} completionText - 后置处理后的补全文本
+ * @returns {*ReplaceRange} 补全以光标前未写完的单词开头时返回覆盖该单词的范围，否则返回nil
+ * @description
+ * - 取光标前紧邻的单词(字母、数字、下划线)，补全以该单词开头(区分大小写)且更长时，
+ *   认为补全包含了该单词，建议替换光标前的这部分
+ * - 光标前不是单词字符时不需要替换
+ * - 单词前的分隔符可能是多字节字符(如"，"、"“")，按其实际宽度定位单词的起点
+ * - 偏移以UTF-16码元计，与VS Code、JetBrains等编辑器的列号一致
+ * @example
+ * r := completionReplaceRange("fmt.Pri", "Println(x)")
+ * // r = &ReplaceRange{Start: -3, End: 0}
+ */
+func completionReplaceRange(prefix, completionText string) *ReplaceRange {
+	start := 0
+	if idx := strings.LastIndexFunc(prefix, func(r rune) bool { return !isWordChar(r) }); idx >= 0 {
+		_, width := utf8.DecodeRuneInString(prefix[idx:])
+		start = idx + width
+	}
+	word := prefix[start:]
+	if word == "" || len(completionText) <= len(word) || !strings.HasPrefix(completionText, word) {
+		return nil
+	}
+	return &ReplaceRange{Start: -len(utf16.Encode([]rune(word))), End: 0}
+}
+
+func isWordChar(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+/**
+ * 按客户端要求规范化补全结果的结尾换行
+ * @param {string} completionText - 修剪后的补全文本
+ * @param {string} mode - 结尾换行的处理方式，取值见TrailingNewline*常量
+ * @returns {string} 返回规范化后的补全文本
+ * @description
+ * - 空串或preserve方式保持原样返回
+ * - none方式去除结尾所有的空白及换行
+ * - single方式去除结尾空白后补上一个换行
+ * - 未知的方式按preserve处理
+ * @example
+ * normalizeTrailingNewline("return x\n\n", TrailingNewlineSingle)
+ * // 返回 "return x\n"
+ */
+func normalizeTrailingNewline(completionText, mode string) string {
+	if completionText == "" {
+		return completionText
+	}
+	switch mode {
+	case TrailingNewlineNone:
+		return strings.TrimRight(completionText, " \t\r\n")
+	case TrailingNewlineSingle:
+		return strings.TrimRight(completionText, " \t\r\n") + "\n"
+	default:
+		return completionText
+	}
+}
@@ -0,0 +1,104 @@
+package completions
+
+import (
+	"strings"
+	"testing"
+
+	"completion-agent/pkg/config"
+)
+
+func Test_NormalizeTrailingNewline(t *testing.T) {
+	cases := []struct {
+		mode string
+		text string
+		want string
+	}{
+		{TrailingNewlineNone, "return x\n\n\n", "return x"},
+		{TrailingNewlineNone, "return x", "return x"},
+		{TrailingNewlineNone, "return x\r\n  \n", "return x"},
+		{TrailingNewlineSingle, "return x", "return x\n"},
+		{TrailingNewlineSingle, "return x\n\n\n", "return x\n"},
+		{TrailingNewlineSingle, "return x\n", "return x\n"},
+		{TrailingNewlinePreserve, "return x\n\n", "return x\n\n"},
+		{"", "return x\n\n", "return x\n\n"},
+		{TrailingNewlineSingle, "", ""},
+	}
+	for _, c := range cases {
+		got := normalizeTrailingNewline(c.text, c.mode)
+		if got != c.want {
+			t.Errorf("mode=%q text=%q: expected %q, got %q", c.mode, c.text, c.want, got)
+		}
+	}
+}
+
+func Test_LimitCompletionTokens(t *testing.T) {
+	tk := loadTestTokenizer(t)
+	h := NewCompletionHandler(&fakeLLM{cfg: &config.ModelConfig{}, tokenizer: tk})
+
+	text := "x := compute(a, b)\nif x > 0 {\n\treturn x\n}\nreturn -x\n"
+	maxTokens := 12
+	got := h.limitCompletionTokens(text, "test", maxTokens)
+	if n := tk.GetTokenCount(got); n > maxTokens {
+		t.Fatalf("truncated to %d tokens, want <= %d: %q", n, maxTokens, got)
+	}
+	if !strings.HasPrefix(text, got) || got == "" {
+		t.Fatalf("truncated text %q is not a non-empty prefix", got)
+	}
+	// 截断在完整的行结尾
+	if !strings.HasPrefix(text[len(got):], "\n") {
+		t.Fatalf("truncated in the middle of a line: %q", got)
+	}
+
+	// 未超出上限时原样返回
+	if got := h.limitCompletionTokens(text, "test", 1000); got != text {
+		t.Fatalf("expected unchanged, got %q", got)
+	}
+
+	// 单行时回退到完整的单词
+	line := "return someFunction(firstArgument, secondArgument, thirdArgument)"
+	got = h.limitCompletionTokens(line, "test", 5)
+	if n := tk.GetTokenCount(got); n > 5 || !strings.HasPrefix(line, got) {
+		t.Fatalf("unexpected single line truncation: %q", got)
+	}
+	if rest := line[len(got):]; rest != "" && rest[0] != ' ' {
+		t.Fatalf("truncated in the middle of a word: %q", got)
+	}
+}
+
+func Test_LimitCompletionTokensByChars(t *testing.T) {
+	h := NewCompletionHandler(&fakeLLM{cfg: &config.ModelConfig{}})
+	text := "line one\nline two\nline three\n"
+	// 没有分词器时按每个token约4个字符估算
+	if got := h.limitCompletionTokens(text, "test", 4); got != "line one" {
+		t.Fatalf("expected %q, got %q", "line one", got)
+	}
+}
+
+func Test_CompletionReplaceRange(t *testing.T) {
+	cases := []struct {
+		prefix string
+		text   string
+		want   *ReplaceRange
+	}{
+		{"fmt.Pri", "Println(x)", &ReplaceRange{Start: -3, End: 0}},
+		{"\tx := Pri", "Println(x)", &ReplaceRange{Start: -3, End: 0}},
+		{"\tx := pri", "Println(x)", nil},
+		{"s := \"中文", "中文字符\"", &ReplaceRange{Start: -2, End: 0}},
+		// 单词前是多字节的中文标点
+		{"s := “Pri", "Println(x)", &ReplaceRange{Start: -3, End: 0}},
+		{"a，变", "变量名", &ReplaceRange{Start: -1, End: 0}},
+		// 基本多文种平面之外的字符占两个UTF-16码元
+		{"s := 𝑥", "𝑥1", &ReplaceRange{Start: -2, End: 0}},
+		{"fmt.Pri", "ntln(x)", nil},
+		{"fmt.", "Println(x)", nil},
+		{"x := ", "y", nil},
+		{"fmt.Println", "Println", nil},
+		{"", "foo", nil},
+	}
+	for _, c := range cases {
+		got := completionReplaceRange(c.prefix, c.text)
+		if (got == nil) != (c.want == nil) || (got != nil && *got != *c.want) {
+			t.Errorf("prefix %q, text %q: got %+v, want %+v", c.prefix, c.text, got, c.want)
+		}
+	}
+}
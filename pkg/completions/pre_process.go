@@ -2,20 +2,48 @@ package completions
 
 import (
 	"completion-agent/pkg/config"
+	"completion-agent/pkg/model"
 	"completion-agent/pkg/tokenizers"
+	"context"
+	"math"
+	"slices"
 	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
 )
 
+// 按字符估算token时，每个token对应的平均字符数，与codebase_context共用tokenizers中的估算
+func charsPerToken() float64 {
+	return tokenizers.CharsPerToken()
+}
+
+// 将token数换算为估算的字符(rune)数
+func tokensToChars(tokens int) int {
+	return int(float64(tokens) * charsPerToken())
+}
+
+// 按字符(rune)数估算token数，不足一个token的部分按一个计算
+func charsToTokens(chars int) int {
+	return int(math.Ceil(float64(chars) / charsPerToken()))
+}
+
 /**
  * 截断超长的提示词(前缀，后缀，上下文)
+ * @param {context.Context} ctx - 请求上下文，分词时遵循其截止时间
  * @param {*config.ModelConfig} cfg - 模型配置，包含最大前缀和后缀token限制
  * @param {*PromptOptions} ppt - 提示词选项，包含前缀、后缀和代码上下文
  * @description
  * - 检查并截断超过模型限制的长提示词
+ * - 使用当前模型的分词器计算token，模型未指定分词器时使用全局分词器
+ * - 请求临近截止时间导致分词中断时，改用按字符估算的方式截断
  * - 优先保留最靠近补全位置的代码
  * - 如果前缀已超长，完全丢弃上下文
  * - 否则截断上下文以保留前缀
  * - 同时处理后缀的截断
+ * - FIM标记等组装prompt时加入的固定内容计入前缀的预算
+ * - FIM模式下配置了balanceRatio时，前后缀的预算由balanceBudget按比例重新分配
  * @example
  * cfg := &config.ModelConfig{MaxPrefix: 1000, MaxSuffix: 500}
  * ppt := &PromptOptions{
@@ -23,27 +51,42 @@ import (
  *     Suffix: "long suffix...",
  *     CodeContext: "long context...",
  * }
- * handler.truncatePrompt(cfg, ppt)
+ * handler.truncatePrompt(ctx, cfg, ppt)
  * // ppt中的内容会被截断到模型限制范围内
  */
-func (h *CompletionHandler) truncatePrompt(cfg *config.ModelConfig, ppt *PromptOptions) {
-	tokenizer := tokenizers.GetTokenizer()
+func (h *CompletionHandler) truncatePrompt(ctx context.Context, cfg *config.ModelConfig, ppt *PromptOptions) {
+	// 获取最大模型长度限制
+	prefixMax := h.llm.Config().MaxPrefix
+	suffixMax := h.llm.Config().MaxSuffix
+
+	tokenizer := h.llm.Tokenizer()
 	if tokenizer == nil {
+		// 分词器不可用(wrapper.tokenizer.fallback为estimate)，按字符数估算
+		h.truncatePromptByChars(ppt, prefixMax, suffixMax)
 		return
 	}
 
-	prefixTokens := tokenizer.Encode(ppt.Prefix)
+	prefixTokens, err := ppt.pretokenized.encode(ctx, tokenizer, ppt.Prefix)
+	var suffixTokens, contextTokens []int
+	if err == nil {
+		suffixTokens, err = ppt.pretokenized.encode(ctx, tokenizer, ppt.Suffix)
+	}
+	if err == nil {
+		contextTokens, err = tokenizer.EncodeContext(ctx, ppt.CodeContext)
+	}
+	if err != nil {
+		zap.L().Warn("tokenize prompt interrupted, truncate by estimated chars", zap.Error(err))
+		h.truncatePromptByChars(ppt, prefixMax, suffixMax)
+		return
+	}
 	prefixTokensNum := len(prefixTokens)
-
-	suffixTokens := tokenizer.Encode(ppt.Suffix)
 	suffixTokensNum := len(suffixTokens)
-
-	contextTokens := tokenizer.Encode(ppt.CodeContext)
 	contextTokensNum := len(contextTokens)
-
-	// 获取最大模型长度限制
-	prefixMax := h.llm.Config().MaxPrefix
-	suffixMax := h.llm.Config().MaxSuffix
+	// prompt由模型客户端按model.BuildPrompt组装，FIM标记等固定部分同样占用前缀的预算
+	if overhead := tokenizer.GetTokenCount(model.BuildPrompt(h.llm.Config(), &model.CompletionParameter{})); overhead > 0 && prefixMax > overhead {
+		prefixMax -= overhead
+	}
+	prefixMax, suffixMax = h.balanceBudget(prefixTokensNum+contextTokensNum, suffixTokensNum, prefixMax, suffixMax)
 
 	// 如果总token数超过限制，需要截断
 	if prefixTokensNum+contextTokensNum > prefixMax {
@@ -67,13 +110,164 @@ func (h *CompletionHandler) truncatePrompt(cfg *config.ModelConfig, ppt *PromptO
 	}
 }
 
+// 预先分词的前后缀，文本与分词时一致才复用
+type promptTokens struct {
+	tokenizer    *tokenizers.Tokenizer
+	prefix       string
+	suffix       string
+	prefixTokens []int
+	suffixTokens []int
+}
+
+/**
+ * 对文本分词，文本是预先分词过的前缀或后缀时直接复用结果
+ * @param {context.Context} ctx - 请求上下文，分词时遵循其截止时间
+ * @param {*tokenizers.Tokenizer} tokenizer - 分词器
+ * @param {string} text - 待分词的文本
+ * @returns {[]int, error} 返回token序列，分词被中断时返回错误
+ * @description
+ * - p为nil、分词器不同或文本在预先分词后被修改(如规范化)时重新分词
+ */
+func (p *promptTokens) encode(ctx context.Context, tokenizer *tokenizers.Tokenizer, text string) ([]int, error) {
+	if p != nil && p.tokenizer == tokenizer {
+		switch text {
+		case p.prefix:
+			if p.prefixTokens != nil {
+				return p.prefixTokens, nil
+			}
+		case p.suffix:
+			if p.suffixTokens != nil {
+				return p.suffixTokens, nil
+			}
+		}
+	}
+	return tokenizer.EncodeContext(ctx, text)
+}
+
+/**
+ * 预先对前后缀分词
+ * @param {context.Context} ctx - 请求上下文，请求取消时中断分词
+ * @param {string} prefix - 前缀
+ * @param {string} suffix - 后缀
+ * @param {string} language - 请求的语言，用于按截断前的规范化结果分词
+ * @returns {*promptTokens} 返回分词结果，没有分词器时返回nil，分词中断的部分不缓存
+ * @description
+ * - 与获取上下文并行执行，只读取传入的字符串，不修改提示词
+ * - 分词的是normalizePrompt规范化之后的文本，与truncatePrompt实际处理的文本一致
+ */
+func (h *CompletionHandler) pretokenize(ctx context.Context, prefix, suffix, language string) *promptTokens {
+	tokenizer := h.llm.Tokenizer()
+	if tokenizer == nil {
+		return nil
+	}
+	normalized := PromptOptions{Prefix: prefix, Suffix: suffix}
+	normalizePrompt(&normalized, language)
+	p := &promptTokens{tokenizer: tokenizer, prefix: normalized.Prefix, suffix: normalized.Suffix}
+	if ids, err := tokenizer.EncodeContext(ctx, p.prefix); err == nil {
+		p.prefixTokens = ids
+	}
+	if ids, err := tokenizer.EncodeContext(ctx, p.suffix); err == nil {
+		p.suffixTokens = ids
+	}
+	return p
+}
+
+/**
+ * 获取上下文，同时预先对前后缀分词
+ * @param {*CompletionContext} c - 补全上下文
+ * @param {*CompletionInput} input - 补全输入，已通过拒绝规则
+ * @description
+ * - 上下文检索主要耗时在等待代码库服务，分词与之重叠，缩短截断阶段的耗时
+ * - 两个分支都使用请求的上下文，请求被取消或超时时同时中断
+ * - 等待两个分支都结束后返回，分词结果保存在提示词中，由truncatePrompt复用
+ */
+func (h *CompletionHandler) prepareContext(c *CompletionContext, input *CompletionInput) {
+	prefix, suffix := input.Prompts.Prefix, input.Prompts.Suffix
+	var tokens *promptTokens
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		tokens = h.pretokenize(c.Ctx, prefix, suffix, input.LanguageID)
+	}()
+	input.GetContext(c)
+	wg.Wait()
+	input.Prompts.pretokenized = tokens
+}
+
+/**
+ * 按字符数估算token，截断超长的提示词
+ * @param {*PromptOptions} ppt - 提示词选项，包含前缀、后缀和代码上下文
+ * @param {int} prefixMax - 前缀(含上下文)的最大token数
+ * @param {int} suffixMax - 后缀的最大token数
+ * @description
+ * - 按每个token约charsPerToken()个字符，将token限制换算为字符(rune)限制
+ * - 截断策略与truncatePrompt一致：优先保留前缀，前缀超长时丢弃上下文
+ * - 截断后同样去掉不完整的首行/末行
+ * - 与truncatePrompt一样按balanceBudget重新分配前后缀的预算
+ */
+func (h *CompletionHandler) truncatePromptByChars(ppt *PromptOptions, prefixMax, suffixMax int) {
+	prefix := []rune(ppt.Prefix)
+	codeContext := []rune(ppt.CodeContext)
+	suffix := []rune(ppt.Suffix)
+	prefixLimit, suffixLimit := h.balanceBudget(len(prefix)+len(codeContext), len(suffix),
+		tokensToChars(prefixMax), tokensToChars(suffixMax))
+
+	if len(prefix)+len(codeContext) > prefixLimit {
+		if len(prefix) >= prefixLimit {
+			ppt.CodeContext = ""
+			ppt.Prefix = h.trimFirstLine(string(prefix[len(prefix)-prefixLimit:]))
+		} else {
+			ppt.CodeContext = string(codeContext[len(prefix)+len(codeContext)-prefixLimit:])
+		}
+	}
+	if len(suffix) > suffixLimit {
+		ppt.Suffix = h.trimLastLine(string(suffix[:suffixLimit]))
+	}
+}
+
+/**
+ * 以光标为中心重新分配前后缀的截断预算
+ * @param {int} prefixLen - 前缀与上下文的总长度
+ * @param {int} suffixLen - 后缀的长度
+ * @param {int} prefixMax - 前缀(含上下文)原本的预算
+ * @param {int} suffixMax - 后缀原本的预算
+ * @returns {int, int} 返回重新分配后的前缀预算和后缀预算，长度单位与参数一致
+ * @description
+ * - 仅在FIM模式且模型配置了0~1之间的balanceRatio时生效，否则原样返回
+ * - 前后缀共用prefixMax+suffixMax的总预算，前缀分得balanceRatio的比例，其余给后缀
+ * - 一侧的实际长度不足分得的预算时，余量分给另一侧，保证总预算用满
+ * @example
+ * // balanceRatio=0.5, 前后缀都超长
+ * h.balanceBudget(5000, 5000, 1500, 500) // 返回 1000, 1000
+ * // 后缀只有200
+ * h.balanceBudget(5000, 200, 1500, 500) // 返回 1800, 200
+ */
+func (h *CompletionHandler) balanceBudget(prefixLen, suffixLen, prefixMax, suffixMax int) (int, int) {
+	cfg := h.llm.Config()
+	if !cfg.FimMode || cfg.BalanceRatio <= 0 || cfg.BalanceRatio >= 1 {
+		return prefixMax, suffixMax
+	}
+	total := prefixMax + suffixMax
+	prefixMax = int(float64(total) * cfg.BalanceRatio)
+	suffixMax = total - prefixMax
+	if prefixLen < prefixMax {
+		suffixMax += prefixMax - prefixLen
+		prefixMax = prefixLen
+	} else if suffixLen < suffixMax {
+		prefixMax += suffixMax - suffixLen
+		suffixMax = suffixLen
+	}
+	return prefixMax, suffixMax
+}
+
 /**
  * 修剪提示词的第一行
  * @param {string} prompt - 要修剪的提示词文本
  * @returns {string} 返回修剪后的提示词文本
  * @description
  * - 从提示词中移除第一行（如果不是以换行符开头）
- * - 使用SplitAfter方法分割文本
+ * - 支持\n和\r\n换行，第一行连同其换行符一起移除，不会留下单独的\r
  * - 保留除第一行外的所有内容
  * - 用于处理提示词格式，确保正确的代码缩进
  * @example
@@ -82,16 +276,16 @@ func (h *CompletionHandler) truncatePrompt(cfg *config.ModelConfig, ppt *PromptO
  *
  * result = handler.trimFirstLine("\nline1\nline2")
  * // result = "\nline1\nline2" (第一行以换行符开头，保留)
+ *
+ * result = handler.trimFirstLine("ne1\r\nline2")
+ * // result = "line2"
  */
 func (h *CompletionHandler) trimFirstLine(prompt string) string {
-	lines := strings.SplitAfter(prompt, "\n")
-	if len(lines) > 0 {
-		if !strings.HasPrefix(lines[0], "\n") && !strings.HasPrefix(lines[0], "\r\n") {
-			lines = lines[1:]
-		}
-		return strings.Join(lines, "")
+	if strings.HasPrefix(prompt, "\n") || strings.HasPrefix(prompt, "\r\n") {
+		return prompt
 	}
-	return prompt
+	_, rest, _ := strings.Cut(prompt, "\n")
+	return rest
 }
 
 /**
@@ -100,34 +294,33 @@ func (h *CompletionHandler) trimFirstLine(prompt string) string {
  * @returns {string} 返回修剪后的后缀文本
  * @description
  * - 从后缀中移除最后一行（如果不是以换行符结尾）
- * - 使用SplitAfter方法分割文本
- * - 保留除最后一行外的所有内容
+ * - 只有一行时保留该行
+ * - 支持\n和\r\n换行，截断落在\r\n之间时去掉末尾单独的\r
  * - 用于处理后缀格式，确保正确的代码结构
  * @example
  * result := handler.trimLastLine("line1\nline2\nline3")
- * // result = "line1\nline2"
+ * // result = "line1\nline2\n"
  *
  * result = handler.trimLastLine("line1\nline2\n")
  * // result = "line1\nline2\n" (最后一行以换行符结尾，保留)
+ *
+ * result = handler.trimLastLine("line1\r\nli")
+ * // result = "line1\r\n"
  */
 func (h *CompletionHandler) trimLastLine(suffix string) string {
-	lines := strings.SplitAfter(suffix, "\n")
-	if len(lines) > 0 {
-		if len(lines) > 1 && !strings.HasSuffix(lines[len(lines)-1], "\n") {
-			lines = lines[:len(lines)-1]
-		}
-		return strings.Join(lines, "")
+	if idx := strings.LastIndex(suffix, "\n"); idx >= 0 {
+		suffix = suffix[:idx+1]
 	}
-	return suffix
+	return strings.TrimSuffix(suffix, "\r")
 }
 
 /**
  * 获取提示词的token数量
  * @param {string} prompt - 要计算token数量的提示词文本
- * @returns {int} 返回token数量，如果tokenizer不可用返回0
+ * @returns {int} 返回token数量
  * @description
- * - 使用全局tokenizer计算文本的token数量
- * - 如果tokenizer未初始化，返回0
+ * - 使用当前模型的tokenizer计算文本的token数量
+ * - 如果tokenizer不可用，按每个token约charsPerToken()个字符估算
  * - 用于检查提示词长度是否超过模型限制
  * - 在truncatePrompt方法中调用
  * @example
@@ -135,60 +328,97 @@ func (h *CompletionHandler) trimLastLine(suffix string) string {
  * // count = 10 (实际数量取决于tokenizer实现)
  */
 func (h *CompletionHandler) getTokensCount(prompt string) int {
-	tokenizer := tokenizers.GetTokenizer()
+	tokenizer := h.llm.Tokenizer()
 	if tokenizer == nil {
-		return 0
+		return charsToTokens(utf8.RuneCountInString(prompt))
 	}
 	return tokenizer.GetTokenCount(prompt)
 }
 
-/**
- * 获取加了FIM标记的prompt文本
- * @param {string} prefix - 代码前缀文本
- * @param {string} suffix - 代码后缀文本
- * @param {string} codeContext - 代码上下文文本
- * @param {*config.ModelConfig} cfg - 模型配置，包含FIM相关标记
- * @returns {string} 返回添加了FIM标记的完整prompt文本
- * @description
- * - 按照FIM(Fill In the Middle)格式组装prompt
- * - 使用配置中的FIM标记：FimBegin、FimHole、FimEnd
- * - 格式为：FimBegin + codeContext + "\n" + prefix + FimHole + suffix + FimEnd
- * - 用于支持FIM模式的代码补全
- * @example
- * cfg := &config.ModelConfig{
- *     FimBegin: "<fim-prefix>",
- *     FimHole: "<fim-suffix>",
- *     FimEnd: "<fim-middle>",
- * }
- * prompt := handler.getFimPrompt("function test", "}", "context", cfg)
- * // prompt = "<fim-prefix>context\nfunction test<fim-suffix>}<fim-middle>"
- */
-func (h *CompletionHandler) getFimPrompt(prefix, suffix, codeContext string, cfg *config.ModelConfig) string {
-	return cfg.FimBegin + codeContext + "\n" + prefix + cfg.FimHole + suffix + cfg.FimEnd
-}
-
 /**
  * 准备停用词
  * @param {*CompletionInput} input - 补全输入对象，包含请求参数和停用词设置
  * @returns {[]string} 返回停用词列表
  * @description
- * - 合并请求中的停用词和系统默认停用词
- * - 添加默认的FIM停用词"<｜end▁of▁sentence｜>"
- * - 如果后缀为空或只包含空白字符，添加多行停用词
- * - 用于控制补全生成的停止条件
+ * - 合并系统停用词和请求中的停用词，系统停用词在前，模型限制停用词个数时优先保留
+ * - 添加模型配置的结束符fimStop，未配置时使用默认的"<｜end▁of▁sentence｜>"
+ * - 如果后缀为空或只包含空白字符，添加多行停用词"\n\n"(已涵盖更多的连续空行)
+ * - 自动触发(automatic)时无论后缀如何都添加多行停用词，倾向较短的补全
+ * - 手动触发(manual)时不添加多行停用词，允许跨越空行的多行补全
+ * - 模型配置了disableBlankLineStop时不添加多行停用词
+ * - 单行补全不添加"\n"停用词：模型有时以换行开头，会导致补全为空，改由后置处理截断到第一行
+ * - 光标行之后首个非空后缀行较短时，以"\n"加该行(含缩进)作为停用词，模型重复输出后缀中已有的
+ *   结束括号或下一条语句时随即停止，见suffixStopWord
+ * - 用于控制补全生成的停止条件；模型配置了maxStopWords时，超出部分由模型客户端截去，见model.requestStopWords
  */
 func (h *CompletionHandler) prepareStopWords(input *CompletionInput) []string {
 	var stopWords []string
 
-	// 添加请求中的停用词
-	if len(input.Stop) > 0 {
-		stopWords = append(stopWords, input.Stop...)
+	// 添加模型的结束符
+	eot := h.cfg.FimStop
+	if len(eot) == 0 {
+		eot = []string{defaultEOTStop}
 	}
-	// 添加默认的FIM停用词
-	stopWords = append(stopWords, "<｜end▁of▁sentence｜>")
-	// 如果后缀为空，添加系统停用词
-	if input.Prompts.Suffix == "" || strings.TrimSpace(input.Prompts.Suffix) == "" {
-		stopWords = append(stopWords, "\n\n", "\n\n\n")
+	stopWords = appendStopWords(stopWords, eot...)
+	// 单行补全不添加"\n"，以免模型以换行开头时补全为空，见firstCompletionLine
+	// 如果后缀为空，添加系统停用词；自动触发总是添加，手动触发不添加
+	if !h.cfg.DisableBlankLineStop {
+		switch input.TriggerMode {
+		case TriggerModeAutomatic:
+			stopWords = appendStopWords(stopWords, "\n\n")
+		case TriggerModeManual:
+		default:
+			if input.Prompts.Suffix == "" || strings.TrimSpace(input.Prompts.Suffix) == "" {
+				stopWords = appendStopWords(stopWords, "\n\n")
+			}
+		}
+	}
+	if stop := suffixStopWord(input.Prompts.Suffix); stop != "" {
+		stopWords = appendStopWords(stopWords, stop)
+	}
+	// 最后添加请求中的停用词
+	return appendStopWords(stopWords, input.Stop...)
+}
+
+// 模型未配置fimStop时使用的结束符
+const defaultEOTStop = "<｜end▁of▁sentence｜>"
+
+// 追加停用词，跳过空字符串和已有的停用词
+func appendStopWords(stopWords []string, words ...string) []string {
+	for _, w := range words {
+		if w != "" && !slices.Contains(stopWords, w) {
+			stopWords = append(stopWords, w)
+		}
 	}
 	return stopWords
 }
+
+// 作为停用词的后缀行去除首尾空白后的最大字符数
+const maxSuffixStopLen = 40
+
+/**
+ * 根据后缀生成停用词
+ * @param {string} suffix - 光标后的代码，第一行为光标行的剩余部分
+ * @returns {string} 返回"\n"加光标行之后首个非空行(保留缩进，去除行尾空白)，该行过长或后缀没有非空行时返回空字符串
+ * @description
+ * - 光标行的剩余部分不参与，补全通常就插在它之前
+ * - 带上换行和缩进，只有模型另起一行重复输出该行时才停止，补全中间出现相同的文本不受影响
+ * @example
+ * suffixStopWord("\n\t}\n") // "\n\t}"
+ * suffixStopWord("\n\n    return result\n") // "\n    return result"
+ */
+func suffixStopWord(suffix string) string {
+	lines := strings.Split(suffix, "\n")
+	for _, line := range lines[1:] {
+		line = strings.TrimRight(line, " \t\r")
+		text := strings.TrimSpace(line)
+		if text == "" {
+			continue
+		}
+		if utf8.RuneCountInString(text) > maxSuffixStopLen {
+			return ""
+		}
+		return "\n" + line
+	}
+	return ""
+}
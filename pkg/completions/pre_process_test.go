@@ -0,0 +1,278 @@
+package completions
+
+import (
+	"context"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"completion-agent/pkg/config"
+	"completion-agent/pkg/model"
+	"completion-agent/pkg/tokenizers"
+)
+
+// withConfig 为测试设置全局配置，测试结束时恢复原来的配置及过滤器链
+// wrapper为nil时使用空配置，Context重置为空配置
+func withConfig(t *testing.T, wrapper *config.WrapperConfig) {
+	t.Helper()
+	savedWrapper, savedContext, savedServer, savedChain := config.Wrapper, config.Context, config.Server, filterChain
+	t.Cleanup(func() {
+		config.Wrapper, config.Context, config.Server, filterChain = savedWrapper, savedContext, savedServer, savedChain
+	})
+	if wrapper == nil {
+		wrapper = &config.WrapperConfig{}
+	}
+	config.Wrapper, config.Context = wrapper, &config.ContextConfig{}
+}
+
+// 测试用的模型，不实际调用后端
+type fakeLLM struct {
+	cfg       *config.ModelConfig
+	tokenizer *tokenizers.Tokenizer
+	rsp       *model.CompletionResponse
+	status    model.CompletionStatus
+	err       error
+}
+
+func (m *fakeLLM) Completions(ctx context.Context, param *model.CompletionParameter) (*model.CompletionResponse, model.CompletionStatus, error) {
+	return m.rsp, m.status, m.err
+}
+
+func (m *fakeLLM) Config() *config.ModelConfig {
+	return m.cfg
+}
+
+func (m *fakeLLM) Tokenizer() *tokenizers.Tokenizer {
+	return m.tokenizer
+}
+
+func loadTestTokenizer(t *testing.T) *tokenizers.Tokenizer {
+	path := "../../bin/deepseek-tokenizer/tokenizer.json"
+	if _, err := os.Stat(path); err != nil {
+		t.Skip("tokenizer file not found:", path)
+	}
+	tk, err := tokenizers.LoadTokenizer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tk
+}
+
+func Test_TruncatePromptDeadline(t *testing.T) {
+	cfg := &config.ModelConfig{MaxPrefix: 10, MaxSuffix: 10}
+	h := NewCompletionHandler(&fakeLLM{cfg: cfg, tokenizer: loadTestTokenizer(t)})
+
+	line := "value = compute(value)\n"
+	ppt := &PromptOptions{
+		Prefix:      strings.Repeat(line, 100),
+		Suffix:      strings.Repeat(line, 100),
+		CodeContext: strings.Repeat(line, 100),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+
+	start := time.Now()
+	h.truncatePrompt(ctx, cfg, ppt)
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("truncatePrompt took %v on an expired context", elapsed)
+	}
+	if ppt.CodeContext != "" {
+		t.Errorf("expected context to be dropped, got %d chars", len(ppt.CodeContext))
+	}
+	if n := len([]rune(ppt.Prefix)); n == 0 || n > tokensToChars(cfg.MaxPrefix) {
+		t.Errorf("prefix length %d out of estimated limit", n)
+	}
+	if !strings.HasPrefix(ppt.Prefix, "value") {
+		t.Errorf("prefix should start at a whole line, got %q", ppt.Prefix)
+	}
+	if n := len([]rune(ppt.Suffix)); n == 0 || n > tokensToChars(cfg.MaxSuffix) {
+		t.Errorf("suffix length %d out of estimated limit", n)
+	}
+	if !strings.HasSuffix(ppt.Suffix, "\n") {
+		t.Errorf("suffix should end at a whole line, got %q", ppt.Suffix)
+	}
+}
+
+func Test_TruncatePromptBalanced(t *testing.T) {
+	cfg := &config.ModelConfig{MaxPrefix: 60, MaxSuffix: 20, FimMode: true, BalanceRatio: 0.5}
+	h := NewCompletionHandler(&fakeLLM{cfg: cfg, tokenizer: loadTestTokenizer(t)})
+
+	if p, s := h.balanceBudget(500, 500, 60, 20); p != 40 || s != 40 {
+		t.Errorf("both huge: budget = %d/%d, want 40/40", p, s)
+	}
+	if p, s := h.balanceBudget(500, 10, 60, 20); p != 70 || s != 10 {
+		t.Errorf("short suffix: budget = %d/%d, want 70/10", p, s)
+	}
+	if p, s := h.balanceBudget(30, 500, 60, 20); p != 30 || s != 50 {
+		t.Errorf("short prefix: budget = %d/%d, want 30/50", p, s)
+	}
+
+	prefixLine, suffixLine := "before = 1\n", "after = 2\n"
+	ppt := &PromptOptions{
+		Prefix: strings.Repeat(prefixLine, 100),
+		Suffix: strings.Repeat(suffixLine, 100),
+	}
+	h.truncatePrompt(context.Background(), cfg, ppt)
+	prefixTokens, suffixTokens := h.getTokensCount(ppt.Prefix), h.getTokensCount(ppt.Suffix)
+	// 前后缀各分得40个token，后缀超过了原本的maxSuffix
+	if prefixTokens > 40 || suffixTokens > 40 || suffixTokens <= cfg.MaxSuffix {
+		t.Errorf("tokens = %d/%d, want both near 40", prefixTokens, suffixTokens)
+	}
+	if !strings.HasSuffix(ppt.Prefix, prefixLine) || !strings.HasPrefix(ppt.Suffix, suffixLine) {
+		t.Errorf("truncation not centered on the cursor: %q|%q", ppt.Prefix, ppt.Suffix)
+	}
+
+	// 非FIM模式不重新分配
+	cfg.FimMode = false
+	if p, s := h.balanceBudget(500, 500, 60, 20); p != 60 || s != 20 {
+		t.Errorf("non-FIM budget = %d/%d, want 60/20", p, s)
+	}
+}
+
+func Test_TruncatePromptFimOverhead(t *testing.T) {
+	cfg := &config.ModelConfig{
+		MaxPrefix: 30,
+		MaxSuffix: 30,
+		FimMode:   true,
+		FimBegin:  "<｜fim▁begin｜>",
+		FimHole:   "<｜fim▁hole｜>",
+		FimEnd:    "<｜fim▁end｜>",
+	}
+	h := NewCompletionHandler(&fakeLLM{cfg: cfg, tokenizer: loadTestTokenizer(t)})
+
+	ppt := &PromptOptions{Prefix: strings.Repeat("value = compute(value)\n", 50)}
+	h.truncatePrompt(context.Background(), cfg, ppt)
+	// 按实际发送的prompt统计，前缀连同FIM标记不超过maxPrefix
+	prompt := model.BuildPrompt(cfg, &model.CompletionParameter{Prefix: ppt.Prefix})
+	if n := h.getTokensCount(prompt); n > cfg.MaxPrefix {
+		t.Errorf("assembled prompt has %d tokens, maxPrefix %d", n, cfg.MaxPrefix)
+	}
+	if ppt.Prefix == "" {
+		t.Error("prefix dropped entirely")
+	}
+}
+
+func Test_TruncatePromptWithoutTokenizer(t *testing.T) {
+	cfg := &config.ModelConfig{MaxPrefix: 10, MaxSuffix: 10}
+	h := NewCompletionHandler(&fakeLLM{cfg: cfg})
+
+	line := "value = compute(value)\n"
+	ppt := &PromptOptions{
+		Prefix:      strings.Repeat(line, 100),
+		Suffix:      strings.Repeat(line, 100),
+		CodeContext: strings.Repeat(line, 100),
+	}
+	h.truncatePrompt(context.Background(), cfg, ppt)
+	if ppt.CodeContext != "" {
+		t.Errorf("expected context to be dropped, got %d chars", len(ppt.CodeContext))
+	}
+	if n := len([]rune(ppt.Prefix)); n == 0 || n > tokensToChars(cfg.MaxPrefix) {
+		t.Errorf("prefix length %d out of estimated limit", n)
+	}
+	if n := len([]rune(ppt.Suffix)); n == 0 || n > tokensToChars(cfg.MaxSuffix) {
+		t.Errorf("suffix length %d out of estimated limit", n)
+	}
+	if n := h.getTokensCount("abcdefghi"); n != 3 {
+		t.Errorf("estimated tokens = %d, want 3", n)
+	}
+}
+
+func Test_CharsPerToken(t *testing.T) {
+	withConfig(t, nil)
+
+	config.Wrapper = nil
+	if n := charsToTokens(9); n != 3 {
+		t.Errorf("default estimate = %d, want 3", n)
+	}
+	config.Wrapper = &config.WrapperConfig{}
+	config.Wrapper.Tokenizer.CharsPerToken = 2
+	if n := charsToTokens(9); n != 5 {
+		t.Errorf("estimate = %d, want 5", n)
+	}
+	if n := tokensToChars(10); n != 20 {
+		t.Errorf("chars = %d, want 20", n)
+	}
+
+	cfg := &config.ModelConfig{MaxPrefix: 10, MaxSuffix: 10}
+	h := NewCompletionHandler(&fakeLLM{cfg: cfg})
+	ppt := &PromptOptions{Prefix: strings.Repeat("abc\n", 20)}
+	h.truncatePrompt(context.Background(), cfg, ppt)
+	if n := len([]rune(ppt.Prefix)); n == 0 || n > 20 {
+		t.Errorf("prefix length %d out of limit 20", n)
+	}
+}
+
+func Test_Pretokenize(t *testing.T) {
+	cfg := &config.ModelConfig{MaxPrefix: 10, MaxSuffix: 10}
+	tokenizer := loadTestTokenizer(t)
+	h := NewCompletionHandler(&fakeLLM{cfg: cfg, tokenizer: tokenizer})
+
+	prefix, suffix := "func main() {\n\tx := ", "\n}\n"
+	p := h.pretokenize(context.Background(), prefix, suffix, "go")
+	if p == nil || p.prefixTokens == nil || p.suffixTokens == nil {
+		t.Fatalf("expected prefix and suffix to be tokenized, got %+v", p)
+	}
+	ids, err := p.encode(context.Background(), tokenizer, prefix)
+	if err != nil || !slices.Equal(ids, tokenizer.Encode(prefix)) {
+		t.Errorf("cached prefix tokens differ from tokenizer: %v, %v", ids, err)
+	}
+	// 文本已变化时重新分词
+	changed := prefix + "1"
+	if ids, _ := p.encode(context.Background(), tokenizer, changed); !slices.Equal(ids, tokenizer.Encode(changed)) {
+		t.Errorf("changed text should be tokenized again, got %v", ids)
+	}
+
+	// 请求已取消时不缓存分词结果
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if p := h.pretokenize(ctx, strings.Repeat(prefix, 100), suffix, "go"); p.prefixTokens != nil {
+		t.Error("canceled pretokenize should not cache tokens")
+	}
+	if p := NewCompletionHandler(&fakeLLM{cfg: cfg}).pretokenize(context.Background(), prefix, suffix, "go"); p != nil {
+		t.Error("expected nil without a tokenizer")
+	}
+}
+
+func Test_TrimLinesCRLF(t *testing.T) {
+	h := NewCompletionHandler(&fakeLLM{cfg: &config.ModelConfig{}})
+	first := []struct{ prompt, want string }{
+		{"ne1\nline2\n", "line2\n"},
+		{"ne1\r\nline2\r\n", "line2\r\n"},
+		{"\r\nline1\r\n", "\r\nline1\r\n"},
+		{"\nline1\r\n", "\nline1\r\n"},
+		{"partial", ""},
+	}
+	for _, c := range first {
+		if got := h.trimFirstLine(c.prompt); got != c.want {
+			t.Errorf("trimFirstLine(%q) = %q, want %q", c.prompt, got, c.want)
+		}
+	}
+	last := []struct{ suffix, want string }{
+		{"line1\nline2\nli", "line1\nline2\n"},
+		{"line1\r\nline2\r\nli", "line1\r\nline2\r\n"},
+		{"line1\r\nline2\r", "line1\r\n"},
+		{"line1\r\n", "line1\r\n"},
+		{"line1\r", "line1"},
+		{"single", "single"},
+	}
+	for _, c := range last {
+		if got := h.trimLastLine(c.suffix); got != c.want {
+			t.Errorf("trimLastLine(%q) = %q, want %q", c.suffix, got, c.want)
+		}
+	}
+
+	// 截断Windows换行的提示词后，首尾只保留完整的行
+	cfg := &config.ModelConfig{MaxPrefix: 10, MaxSuffix: 10}
+	h = NewCompletionHandler(&fakeLLM{cfg: cfg})
+	line := "abcd\r\n"
+	ppt := &PromptOptions{Prefix: strings.Repeat(line, 100), Suffix: strings.Repeat(line, 100)}
+	h.truncatePromptByChars(ppt, cfg.MaxPrefix, cfg.MaxSuffix)
+	for name, text := range map[string]string{"prefix": ppt.Prefix, "suffix": ppt.Suffix} {
+		if text == "" || strings.ReplaceAll(text, line, "") != "" {
+			t.Errorf("%s not aligned to CRLF lines: %q", name, text)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package completions
+
+import (
+	"completion-agent/pkg/codebase_context"
+	"completion-agent/pkg/model"
+)
+
+/**
+ * 提示词预览结构体
+ * @description
+ * - 完整执行前置处理后，将要发给模型的内容，用于调试提示词的组装
+ * - prompt为模型客户端按model.BuildPrompt组装的文本，非FIM模式下后缀单独发送
+ * - 过滤器拒绝的请求同样给出预览，并在rejected中说明原因
+ */
+type PromptPreview struct {
+	Model        string                            `json:"model"`              // 实际调用的模型
+	Prompt       string                            `json:"prompt"`             // 发给模型的prompt
+	Suffix       string                            `json:"suffix,omitempty"`   // 非FIM模式下单独发送的后缀
+	Stop         []string                          `json:"stop"`               // 停用词
+	MaxTokens    int                               `json:"max_tokens"`         // 最大输出token数
+	Temperature  float32                           `json:"temperature"`        // 温度
+	PromptTokens int                               `json:"prompt_tokens"`      // prompt的token数
+	Snippets     []codebase_context.ContextSnippet `json:"snippets"`           // 拼入上下文的片段，按拼接顺序
+	Rejected     string                            `json:"rejected,omitempty"` // 被过滤器拒绝的原因
+}
+
+/**
+ * 预览请求将要发给模型的提示词
+ * @param {*CompletionContext} c - 补全上下文
+ * @param {*CompletionInput} input - 补全输入
+ * @returns {*PromptPreview, error} 返回提示词预览，请求缺少prompt_options、提示词过大或过滤器配置错误时返回错误
+ * @description
+ * - 依次执行过滤器判断、上下文获取、规范化、截断和停用词准备，与HandleCompletion一致
+ * - 不调用模型，不记录补全指标
+ * - 过滤器拒绝时继续组装，便于检查被拒绝的请求
+ * @example
+ * preview, err := handler.PreviewPrompt(ctx, input)
+ * fmt.Println(preview.Prompt, preview.Stop)
+ */
+func (h *CompletionHandler) PreviewPrompt(c *CompletionContext, input *CompletionInput) (*PromptPreview, error) {
+	c.Input = input
+	input.contextBudget = codebase_context.ContextBudget(h.cfg.MaxPrefix)
+	if err := input.GetPrompts(); err != nil {
+		return nil, err
+	}
+	if err := input.checkPromptSize(); err != nil {
+		return nil, err
+	}
+	input.normalizeLineEndings()
+	input.ExtraOptions()
+	chain, err := currentFilterChain()
+	if err != nil {
+		return nil, err
+	}
+	preview := &PromptPreview{}
+	if err := chain.Handle(input); err != nil {
+		preview.Rejected = err.Error()
+	} else if err := h.checkMinPrefix(input); err != nil {
+		preview.Rejected = err.Error()
+	}
+	input.GetContext(c)
+	para := h.Adapt(c, input)
+
+	preview.Model = para.Model
+	preview.Prompt = model.BuildPrompt(h.cfg, para)
+	if !h.cfg.FimMode {
+		preview.Suffix = para.Suffix
+	}
+	preview.Stop = para.Stop
+	preview.MaxTokens = min(para.MaxTokens, h.cfg.MaxOutput)
+	preview.Temperature = para.Temperature
+	preview.PromptTokens = h.getTokensCount(preview.Prompt)
+	preview.Snippets = input.contextSnippets
+	if preview.Snippets == nil {
+		preview.Snippets = []codebase_context.ContextSnippet{}
+	}
+	return preview, nil
+}
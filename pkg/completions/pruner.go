@@ -1,9 +1,12 @@
 package completions
 
 import (
+	"completion-agent/pkg/config"
 	"completion-agent/pkg/parser"
 	"fmt"
+	"regexp"
 	"strings"
+	"unicode"
 )
 
 /**
@@ -12,6 +15,7 @@ import (
  * - 定义后置处理器的类型枚举
  * - TypeDiscarder: 丢弃类型处理器，会完全丢弃补全内容
  * - TypeCutter: 裁剪类型处理器，会部分修改补全内容
+ * - TypeSanitizer: 清洗类型处理器，在丢弃器之前执行，只清理内容不丢弃
  * - 用于区分不同类型的处理逻辑
  * @example
  * var processorType PrunerType = TypeDiscarder
@@ -24,6 +28,7 @@ type PrunerType string
 const (
 	TypeDiscarder PrunerType = "discarder"
 	TypeCutter    PrunerType = "cutter"
+	TypeSanitizer PrunerType = "sanitizer"
 )
 
 const (
@@ -37,8 +42,18 @@ const (
 	CutPrefixOverlap         string = "cut-prefix-overlap"
 	CutSuffixOverlap         string = "cut-suffix-overlap"
 	CutSyntaxError           string = "cut-syntax-error"
+	CutSuffixIndent          string = "cut-suffix-indent"
+	SanitizeControlChars     string = "sanitize-control-chars"
+	CutDuplicateLines        string = "cut-duplicate-lines"
+	FormatWhitespace         string = "formatting"
 )
 
+// 缩进敏感的语言，补全结果的缩进必须与后缀保持一致
+var indentSensitiveLanguages = map[string]bool{
+	"python": true,
+	"yaml":   true,
+}
+
 /**
  * 后置处理器定义映射
  * @description
@@ -63,6 +78,10 @@ var prunerDefs map[string]Pruner = map[string]Pruner{
 	CutPrefixOverlap:         &PrefixOverlapCutter{},
 	CutSuffixOverlap:         &SuffixOverlapCutter{},
 	CutSyntaxError:           &SyntaxErrorCutter{},
+	CutSuffixIndent:          &SuffixIndentCutter{},
+	SanitizeControlChars:     &ControlCharsSanitizer{},
+	CutDuplicateLines:        &DuplicateLinesCutter{},
+	FormatWhitespace:         &FormattingCutter{},
 }
 
 /**
@@ -137,6 +156,7 @@ type Pruner interface {
  * }
  */
 type PrunerChain struct {
+	sanitizers    []Pruner
 	discarders    []Pruner
 	cutters       []Pruner
 	hitProcessors []string
@@ -149,6 +169,7 @@ type PrunerChain struct {
  * @returns {*PrunerChain} 返回初始化好的处理器链
  * @description
  * - 使用提供的丢弃器和裁剪器创建处理器链
+ * - cutters中的清洗类型处理器单独存放，在丢弃器之前执行
  * - 初始化命中处理器列表为空
  * - 返回可执行的处理器链实例
  * - 用于自定义处理器组合
@@ -158,11 +179,18 @@ type PrunerChain struct {
  * chain := NewPrunerChain(discarders, cutters)
  */
 func NewPrunerChain(discarders, cutters []Pruner) *PrunerChain {
-	return &PrunerChain{
+	chain := &PrunerChain{
 		discarders:    discarders,
-		cutters:       cutters,
 		hitProcessors: make([]string, 0),
 	}
+	for _, p := range cutters {
+		if p.Type() == TypeSanitizer {
+			chain.sanitizers = append(chain.sanitizers, p)
+		} else {
+			chain.cutters = append(chain.cutters, p)
+		}
+	}
+	return chain
 }
 
 /**
@@ -206,7 +234,9 @@ func NewPrunerChainByNames(names []string) (*PrunerChain, error) {
  * @description
  * - 创建包含标准处理器的默认链
  * - 丢弃器包含：极端重复、语言不匹配、语法错误
+ * - 清洗器包含：控制字符
  * - 裁剪器包含：重复文本、前缀重叠、后缀重叠、语法错误
+ * - 后缀缩进裁剪器不在默认链中，需在wrapper.prune.pruners或请求的extra.pruners中指定cut-suffix-indent
  * - 用于大多数常规补全场景
  * @example
  * chain := NewDefaultPrunerChain()
@@ -220,6 +250,7 @@ func NewDefaultPrunerChain() *PrunerChain {
 			&SyntaxErrorDiscarder{},
 		},
 		[]Pruner{
+			&ControlCharsSanitizer{},
 			&RepetitiveTextCutter{},
 			&PrefixOverlapCutter{},
 			&SuffixOverlapCutter{},
@@ -252,6 +283,24 @@ func (c *PrunerChain) processDiscard(ctx *PrunerContext) bool {
 	return false
 }
 
+/**
+ * 处理清洗类型的处理器
+ * @param {*PrunerContext} ctx - 后置处理器上下文
+ * @returns {bool} 返回是否修改了补全内容
+ * @description
+ * - 在丢弃器之前执行，避免控制字符等噪声导致补全被误丢弃
+ */
+func (c *PrunerChain) processSanitize(ctx *PrunerContext) bool {
+	result := false
+	for _, sanitizer := range c.sanitizers {
+		if sanitizer.Process(ctx) {
+			c.hitProcessors = append(c.hitProcessors, sanitizer.Name())
+			result = true
+		}
+	}
+	return result
+}
+
 /*
 *
 * 处理裁剪类型的处理器
@@ -282,7 +331,8 @@ func (c *PrunerChain) processCut(ctx *PrunerContext) bool {
  * @param {*PrunerContext} ctx - 后置处理器上下文
  * @returns {bool} 返回是否对补全内容进行了修改
  * @description
- * - 首先执行丢弃类型处理器
+ * - 首先执行清洗类型处理器
+ * - 然后执行丢弃类型处理器
  * - 如果触发丢弃，清空补全内容并返回true
  * - 否则执行裁剪类型处理器
  * - 最后去除补全内容末尾的空白字符
@@ -298,13 +348,14 @@ func (c *PrunerChain) processCut(ctx *PrunerContext) bool {
  * // modified = true
  */
 func (c *PrunerChain) Process(ctx *PrunerContext) bool {
-	// 先处理内容丢弃情况，再处理内容裁剪情况
+	// 先清洗内容，再处理内容丢弃情况，最后处理内容裁剪情况
+	sanitized := c.processSanitize(ctx)
 	if c.processDiscard(ctx) {
 		ctx.CompletionCode = ""
 		return true
 	}
 
-	result := c.processCut(ctx)
+	result := c.processCut(ctx) || sanitized
 
 	// 后置验证：去除补全内容末尾的空格
 	if ctx.CompletionCode != "" {
@@ -392,6 +443,18 @@ func (p *Cutter) Type() PrunerType {
 	return TypeCutter
 }
 
+/**
+ * 清洗器基类结构体
+ * @description
+ * - 返回TypeSanitizer类型
+ * - 清洗器修改补全内容的方式与裁剪器相同，但在丢弃器之前执行
+ */
+type Sanitizer struct{}
+
+func (p *Sanitizer) Type() PrunerType {
+	return TypeSanitizer
+}
+
 // ------------------------------------------------------------------------------
 //
 //	Dicarders
@@ -656,6 +719,43 @@ func (p *SuffixOverlapCutter) Name() string {
 	return string(CutSuffixOverlap)
 }
 
+/**
+ * 后缀缩进裁剪处理器
+ * @description
+ * - 仅处理缩进敏感的语言（如python）
+ * - 以光标行之后首个非空后缀行的缩进为下限
+ * - 补全中出现缩进低于该下限的行时，从该行起裁掉，避免破坏后续代码的缩进结构
+ * - 会改变已有用户的补全结果，不在默认链中，通过wrapper.prune.pruners启用
+ * - 继承自Cutter基类
+ * @example
+ * processor := &SuffixIndentCutter{}
+ * ctx := &PrunerContext{
+ *     Language: "python",
+ *     Prefix: "def f(items):\n    for item in items:\n        ",
+ *     Suffix: "\n    return items",
+ *     CompletionCode: "print(item)\nprint(items)",
+ * }
+ * modified := processor.Process(ctx)
+ * // ctx.CompletionCode = "print(item)"，modified = true
+ */
+type SuffixIndentCutter struct{ Cutter }
+
+func (p *SuffixIndentCutter) Process(ctx *PrunerContext) bool {
+	if !indentSensitiveLanguages[ctx.Language] {
+		return false
+	}
+	code := parser.CutSuffixIndent(ctx.CompletionCode, ctx.Prefix, ctx.Suffix)
+	if code != ctx.CompletionCode {
+		ctx.CompletionCode = code
+		return true
+	}
+	return false
+}
+
+func (p *SuffixIndentCutter) Name() string {
+	return string(CutSuffixIndent)
+}
+
 /**
  * 语法错误裁剪处理器
  * @description
@@ -713,6 +813,210 @@ func (p *SingleLineCutter) Name() string {
 	return string(CutSingleLine)
 }
 
+/**
+ * 相邻重复行合并处理器
+ * @description
+ * - 模型偶尔会把同一行连续输出两次，属于生成时的重复问题
+ * - 把紧邻的相同行(含缩进，忽略行尾的\r)合并为一行
+ * - 被其他行隔开的重复行保持不变，空行不合并
+ * - 有意连续重复的代码也会被合并，因此不在默认处理器链中，需在wrapper.prune.pruners中配置启用
+ * - 继承自Cutter基类
+ * @example
+ * processor := &DuplicateLinesCutter{}
+ * ctx := &PrunerContext{CompletionCode: "x += 1\nx += 1\nreturn x"}
+ * modified := processor.Process(ctx)
+ * // ctx.CompletionCode = "x += 1\nreturn x"，modified = true
+ */
+type DuplicateLinesCutter struct{ Cutter }
+
+func (p *DuplicateLinesCutter) Process(ctx *PrunerContext) bool {
+	code := collapseDuplicateLines(ctx.CompletionCode)
+	if code != ctx.CompletionCode {
+		ctx.CompletionCode = code
+		return true
+	}
+	return false
+}
+
+func (p *DuplicateLinesCutter) Name() string {
+	return string(CutDuplicateLines)
+}
+
+// 合并紧邻的相同非空行
+func collapseDuplicateLines(code string) string {
+	lines := strings.SplitAfter(code, "\n")
+	result := make([]string, 0, len(lines))
+	prev := ""
+	for _, line := range lines {
+		content := strings.TrimRight(line, "\r\n")
+		if strings.TrimSpace(content) != "" && content == prev {
+			// 丢弃的是不带换行的最后一行时，保留下来的行也去掉换行，与原文结尾一致
+			if !strings.HasSuffix(line, "\n") {
+				result[len(result)-1] = strings.TrimRight(result[len(result)-1], "\r\n")
+			}
+			continue
+		}
+		result = append(result, line)
+		prev = content
+	}
+	return strings.Join(result, "")
+}
+
+// 无法从前缀推断时，一级缩进对应的空格数
+const defaultIndentWidth = 4
+
+/**
+ * 格式整理处理器
+ * @description
+ * - 去掉补全结尾只含空白的行，最多保留最后一个非空行之后的一个换行
+ * - 配置wrapper.prune.normalizeIndentChars后，把续行(第二行起)的缩进字符统一为光标行的风格：
+ *   光标行用制表符缩进时把空格缩进换算为制表符，用空格缩进时把制表符换算为空格，
+ *   一级缩进的空格数从前缀中推断，推断不出时为4
+ * - 缩进换算只改变缩进所用的字符，不改变缩进的层级
+ * - 光标行没有缩进时无法确定风格，不换算缩进
+ * - 不在默认处理器链中，需在wrapper.prune.pruners中配置formatting启用
+ * - 继承自Cutter基类
+ * @example
+ * processor := &FormattingCutter{}
+ * ctx := &PrunerContext{Prefix: "func f() {\n\t", CompletionCode: "x := 1\n    y := 2\n\n  \n"}
+ * modified := processor.Process(ctx)
+ * // 未开启normalizeIndentChars: ctx.CompletionCode = "x := 1\n    y := 2\n"
+ * // 开启normalizeIndentChars:   ctx.CompletionCode = "x := 1\n\ty := 2\n"
+ */
+type FormattingCutter struct{ Cutter }
+
+func (p *FormattingCutter) Process(ctx *PrunerContext) bool {
+	code := trimTrailingBlankLines(ctx.CompletionCode)
+	if config.Wrapper != nil && config.Wrapper.Prune.NormalizeIndentChars {
+		code = normalizeIndentChars(code, ctx.Prefix)
+	}
+	if code != ctx.CompletionCode {
+		ctx.CompletionCode = code
+		return true
+	}
+	return false
+}
+
+func (p *FormattingCutter) Name() string {
+	return string(FormatWhitespace)
+}
+
+// 去掉结尾只含空白的行，最后一个非空行带换行时保留该换行
+func trimTrailingBlankLines(code string) string {
+	trimmed := strings.TrimRight(code, " \t\r\n")
+	rest := code[len(trimmed):]
+	if i := strings.IndexByte(rest, '\n'); i >= 0 {
+		return trimmed + strings.TrimLeft(rest[:i+1], " \t")
+	}
+	return code[:len(trimmed)] + strings.TrimRight(rest, " \t")
+}
+
+/**
+ * 按光标行的缩进风格换算续行的缩进字符
+ * @param {string} code - 补全文本
+ * @param {string} prefix - 光标前的代码，最后一行为光标行
+ * @returns {string} 返回续行缩进换算后的补全文本
+ */
+func normalizeIndentChars(code, prefix string) string {
+	prefixLines := strings.Split(prefix, "\n")
+	cursorLine := prefixLines[len(prefixLines)-1]
+	indent := cursorLine[:len(cursorLine)-len(strings.TrimLeft(cursorLine, " \t"))]
+	if indent == "" {
+		return code
+	}
+	useTabs := indent[0] == '\t'
+	width := prefixIndentWidth(prefixLines)
+	lines := strings.Split(code, "\n")
+	for i := 1; i < len(lines); i++ {
+		line := lines[i]
+		body := strings.TrimLeft(line, " \t")
+		if body == "" {
+			continue
+		}
+		columns := 0
+		for _, ch := range line[:len(line)-len(body)] {
+			if ch == '\t' {
+				columns += width
+			} else {
+				columns++
+			}
+		}
+		if useTabs {
+			lines[i] = strings.Repeat("\t", columns/width) + strings.Repeat(" ", columns%width) + body
+		} else {
+			lines[i] = strings.Repeat(" ", columns) + body
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// 从前缀中用空格缩进的行推断一级缩进的空格数，取各行缩进宽度的最大公约数
+func prefixIndentWidth(prefixLines []string) int {
+	width := 0
+	for _, line := range prefixLines {
+		n := len(line) - len(strings.TrimLeft(line, " "))
+		if n == 0 || strings.TrimSpace(line) == "" || strings.HasPrefix(line[n:], "\t") {
+			continue
+		}
+		for a := n; a != 0; {
+			width, a = a, width%a
+		}
+	}
+	if width < 2 || width > 8 {
+		return defaultIndentWidth
+	}
+	return width
+}
+
+// ANSI转义序列：CSI(ESC [ ...)、OSC(ESC ] ... BEL/ST)以及两字节的ESC序列
+var ansiEscapeRegexp = regexp.MustCompile(`\x1b\[[0-?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(?:\x07|\x1b\\)|\x1b[@-Z\\-_]`)
+
+/**
+ * 控制字符清洗处理器
+ * @description
+ * - 部分后端会在补全中夹带\x00、ANSI转义等控制字符，插入编辑器后显示错乱
+ * - 先整体移除ANSI转义序列，再移除剩余的不可打印控制字符
+ * - 保留制表符、换行符和回车符
+ * - 清洗类型处理器，先于丢弃器执行，避免控制字符导致语法检查失败而丢弃补全
+ * @example
+ * processor := &ControlCharsSanitizer{}
+ * ctx := &PrunerContext{CompletionCode: "\x1b[31mreturn\x1b[0m x\x00"}
+ * modified := processor.Process(ctx)
+ * // ctx.CompletionCode = "return x"，modified = true
+ */
+type ControlCharsSanitizer struct{ Sanitizer }
+
+func (p *ControlCharsSanitizer) Process(ctx *PrunerContext) bool {
+	code := stripControlChars(ctx.CompletionCode)
+	if code != ctx.CompletionCode {
+		ctx.CompletionCode = code
+		return true
+	}
+	return false
+}
+
+func (p *ControlCharsSanitizer) Name() string {
+	return string(SanitizeControlChars)
+}
+
+// 移除ANSI转义序列以及除\t、\n、\r以外的控制字符
+func stripControlChars(code string) string {
+	if strings.IndexFunc(code, isStrippedControl) < 0 {
+		return code
+	}
+	code = ansiEscapeRegexp.ReplaceAllString(code, "")
+	return strings.Map(func(r rune) rune {
+		if isStrippedControl(r) {
+			return -1
+		}
+		return r
+	}, code)
+}
+
+func isStrippedControl(r rune) bool {
+	return unicode.IsControl(r) && r != '\t' && r != '\n' && r != '\r'
+}
+
 /**
  * 检查代码语法是否正确
  * @param {string} language - 编程语言标识符
@@ -747,27 +1051,35 @@ func isCodeSyntax(language, code, prefix, suffix string) bool {
 }
 
 func pruneSingleLine(completionText, prefix, suffix, lang string) string {
-	var linePrefix, lineSuffix string
-	lines := strings.Split(prefix, "\n")
-	if len(lines) > 0 {
-		linePrefix = lines[len(lines)-1]
-	}
-	lines = strings.Split(suffix, "\n")
-	if len(lines) > 0 {
-		lineSuffix = lines[0]
-		if len(lines) > 1 {
-			lineSuffix += "\n"
-		}
-	}
+	linePrefix, lineSuffix := parser.CursorLine(prefix, suffix)
 	if parser.NeedSingleCompletion(linePrefix, lineSuffix, lang) {
-		lines := strings.Split(completionText, "\n")
-		if len(lines) <= 1 {
-			return completionText
-		}
-		if lines[0] == "" {
-			return "\n" + lines[1]
-		}
-		return lines[0]
+		return firstCompletionLine(completionText)
 	}
 	return completionText
 }
+
+/**
+ * 截取补全结果的第一行
+ * @param {string} completionText - 补全文本
+ * @returns {string} 返回第一行，不含行尾换行
+ * @description
+ * - 模型有时先输出一个换行再给出内容，此时保留开头的换行和随后的一行
+ * - 支持\n和\r\n换行
+ * @example
+ * firstCompletionLine("x := 1\ny := 2") // "x := 1"
+ * firstCompletionLine("\nx := 1\ny := 2") // "\nx := 1"
+ */
+func firstCompletionLine(completionText string) string {
+	leading := ""
+	rest := completionText
+	if strings.HasPrefix(rest, "\r\n") {
+		leading, rest = "\r\n", rest[2:]
+	} else if strings.HasPrefix(rest, "\n") {
+		leading, rest = "\n", rest[1:]
+	}
+	line, _, found := strings.Cut(rest, "\n")
+	if !found {
+		return completionText
+	}
+	return leading + strings.TrimSuffix(line, "\r")
+}
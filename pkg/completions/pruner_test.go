@@ -0,0 +1,231 @@
+package completions
+
+import (
+	"context"
+	"testing"
+
+	"completion-agent/pkg/config"
+	"completion-agent/pkg/model"
+	"completion-agent/pkg/parser"
+)
+
+func Test_SuffixIndentCutter(t *testing.T) {
+	prefix := "def total(items):\n    result = 0\n    for item in items:\n        "
+	cases := []struct {
+		name       string
+		language   string
+		suffix     string
+		completion string
+		want       string
+	}{
+		{"dedented suffix", "python", "\n    return result\n",
+			"result += item\nprint(result)", "result += item"},
+		{"deeper lines kept", "python", "\n    return result\n",
+			"if item:\n            result += item", "if item:\n            result += item"},
+		{"dedent to suffix level kept", "python", "\n    return result\n",
+			"result += item\n    result *= 2", "result += item\n    result *= 2"},
+		{"inline suffix untouched", "python", ")\n    return result\n",
+			"result += item\nprint(result", "result += item\nprint(result"},
+		{"other language untouched", "go", "\n    return result\n",
+			"result += item\nprint(result)", "result += item\nprint(result)"},
+	}
+	for _, c := range cases {
+		ctx := &PrunerContext{
+			Language:       c.language,
+			CompletionCode: c.completion,
+			Prefix:         prefix,
+			Suffix:         c.suffix,
+		}
+		(&SuffixIndentCutter{}).Process(ctx)
+		if ctx.CompletionCode != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, ctx.CompletionCode, c.want)
+		}
+	}
+}
+
+func Test_BlockModeCutScopeEnd(t *testing.T) {
+	cases := []struct {
+		name     string
+		language string
+		prefix   string
+		text     string
+		want     string
+	}{
+		{
+			"function body", "go",
+			"func add(a, b int) int {\n\t",
+			"sum := a + b\n\tif sum > 0 {\n\t\treturn sum\n\t}\n\treturn 0\n}\n\nfunc sub(a, b int) int {\n\treturn a - b\n}\n",
+			"sum := a + b\n\tif sum > 0 {\n\t\treturn sum\n\t}\n\treturn 0\n}",
+		},
+		{
+			"braces in strings and comments", "javascript",
+			"function f() {\n  ",
+			"const s = \"}\"; // }\n  return '{' + s;\n}\nf();",
+			"const s = \"}\"; // }\n  return '{' + s;\n}",
+		},
+		{
+			"scope not closed", "go",
+			"func f() {\n\t",
+			"x := 1\n\ty := 2",
+			"x := 1\n\ty := 2",
+		},
+		{
+			"python dedent", "python",
+			"def add(a, b):\n    ",
+			"total = a + b\n    return total\n\ndef sub(a, b):\n    return a - b\n",
+			"total = a + b\n    return total",
+		},
+	}
+	for _, c := range cases {
+		if got := parser.CutScopeEnd(c.text, c.prefix, c.language); got != c.want {
+			t.Errorf("%s: expected %q, got %q", c.name, c.want, got)
+		}
+	}
+}
+
+func Test_BlockModeCompletion(t *testing.T) {
+	withConfig(t, &config.WrapperConfig{Prune: config.PruneConfig{Disabled: true}})
+
+	h := NewCompletionHandler(&fakeLLM{
+		cfg: &config.ModelConfig{},
+		rsp: &model.CompletionResponse{Choices: []model.CompletionChoice{
+			{Text: "return a + b\n}\n\nfunc sub(a, b int) int {\n\treturn a - b\n}\n"},
+		}},
+		status: model.StatusSuccess,
+	})
+	c := NewCompletionContext(context.Background(), &CompletionPerformance{})
+	c.Input = &CompletionInput{CompletionRequest: CompletionRequest{
+		Extra: map[string]interface{}{ExtraCompletionMode: CompletionModeBlock},
+	}}
+	para := &model.CompletionParameter{Language: "go", Prefix: "func add(a, b int) int {\n\t"}
+	rsp := h.CallLLM(c, para)
+	if got := rsp.Choices[0].Text; got != "return a + b\n}" {
+		t.Errorf("expected completion cut at closing brace, got %q", got)
+	}
+}
+
+func Test_ControlCharsSanitizer(t *testing.T) {
+	cases := []struct {
+		name       string
+		completion string
+		want       string
+		modified   bool
+	}{
+		{"clean text untouched", "if x:\n\treturn y\r\n", "if x:\n\treturn y\r\n", false},
+		{"nul and bell removed", "return\x00 x\x07", "return x", true},
+		{"ansi color removed", "\x1b[31mreturn\x1b[0m x", "return x", true},
+		{"osc sequence removed", "\x1b]0;title\x07foo()", "foo()", true},
+		{"c1 control removed", "a\u0085b\x7f", "ab", true},
+		{"unicode kept", "s = \"中文\"\x1b[K", "s = \"中文\"", true},
+	}
+	for _, c := range cases {
+		ctx := &PrunerContext{CompletionCode: c.completion}
+		modified := (&ControlCharsSanitizer{}).Process(ctx)
+		if ctx.CompletionCode != c.want || modified != c.modified {
+			t.Errorf("%s: got %q (%v), want %q (%v)", c.name, ctx.CompletionCode, modified, c.want, c.modified)
+		}
+	}
+	chain := NewDefaultPrunerChain()
+	ctx := &PrunerContext{Language: "go", CompletionCode: "x := 1\x00\x1b[0m", Prefix: "func f() {\n\t", Suffix: "\n}"}
+	chain.Process(ctx)
+	if ctx.CompletionCode != "x := 1" {
+		t.Errorf("default chain: got %q", ctx.CompletionCode)
+	}
+}
+
+func Test_DuplicateLinesCutter(t *testing.T) {
+	cases := []struct {
+		name       string
+		completion string
+		want       string
+		modified   bool
+	}{
+		{"doubled line collapsed", "x += 1\nx += 1\nreturn x", "x += 1\nreturn x", true},
+		{"tripled line collapsed", "a()\na()\na()\n", "a()\n", true},
+		{"separated repeats kept", "x += 1\ny += 1\nx += 1\n", "x += 1\ny += 1\nx += 1\n", false},
+		{"different indent kept", "\tfoo()\nfoo()", "\tfoo()\nfoo()", false},
+		{"blank lines kept", "a()\n\n\nb()", "a()\n\n\nb()", false},
+		{"trailing duplicate without newline", "a()\na()", "a()", true},
+		{"crlf collapsed", "a()\r\na()\r\nb()", "a()\r\nb()", true},
+	}
+	for _, c := range cases {
+		ctx := &PrunerContext{CompletionCode: c.completion}
+		modified := (&DuplicateLinesCutter{}).Process(ctx)
+		if ctx.CompletionCode != c.want || modified != c.modified {
+			t.Errorf("%s: got %q (%v), want %q (%v)", c.name, ctx.CompletionCode, modified, c.want, c.modified)
+		}
+	}
+	// 默认不启用，需按名称配置
+	ctx := &PrunerContext{Language: "go", CompletionCode: "x++\nx++", Prefix: "func f() {\n\t", Suffix: "\n}"}
+	NewDefaultPrunerChain().Process(ctx)
+	if ctx.CompletionCode != "x++\nx++" {
+		t.Errorf("default chain: got %q", ctx.CompletionCode)
+	}
+	chain, err := NewPrunerChainByNames([]string{CutDuplicateLines})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx.CompletionCode = "x++\nx++"
+	chain.Process(ctx)
+	if ctx.CompletionCode != "x++" {
+		t.Errorf("configured chain: got %q", ctx.CompletionCode)
+	}
+}
+
+func Test_FormattingCutter(t *testing.T) {
+	withConfig(t, nil)
+
+	cases := []struct {
+		name       string
+		normalize  bool
+		language   string
+		prefix     string
+		completion string
+		want       string
+	}{
+		{"go trailing blank lines", false, "go", "func f() {\n\t", "x := 1\n\ty := 2\n\n  \n\t\n", "x := 1\n\ty := 2\n"},
+		{"go whitespace after last line", false, "go", "func f() {\n\t", "x := 1  \n \t", "x := 1\n"},
+		{"go no trailing newline", false, "go", "func f() {\n\t", "x := 1 \t", "x := 1"},
+		{"go spaces kept without normalizing", false, "go", "func f() {\n\t", "x := 1\n    y := 2", "x := 1\n    y := 2"},
+		{"go spaces to tabs", true, "go", "func f() {\n\tif ok {\n\t\t", "x := 1\n        y := 2\n    }", "x := 1\n\t\ty := 2\n\t}"},
+		{"python tabs to spaces", true, "python", "def f():\n    for i in items:\n        ", "x = i\n\t\ty = x\n\treturn y\n\n", "x = i\n        y = x\n    return y\n"},
+		{"python two space indent", true, "python", "def f():\n  if ok:\n    ", "x = 1\n\t\ty = 2", "x = 1\n    y = 2"},
+		{"python clean completion untouched", true, "python", "def f():\n    ", "x = 1\n    return x", "x = 1\n    return x"},
+		{"no indent on cursor line", true, "python", "x = ", "1\n\ty = 2", "1\n\ty = 2"},
+	}
+	for _, c := range cases {
+		config.Wrapper.Prune.NormalizeIndentChars = c.normalize
+		ctx := &PrunerContext{Language: c.language, Prefix: c.prefix, CompletionCode: c.completion}
+		modified := (&FormattingCutter{}).Process(ctx)
+		if ctx.CompletionCode != c.want || modified != (c.want != c.completion) {
+			t.Errorf("%s: got %q (%v), want %q", c.name, ctx.CompletionCode, modified, c.want)
+		}
+	}
+	if _, err := NewPrunerChainByNames([]string{FormatWhitespace}); err != nil {
+		t.Errorf("formatting pruner not registered: %v", err)
+	}
+}
+
+func Test_SuffixIndentCutterOptIn(t *testing.T) {
+	// 默认链不包含后缀缩进裁剪器
+	for _, p := range NewDefaultPrunerChain().cutters {
+		if p.Name() == CutSuffixIndent {
+			t.Fatal("default chain should not include the suffix indent cutter")
+		}
+	}
+	// 指定cut-suffix-indent时启用
+	chain, err := NewPrunerChainByNames([]string{CutSuffixIndent})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &PrunerContext{
+		Language:       "python",
+		CompletionCode: "result += item\nprint(result)",
+		Prefix:         "def total(items):\n    result = 0\n    for item in items:\n        ",
+		Suffix:         "\n    return result\n",
+	}
+	chain.Process(c)
+	if c.CompletionCode != "result += item" {
+		t.Errorf("opt-in chain: got %q", c.CompletionCode)
+	}
+}
@@ -0,0 +1,227 @@
+package completions
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"completion-agent/pkg/config"
+	"completion-agent/pkg/metrics"
+	"completion-agent/pkg/model"
+)
+
+// 请求优先级，数值越大越先出队
+const (
+	PriorityLow    = 1 // 自动触发的后台补全
+	PriorityNormal = 2 // 未指定触发方式
+	PriorityHigh   = 3 // 用户主动触发的补全
+)
+
+// 优先级老化间隔：每高一级优先级相当于提前该时长入队，排队超过该时长的低优先级请求不会再被新到的高一级请求插队
+const priorityAging = time.Second
+
+/**
+ * 获取请求的优先级
+ * @param {*CompletionRequest} req - 补全请求
+ * @returns {int} 返回PriorityLow~PriorityHigh之间的优先级
+ * @description
+ * - 请求明确指定了priority时使用指定值，超出范围时取边界值
+ * - 否则按trigger_mode推导：manual为高优先级，automatic为低优先级，其他为普通优先级
+ */
+func requestPriority(req *CompletionRequest) int {
+	if req.Priority != 0 {
+		return max(PriorityLow, min(PriorityHigh, req.Priority))
+	}
+	switch req.TriggerMode {
+	case TriggerModeManual:
+		return PriorityHigh
+	case TriggerModeAutomatic:
+		return PriorityLow
+	default:
+		return PriorityNormal
+	}
+}
+
+// 排队等待的请求
+type queueWaiter struct {
+	key   time.Time     // 出队顺序：入队时间按优先级提前后的时间，越早越先出队
+	seq   uint64        // 入队序号，key相同时先入队的先出队
+	ready chan struct{} // 分配到名额时关闭
+	index int           // 在堆中的位置，-1表示已出队
+}
+
+// 按key排序的等待队列，实现heap.Interface
+type waiterHeap []*queueWaiter
+
+func (h waiterHeap) Len() int { return len(h) }
+
+func (h waiterHeap) Less(i, j int) bool {
+	if !h[i].key.Equal(h[j].key) {
+		return h[i].key.Before(h[j].key)
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h waiterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *waiterHeap) Push(x any) {
+	w := x.(*queueWaiter)
+	w.index = len(*h)
+	*h = append(*h, w)
+}
+
+func (h *waiterHeap) Pop() any {
+	old := *h
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	w.index = -1
+	*h = old[:len(old)-1]
+	return w
+}
+
+/**
+ * 模型请求池
+ * @description
+ * - 限制同时请求同一模型的并发数，超出的请求排队等待
+ * - 等待队列是优先级队列，高优先级的请求先出队
+ * - 优先级按priorityAging老化：出队顺序按"入队时间 - 优先级*priorityAging"排序，
+ *   相当于低优先级请求的优先级随等待时间增长，避免被源源不断的高优先级请求饿死
+ * - 释放名额时直接转交给队首的请求
+ */
+type modelPool struct {
+	name    string
+	max     int
+	active  int
+	seq     uint64
+	waiters waiterHeap
+	mutex   sync.Mutex
+}
+
+// 各模型的请求池，按模型名称索引
+var (
+	modelPools      = make(map[string]*modelPool)
+	modelPoolsMutex sync.Mutex
+	totalActive     atomic.Int64 // 各模型池正在请求模型的总数
+)
+
+/**
+ * 获取模型的请求池
+ * @param {*config.ModelConfig} cfg - 模型配置，按maxConcurrent限制并发
+ * @returns {*modelPool} 返回模型的请求池，maxConcurrent的变更对之后的请求生效
+ */
+func getModelPool(cfg *config.ModelConfig) *modelPool {
+	modelPoolsMutex.Lock()
+	defer modelPoolsMutex.Unlock()
+	p, ok := modelPools[cfg.ModelName]
+	if !ok {
+		p = &modelPool{name: cfg.ModelName}
+		modelPools[cfg.ModelName] = p
+	}
+	p.mutex.Lock()
+	p.max = cfg.MaxConcurrent
+	p.mutex.Unlock()
+	return p
+}
+
+/**
+ * 占用一个请求模型的名额，没有名额时按优先级排队等待
+ * @param {context.Context} ctx - 请求上下文，取消或超时时放弃等待
+ * @param {int} priority - 请求优先级
+ * @returns {error} 成功返回nil，等待期间上下文结束时返回ctx.Err()
+ * @description
+ * - 未限制并发或有空闲名额且无人排队时立即返回
+ * - 成功后必须调用release释放名额
+ */
+func (p *modelPool) acquire(ctx context.Context, priority int) error {
+	p.mutex.Lock()
+	if p.max <= 0 || (p.active < p.max && len(p.waiters) == 0) {
+		p.active++
+		p.updateMetrics(1)
+		p.mutex.Unlock()
+		return nil
+	}
+	p.seq++
+	w := &queueWaiter{
+		key:   time.Now().Add(-time.Duration(priority) * priorityAging),
+		seq:   p.seq,
+		ready: make(chan struct{}),
+	}
+	heap.Push(&p.waiters, w)
+	p.mutex.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		if w.index < 0 {
+			// 放弃等待的同时已分配到名额，转交给下一个请求
+			p.releaseLocked()
+		} else {
+			heap.Remove(&p.waiters, w.index)
+		}
+		return ctx.Err()
+	}
+}
+
+// 释放名额，有请求排队时直接转交给队首的请求
+func (p *modelPool) release() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.releaseLocked()
+}
+
+func (p *modelPool) releaseLocked() {
+	if len(p.waiters) > 0 && (p.max <= 0 || p.active <= p.max) {
+		w := heap.Pop(&p.waiters).(*queueWaiter)
+		close(w.ready)
+		return
+	}
+	p.active--
+	p.updateMetrics(-1)
+}
+
+func (p *modelPool) updateMetrics(delta int64) {
+	metrics.UpdateCompletionConcurrentByModel(p.name, p.active)
+	metrics.UpdateCompletionConcurrent(int(totalActive.Add(delta)))
+}
+
+/**
+ * 排队后调用大模型
+ * @param {*CompletionContext} c - 补全上下文
+ * @param {*model.CompletionParameter} para - 模型调用参数
+ * @returns {*CompletionResponse} 返回补全响应，排队期间请求被取消或超时时返回相应状态
+ * @description
+ * - 按模型的maxConcurrent限制并发，按请求优先级排队
+ * - 排队时长记录到QueueDuration
+ */
+func (h *CompletionHandler) callQueued(c *CompletionContext, para *model.CompletionParameter) *CompletionResponse {
+	priority := PriorityNormal
+	if c.Input != nil {
+		priority = requestPriority(&c.Input.CompletionRequest)
+	}
+	pool := getModelPool(h.cfg)
+	start := time.Now()
+	err := pool.acquire(c.Ctx, priority)
+	c.Perf.QueueDuration = time.Since(start).Milliseconds()
+	if err != nil {
+		status := model.StatusCanceled
+		if errors.Is(err, context.DeadlineExceeded) {
+			status = model.StatusTimeout
+		}
+		if cause := context.Cause(c.Ctx); errors.Is(cause, errSuperseded) {
+			err = cause
+		}
+		return CancelRequest(para.CompletionID, para.Model, c.Perf, status, err)
+	}
+	defer pool.release()
+	return h.CallLLM(c, para)
+}
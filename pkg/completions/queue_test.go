@@ -0,0 +1,114 @@
+package completions
+
+import (
+	"container/heap"
+	"context"
+	"testing"
+	"time"
+)
+
+func Test_RequestPriority(t *testing.T) {
+	cases := []struct {
+		req  CompletionRequest
+		want int
+	}{
+		{CompletionRequest{TriggerMode: TriggerModeManual}, PriorityHigh},
+		{CompletionRequest{TriggerMode: TriggerModeAutomatic}, PriorityLow},
+		{CompletionRequest{}, PriorityNormal},
+		{CompletionRequest{TriggerMode: TriggerModeAutomatic, Priority: PriorityHigh}, PriorityHigh},
+		{CompletionRequest{Priority: 10}, PriorityHigh},
+		{CompletionRequest{Priority: -1}, PriorityLow},
+	}
+	for _, c := range cases {
+		if got := requestPriority(&c.req); got != c.want {
+			t.Errorf("%+v: got %d, want %d", c.req, got, c.want)
+		}
+	}
+}
+
+func Test_ModelPoolPriority(t *testing.T) {
+	p := &modelPool{name: "test-priority", max: 1}
+	if err := p.acquire(context.Background(), PriorityNormal); err != nil {
+		t.Fatal(err)
+	}
+
+	order := make(chan string, 3)
+	queueLen := func() int {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		return len(p.waiters)
+	}
+	enqueue := func(name string, priority int) {
+		queued := queueLen()
+		go func() {
+			if err := p.acquire(context.Background(), priority); err != nil {
+				t.Error(err)
+				return
+			}
+			order <- name
+			p.release()
+		}()
+		for queueLen() <= queued {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	enqueue("low-1", PriorityLow)
+	enqueue("low-2", PriorityLow)
+	enqueue("high", PriorityHigh)
+	p.release()
+
+	want := []string{"high", "low-1", "low-2"}
+	for _, name := range want {
+		select {
+		case got := <-order:
+			if got != name {
+				t.Fatalf("dequeued %s, want %s", got, name)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for %s", name)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p.mutex.Lock()
+		active := p.active
+		p.mutex.Unlock()
+		if active == 0 && queueLen() == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("active %d, waiters %d after all released", active, queueLen())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func Test_ModelPoolAging(t *testing.T) {
+	now := time.Now()
+	var h waiterHeap
+	// 排队较久的低优先级请求先于刚到的高优先级请求出队
+	heap.Push(&h, &queueWaiter{key: now.Add(-3 * time.Second).Add(-PriorityLow * priorityAging), seq: 1})
+	heap.Push(&h, &queueWaiter{key: now.Add(-PriorityHigh * priorityAging), seq: 2})
+	if w := heap.Pop(&h).(*queueWaiter); w.seq != 1 {
+		t.Fatalf("aged low priority request not dequeued first")
+	}
+}
+
+func Test_ModelPoolCancel(t *testing.T) {
+	p := &modelPool{name: "test-cancel", max: 1}
+	if err := p.acquire(context.Background(), PriorityNormal); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := p.acquire(ctx, PriorityHigh); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if len(p.waiters) != 0 {
+		t.Fatal("canceled waiter still queued")
+	}
+	p.release()
+	if p.active != 0 {
+		t.Fatalf("active %d after release", p.active)
+	}
+}
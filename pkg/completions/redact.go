@@ -0,0 +1,111 @@
+package completions
+
+import (
+	"completion-agent/pkg/logger"
+	"completion-agent/pkg/model"
+)
+
+// 日志中视为敏感、默认脱敏的字段（开启server.logPromptContent后记录原文）：
+//   - 请求：prompt_options中的prefix、suffix、code_context、import_content及各类片段的content
+//   - 模型参数：prefix、suffix、context
+//   - 响应：choices中的补全文本，verbose中回显的模型输入输出及诊断信息中的prompt
+//   - 请求头：不记录（其中包含Authorization等凭证）
+
+/**
+ * 生成用于日志的请求副本，敏感字段已脱敏
+ * @param {*CompletionRequest} req - 补全请求
+ * @returns {*CompletionRequest} 脱敏后的请求副本，不修改原请求
+ */
+func sanitizeRequest(req *CompletionRequest) *CompletionRequest {
+	if req == nil {
+		return nil
+	}
+	r := *req
+	if req.Prompts != nil {
+		p := *req.Prompts
+		p.Prefix = logger.RedactText(p.Prefix)
+		p.Suffix = logger.RedactText(p.Suffix)
+		p.CodeContext = logger.RedactText(p.CodeContext)
+		p.ImportContent = logger.RedactText(p.ImportContent)
+		p.RecentlyEditedRanges = sanitizeSnippets(p.RecentlyEditedRanges)
+		p.RecentlyVisitedRanges = sanitizeSnippets(p.RecentlyVisitedRanges)
+		p.ClipboardContent = sanitizeSnippets(p.ClipboardContent)
+		p.RecentlyOpenedFiles = sanitizeSnippets(p.RecentlyOpenedFiles)
+		p.StaticContext = sanitizeSnippets(p.StaticContext)
+		r.Prompts = &p
+	}
+	return &r
+}
+
+// 脱敏片段内容，保留类型和路径
+func sanitizeSnippets(snippets []Snippet) []Snippet {
+	if len(snippets) == 0 {
+		return snippets
+	}
+	result := make([]Snippet, len(snippets))
+	for i, s := range snippets {
+		s.Content = logger.RedactText(s.Content)
+		result[i] = s
+	}
+	return result
+}
+
+/**
+ * 生成用于日志的模型参数副本，敏感字段已脱敏
+ * @param {*model.CompletionParameter} para - 模型调用参数
+ * @returns {*model.CompletionParameter} 脱敏后的参数副本
+ */
+func sanitizeParameter(para *model.CompletionParameter) *model.CompletionParameter {
+	if para == nil {
+		return nil
+	}
+	p := *para
+	p.Prefix = logger.RedactText(p.Prefix)
+	p.Suffix = logger.RedactText(p.Suffix)
+	p.CodeContext = logger.RedactText(p.CodeContext)
+	return &p
+}
+
+/**
+ * 生成用于日志的响应副本，敏感字段已脱敏
+ * @param {*CompletionResponse} rsp - 补全响应
+ * @returns {*CompletionResponse} 脱敏后的响应副本
+ */
+func sanitizeResponse(rsp *CompletionResponse) *CompletionResponse {
+	if rsp == nil {
+		return nil
+	}
+	r := *rsp
+	r.Choices = make([]CompletionChoice, len(rsp.Choices))
+	for i, c := range rsp.Choices {
+		c.Text = logger.RedactText(c.Text)
+		r.Choices[i] = c
+	}
+	if rsp.Verbose != nil && (len(rsp.Verbose.Input)+len(rsp.Verbose.Output) > 0 || rsp.Verbose.Diagnostics != nil) {
+		v := *rsp.Verbose
+		v.Input = sanitizeVerboseMap(v.Input)
+		v.Output = sanitizeVerboseMap(v.Output)
+		if v.Diagnostics != nil {
+			d := *v.Diagnostics
+			d.Prompt = logger.RedactText(d.Prompt)
+			v.Diagnostics = &d
+		}
+		r.Verbose = &v
+	}
+	return &r
+}
+
+// 脱敏verbose中的字符串值
+func sanitizeVerboseMap(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+	result := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		if s, ok := v.(string); ok {
+			v = logger.RedactText(s)
+		}
+		result[k] = v
+	}
+	return result
+}
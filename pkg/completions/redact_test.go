@@ -0,0 +1,50 @@
+package completions
+
+import (
+	"strings"
+	"testing"
+
+	"completion-agent/pkg/logger"
+	"completion-agent/pkg/model"
+)
+
+func Test_SanitizeForLog(t *testing.T) {
+	defer logger.SetLogPromptContent(false)
+	secret := "func secret() { return 42 }"
+	req := &CompletionRequest{
+		ClientID: "client",
+		Prompts: &PromptOptions{
+			Prefix:           secret,
+			Suffix:           secret,
+			ClipboardContent: []Snippet{{Type: "clipboard", Content: secret}},
+		},
+	}
+	rsp := &CompletionResponse{
+		Choices: []CompletionChoice{{Text: secret, ReplaceRange: &ReplaceRange{Start: -3, End: 0}}},
+		Verbose: &model.CompletionVerbose{Input: map[string]interface{}{"prompt": secret}},
+	}
+
+	logger.SetLogPromptContent(false)
+	r := sanitizeRequest(req)
+	s := sanitizeResponse(rsp)
+	for _, v := range []string{r.Prompts.Prefix, r.Prompts.Suffix, r.Prompts.ClipboardContent[0].Content,
+		s.Choices[0].Text, s.Verbose.Input["prompt"].(string)} {
+		if strings.Contains(v, "secret") || !strings.HasPrefix(v, "[redacted") {
+			t.Errorf("content not redacted: %q", v)
+		}
+	}
+	if s.Choices[0].ReplaceRange == nil || *s.Choices[0].ReplaceRange != (ReplaceRange{Start: -3, End: 0}) {
+		t.Errorf("replace range lost after sanitizing: %+v", s.Choices[0].ReplaceRange)
+	}
+	if r.ClientID != "client" {
+		t.Errorf("non-sensitive field changed: %q", r.ClientID)
+	}
+	if req.Prompts.Prefix != secret || rsp.Choices[0].Text != secret || rsp.Verbose.Input["prompt"] != secret {
+		t.Errorf("sanitizing modified the original request or response")
+	}
+
+	logger.SetLogPromptContent(true)
+	if r := sanitizeRequest(req); r.Prompts.Prefix != secret {
+		t.Errorf("content should be kept when logPromptContent is enabled, got %q", r.Prompts.Prefix)
+	}
+}
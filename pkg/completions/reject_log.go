@@ -0,0 +1,43 @@
+package completions
+
+import (
+	"math/rand"
+	"strings"
+
+	"completion-agent/pkg/config"
+	"completion-agent/pkg/logger"
+	"completion-agent/pkg/parser"
+
+	"go.uber.org/zap"
+)
+
+/**
+ * 按抽样记录被过滤器拒绝的请求
+ * @param {*CompletionInput} in - 被拒绝的补全输入
+ * @param {error} reason - 过滤器返回的拒绝原因
+ * @description
+ * - 仅在配置了wrapper.rejectLog.sampleRate且命中抽样时记录
+ * - 使用名为rejected的logger，与补全访问日志分开，便于单独收集
+ * - 只记录光标所在行，按server.logPromptContent脱敏
+ */
+func logRejected(in *CompletionInput, reason error) {
+	if config.Wrapper == nil {
+		return
+	}
+	rate := config.Wrapper.RejectLog.SampleRate
+	if rate <= 0 || (rate < 1 && rand.Float64() >= rate) {
+		return
+	}
+	var linePrefix, lineSuffix string
+	if in.Prompts != nil {
+		linePrefix, lineSuffix = parser.CursorLine(in.Prompts.Prefix, in.Prompts.Suffix)
+	}
+	zap.L().Named("rejected").Info("Rejected request sample",
+		zap.String("completion_id", in.CompletionID),
+		zap.String("client_id", in.ClientID),
+		zap.String("language", strings.ToLower(in.LanguageID)),
+		zap.String("trigger_mode", in.TriggerMode),
+		zap.String("reason", reason.Error()),
+		logger.Sensitive("line_prefix", linePrefix),
+		logger.Sensitive("line_suffix", lineSuffix))
+}
@@ -0,0 +1,70 @@
+package completions
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"completion-agent/pkg/config"
+	"completion-agent/pkg/logger"
+	"completion-agent/pkg/model"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// 总是拒绝的过滤器
+type rejectAllFilter struct{}
+
+func (rejectAllFilter) Judge(in *CompletionInput) RejectCode { return LowHiddenScore }
+
+func Test_LogRejected(t *testing.T) {
+	withConfig(t, nil)
+	filterChain = &FilterChain{filters: []Filter{rejectAllFilter{}}}
+
+	core, logs := observer.New(zap.InfoLevel)
+	defer zap.ReplaceGlobals(zap.New(core))()
+
+	preprocess := func(id string) *CompletionResponse {
+		in := &CompletionInput{CompletionRequest: CompletionRequest{
+			CompletionID: id,
+			ClientID:     "client-1",
+			LanguageID:   "Go",
+			Prompts:      &PromptOptions{Prefix: "package main\n\tfmt.Pri", Suffix: "ntln()\n}"},
+		}}
+		return in.Preprocess(NewCompletionContext(context.Background(), &CompletionPerformance{}))
+	}
+
+	// 未配置抽样时不记录
+	config.Wrapper = &config.WrapperConfig{}
+	if rsp := preprocess("cmpl-off"); rsp == nil || rsp.Status != model.StatusRejected {
+		t.Fatalf("request not rejected: %+v", rsp)
+	}
+	if n := logs.FilterMessage("Rejected request sample").Len(); n != 0 {
+		t.Fatalf("rejected samples = %d, want 0", n)
+	}
+
+	config.Wrapper = &config.WrapperConfig{RejectLog: config.RejectLogConfig{SampleRate: 1}}
+	preprocess("cmpl-redacted")
+	logger.SetLogPromptContent(true)
+	defer logger.SetLogPromptContent(false)
+	preprocess("cmpl-plain")
+
+	samples := logs.FilterMessage("Rejected request sample").All()
+	if len(samples) != 2 {
+		t.Fatalf("rejected samples = %d, want 2", len(samples))
+	}
+	if samples[0].LoggerName != "rejected" {
+		t.Errorf("logger name = %q, want rejected", samples[0].LoggerName)
+	}
+	redacted, plain := samples[0].ContextMap(), samples[1].ContextMap()
+	if redacted["completion_id"] != "cmpl-redacted" || redacted["reason"] != string(LowHiddenScore) || redacted["language"] != "go" {
+		t.Errorf("unexpected sample: %v", redacted)
+	}
+	if s, _ := redacted["line_prefix"].(string); !strings.HasPrefix(s, "[redacted") {
+		t.Errorf("line_prefix = %q, want redacted", s)
+	}
+	if plain["line_prefix"] != "\tfmt.Pri" || plain["line_suffix"] != "ntln()" {
+		t.Errorf("cursor line = %q|%q", plain["line_prefix"], plain["line_suffix"])
+	}
+}
@@ -6,9 +6,12 @@ type CompletionRequest struct {
 	LanguageID   string                 `json:"language_id,omitempty"`
 	ClientID     string                 `json:"client_id,omitempty"`
 	CompletionID string                 `json:"completion_id,omitempty"`
-	Temperature  float64                `json:"temperature,omitempty"`
-	TriggerMode  string                 `json:"trigger_mode,omitempty"`
+	Temperature  *float64               `json:"temperature,omitempty"`  // 温度，未指定时使用模型配置的defaultTemperature
+	TriggerMode  string                 `json:"trigger_mode,omitempty"` // 触发方式: automatic(输入时自动触发)、manual(主动触发)，其他值按默认策略处理
 	ParentID     string                 `json:"parent_id,omitempty"`
+	Priority     int                    `json:"priority,omitempty"`   // 排队优先级: 1(低)、2(普通)、3(高)，为0时按trigger_mode推导
+	Seed         *int                   `json:"seed,omitempty"`       // 随机种子，配合temperature为0得到可复现的补全，模型不支持时忽略
+	MaxTokens    int                    `json:"max_tokens,omitempty"` // 最大输出token数，不超过模型的maxOutput，为0时使用maxOutput
 	Stop         []string               `json:"stop,omitempty"`
 	Verbose      bool                   `json:"verbose,omitempty"`
 	Extra        map[string]interface{} `json:"extra,omitempty"`
@@ -36,6 +39,14 @@ type PromptOptions struct {
 	ClipboardContent      []Snippet `json:"clipboard_content,omitempty"`       // Clipboard Snippets
 	RecentlyOpenedFiles   []Snippet `json:"recently_opened_files,omitempty"`   // Recently Opened Files Snippets
 	StaticContext         []Snippet `json:"static_context,omitempty"`          // Static Snippets
+
+	pretokenized *promptTokens // 获取上下文期间预先分词的前后缀，见pretokenize
+}
+
+// 请求携带的各类客户端片段
+func (p *PromptOptions) clientSnippets() [][]Snippet {
+	return [][]Snippet{p.RecentlyEditedRanges, p.RecentlyVisitedRanges,
+		p.ClipboardContent, p.RecentlyOpenedFiles, p.StaticContext}
 }
 
 // 计算隐藏分数配置
@@ -1,8 +1,11 @@
 package completions
 
 import (
+	"completion-agent/pkg/config"
 	"completion-agent/pkg/metrics"
 	"completion-agent/pkg/model"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 )
@@ -30,7 +33,23 @@ type CompletionUsage struct {
  * - 用于向客户端返回补全建议
  */
 type CompletionChoice struct {
-	Text string `json:"text"`
+	Text         string        `json:"text"`
+	ReplaceRange *ReplaceRange `json:"replace_range,omitempty"` // 建议替换的范围，为空表示在光标处插入
+}
+
+/**
+ * 补全建议替换的范围
+ * @description
+ * - 补全结果包含了光标前未写完的单词时(如前缀以"pri"结尾，补全为"print(x)")，
+ *   编辑器应替换该范围而不是在光标处插入
+ * - 偏移相对光标位置，单位为UTF-16码元，与编辑器的列号一致；基本多文种平面内的字符(含中文)各占1
+ * @example
+ * // 前缀 "fmt.Pri"，补全 "Println(x)"
+ * // ReplaceRange{Start: -3, End: 0}：用补全替换光标前的"Pri"
+ */
+type ReplaceRange struct {
+	Start int `json:"start"` // 替换范围的起点，相对光标的偏移，不大于0
+	End   int `json:"end"`   // 替换范围的终点，相对光标的偏移，不小于0
 }
 
 /**
@@ -42,13 +61,16 @@ type CompletionChoice struct {
  * - 用于性能监控和优化分析
  */
 type CompletionPerformance struct {
-	ReceiveTime      time.Time `json:"receive_time"`      //收到请求的时间
-	ContextDuration  int64     `json:"context_duration"`  //获取上下文的时长(毫秒)
-	LLMDuration      int64     `json:"llm_duration"`      //调用大语言模型耗用的时长(毫秒)
-	TotalDuration    int64     `json:"total_duration"`    //总时长(毫秒)
-	PromptTokens     int       `json:"prompt_tokens"`     //提示词token数
-	CompletionTokens int       `json:"completion_tokens"` //补全结果token数
-	TotalTokens      int       `json:"total_tokens"`      //总token数
+	ReceiveTime        time.Time `json:"receive_time"`         //收到请求的时间
+	QueueDuration      int64     `json:"queue_duration"`       //排队等待的时长(毫秒)
+	ContextDuration    int64     `json:"context_duration"`     //获取上下文的时长(毫秒)
+	LLMDuration        int64     `json:"llm_duration"`         //调用大语言模型耗用的时长(毫秒)
+	FirstTokenTime     time.Time `json:"-"`                    //收到首个token的时间，非流式请求为零值
+	FirstTokenDuration int64     `json:"first_token_duration"` //从收到请求到收到首个token的时长(毫秒)，非流式请求为0
+	TotalDuration      int64     `json:"total_duration"`       //总时长(毫秒)
+	PromptTokens       int       `json:"prompt_tokens"`        //提示词token数
+	CompletionTokens   int       `json:"completion_tokens"`    //补全结果token数
+	TotalTokens        int       `json:"total_tokens"`         //总token数
 }
 
 /**
@@ -56,19 +78,56 @@ type CompletionPerformance struct {
  * @description
  * - 表示补全请求的完整响应
  * - 包含响应ID、模型名称、补全选择列表、使用统计和状态
- * - 支持错误信息和详细输出
+ * - 支持错误信息和详细输出，被过滤器拒绝时reject_reason给出细分原因
  * - 用于向客户端返回补全结果
  */
 type CompletionResponse struct {
-	ID      string                   `json:"id"`
-	Model   string                   `json:"model"`
-	Object  string                   `json:"object"`
-	Choices []CompletionChoice       `json:"choices"`
-	Created int                      `json:"created"`
-	Usage   CompletionPerformance    `json:"usage"`
-	Status  model.CompletionStatus   `json:"status"`
-	Error   string                   `json:"error,omitempty"`
-	Verbose *model.CompletionVerbose `json:"verbose,omitempty"`
+	ID           string                   `json:"id"`
+	Model        string                   `json:"model"`
+	Object       string                   `json:"object"`
+	Choices      []CompletionChoice       `json:"choices"`
+	Created      CreatedTime              `json:"created"`
+	Usage        CompletionPerformance    `json:"usage"`
+	Status       model.CompletionStatus   `json:"status"`
+	Error        string                   `json:"error,omitempty"`
+	RejectReason string                   `json:"reject_reason,omitempty"`
+	Verbose      *model.CompletionVerbose `json:"verbose,omitempty"`
+}
+
+/**
+ * 补全响应的创建时间
+ * @description
+ * - 序列化格式由server.createdFormat决定：默认为秒级时间戳，rfc3339时为RFC3339格式的字符串
+ * - 反序列化时两种格式都接受
+ * @example
+ * created := CreatedTime(time.Unix(1700000000, 0))
+ * json.Marshal(created) // 1700000000 或 "2023-11-14T22:13:20Z"
+ */
+type CreatedTime time.Time
+
+func (t CreatedTime) MarshalJSON() ([]byte, error) {
+	if config.Server != nil && config.Server.CreatedFormat == config.CreatedFormatRFC3339 {
+		return json.Marshal(time.Time(t).Format(time.RFC3339))
+	}
+	return json.Marshal(time.Time(t).Unix())
+}
+
+func (t *CreatedTime) UnmarshalJSON(data []byte) error {
+	var epoch int64
+	if err := json.Unmarshal(data, &epoch); err == nil {
+		*t = CreatedTime(time.Unix(epoch, 0))
+		return nil
+	}
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return fmt.Errorf("invalid created: %s", data)
+	}
+	v, err := time.Parse(time.RFC3339, text)
+	if err != nil {
+		return err
+	}
+	*t = CreatedTime(v)
+	return nil
 }
 
 /**
@@ -78,6 +137,7 @@ type CompletionResponse struct {
  * @param {*CompletionPerformance} perf - 性能统计对象，包含各阶段耗时和token使用情况
  * @description
  * - 记录补全请求的各阶段耗时指标
+ * - 流式请求记录首个token的返回耗时，非流式请求该值为0，不记录
  * - 记录补全请求计数指标
  * - 记录输入和输出token使用指标
  * - 使用metrics包进行指标上报
@@ -85,7 +145,10 @@ type CompletionResponse struct {
  */
 func Metrics(modelName string, status string, perf *CompletionPerformance) {
 	metrics.RecordCompletionDuration(modelName, status,
-		0, perf.ContextDuration, perf.LLMDuration, perf.TotalDuration)
+		perf.QueueDuration, perf.ContextDuration, perf.LLMDuration, perf.TotalDuration)
+	if perf.FirstTokenDuration > 0 {
+		metrics.RecordFirstTokenDuration(modelName, status, perf.FirstTokenDuration)
+	}
 	metrics.IncrementCompletionRequests(modelName, status)
 	metrics.RecordCompletionTokens(modelName, metrics.TokenTypeInput, perf.PromptTokens)
 	metrics.RecordCompletionTokens(modelName, metrics.TokenTypeOutput, perf.CompletionTokens)
@@ -119,7 +182,7 @@ func ErrorResponse(completionId, modelName string, status model.CompletionStatus
 		Model:   modelName,
 		Object:  "text_completion",
 		Choices: []CompletionChoice{{Text: ""}}, // 使用后置处理后的补全结果
-		Created: int(perf.ReceiveTime.Unix()),
+		Created: CreatedTime(perf.ReceiveTime),
 		Usage:   *perf,
 		Status:  status,
 		Error:   err.Error(),
@@ -152,7 +215,7 @@ func SuccessResponse(completionId, modelName, completionText string, perf *Compl
 		Model:   modelName,
 		Object:  "text_completion",
 		Choices: []CompletionChoice{{Text: completionText}}, // 使用后置处理后的补全结果
-		Created: int(perf.ReceiveTime.Unix()),
+		Created: CreatedTime(perf.ReceiveTime),
 		Usage:   *perf,
 		Status:  model.StatusSuccess,
 		Verbose: verbose,
@@ -173,19 +236,26 @@ func SuccessResponse(completionId, modelName, completionText string, perf *Compl
  * - 计算总耗时并记录性能指标
  * - 设置空的选择结果
  * - 包含错误详情和性能统计信息
+ * - 被过滤器拒绝(*RejectError)时填写reject_reason，并按原因记录拒绝次数
  */
 func CancelRequest(completionId, modelName string, perf *CompletionPerformance,
 	status model.CompletionStatus, err error) *CompletionResponse {
 	perf.TotalDuration = time.Since(perf.ReceiveTime).Milliseconds()
 	Metrics(modelName, string(status), perf)
-	return &CompletionResponse{
+	rsp := &CompletionResponse{
 		ID:      completionId,
 		Model:   modelName,
 		Object:  "text_completion",
 		Choices: []CompletionChoice{{Text: ""}},
-		Created: int(perf.ReceiveTime.Unix()),
+		Created: CreatedTime(perf.ReceiveTime),
 		Usage:   *perf,
 		Status:  status,
 		Error:   err.Error(),
 	}
+	var rejectErr *RejectError
+	if errors.As(err, &rejectErr) {
+		rsp.RejectReason = rejectErr.Reason
+		metrics.IncrementRejections(rejectErr.Reason)
+	}
+	return rsp
 }
@@ -0,0 +1,54 @@
+package completions
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"completion-agent/pkg/config"
+	"completion-agent/pkg/model"
+)
+
+func Test_CreatedFormat(t *testing.T) {
+	withConfig(t, nil)
+
+	perf := &CompletionPerformance{ReceiveTime: time.Unix(1700000000, 0)}
+	responses := []*CompletionResponse{
+		SuccessResponse("c1", "m", "x", perf, nil),
+		ErrorResponse("c2", "m", model.StatusModelError, perf, nil, nil),
+		CancelRequest("c3", "m", perf, model.StatusCanceled, errors.New("canceled")),
+	}
+	cases := []struct {
+		server *config.ServerConfig
+		want   string
+	}{
+		{nil, `1700000000`},
+		{&config.ServerConfig{CreatedFormat: config.CreatedFormatEpoch}, `1700000000`},
+		{&config.ServerConfig{CreatedFormat: config.CreatedFormatRFC3339}, `"` + time.Unix(1700000000, 0).Format(time.RFC3339) + `"`},
+	}
+	for _, c := range cases {
+		config.Server = c.server
+		for _, rsp := range responses {
+			data, err := json.Marshal(rsp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var fields map[string]json.RawMessage
+			if err := json.Unmarshal(data, &fields); err != nil {
+				t.Fatal(err)
+			}
+			if got := string(fields["created"]); got != c.want {
+				t.Errorf("%s: created = %s, want %s", rsp.ID, got, c.want)
+			}
+			// 两种格式都能解析回来
+			var parsed CompletionResponse
+			if err := json.Unmarshal(data, &parsed); err != nil {
+				t.Fatal(err)
+			}
+			if !time.Time(parsed.Created).Equal(perf.ReceiveTime) {
+				t.Errorf("%s: parsed created = %v", rsp.ID, time.Time(parsed.Created))
+			}
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package completions
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"completion-agent/pkg/config"
+	"completion-agent/pkg/env"
+	"completion-agent/pkg/logger"
+	"completion-agent/pkg/model"
+
+	"go.uber.org/zap"
+)
+
+// 影子请求的结果，主模型请求结束后与之对比记录
+type shadowResult struct {
+	text     string
+	status   model.CompletionStatus
+	duration time.Duration
+}
+
+/**
+ * 查找影子模型
+ * @param {string} name - 影子模型的modelTitle或modelName
+ * @returns {model.LLM} 返回影子模型，未找到时返回nil
+ */
+func findShadowModel(name string) model.LLM {
+	for _, m := range model.Models() {
+		if cfg := m.Config(); cfg.ModelTitle == name || cfg.ModelName == name {
+			return m
+		}
+	}
+	return nil
+}
+
+/**
+ * 按抽样启动影子请求
+ * @param {*CompletionContext} c - 补全上下文
+ * @param {*model.CompletionParameter} para - 主模型的调用参数
+ * @returns {chan<- shadowResult} 返回接收主模型结果的通道，未启动影子请求时返回nil
+ * @description
+ * - 仅在调试模式下、配置了wrapper.shadow.model且命中抽样时启动
+ * - 影子模型与主模型相同时不启动
+ * - 影子请求使用主模型截断后的prompt，模型名称和输出长度使用影子模型的配置
+ * - 影子请求不随客户端断开而取消，受wrapper.shadow.timeout限制
+ * - 影子请求与主模型请求并发执行，两者都结束后记录一条对比日志
+ * - 调用方必须把主模型的结果发送到返回的通道
+ */
+func (h *CompletionHandler) startShadow(c *CompletionContext, para *model.CompletionParameter) chan<- shadowResult {
+	if !env.DebugMode || config.Wrapper == nil {
+		return nil
+	}
+	cfg := config.Wrapper.Shadow
+	if cfg.Model == "" || cfg.SampleRate <= 0 || rand.Float64() >= cfg.SampleRate {
+		return nil
+	}
+	shadow := findShadowModel(cfg.Model)
+	if shadow == nil {
+		zap.L().Warn("Shadow model not found", zap.String("model", cfg.Model))
+		return nil
+	}
+	if shadow.Config() == h.cfg {
+		return nil
+	}
+
+	shadowPara := *para
+	shadowPara.Model = shadow.Config().ModelName
+	shadowPara.MaxTokens = shadow.Config().MaxOutput
+	ctx := context.WithoutCancel(c.Ctx)
+	primary := make(chan shadowResult, 1)
+	go func() {
+		var cancel context.CancelFunc = func() {}
+		if timeout := cfg.Timeout.Duration(); timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		defer cancel()
+
+		start := time.Now()
+		rsp, status, err := shadow.Completions(ctx, &shadowPara)
+		result := shadowResult{status: status, duration: time.Since(start)}
+		if rsp != nil && len(rsp.Choices) > 0 {
+			result.text = rsp.Choices[0].Text
+		}
+		p := <-primary
+		fields := []zap.Field{
+			zap.String("completionID", para.CompletionID),
+			zap.String("primaryModel", para.Model),
+			zap.String("shadowModel", shadowPara.Model),
+			zap.String("primaryStatus", string(p.status)),
+			zap.String("shadowStatus", string(result.status)),
+			zap.Int64("primaryDuration", p.duration.Milliseconds()),
+			zap.Int64("shadowDuration", result.duration.Milliseconds()),
+			logger.Sensitive("primaryText", p.text),
+			logger.Sensitive("shadowText", result.text),
+		}
+		if err != nil {
+			fields = append(fields, zap.Error(err))
+		}
+		zap.L().Info("shadow completion", fields...)
+	}()
+	return primary
+}
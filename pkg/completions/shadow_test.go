@@ -0,0 +1,83 @@
+package completions
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"completion-agent/pkg/config"
+	"completion-agent/pkg/env"
+	"completion-agent/pkg/model"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func Test_ShadowCompletion(t *testing.T) {
+	upstream := func(text string, called chan<- string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(io.Discard, r.Body)
+			called <- text
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"choices": [{"text": "`+text+`"}], "usage": {"prompt_tokens": 5, "completion_tokens": 2}}`)
+		}))
+	}
+	called := make(chan string, 2)
+	primarySrv := upstream("primary()", called)
+	defer primarySrv.Close()
+	shadowSrv := upstream("shadow()", called)
+	defer shadowSrv.Close()
+
+	savedDebug := env.DebugMode
+	defer func() { env.DebugMode = savedDebug }()
+	env.DebugMode = true
+	withConfig(t, &config.WrapperConfig{
+		Score:  config.ScoreFilterConfig{Disabled: true},
+		Syntax: config.SyntaxFilterConfig{Disabled: true},
+		Prune:  config.PruneConfig{Disabled: true},
+		Shadow: config.ShadowConfig{Model: "shadow-model", SampleRate: 1},
+	})
+	if err := model.Init([]config.ModelConfig{
+		{Provider: "openai", ModelName: "primary-model", CompletionsUrl: primarySrv.URL, MaxPrefix: 100, MaxSuffix: 100, MaxOutput: 16},
+		{Provider: "openai", ModelName: "shadow-model", CompletionsUrl: shadowSrv.URL, MaxPrefix: 100, MaxSuffix: 100, MaxOutput: 8},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	core, logs := observer.New(zap.InfoLevel)
+	defer zap.ReplaceGlobals(zap.New(core))()
+
+	handler := NewCompletionHandler(model.Models()[0])
+	input := &CompletionInput{CompletionRequest: CompletionRequest{
+		CompletionID: "cmpl-shadow",
+		Prompts:      &PromptOptions{Prefix: "func main() {\n\t", Suffix: "\n}"},
+	}}
+	rsp := handler.HandleCompletion(NewCompletionContext(context.Background(), &CompletionPerformance{ReceiveTime: time.Now()}), input)
+	if rsp.Status != model.StatusSuccess || rsp.Choices[0].Text != "primary()" {
+		t.Fatalf("unexpected response: status %s, text %q", rsp.Status, rsp.Choices[0].Text)
+	}
+
+	seen := map[string]bool{}
+	for len(seen) < 2 {
+		select {
+		case text := <-called:
+			seen[text] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("models called: %v, want both primary and shadow", seen)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for logs.FilterMessage("shadow completion").Len() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("shadow completion was not logged")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	fields := logs.FilterMessage("shadow completion").All()[0].ContextMap()
+	if fields["primaryModel"] != "primary-model" || fields["shadowModel"] != "shadow-model" || fields["shadowStatus"] != string(model.StatusSuccess) {
+		t.Errorf("unexpected shadow log: %v", fields)
+	}
+}
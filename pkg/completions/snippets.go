@@ -0,0 +1,139 @@
+package completions
+
+import (
+	"completion-agent/pkg/codebase_context"
+	"completion-agent/pkg/config"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 客户端片段的来源，用于verbose说明
+const (
+	SourceStatic          = "static"
+	SourceRecentlyOpened  = "recently_opened"
+	SourceRecentlyVisited = "recently_visited"
+	SourceRecentlyEdited  = "recently_edited"
+	SourceClipboard       = "clipboard"
+)
+
+// 每类客户端片段默认的token上限
+const defaultSnippetTokens = 256
+
+/**
+ * 将请求携带的客户端片段拼接为上下文
+ * @param {*PromptOptions} ppt - 提示词选项，包含最近编辑、剪贴板等片段
+ * @param {int} budget - 所有类别合计的token上限，0表示不限制
+ * @returns {string, []codebase_context.ContextSnippet} 返回注释后的上下文及其包含的片段
+ * @description
+ * - 依次处理静态上下文、最近打开、最近浏览、最近编辑、剪贴板五类片段，越靠后越靠近光标
+ * - 已在context.snippets中禁用的类别跳过
+ * - 每类片段按copiedAt从新到旧选取，不超过该类的token上限，内容重复的片段只保留一个
+ * - 设置了合计上限时，越靠近光标的类别越优先占用预算，超出上限时先丢弃最远的类别
+ * - 同类中最新的片段放在最后
+ * - 拼接结果按当前文件的语言转为注释
+ * @example
+ * text, used := buildClientContext(&PromptOptions{
+ *     FileProjectPath: "main.go",
+ *     ClipboardContent: []Snippet{{Content: "fmt.Println(x)"}},
+ * }, 0)
+ * // text = "// fmt.Println(x)"
+ */
+func buildClientContext(ppt *PromptOptions, budget int) (string, []codebase_context.ContextSnippet) {
+	var cfg config.SnippetsConfig
+	if config.Context != nil {
+		cfg = config.Context.Snippets
+	}
+	categories := []struct {
+		source   string
+		snippets []Snippet
+		cfg      config.SnippetCategoryConfig
+	}{
+		{SourceStatic, ppt.StaticContext, cfg.Static},
+		{SourceRecentlyOpened, ppt.RecentlyOpenedFiles, cfg.RecentlyOpened},
+		{SourceRecentlyVisited, ppt.RecentlyVisitedRanges, cfg.RecentlyVisited},
+		{SourceRecentlyEdited, ppt.RecentlyEditedRanges, cfg.RecentlyEdited},
+		{SourceClipboard, ppt.ClipboardContent, cfg.Clipboard},
+	}
+
+	// 从最靠近光标的类别开始占用合计预算
+	type part struct {
+		text   string
+		picked []codebase_context.ContextSnippet
+	}
+	var parts []part
+	remaining := budget
+	for i := len(categories) - 1; i >= 0; i-- {
+		cat := categories[i]
+		if cat.cfg.Disabled || len(cat.snippets) == 0 {
+			continue
+		}
+		catBudget := cat.cfg.MaxTokens
+		if catBudget <= 0 {
+			catBudget = defaultSnippetTokens
+		}
+		if budget > 0 {
+			if remaining <= 0 {
+				break
+			}
+			catBudget = min(catBudget, remaining)
+		}
+		text, picked := codebase_context.MergeSnippets(byRecency(cat.source, cat.snippets), catBudget)
+		if text == "" {
+			continue
+		}
+		parts = append(parts, part{text, picked})
+		remaining -= codebase_context.CountTokens(text)
+	}
+
+	// 按类别原来的顺序拼接，转为注释后仍超出合计上限时丢弃最远的类别
+	for len(parts) > 0 {
+		var texts []string
+		var used []codebase_context.ContextSnippet
+		for i := len(parts) - 1; i >= 0; i-- {
+			texts = append(texts, parts[i].text)
+			used = append(used, parts[i].picked...)
+		}
+		text := codebase_context.CommentCode(ppt.FileProjectPath, strings.Join(texts, "\n"))
+		if budget <= 0 || codebase_context.CountTokens(text) <= budget {
+			return text, used
+		}
+		parts = parts[:len(parts)-1]
+	}
+	return "", nil
+}
+
+// byRecency 按copiedAt从新到旧排列片段，没有时间的片段排在最后并保持原有顺序
+func byRecency(source string, snippets []Snippet) []codebase_context.RetrievedSnippet {
+	sorted := append([]Snippet(nil), snippets...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return parseCopiedAt(sorted[i].CopiedAt).After(parseCopiedAt(sorted[j].CopiedAt))
+	})
+	result := make([]codebase_context.RetrievedSnippet, 0, len(sorted))
+	for _, s := range sorted {
+		result = append(result, codebase_context.RetrievedSnippet{
+			ContextSnippet: codebase_context.ContextSnippet{Source: source, FilePath: s.FilePath},
+			Content:        s.Content,
+		})
+	}
+	return result
+}
+
+// parseCopiedAt 解析copiedAt，支持RFC3339格式以及秒或毫秒级的时间戳，无法解析时返回零值
+func parseCopiedAt(s string) time.Time {
+	if s == "" {
+		return time.Time{}
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	if n > 1e12 {
+		return time.UnixMilli(n)
+	}
+	return time.Unix(n, 0)
+}
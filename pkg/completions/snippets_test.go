@@ -0,0 +1,168 @@
+package completions
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"completion-agent/pkg/codebase_context"
+	"completion-agent/pkg/config"
+)
+
+func Test_BuildClientContext(t *testing.T) {
+	withConfig(t, nil)
+
+	ppt := &PromptOptions{
+		FileProjectPath: "src/main.py",
+		ClipboardContent: []Snippet{
+			{Content: "old_value = 1", CopiedAt: "2024-01-01T10:00:00Z"},
+			{Content: "new_value = 2", CopiedAt: "2024-01-01T12:00:00Z"},
+			{Content: "mid_value = 3", CopiedAt: "1704106800000"}, // 2024-01-01T11:00:00Z
+		},
+		RecentlyEditedRanges: []Snippet{
+			{FilePath: "src/util.py", Content: "def helper():\n    pass"},
+		},
+	}
+
+	text, used := buildClientContext(ppt, 0)
+	want := strings.Join([]string{
+		"# Path: src/util.py", "# def helper():", "#     pass",
+		"# old_value = 1", "# mid_value = 3", "# new_value = 2",
+	}, "\n")
+	if text != want {
+		t.Errorf("context:\n%s\nwant:\n%s", text, want)
+	}
+	if len(used) != 4 || used[0].Source != SourceRecentlyEdited || used[3].Source != SourceClipboard {
+		t.Errorf("unexpected snippets: %+v", used)
+	}
+
+	// 剪贴板出于隐私考虑被禁用
+	config.Context.Snippets.Clipboard.Disabled = true
+	text, _ = buildClientContext(ppt, 0)
+	if strings.Contains(text, "value") {
+		t.Errorf("clipboard should be disabled:\n%s", text)
+	}
+
+	// token上限只够一个片段时保留最新的剪贴板内容
+	config.Context.Snippets = config.SnippetsConfig{
+		RecentlyEdited: config.SnippetCategoryConfig{Disabled: true},
+		Clipboard:      config.SnippetCategoryConfig{MaxTokens: 4},
+	}
+	text, _ = buildClientContext(ppt, 0)
+	if text != "# new_value = 2" {
+		t.Errorf("capped context: %q", text)
+	}
+}
+
+func Test_CombinedContextCap(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Write([]byte(`{"data": {"list": [{"filePath": "pkg/math/add.go", "name": "Add",
+			"type": "definition.function", "content": "func Add(a, b int) int"}]}}`))
+	}))
+	defer srv.Close()
+
+	withConfig(t, nil)
+	var cfg config.ContextConfig
+	if err := json.Unmarshal([]byte(`{
+		"definition": {"url": "`+srv.URL+`"},
+		"semantic": {"disabled": true},
+		"relation": {"disabled": true},
+		"requestTimeout": "1s",
+		"totalTimeout": "1s"
+	}`), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	config.Context = &cfg
+
+	getContext := func() *CompletionInput {
+		in := &CompletionInput{CompletionRequest: CompletionRequest{
+			ClientID: "client",
+			Prompts: &PromptOptions{
+				ProjectPath:          "/project",
+				FileProjectPath:      "main.go",
+				Prefix:               "func main() {\n\tx := ",
+				StaticContext:        []Snippet{{Content: strings.Repeat("static := 0\n", 10)}},
+				RecentlyEditedRanges: []Snippet{{Content: "edited := 1"}},
+				ClipboardContent:     []Snippet{{Content: "copied := 2"}},
+			},
+		}}
+		in.GetContext(NewCompletionContext(context.Background(), &CompletionPerformance{ReceiveTime: time.Now()}))
+		return in
+	}
+
+	// 预算只够最靠近光标的两类片段：丢弃静态上下文，也不请求代码库服务
+	both := codebase_context.CommentCode("main.go", "edited := 1\ncopied := 2")
+	cfg.MaxTotalTokens = codebase_context.CountTokens(both)
+	in := getContext()
+	if in.Prompts.CodeContext != both {
+		t.Errorf("capped context:\n%s\nwant:\n%s", in.Prompts.CodeContext, both)
+	}
+	if n := calls.Load(); n != 0 {
+		t.Errorf("context service called %d times with an exhausted budget", n)
+	}
+
+	// 预算足够时各来源都拼入，合计不超过上限
+	cfg.MaxTotalTokens = 200
+	in = getContext()
+	for _, want := range []string{"func Add", "static := 0", "edited := 1", "copied := 2"} {
+		if !strings.Contains(in.Prompts.CodeContext, want) {
+			t.Errorf("context missing %q:\n%s", want, in.Prompts.CodeContext)
+		}
+	}
+	if n := codebase_context.CountTokens(in.Prompts.CodeContext); n > cfg.MaxTotalTokens {
+		t.Errorf("combined context has %d tokens, cap %d", n, cfg.MaxTotalTokens)
+	}
+	if calls.Load() == 0 {
+		t.Error("context service not called with remaining budget")
+	}
+}
+
+func Test_CombinedContextTrim(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data": {"list": [
+			{"filePath": "pkg/math/add.go", "name": "Add", "type": "definition.function", "content": "func Add(a, b int) int"},
+			{"filePath": "pkg/math/sub.go", "name": "Sub", "type": "definition.function", "content": "func Sub(a, b int) int"}]}}`))
+	}))
+	defer srv.Close()
+
+	withConfig(t, nil)
+	var cfg config.ContextConfig
+	if err := json.Unmarshal([]byte(`{
+		"definition": {"url": "`+srv.URL+`"},
+		"semantic": {"disabled": true},
+		"relation": {"disabled": true},
+		"requestTimeout": "1s",
+		"totalTimeout": "1s"
+	}`), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	// 两个定义合并前刚好在预算内，转为注释后超出
+	cfg.MaxTotalTokens = codebase_context.CountTokens("Path: pkg/math/add.go\nfunc Add(a, b int) int\n") +
+		codebase_context.CountTokens("Path: pkg/math/sub.go\nfunc Sub(a, b int) int\n")
+	config.Context = &cfg
+
+	in := &CompletionInput{CompletionRequest: CompletionRequest{
+		ClientID: "client",
+		Prompts: &PromptOptions{
+			ProjectPath:     "/project",
+			FileProjectPath: "main.go",
+			Prefix:          "func main() {\n\tx := ",
+		},
+	}}
+	in.GetContext(NewCompletionContext(context.Background(), &CompletionPerformance{ReceiveTime: time.Now()}))
+
+	// 超出上限时只丢弃优先级最低的片段，不丢弃全部检索上下文
+	if !strings.Contains(in.Prompts.CodeContext, "func Add") || strings.Contains(in.Prompts.CodeContext, "func Sub") {
+		t.Errorf("trimmed context:\n%s", in.Prompts.CodeContext)
+	}
+	if n := codebase_context.CountTokens(in.Prompts.CodeContext); n > cfg.MaxTotalTokens {
+		t.Errorf("combined context has %d tokens, cap %d", n, cfg.MaxTotalTokens)
+	}
+}
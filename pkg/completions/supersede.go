@@ -0,0 +1,66 @@
+package completions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// 同一客户端有更新的请求到达时，旧请求被取消的原因
+var errSuperseded = errors.New("superseded by newer request")
+
+// 正在处理的请求
+type inflightRequest struct {
+	completionID string
+	cancel       context.CancelCauseFunc
+}
+
+/**
+ * 各客户端正在处理的补全请求
+ * @description
+ * - 编辑器每次击键都会发起补全，旧请求的结果到达时往往已被编辑器丢弃
+ * - 每个client_id只保留最新的一个请求，新请求到达时取消旧请求，节省模型算力
+ * - 被取消的旧请求返回StatusCanceled
+ */
+var inflight = struct {
+	requests map[string]*inflightRequest
+	mutex    sync.Mutex
+}{requests: make(map[string]*inflightRequest)}
+
+/**
+ * 登记客户端正在处理的请求，并取消该客户端更早的请求
+ * @param {context.Context} ctx - 请求上下文
+ * @param {string} clientID - 客户端ID，为空时不登记也不取消其他请求
+ * @param {string} completionID - 补全请求ID，用于说明取消原因
+ * @returns {context.Context, func()} 返回被更新请求取代时会取消的上下文，以及请求结束时调用的释放函数
+ * @description
+ * - 同一客户端已有正在处理的请求时，以errSuperseded为原因取消它
+ * - 释放函数只删除自己的登记，不影响已经取代它的新请求
+ * @example
+ * ctx, done := trackRequest(c.Ctx, "client-1", "cmpl-2")
+ * defer done()
+ */
+func trackRequest(ctx context.Context, clientID, completionID string) (context.Context, func()) {
+	if clientID == "" {
+		return ctx, func() {}
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	req := &inflightRequest{completionID: completionID, cancel: cancel}
+
+	inflight.mutex.Lock()
+	if prev, ok := inflight.requests[clientID]; ok {
+		prev.cancel(fmt.Errorf("%w '%s'", errSuperseded, completionID))
+	}
+	inflight.requests[clientID] = req
+	inflight.mutex.Unlock()
+
+	return ctx, func() {
+		inflight.mutex.Lock()
+		if inflight.requests[clientID] == req {
+			delete(inflight.requests, clientID)
+		}
+		inflight.mutex.Unlock()
+		cancel(nil)
+	}
+}
@@ -0,0 +1,77 @@
+package completions
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"completion-agent/pkg/config"
+	"completion-agent/pkg/model"
+)
+
+// 测试用的模型，阻塞直到请求上下文被取消或超时
+type blockingLLM struct {
+	fakeLLM
+	entered chan struct{}
+}
+
+func (m *blockingLLM) Completions(ctx context.Context, param *model.CompletionParameter) (*model.CompletionResponse, model.CompletionStatus, error) {
+	m.entered <- struct{}{}
+	<-ctx.Done()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, model.StatusTimeout, ctx.Err()
+	}
+	return nil, model.StatusCanceled, ctx.Err()
+}
+
+func Test_SupersededRequest(t *testing.T) {
+	withConfig(t, &config.WrapperConfig{
+		Score:  config.ScoreFilterConfig{Disabled: true},
+		Syntax: config.SyntaxFilterConfig{Disabled: true},
+		Prune:  config.PruneConfig{Disabled: true},
+	})
+	cfg := &config.ModelConfig{ModelName: "test", MaxPrefix: 100, MaxSuffix: 100}
+	newInput := func(completionID string) *CompletionInput {
+		return &CompletionInput{CompletionRequest: CompletionRequest{
+			CompletionID: completionID,
+			ClientID:     "client-supersede",
+			Prompts:      &PromptOptions{Prefix: "func main() {\n\t", Suffix: "\n}"},
+		}}
+	}
+	newContext := func() *CompletionContext {
+		return NewCompletionContext(context.Background(), &CompletionPerformance{ReceiveTime: time.Now()})
+	}
+
+	slow := &blockingLLM{fakeLLM: fakeLLM{cfg: cfg}, entered: make(chan struct{}, 1)}
+	stale := make(chan *CompletionResponse, 1)
+	go func() {
+		stale <- NewCompletionHandler(slow).HandleCompletion(newContext(), newInput("cmpl-1"))
+	}()
+	<-slow.entered
+
+	fast := &fakeLLM{cfg: cfg, status: model.StatusSuccess, rsp: &model.CompletionResponse{
+		Choices: []model.CompletionChoice{{Text: "fmt.Println()"}},
+	}}
+	rsp := NewCompletionHandler(fast).HandleCompletion(newContext(), newInput("cmpl-2"))
+	if rsp.Status != model.StatusSuccess {
+		t.Fatalf("newer request: status %s, error %q", rsp.Status, rsp.Error)
+	}
+
+	select {
+	case rsp := <-stale:
+		if rsp.Status != model.StatusCanceled || !strings.Contains(rsp.Error, "cmpl-2") {
+			t.Fatalf("stale request: status %s, error %q", rsp.Status, rsp.Error)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stale request was not canceled")
+	}
+
+	// 请求结束后不再登记
+	inflight.mutex.Lock()
+	_, ok := inflight.requests["client-supersede"]
+	inflight.mutex.Unlock()
+	if ok {
+		t.Fatal("finished request still tracked")
+	}
+}
@@ -0,0 +1,75 @@
+package completions
+
+import (
+	"strings"
+
+	"completion-agent/pkg/config"
+	"completion-agent/pkg/parser"
+)
+
+// 请求的触发方式(trigger_mode)
+const (
+	TriggerModeAutomatic = "automatic" // 用户输入时自动触发
+	TriggerModeManual    = "manual"    // 用户主动触发
+)
+
+/**
+ * 获取请求触发方式对应的策略
+ * @param {string} mode - 请求的trigger_mode
+ * @returns {*config.TriggerPolicy} 返回wrapper.trigger中对应的策略，未知或为空的触发方式返回nil
+ */
+func triggerPolicy(mode string) *config.TriggerPolicy {
+	if config.Wrapper == nil {
+		return nil
+	}
+	switch mode {
+	case TriggerModeAutomatic:
+		return &config.Wrapper.Trigger.Automatic
+	case TriggerModeManual:
+		return &config.Wrapper.Trigger.Manual
+	default:
+		return nil
+	}
+}
+
+/**
+ * 判断请求是否按单行补全
+ * @param {*CompletionInput} input - 补全输入
+ * @returns {bool} 光标位置适合单行补全时返回true
+ * @description
+ * - 请求extra.completion_mode为single时总是按单行补全，为multi或block时总是允许多行
+ * - 否则只有自动触发(automatic)才按单行补全，手动触发(manual)以及未知或为空的触发方式保持多行补全
+ * - 自动触发时由parser.CursorLine取出光标行，再由parser.NeedSingleCompletion判断
+ * - 判断为单行时，后置处理把补全结果截断到第一行
+ */
+func needSingleLine(input *CompletionInput) bool {
+	switch input.ExtraOptions().CompletionMode {
+	case CompletionModeSingle:
+		return true
+	case CompletionModeMulti, CompletionModeBlock:
+		return false
+	}
+	if input.TriggerMode != TriggerModeAutomatic || input.Prompts == nil {
+		return false
+	}
+	linePrefix, lineSuffix := parser.CursorLine(input.Prompts.Prefix, input.Prompts.Suffix)
+	return parser.NeedSingleCompletion(linePrefix, lineSuffix, strings.ToLower(input.LanguageID))
+}
+
+/**
+ * 获取补全结果的最大行数
+ * @param {*CompletionInput} input - 补全输入，可为nil
+ * @returns {int} 返回模型maxLines与请求extra.max_lines中较小的正数，都未设置时返回0表示不限制
+ * @description
+ * - 请求只能收紧模型配置的上限，不能放宽
+ * - 后置处理由parser.CutMaxLines在不超过该行数的语法安全位置截断
+ */
+func (h *CompletionHandler) maxLines(input *CompletionInput) int {
+	limit := h.cfg.MaxLines
+	if input != nil {
+		if n := input.ExtraOptions().MaxLines; n > 0 && (limit <= 0 || n < limit) {
+			limit = n
+		}
+	}
+	return max(limit, 0)
+}
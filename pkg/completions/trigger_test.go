@@ -0,0 +1,255 @@
+package completions
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"completion-agent/pkg/config"
+	"completion-agent/pkg/model"
+)
+
+func Test_TriggerMode(t *testing.T) {
+	withConfig(t, nil)
+	if err := json.Unmarshal([]byte(`{
+		"score": {"disabled": true},
+		"syntax": {"disabled": true},
+		"prune": {"disabled": true},
+		"trigger": {"automatic": {"timeout": "50ms", "maxOutput": 16}}
+	}`), config.Wrapper); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.ModelConfig{ModelName: "test", MaxPrefix: 100, MaxSuffix: 100, MaxOutput: 64}
+	newInput := func(mode string) *CompletionInput {
+		return &CompletionInput{CompletionRequest: CompletionRequest{
+			TriggerMode: mode,
+			LanguageID:  "go",
+			Prompts:     &PromptOptions{Prefix: "func f() {\n\tx := ", Suffix: "\n}"},
+		}}
+	}
+	newContext := func() *CompletionContext {
+		return NewCompletionContext(context.Background(), &CompletionPerformance{ReceiveTime: time.Now()})
+	}
+	h := NewCompletionHandler(&fakeLLM{cfg: cfg})
+
+	// 输出token数和停用词
+	cases := []struct {
+		mode      string
+		maxTokens int
+		blankStop bool
+	}{
+		{TriggerModeAutomatic, 16, true},
+		{TriggerModeManual, 64, false},
+		{"", 64, false},
+		{"unknown", 64, false},
+	}
+	for _, c := range cases {
+		para := h.Adapt(newContext(), newInput(c.mode))
+		if para.MaxTokens != c.maxTokens {
+			t.Errorf("mode %q: max tokens %d, want %d", c.mode, para.MaxTokens, c.maxTokens)
+		}
+		if got := slices.Contains(para.Stop, "\n\n"); got != c.blankStop {
+			t.Errorf("mode %q: blank line stop %v, want %v", c.mode, got, c.blankStop)
+		}
+	}
+	// 后缀为空时，默认方式添加多行停用词，手动触发不添加
+	input := newInput("")
+	input.Prompts.Suffix = ""
+	if !slices.Contains(h.prepareStopWords(input), "\n\n") {
+		t.Error("default mode: missing blank line stop for empty suffix")
+	}
+	input.TriggerMode = TriggerModeManual
+	if slices.Contains(h.prepareStopWords(input), "\n\n") {
+		t.Error("manual mode: unexpected blank line stop")
+	}
+
+	// 自动触发时光标行有内容，只保留第一行
+	multiLine := &fakeLLM{cfg: cfg, status: model.StatusSuccess, rsp: &model.CompletionResponse{
+		Choices: []model.CompletionChoice{{Text: "compute()\n\treturn x"}},
+	}}
+	h = NewCompletionHandler(multiLine)
+	if rsp := h.HandleCompletion(newContext(), newInput(TriggerModeAutomatic)); rsp.Choices[0].Text != "compute()" {
+		t.Errorf("automatic: got %q", rsp.Choices[0].Text)
+	}
+	if rsp := h.HandleCompletion(newContext(), newInput(TriggerModeManual)); rsp.Choices[0].Text != "compute()\n\treturn x" {
+		t.Errorf("manual: got %q", rsp.Choices[0].Text)
+	}
+
+	// 自动触发的超时
+	slow := &blockingLLM{fakeLLM: fakeLLM{cfg: cfg}, entered: make(chan struct{}, 1)}
+	rsp := NewCompletionHandler(slow).HandleCompletion(newContext(), newInput(TriggerModeAutomatic))
+	if rsp.Status != model.StatusTimeout {
+		t.Errorf("automatic timeout: status %s", rsp.Status)
+	}
+}
+
+func Test_SingleLineCompletion(t *testing.T) {
+	cases := []struct {
+		text string
+		want string
+	}{
+		{"x := 1", "x := 1"},
+		{"x := 1\ny := 2", "x := 1"},
+		{"x := 1\r\ny := 2", "x := 1"},
+		{"\nx := 1\ny := 2", "\nx := 1"},
+		{"\r\nx := 1\r\ny := 2", "\r\nx := 1"},
+		{"\nx := 1", "\nx := 1"},
+		{"x := 1\n", "x := 1"},
+	}
+	for _, c := range cases {
+		if got := firstCompletionLine(c.text); got != c.want {
+			t.Errorf("%q: got %q, want %q", c.text, got, c.want)
+		}
+	}
+
+	withConfig(t, &config.WrapperConfig{
+		Score:  config.ScoreFilterConfig{Disabled: true},
+		Syntax: config.SyntaxFilterConfig{Disabled: true},
+		Prune:  config.PruneConfig{Disabled: true},
+	})
+	cfg := &config.ModelConfig{ModelName: "test", MaxPrefix: 100, MaxSuffix: 100, MaxOutput: 64}
+	complete := func(mode, text, prefix, suffix string) string {
+		llm := &fakeLLM{cfg: cfg, status: model.StatusSuccess, rsp: &model.CompletionResponse{
+			Choices: []model.CompletionChoice{{Text: text}},
+		}}
+		input := &CompletionInput{CompletionRequest: CompletionRequest{
+			TriggerMode: mode,
+			LanguageID:  "go",
+			Prompts:     &PromptOptions{Prefix: prefix, Suffix: suffix},
+		}}
+		h := NewCompletionHandler(llm)
+		if slices.Contains(h.prepareStopWords(input), "\n") {
+			t.Errorf("unexpected newline stop word")
+		}
+		ctx := NewCompletionContext(context.Background(), &CompletionPerformance{ReceiveTime: time.Now()})
+		return h.HandleCompletion(ctx, input).Choices[0].Text
+	}
+	// 光标行后缀非空，截断到第一行，开头的换行保留
+	if got := complete(TriggerModeAutomatic, "a, b)\nreturn", "x := foo(", ")\n}"); got != "a, b)" {
+		t.Errorf("single line: got %q", got)
+	}
+	if got := complete(TriggerModeAutomatic, "\n\treturn x\n}", "x := foo(", ")\n}"); got != "\n\treturn x" {
+		t.Errorf("leading newline: got %q", got)
+	}
+	// 光标在空行，允许多行
+	if got := complete(TriggerModeAutomatic, "a := 1\nb := 2", "func f() {\n\t", "\n}"); got != "a := 1\nb := 2" {
+		t.Errorf("multi line: got %q", got)
+	}
+	// 未指定或未知的触发方式保持原有行为，不截断到第一行
+	for _, mode := range []string{"", "unknown"} {
+		if got := complete(mode, "a, b)\nreturn", "x := foo(", ")\n}"); got != "a, b)\nreturn" {
+			t.Errorf("mode %q: got %q", mode, got)
+		}
+	}
+}
+
+func Test_MaxLines(t *testing.T) {
+	withConfig(t, &config.WrapperConfig{Prune: config.PruneConfig{Disabled: true}})
+
+	cfg := &config.ModelConfig{MaxLines: 4}
+	h := NewCompletionHandler(&fakeLLM{
+		cfg: cfg,
+		rsp: &model.CompletionResponse{Choices: []model.CompletionChoice{
+			{Text: "x := 1\nif x > 0 {\n\tx--\n}\ny := x\nz := y\n"},
+		}},
+		status: model.StatusSuccess,
+	})
+	complete := func(extra map[string]interface{}) string {
+		c := NewCompletionContext(context.Background(), &CompletionPerformance{})
+		c.Input = &CompletionInput{CompletionRequest: CompletionRequest{Extra: extra}}
+		para := &model.CompletionParameter{Language: "go", Prefix: "func f() {\n\t"}
+		return h.CallLLM(c, para).Choices[0].Text
+	}
+
+	// 模型上限为4行，在if块结束处截断
+	if got := complete(nil); got != "x := 1\nif x > 0 {\n\tx--\n}" {
+		t.Errorf("model limit: got %q", got)
+	}
+	// 请求收紧到3行，不在if块中间截断
+	if got := complete(map[string]interface{}{ExtraMaxLines: float64(3)}); got != "x := 1" {
+		t.Errorf("request limit: got %q", got)
+	}
+	// 请求不能放宽模型的上限
+	if got := complete(map[string]interface{}{ExtraMaxLines: float64(10)}); got != "x := 1\nif x > 0 {\n\tx--\n}" {
+		t.Errorf("request above model limit: got %q", got)
+	}
+	cfg.MaxLines = 0
+	if got := complete(map[string]interface{}{ExtraMaxLines: float64(5)}); got != "x := 1\nif x > 0 {\n\tx--\n}\ny := x" {
+		t.Errorf("request limit without model limit: got %q", got)
+	}
+}
+
+func Test_SuffixStopWord(t *testing.T) {
+	cases := []struct {
+		name   string
+		suffix string
+		want   string
+	}{
+		{"closing brace", "\n}\n", "\n}"},
+		{"indented closing brace", "\n\t}\n}\n", "\n\t}"},
+		{"return statement", "\n\n    return result  \n", "\n    return result"},
+		{"cursor line rest ignored", ")\n\treturn x\n", "\n\treturn x"},
+		{"whitespace only", "\n  \n\t\n", ""},
+		{"empty", "", ""},
+		{"too long", "\n\t" + strings.Repeat("x", maxSuffixStopLen+1) + "\n", ""},
+	}
+	for _, c := range cases {
+		if got := suffixStopWord(c.suffix); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+
+	h := NewCompletionHandler(&fakeLLM{cfg: &config.ModelConfig{}})
+	input := &CompletionInput{CompletionRequest: CompletionRequest{
+		TriggerMode: TriggerModeManual,
+		Stop:        []string{"\n}"},
+		Prompts:     &PromptOptions{Prefix: "func f() {\n\t", Suffix: "\n}"},
+	}}
+	// 与系统停用词相同的请求停用词不重复添加
+	if got := h.prepareStopWords(input); !slices.Equal(got, []string{"<｜end▁of▁sentence｜>", "\n}"}) {
+		t.Errorf("stop words = %q", got)
+	}
+	input.Stop = nil
+	input.Prompts.Suffix = "\n\treturn x\n}"
+	if got := h.prepareStopWords(input); !slices.Contains(got, "\n\treturn x") {
+		t.Errorf("stop words = %q, want suffix line", got)
+	}
+}
+
+func Test_PrepareStopWordsModel(t *testing.T) {
+	cfg := &config.ModelConfig{FimStop: []string{"<|endoftext|>", "<|fim_pad|>"}}
+	h := NewCompletionHandler(&fakeLLM{cfg: cfg})
+	input := &CompletionInput{CompletionRequest: CompletionRequest{
+		TriggerMode: TriggerModeAutomatic,
+		Stop:        []string{"<|endoftext|>"},
+		Prompts:     &PromptOptions{Prefix: "x = ", Suffix: ""},
+	}}
+	// fimStop取代默认结束符，与请求中的停用词不重复
+	want := []string{"<|endoftext|>", "<|fim_pad|>", "\n\n"}
+	if got := h.prepareStopWords(input); !slices.Equal(got, want) {
+		t.Errorf("stop words = %q, want %q", got, want)
+	}
+
+	cfg.DisableBlankLineStop = true
+	want = []string{"<|endoftext|>", "<|fim_pad|>"}
+	if got := h.prepareStopWords(input); !slices.Equal(got, want) {
+		t.Errorf("stop words = %q, want %q", got, want)
+	}
+	input.TriggerMode = ""
+	if got := h.prepareStopWords(input); !slices.Equal(got, want) {
+		t.Errorf("empty suffix stop words = %q, want %q", got, want)
+	}
+
+	// 系统停用词排在请求中的停用词之前，截断时优先保留
+	cfg.DisableBlankLineStop = false
+	input.TriggerMode = TriggerModeAutomatic
+	input.Stop = []string{"#", "<|endoftext|>"}
+	input.Prompts.Suffix = "\n}"
+	want = []string{"<|endoftext|>", "<|fim_pad|>", "\n\n", "\n}", "#"}
+	if got := h.prepareStopWords(input); !slices.Equal(got, want) {
+		t.Errorf("stop words = %q, want %q", got, want)
+	}
+}
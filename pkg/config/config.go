@@ -2,11 +2,15 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"time"
+
+	"completion-agent/pkg/env"
 )
 
 /**
@@ -14,8 +18,22 @@ import (
  * @description
  * - 包含模型的基本信息如提供商、名称、标题等
  * - 定义了模型请求的URL和认证信息
+ * - headers中的头部附加到每个模型请求上，与同名的默认头部冲突时以headers为准，值支持{{.Env.XXX}}等模板
  * - 设置了模型请求的各种限制参数
  * - 支持FIM(Fill in the Middle)模式的配置
+ * - generic供应商按OpenAI协议发送请求，按textPath/usagePath从响应中提取补全文本和token用量
+ * - 配置maxConcurrent后，超出并发数的请求排队等待，高优先级的请求先出队
+ * - 配置breaker后，连续失败的模型暂时不参与自动选择
+ * - 请求的temperature被限制在[0, maxTemperature]之间，未指定时使用defaultTemperature
+ * - 配置topP后随请求发给模型，0表示使用模型服务的默认值
+ * - FIM模式下配置balanceRatio后，前后缀共用maxPrefix+maxSuffix的预算，按比例以光标为中心截断，一侧不足时余量给另一侧
+ * - 不确定模型服务是否支持原生suffix时可开启suffixProbe，启动时探测一次，不支持则自动改用FIM模式
+ * - 模型服务的响应体超出maxResponseBytes时不再读取，按模型错误处理
+ * - OpenAI兼容服务的字段名不同时，通过requestBody改名或附加请求体字段，不需要新增供应商
+ * - minPrefix限制触发补全的最短前缀，未配置的字段使用wrapper.minPrefix
+ * - maxLines限制补全结果的行数，请求的extra.max_lines只能进一步收紧
+ * - fimStop中的结束符总是作为停用词发送；自动触发或后缀为空时另加空行停用词，disableBlankLineStop可关闭
+ * - 模型服务限制停用词个数时(如OpenAI官方接口最多4个)配置maxStopWords，超出时先丢弃请求中的停用词
  * @example
  * {
  *   "provider": "openai",
@@ -28,29 +46,95 @@ import (
  *   "maxPrefix": 2048,
  *   "maxSuffix": 2048,
  *   "maxOutput": 256,
+ *   "defaultTemperature": 0.2,
+ *   "topP": 0.95,
  *   "fimMode": true,
  *   "fimBegin": "<|fim_prefix|>",
  *   "fimEnd": "<|fim_suffix|>",
  *   "fimHole": "<|fim_middle|>",
- *   "fimStop": ["<|endoftext|>"]
+ *   "fimOrder": "psm",
+ *   "fimStop": ["<|endoftext|>"],
+ *   "tokenizer": {
+ *     "path": "/path/to/model/tokenizer.json"
+ *   }
  * }
  */
 type ModelConfig struct {
-	Provider       string   `json:"provider"`                // 模型供应商，代表着具体的模型接口/类型
-	ModelTitle     string   `json:"modelTitle,omitempty"`    // 模型的标题，方便用户区分不同的模型来源
-	ModelName      string   `json:"modelName"`               // 真实的模型名称
-	CompletionsUrl string   `json:"completionsUrl"`          // 补全地址
-	Tags           []string `json:"tags"`                    // 模型标签，用户可以根据标签选择补全模型
-	Authorization  string   `json:"authorization,omitempty"` // 认证信息
-	Timeout        duration `json:"timeout"`                 // 超时时间ms
-	MaxPrefix      int      `json:"maxPrefix"`               // 最大前缀token数
-	MaxSuffix      int      `json:"maxSuffix"`               // 最大后缀token数
-	MaxOutput      int      `json:"maxOutput"`               // 最大输出token数
-	FimMode        bool     `json:"fimMode,omitempty"`       // 填充FIM标记的模式
-	FimBegin       string   `json:"fimBegin,omitempty"`      // 开始
-	FimEnd         string   `json:"fimEnd,omitempty"`        // 结束
-	FimHole        string   `json:"fimHole,omitempty"`       // 待补全的空洞位置
-	FimStop        []string `json:"fimStop,omitempty"`       // 结束符
+	Provider             string            `json:"provider"`                       // 模型供应商，代表着具体的模型接口/类型
+	ModelTitle           string            `json:"modelTitle,omitempty"`           // 模型的标题，方便用户区分不同的模型来源
+	ModelName            string            `json:"modelName"`                      // 真实的模型名称
+	CompletionsUrl       string            `json:"completionsUrl"`                 // 补全地址
+	Tags                 []string          `json:"tags"`                           // 模型标签，用户可以根据标签选择补全模型
+	Authorization        string            `json:"authorization,omitempty"`        // 认证信息
+	Headers              map[string]string `json:"headers,omitempty"`              // 请求模型服务时附加的HTTP头部，如网关路由需要的X-Tenant
+	Timeout              duration          `json:"timeout"`                        // 超时时间ms
+	MaxPrefix            int               `json:"maxPrefix"`                      // 最大前缀token数
+	MaxSuffix            int               `json:"maxSuffix"`                      // 最大后缀token数
+	MaxOutput            int               `json:"maxOutput"`                      // 最大输出token数
+	FimMode              bool              `json:"fimMode,omitempty"`              // 填充FIM标记的模式
+	FimBegin             string            `json:"fimBegin,omitempty"`             // 开始
+	FimEnd               string            `json:"fimEnd,omitempty"`               // 结束
+	FimHole              string            `json:"fimHole,omitempty"`              // 待补全的空洞位置
+	FimOrder             string            `json:"fimOrder,omitempty"`             // FIM的拼接顺序：psm(默认)或spm
+	FimStop              []string          `json:"fimStop,omitempty"`              // 结束符，作为停用词发送，未配置时为<｜end▁of▁sentence｜>
+	Tokenizer            TokenizerConfig   `json:"tokenizer,omitempty"`            // 模型专用的分词器，未配置时使用全局分词器
+	TextPath             string            `json:"textPath,omitempty"`             // generic供应商：响应中补全文本的路径，如data.output.text，默认choices[0].text
+	UsagePath            string            `json:"usagePath,omitempty"`            // generic供应商：响应中token用量的路径，默认usage
+	MaxConcurrent        int               `json:"maxConcurrent,omitempty"`        // 同时请求模型的最大并发数，超出时按优先级排队，0表示不限制
+	Breaker              BreakerConfig     `json:"breaker,omitempty"`              // 熔断配置
+	DefaultTemperature   float64           `json:"defaultTemperature,omitempty"`   // 请求未指定temperature时使用的温度
+	MaxTemperature       float64           `json:"maxTemperature,omitempty"`       // 允许的最大温度，超出时截断，默认2
+	TopP                 float64           `json:"topP,omitempty"`                 // 核采样概率top_p，0表示不指定
+	BalanceRatio         float64           `json:"balanceRatio,omitempty"`         // FIM模式下前缀(含上下文)占前后缀总预算的比例，0表示前后缀各自截断
+	SuffixProbe          bool              `json:"suffixProbe,omitempty"`          // 启动时探测模型是否支持原生suffix，不支持时切换为FIM模式，需配置FIM标记
+	MaxResponseBytes     int               `json:"maxResponseBytes,omitempty"`     // 模型服务响应体的最大字节数，超出时按模型错误处理，默认1MB
+	RequestBody          RequestBodyConfig `json:"requestBody,omitempty"`          // OpenAI协议请求体的字段改名和附加字段
+	MinPrefix            MinPrefixConfig   `json:"minPrefix,omitempty"`            // 触发补全的最短前缀，非0的字段覆盖wrapper.minPrefix
+	MaxLines             int               `json:"maxLines,omitempty"`             // 补全结果的最大行数，0表示不限制
+	DisableBlankLineStop bool              `json:"disableBlankLineStop,omitempty"` // 不添加"\n\n"等空行停用词
+	MaxStopWords         int               `json:"maxStopWords,omitempty"`         // OpenAI协议请求中停用词的最大个数，0表示不限制
+}
+
+// FIM的拼接顺序(fimOrder)
+const (
+	FimOrderPSM = "psm" // 前缀-后缀-中间：FimBegin + 上下文 + 前缀 + FimHole + 后缀 + FimEnd
+	FimOrderSPM = "spm" // 后缀-前缀-中间：FimBegin + FimHole + 后缀 + FimEnd + 上下文 + 前缀
+)
+
+/**
+ * 模型熔断配置结构体
+ * @description
+ * - 模型连续失败(模型错误、认证失败、限流、超时)达到failures次后熔断，cooldown期间自动选择模型时跳过它
+ * - cooldown结束后恢复选择，再失败一次立即重新熔断，成功一次则完全恢复
+ * - failures为0表示不熔断
+ * @example
+ * {
+ *   "failures": 5,
+ *   "cooldown": "30s"
+ * }
+ */
+type BreakerConfig struct {
+	Failures int      `json:"failures,omitempty"` // 触发熔断的连续失败次数，0表示不熔断
+	Cooldown duration `json:"cooldown,omitempty"` // 熔断持续时间，未配置时为30秒
+}
+
+/**
+ * 请求体定制配置结构体，用于适配字段名不同的OpenAI兼容服务
+ * @description
+ * - 仅对按OpenAI协议发送请求的供应商(openai、generic)生效
+ * - rename把标准字段改名后发送，如max_tokens改为max_new_tokens
+ * - extra中的字段合并到请求体中，如repetition_penalty
+ * - extra中与标准字段(改名后)同名的字段默认被忽略，override为true时覆盖标准字段
+ * @example
+ * {
+ *   "rename": {"max_tokens": "max_new_tokens", "stop": "stop_sequences"},
+ *   "extra": {"repetition_penalty": 1.1}
+ * }
+ */
+type RequestBodyConfig struct {
+	Rename   map[string]string      `json:"rename,omitempty"`   // 标准字段的新名称
+	Extra    map[string]interface{} `json:"extra,omitempty"`    // 合并到请求体中的字段
+	Override bool                   `json:"override,omitempty"` // extra中的字段是否覆盖同名的标准字段
 }
 
 /**
@@ -114,12 +198,71 @@ type DefinitionConfig struct {
 	Url      string `json:"url"`      // 定义查询服务地址
 }
 
+/**
+ * 上下文合并配置结构体，定义了检索片段拼接为补全上下文的方式
+ * @description
+ * - 片段按来源(定义>语义>关系)和检索得分排序，内容相同的片段只保留一个
+ * - 按token预算依次选取最相关的片段，放不下的片段跳过
+ * - token预算 = 模型maxPrefix * budgetRatio，且不超过maxTokens
+ * - 最相关的片段放在最后，即最靠近光标的位置
+ * - 每个片段前加一行来源说明，整体按当前文件的语言注释
+ * @example
+ * {
+ *   "budgetRatio": 0.5,
+ *   "maxTokens": 2048,
+ *   "pathFormat": "Path: %s",
+ *   "separator": "\n"
+ * }
+ */
+type MergeConfig struct {
+	BudgetRatio float64 `json:"budgetRatio,omitempty"` // 上下文token预算占模型maxPrefix的比例，未配置时为0.5
+	MaxTokens   int     `json:"maxTokens,omitempty"`   // 上下文token预算上限，0表示不限制
+	PathFormat  string  `json:"pathFormat,omitempty"`  // 片段来源说明行的格式，%s替换为文件路径，未配置时为"Path: %s"
+	Separator   string  `json:"separator,omitempty"`   // 片段之间的分隔符，未配置时为换行
+}
+
+/**
+ * 客户端片段类别配置结构体
+ * @description
+ * - 控制一类客户端片段是否拼入上下文
+ * - 限制该类片段拼入上下文的token数，未配置时为256
+ */
+type SnippetCategoryConfig struct {
+	Disabled  bool `json:"disabled,omitempty"`  // 是否禁用该类片段
+	MaxTokens int  `json:"maxTokens,omitempty"` // 该类片段的token上限，未配置时为256
+}
+
+/**
+ * 客户端片段配置结构体，定义了请求中prompt_options携带的片段如何拼入上下文
+ * @description
+ * - 分别控制最近编辑、最近浏览、剪贴板、最近打开文件、静态上下文五类片段
+ * - 每类片段可单独禁用，如出于隐私考虑禁用剪贴板内容
+ * - 每类片段单独限制token数，片段按copiedAt从新到旧选取，最新的放在最靠近光标的位置
+ * @example
+ * {
+ *   "clipboard": {"disabled": true},
+ *   "recentlyEdited": {"maxTokens": 512}
+ * }
+ */
+type SnippetsConfig struct {
+	RecentlyEdited  SnippetCategoryConfig `json:"recentlyEdited,omitempty"`  // 最近编辑的代码片段
+	RecentlyVisited SnippetCategoryConfig `json:"recentlyVisited,omitempty"` // 最近浏览的代码片段
+	Clipboard       SnippetCategoryConfig `json:"clipboard,omitempty"`       // 剪贴板内容
+	RecentlyOpened  SnippetCategoryConfig `json:"recentlyOpened,omitempty"`  // 最近打开的文件
+	Static          SnippetCategoryConfig `json:"static,omitempty"`          // 静态上下文
+}
+
 /**
  * 上下文配置结构体，定义了代码补全的上下文获取配置
  * @description
  * - 包含定义查询、语义查询和关系链查询的配置
  * - 设置单个请求的超时时间
  * - 设置整个上下文获取过程的总超时时间
+ * - 设置上下文服务的保活探测间隔，为0时不探测
+ * - 设置检索片段合并为上下文的预算和格式
+ * - 设置客户端片段(最近编辑、剪贴板等)拼入上下文的方式
+ * - 设置所有来源合计的上下文token上限，超出时先丢弃优先级低的来源
+ * - totalTimeout与模型的timeout之和作为整个补全请求的处理时限，模型未配置timeout时不限制
  * - 用于控制代码补全时获取相关代码上下文的行为
  * @example
  * {
@@ -140,15 +283,31 @@ type DefinitionConfig struct {
  *     "includeContent": true
  *   },
  *   "requestTimeout": "5s",
- *   "totalTimeout": "15s"
+ *   "totalTimeout": "15s",
+ *   "keepaliveInterval": "30s",
+ *   "merge": {
+ *     "budgetRatio": 0.5,
+ *     "pathFormat": "Path: %s"
+ *   },
+ *   "snippets": {
+ *     "clipboard": {"disabled": true}
+ *   },
+ *   "overlapThreshold": 0.8,
+ *   "breaker": {"failures": 3, "cooldown": "30s"}
  * }
  */
 type ContextConfig struct {
-	Definition     DefinitionConfig `json:"definition"`     // 定义查询配置
-	Semantic       SemanticConfig   `json:"semantic"`       // 语义相关性查询配置
-	Relation       RelationConfig   `json:"relation"`       // 关系链查询配置
-	RequestTimeout duration         `json:"requestTimeout"` // 单个请求超时时间
-	TotalTimeout   duration         `json:"totalTimeout"`   // 上下文获取总超时时间
+	Definition        DefinitionConfig `json:"definition"`                  // 定义查询配置
+	Semantic          SemanticConfig   `json:"semantic"`                    // 语义相关性查询配置
+	Relation          RelationConfig   `json:"relation"`                    // 关系链查询配置
+	RequestTimeout    duration         `json:"requestTimeout"`              // 单个请求超时时间
+	TotalTimeout      duration         `json:"totalTimeout"`                // 上下文获取总超时时间
+	KeepaliveInterval duration         `json:"keepaliveInterval,omitempty"` // 上下文服务保活探测间隔，0表示不探测
+	Merge             MergeConfig      `json:"merge,omitempty"`             // 检索片段合并配置
+	Snippets          SnippetsConfig   `json:"snippets,omitempty"`          // 客户端片段配置
+	MaxTotalTokens    int              `json:"maxTotalTokens,omitempty"`    // 检索上下文与客户端片段合计的token上限，0表示不限制
+	OverlapThreshold  float64          `json:"overlapThreshold,omitempty"`  // 检索片段与当前文件前后缀的重合度达到该值时丢弃，未配置时为0.8，大于1时不去重
+	Breaker           BreakerConfig    `json:"breaker,omitempty"`           // 各检索来源的熔断配置，连续失败的来源在cooldown期间不再请求
 }
 
 /**
@@ -158,15 +317,33 @@ type ContextConfig struct {
  * - 设置接受补全的最低分数阈值
  * - 用于过滤低质量的补全建议
  * - 分数基于上下文特征计算，如语言类型、光标位置等
+ * - 特征权重和截距可配置，未配置时使用hidden-scores.json或内置默认值
+ * - 计算公式(w为weights，ln为自然对数):
+ *     s = intercept
+ *       + w[0]*上次补全是否被接受(0/1)
+ *       + w[1]*光标后本行是否为空(0/1)
+ *       + w[2]*ln(1+max(3.6, 距上次接受的秒数))
+ *       + w[3]*ln(1+前缀尾行长度)
+ *       + w[4]*ln(1+去除尾部空白后前缀尾行长度)
+ *       + w[5]*ln(1+文档长度)
+ *       + w[6]*ln(1+光标偏移)
+ *       + w[7]*(光标偏移+0.5)/(1+文档长度)
+ *       + w[8+语言序号] + w[29+前缀末字符序号] + w[125+去除尾部空白后前缀末字符序号]
+ *     score = 1/(1+exp(-s))，score低于threshold时拒绝补全
+ * - weights长度不足时，缺失的项不参与计算
  * @example
  * {
  *   "disabled": false,
- *   "threshold": 0.3
+ *   "threshold": 0.3,
+ *   "intercept": -0.3,
+ *   "weights": [0.99, 0.7, -0.17, -0.22, 0.13, -0.007, 0.005, 0.41]
  * }
  */
 type ScoreFilterConfig struct {
-	Disabled  bool    `json:"disabled"`  // 是否禁用隐藏分过滤
-	Threshold float64 `json:"threshold"` // 接受补全的最低分数阈值
+	Disabled  bool      `json:"disabled"`            // 是否禁用隐藏分过滤
+	Threshold float64   `json:"threshold"`           // 接受补全的最低分数阈值
+	Intercept *float64  `json:"intercept,omitempty"` // 截距，未配置时使用默认值
+	Weights   []float64 `json:"weights,omitempty"`   // 特征权重，未配置时使用默认值
 }
 
 /**
@@ -176,6 +353,10 @@ type ScoreFilterConfig struct {
  * - 设置过滤阈值和各种模式匹配规则
  * - 定义最少提示行数和结束标签
  * - 用于判断是否应该触发代码补全
+ * - 光标所在行匹配strPattern(从行首匹配，忽略缩进)时不触发，如import语句
+ * - 前缀非空行数少于minPromptLine时不触发
+ * - 光标左侧是endTag且右侧为空，或光标紧挨在endTag之前时不触发
+ * - 正则表达式在启动时编译，非法时启动失败
  * @example
  * {
  *   "disabled": false,
@@ -199,16 +380,23 @@ type SyntaxFilterConfig struct {
  * @description
  * - 控制是否启用后期修剪功能
  * - 配置使用的修剪工具列表
+ * - 可限制补全结果的token数，修剪之后按分词器截断到干净的边界，不受disabled影响
+ * - normalizeIndentChars开启formatting修剪器的缩进字符换算，把续行的缩进字符(制表符或空格)统一为
+ *   光标行的风格，不调整缩进层级；缩进敏感的语言中换算可能改变代码含义，默认关闭
  * - 用于对补全结果进行后处理，提高质量
  * @example
  * {
  *   "disabled": false,
- *   "pruners": ["deduplication", "formatting", "validation"]
+ *   "pruners": ["deduplication", "formatting", "validation"],
+ *   "maxTokens": 40,
+ *   "normalizeIndentChars": true
  * }
  */
 type PruneConfig struct {
-	Disabled bool     `json:"disabled"` // 是否禁用后期修剪
-	Pruners  []string `json:"pruners"`  // 自定义的后期修剪工具列表
+	Disabled             bool     `json:"disabled"`                       // 是否禁用后期修剪
+	Pruners              []string `json:"pruners"`                        // 自定义的后期修剪工具列表
+	MaxTokens            int      `json:"maxTokens,omitempty"`            // 补全结果的最大token数，0表示不限制
+	NormalizeIndentChars bool     `json:"normalizeIndentChars,omitempty"` // formatting修剪器是否换算续行的缩进字符
 }
 
 /**
@@ -217,13 +405,155 @@ type PruneConfig struct {
  * - 设置分词器文件的路径
  * - 用于代码文本的预处理和tokenization
  * - 是补全模型输入处理的重要组件
+ * - fallback决定全局分词器(wrapper.tokenizer)无法加载时的处理：
+ *   fail(默认)启动失败；estimate记录告警后继续运行，按字符数估算token数并截断提示词
+ * - charsPerToken为没有分词器(或分词超时)时，每个token对应的平均字符数，未配置时为4
  * @example
  * {
- *   "path": "/path/to/tokenizer"
+ *   "path": "/path/to/tokenizer",
+ *   "fallback": "estimate",
+ *   "charsPerToken": 3.5
  * }
  */
 type TokenizerConfig struct {
-	Path string `json:"path"` // 分词器文件路径
+	Path          string  `json:"path"`                    // 分词器文件路径
+	Fallback      string  `json:"fallback,omitempty"`      // 全局分词器无法加载时的处理：fail(默认)或estimate
+	CharsPerToken float64 `json:"charsPerToken,omitempty"` // 按字符估算时每个token的平均字符数
+}
+
+// 全局分词器无法加载时的处理(wrapper.tokenizer.fallback)
+const (
+	TokenizerFallbackFail     = "fail"     // 启动失败
+	TokenizerFallbackEstimate = "estimate" // 按字符数估算token数
+)
+
+/**
+ * 最短前缀配置结构体，定义了触发补全所需的最少前缀长度
+ * @description
+ * - 前缀(去除首尾空白)的字符数少于chars，或token数少于tokens时拒绝补全，拒绝原因为too_short
+ * - 用于减少编辑器在空文件或刚输入一两个字符时触发的无效请求
+ * - wrapper.minPrefix为全局配置，模型的minPrefix中非0的字段覆盖全局配置
+ * - 手动触发(manual)的请求不检查
+ * - 0表示不限制
+ * @example
+ * {
+ *   "chars": 3,
+ *   "tokens": 2
+ * }
+ */
+type MinPrefixConfig struct {
+	Chars  int `json:"chars,omitempty"`  // 前缀的最少字符数
+	Tokens int `json:"tokens,omitempty"` // 前缀的最少token数
+}
+
+/**
+ * 提示词规范化配置结构体，定义了是否把前后缀中的unicode标点转换为ASCII
+ * @description
+ * - 从文档粘贴的代码常含弯引号、不间断空格等字符，会干扰代码模型
+ * - 开启后在发送给模型前把前缀和后缀中的这些字符转换为ASCII等价字符
+ * - 只对languages中列出的语言生效，避免破坏其他语言代码中的非英文字符串
+ * - languages为空时对所有语言生效
+ * - 换行符的统一与上述开关无关，默认开启：提示词统一为\n换行，补全结果还原为文档的主要换行符；
+ *   keepLineEndings开启时原样发给模型，也不转换补全结果
+ * @example
+ * {
+ *   "enabled": true,
+ *   "languages": ["python", "go", "javascript"]
+ * }
+ */
+type NormalizeConfig struct {
+	Enabled         bool     `json:"enabled,omitempty"`         // 是否开启规范化
+	Languages       []string `json:"languages,omitempty"`       // 生效的语言，为空表示所有语言
+	KeepLineEndings bool     `json:"keepLineEndings,omitempty"` // 不统一换行符
+}
+
+/**
+ * 触发方式策略结构体，定义了某种触发方式(trigger_mode)下的补全限制
+ * @description
+ * - timeout限制整个补全请求(含获取上下文)的处理时间，只能比模型自身的超时更短
+ * - maxOutput限制补全结果的token数，只能比模型的maxOutput更小
+ * - 未配置(0)时使用模型自身的配置
+ * @example
+ * {
+ *   "timeout": "1500ms",
+ *   "maxOutput": 64
+ * }
+ */
+type TriggerPolicy struct {
+	Timeout   duration `json:"timeout,omitempty"`   // 补全请求的超时时间
+	MaxOutput int      `json:"maxOutput,omitempty"` // 最大输出token数
+}
+
+/**
+ * 触发方式配置结构体，按请求的trigger_mode区分补全策略
+ * @description
+ * - automatic: 用户输入时自动触发，通常配置更短的超时和更少的输出，并倾向较短的补全
+ * - manual: 用户主动触发，通常使用模型自身较长的超时，总是允许多行补全
+ * - 其他或为空的trigger_mode不受影响
+ * @example
+ * {
+ *   "automatic": {"timeout": "1500ms", "maxOutput": 64},
+ *   "manual": {"timeout": "5s"}
+ * }
+ */
+type TriggerConfig struct {
+	Automatic TriggerPolicy `json:"automatic"` // 自动触发的策略
+	Manual    TriggerPolicy `json:"manual"`    // 手动触发的策略
+}
+
+/**
+ * 影子模型配置结构体，定义了离线对比评估用的影子请求
+ * @description
+ * - 仅在调试模式下生效
+ * - 按sampleRate抽样，把同一请求同时发给影子模型
+ * - 记录主模型和影子模型的输出及耗时，只把主模型的结果返回给客户端
+ * - 影子请求不影响用户请求的耗时和结果
+ * - model为影子模型的modelTitle或modelName，必须是已配置的模型
+ * @example
+ * {
+ *   "model": "deepseek-coder-v2",
+ *   "sampleRate": 0.1,
+ *   "timeout": "5s"
+ * }
+ */
+type ShadowConfig struct {
+	Model      string   `json:"model,omitempty"`      // 影子模型的modelTitle或modelName，为空表示不启用
+	SampleRate float64  `json:"sampleRate,omitempty"` // 抽样比例，0~1
+	Timeout    duration `json:"timeout,omitempty"`    // 影子请求超时时间，未配置时使用影子模型自身的超时
+}
+
+/**
+ * 拒绝样本日志配置结构体，定义了被过滤器拒绝的请求的抽样记录
+ * @description
+ * - 用于调整syntax/score过滤器的阈值和规则，检查哪些请求被拒绝
+ * - 按sampleRate抽样，被拒绝的请求单独记录一条日志(logger名为rejected)，与正常补全的访问日志分开
+ * - 只记录拒绝原因和光标所在行，不记录完整的前后缀
+ * - 光标行按server.logPromptContent脱敏
+ * @example
+ * {
+ *   "sampleRate": 0.01
+ * }
+ */
+type RejectLogConfig struct {
+	SampleRate float64 `json:"sampleRate,omitempty"` // 抽样比例，0~1，为0表示不记录
+}
+
+/**
+ * 负结果缓存配置结构体，定义了被拒绝和结果为空的请求的短期缓存
+ * @description
+ * - 同一上下文的拒绝和空结果是确定的，编辑器停顿时反复发起的相同请求直接返回缓存的结果
+ * - 命中缓存时不再执行过滤器，也不调用模型
+ * - 每个客户端的每个文件只缓存最近一次的负结果，上下文发生变化(编辑)时即失效
+ * - ttl为0表示不启用
+ * @example
+ * {
+ *   "ttl": "2s",
+ *   "maxEntries": 4096
+ * }
+ */
+type NegativeCacheConfig struct {
+	TTL        duration `json:"ttl,omitempty"`        // 负结果的缓存时长，为0表示不启用
+	MaxEntries int      `json:"maxEntries,omitempty"` // 最多缓存的条目数，默认1024
 }
 
 /**
@@ -233,6 +563,14 @@ type TokenizerConfig struct {
  * - 包含语法过滤器的配置，用于语法判断
  * - 包含后期修剪的配置，用于结果优化
  * - 包含分词器的配置，用于文本预处理
+ * - 包含影子模型的配置，用于调试模式下对比评估模型
+ * - 包含提示词规范化的配置，用于转换unicode标点
+ * - 包含触发方式的配置，用于区分自动触发和手动触发的补全策略
+ * - 包含拒绝样本日志的配置，用于调整过滤器
+ * - 包含负结果缓存的配置，用于快速返回重复的拒绝和空结果
+ * - 包含extra透传字段的白名单，用于按请求调整模型参数(如seed、logit_bias)；未配置时不透传
+ * - 包含触发补全的最短前缀，用于拒绝编辑器过于频繁的触发
+ * - 包含提示词的最大字节数，用于在分词之前拒绝过大的请求
  * - 用于控制补全请求的前后处理流程
  * @example
  * {
@@ -254,14 +592,162 @@ type TokenizerConfig struct {
  *   },
  *   "tokenizer": {
  *     "path": "/path/to/tokenizer"
+ *   },
+ *   "minPrefix": {
+ *     "chars": 3
  *   }
  * }
  */
 type WrapperConfig struct {
-	Score     ScoreFilterConfig  `json:"score"`     // 隐藏分过滤器配置
-	Syntax    SyntaxFilterConfig `json:"syntax"`    // 语法过滤器配置
-	Prune     PruneConfig        `json:"prune"`     // 后期修剪配置
-	Tokenizer TokenizerConfig    `json:"tokenizer"` // 分词器配置
+	Score          ScoreFilterConfig   `json:"score"`                    // 隐藏分过滤器配置
+	Syntax         SyntaxFilterConfig  `json:"syntax"`                   // 语法过滤器配置
+	Prune          PruneConfig         `json:"prune"`                    // 后期修剪配置
+	Tokenizer      TokenizerConfig     `json:"tokenizer"`                // 分词器配置
+	Shadow         ShadowConfig        `json:"shadow"`                   // 影子模型配置
+	Normalize      NormalizeConfig     `json:"normalize"`                // 提示词规范化配置
+	Trigger        TriggerConfig       `json:"trigger"`                  // 触发方式配置
+	RejectLog      RejectLogConfig     `json:"rejectLog"`                // 拒绝样本日志配置
+	NegativeCache  NegativeCacheConfig `json:"negativeCache"`            // 负结果缓存配置
+	Passthrough    []string            `json:"passthrough"`              // 允许客户端通过extra透传给模型的请求体字段，"*"表示任意字段
+	MinPrefix      MinPrefixConfig     `json:"minPrefix"`                // 触发补全的最短前缀
+	MaxPromptBytes int                 `json:"maxPromptBytes,omitempty"` // 前后缀和客户端片段的合计字节数上限，0表示默认1MiB，负数表示不限制
+}
+
+/**
+ * 接口认证配置结构体，定义了访问服务接口所需的API Key
+ * @description
+ * - 配置了keys时，请求必须携带"Authorization: Bearer <key>"头部，否则返回401
+ * - 未配置keys时不做认证，仅适合只监听本机的部署
+ * - /healthz和/metrics不需要认证
+ * - key支持{{.Env.XXX}}等模板，便于从环境变量注入
+ * @example
+ * {
+ *   "keys": ["sk-team-a", "sk-team-b"]
+ * }
+ */
+type APIKeyConfig struct {
+	Keys []string `json:"keys,omitempty"` // 允许访问的API Key列表，为空表示不认证
+}
+
+/**
+ * 补全请求限流配置结构体，按client_id使用令牌桶限流
+ * @description
+ * - 每个client_id一个令牌桶，按rate匀速补充令牌，最多积累burst个
+ * - 请求体和X-Client-ID头部都没有client_id的请求共用一个令牌桶
+ * - 超出限制的请求返回rateLimited状态，HTTP状态码429
+ * - rate为0表示不限流
+ * - 被拒绝的请求按client_id计入指标；配置metricClients时只有其中的客户端单独计数，
+ *   未配置时最先被限流的若干个客户端单独计数，其余客户端合并为other，避免标签基数无限增长
+ * @example
+ * {
+ *   "rate": 5,
+ *   "burst": 10,
+ *   "metricClients": ["vscode-team-a", "jetbrains-team-b"]
+ * }
+ */
+type RateLimitConfig struct {
+	Rate          float64  `json:"rate,omitempty"`          // 每个客户端每秒允许的请求数，0表示不限流
+	Burst         int      `json:"burst,omitempty"`         // 令牌桶容量，即允许的突发请求数，默认取rate向上取整
+	MetricClients []string `json:"metricClients,omitempty"` // 在限流指标中单独计数的client_id，其余计入other
+}
+
+/**
+ * Prometheus指标配置结构体
+ * @description
+ * - durationBuckets为completion_durations和completion_first_token_duration的桶上界，单位毫秒
+ * - 桶必须为正数且严格递增，未配置时使用覆盖50ms~10s的默认桶
+ * @example
+ * {
+ *   "durationBuckets": [100, 250, 500, 1000, 2500, 5000, 10000]
+ * }
+ */
+type MetricsConfig struct {
+	DurationBuckets []float64 `json:"durationBuckets,omitempty"` // 耗时分布指标的桶(毫秒)
+}
+
+/**
+ * 就绪检查配置结构体
+ * @description
+ * - /readyz并发向每个模型发送max_tokens为1的试补全，timeout为每个模型的超时时间，默认3秒
+ * - 检查结果缓存cacheTTL，避免负载均衡器频繁探测时反复调用模型，默认5秒
+ * @example
+ * {
+ *   "timeout": "3s",
+ *   "cacheTTL": "5s"
+ * }
+ */
+type ReadyConfig struct {
+	Timeout  duration `json:"timeout,omitempty"`  // 每个模型试补全的超时时间
+	CacheTTL duration `json:"cacheTTL,omitempty"` // 检查结果的缓存时长
+}
+
+// 补全响应中created的格式(server.createdFormat)
+const (
+	CreatedFormatEpoch   = "epoch"   // 秒级时间戳，如1700000000
+	CreatedFormatRFC3339 = "rfc3339" // RFC3339格式的字符串，如"2023-11-14T22:13:20Z"
+)
+
+/**
+ * 服务配置结构体，定义了HTTP服务自身的行为
+ * @description
+ * - 设置受信任的代理地址，用于从X-Forwarded-For等头部提取真实客户端IP
+ * - 仅当请求直接来自受信任代理时才采信转发头部，防止客户端伪造IP
+ * - 未配置时仅信任本机回环地址
+ * - 日志中的代码及提示词内容默认脱敏，开启logPromptContent后记录原文
+ * - 限制同时存在的流式连接数，超出时返回503
+ * - 模型正常响应但没有给出建议时，默认返回200及noSuggestion状态，可配置为204(无响应体)
+ * - 配置API Key后，接口需要认证才能访问
+ * - 按client_id限制补全请求频率，超出时返回429
+ * - 补全响应中的created默认为秒级时间戳，可配置为RFC3339格式的字符串
+ * - 补全响应默认在X-Completion-Id和X-Completion-Status头部中回显completion_id和状态，便于不解析响应体的代理关联请求
+ * - 耗时分布指标的桶可按部署调整
+ * - /readyz探测各模型是否可达，全部不可达时返回503，/healthz只用于存活检查
+ * - 限制请求体的字节数，超出时返回413，默认8MiB
+ * - 批量补全接口限制每批的请求数和并发处理数
+ * @example
+ * {
+ *   "trustedProxies": ["127.0.0.1", "10.0.0.0/8"],
+ *   "logPromptContent": false,
+ *   "maxStreams": 64,
+ *   "noSuggestionStatus": 204,
+ *   "auth": {"keys": ["sk-team-a"]},
+ *   "rateLimit": {"rate": 5, "burst": 10},
+ *   "createdFormat": "epoch",
+ *   "metrics": {"durationBuckets": [100, 250, 500, 1000, 2500, 5000, 10000]},
+ *   "ready": {"timeout": "3s", "cacheTTL": "5s"},
+ *   "maxBodyBytes": 8388608,
+ *   "batch": {"maxItems": 100, "concurrency": 4}
+ * }
+ */
+type ServerConfig struct {
+	TrustedProxies     []string        `json:"trustedProxies,omitempty"`     // 受信任的代理地址(IP或CIDR)，默认仅信任回环地址
+	LogPromptContent   bool            `json:"logPromptContent,omitempty"`   // 是否在日志中记录代码及提示词原文
+	MaxStreams         int             `json:"maxStreams,omitempty"`         // 同时存在的流式连接数上限，0表示不限制
+	NoSuggestionStatus int             `json:"noSuggestionStatus,omitempty"` // 模型没有给出建议时的HTTP状态码：200(默认)或204
+	Auth               APIKeyConfig    `json:"auth,omitempty"`               // 接口认证配置
+	RateLimit          RateLimitConfig `json:"rateLimit,omitempty"`          // 按client_id的补全请求限流配置
+	CreatedFormat      string          `json:"createdFormat,omitempty"`      // 响应中created的格式：epoch(默认)或rfc3339
+	DisableEchoHeaders bool            `json:"disableEchoHeaders,omitempty"` // 不在响应头部中回显completion_id和状态
+	Metrics            MetricsConfig   `json:"metrics,omitempty"`            // Prometheus指标配置
+	Ready              ReadyConfig     `json:"ready,omitempty"`              // /readyz就绪检查配置
+	MaxBodyBytes       int64           `json:"maxBodyBytes,omitempty"`       // 请求体的最大字节数，0表示默认8MiB，负数表示不限制
+	Batch              BatchConfig     `json:"batch,omitempty"`              // 批量补全接口配置
+}
+
+/**
+ * 批量补全接口配置结构体
+ * @description
+ * - maxItems限制每批的请求数，超出时整批返回400，默认100
+ * - concurrency限制同一批中同时处理的请求数，默认4
+ * @example
+ * {
+ *   "maxItems": 100,
+ *   "concurrency": 4
+ * }
+ */
+type BatchConfig struct {
+	MaxItems    int `json:"maxItems,omitempty"`    // 每批的最大请求数
+	Concurrency int `json:"concurrency,omitempty"` // 同一批中同时处理的请求数
 }
 
 /**
@@ -270,6 +756,8 @@ type WrapperConfig struct {
  * - 包含所有AI模型的配置列表
  * - 包含上下文获取的相关配置
  * - 包含补全前后处理的过滤器配置
+ * - 包含HTTP服务自身的配置
+ * - 严格模式下，模型供应商未知时初始化失败，而不是回退到默认供应商
  * - 是应用程序的主要配置结构
  * @example
  * {
@@ -332,13 +820,19 @@ type WrapperConfig struct {
  *     "tokenizer": {
  *       "path": "/path/to/tokenizer"
  *     }
- *   }
+ *   },
+ *   "server": {
+ *     "trustedProxies": ["127.0.0.1", "::1"]
+ *   },
+ *   "strictProvider": false
  * }
  */
 type SoftwareConfig struct {
-	Models  []ModelConfig `json:"models"`  // AI模型配置列表
-	Context ContextConfig `json:"context"` // 上下文获取配置
-	Wrapper WrapperConfig `json:"wrapper"` // 补全前后处理配置
+	Models         []ModelConfig `json:"models"`                   // AI模型配置列表
+	Context        ContextConfig `json:"context"`                  // 上下文获取配置
+	Wrapper        WrapperConfig `json:"wrapper"`                  // 补全前后处理配置
+	Server         ServerConfig  `json:"server"`                   // HTTP服务配置
+	StrictProvider bool          `json:"strictProvider,omitempty"` // 严格模式：模型供应商未知时报错，不回退到默认供应商
 }
 
 /**
@@ -420,41 +914,57 @@ func (d duration) Duration() time.Duration {
 var Config *SoftwareConfig
 var Context *ContextConfig
 var Wrapper *WrapperConfig
+var Server *ServerConfig
+
+// 尚未调用LoadConfig加载配置
+var ErrNotLoaded = errors.New("config is not loaded")
+
+/**
+ * 获取已加载的配置
+ * @returns {*SoftwareConfig, error} 返回已加载的配置，尚未加载时返回ErrNotLoaded
+ * @description
+ * - 供库调用方和测试使用，配置未加载时不会退出进程
+ * - 是否因配置未加载而退出由main决定
+ * @example
+ * cfg, err := ConfigOrError()
+ * if err != nil {
+ *     return err
+ * }
+ */
+func ConfigOrError() (*SoftwareConfig, error) {
+	if Config == nil {
+		return nil, ErrNotLoaded
+	}
+	return Config, nil
+}
 
 /**
  * 获取costrict目录结构设定
  * @returns {string} 返回costrict配置目录的完整路径
  * @description
- * - 获取用户主目录路径
- * - 在用户主目录下创建.costrict子目录
+ * - 设置了COSTRICT_DIR环境变量时使用该目录
+ * - 否则为用户主目录下的.costrict子目录
  * - 用于存储配置文件和相关数据
- * - 如果获取用户主目录失败，返回当前目录
+ * - 如果获取用户主目录失败，返回当前目录下的.costrict
  * @example
  * dir := getCostrictDir()
  * // 返回类似: "C:\\Users\\username\\.costrict" (Windows)
  * // 或 "/home/username/.costrict" (Linux/Mac)
  */
 func getCostrictDir() string {
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		homeDir = "."
-	}
-	return filepath.Join(homeDir, ".costrict")
+	return env.GetCostrictDir()
 }
 
 /**
  * 加载本地配置
  * @returns {*SoftwareConfig, error} 返回加载的配置对象和错误，成功时错误为nil
  * @description
- * - 构建配置文件的完整路径
- * - 读取配置文件内容
- * - 将JSON内容反序列化为SoftwareConfig对象
- * - 对配置进行本地化处理
- * - 打印配置信息用于调试
+ * - 从COMPLETION_AGENT_CONFIG环境变量指定的路径加载配置，未设置时使用默认路径~/.costrict/config/completion-agent.json
  * - 用于从本地文件加载应用程序配置
  * @throws
  * - 读取文件失败时返回错误
  * - JSON反序列化失败时返回错误
+ * - 模板字符串无法解析或执行时返回错误
  * @example
  * config, err := loadLocalConfig()
  * if err != nil {
@@ -462,28 +972,109 @@ func getCostrictDir() string {
  * }
  */
 func loadLocalConfig() (*SoftwareConfig, error) {
-	fname := filepath.Join(getCostrictDir(), "config", "completion-agent.json")
+	return loadConfigFile(env.GetConfigPath())
+}
 
+// loadConfigFile 读取并解析指定路径的配置文件，合并同目录下config.d中的覆盖配置
+func loadConfigFile(fname string) (*SoftwareConfig, error) {
 	bytes, err := os.ReadFile(fname)
 	if err != nil {
-		return nil, fmt.Errorf("load 'completion-agent.json' failed: %v", err)
+		return nil, fmt.Errorf("load '%s' failed: %v", fname, err)
+	}
+	bytes, err = mergeOverrideDir(bytes, fname, filepath.Join(filepath.Dir(fname), overrideDirName))
+	if err != nil {
+		return nil, err
 	}
+	return parseConfig(bytes, fname)
+}
+
+/**
+ * 解析配置内容
+ * @param {[]byte} data - JSON格式的配置内容
+ * @param {string} source - 配置来源，用于错误信息
+ * @returns {*SoftwareConfig, error} 返回解析并本地化后的配置对象
+ * @description
+ * - 将JSON内容反序列化为SoftwareConfig对象
+ * - 对配置进行本地化处理
+ * - 打印配置信息用于调试
+ */
+func parseConfig(data []byte, source string) (*SoftwareConfig, error) {
 	var c SoftwareConfig
-	if err := json.Unmarshal(bytes, &c); err != nil {
-		return nil, fmt.Errorf("unmarshal 'completion-agent.json' failed: %v", err)
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("unmarshal '%s' failed: %v", source, err)
+	}
+	if err := localize(&c); err != nil {
+		return nil, fmt.Errorf("localize '%s' failed: %v", source, err)
 	}
-	localize(&c)
 	fmt.Printf("Config: %+v", &c)
 	return &c, nil
 }
 
+// setConfig 设置全局配置及各部分配置的引用
+func setConfig(cfg *SoftwareConfig) {
+	Config = cfg
+	Context = &cfg.Context
+	Wrapper = &cfg.Wrapper
+	Server = &cfg.Server
+}
+
+/**
+ * 从指定路径加载配置
+ * @param {string} path - 配置文件路径，为空时与LoadConfig相同，优先使用COMPLETION_AGENT_CONFIG环境变量
+ * @returns {error} 返回加载过程中的错误，成功返回nil
+ * @description
+ * - 与LoadConfig的解析和本地化流程相同，同样合并该文件所在目录下config.d中的覆盖配置
+ * - 总是重新加载并替换已加载的配置
+ * - 用于配置文件挂载在其他位置的容器化部署
+ * @example
+ * if err := LoadConfigFromFile("/etc/completion-agent/config.json"); err != nil {
+ *     log.Fatalf("程序启动失败: %v", err)
+ * }
+ */
+func LoadConfigFromFile(path string) error {
+	if path == "" {
+		path = env.GetConfigPath()
+	}
+	cfg, err := loadConfigFile(path)
+	if err != nil {
+		return err
+	}
+	setConfig(cfg)
+	return nil
+}
+
+/**
+ * 从io.Reader加载配置
+ * @param {io.Reader} r - JSON格式的配置内容
+ * @returns {error} 返回读取或解析过程中的错误，成功返回nil
+ * @description
+ * - 与LoadConfig的解析和本地化流程相同
+ * - 总是重新加载并替换已加载的配置
+ * - 用于测试中直接从内存加载配置
+ * @example
+ * err := LoadConfigFromReader(strings.NewReader(`{"models": [...]}`))
+ */
+func LoadConfigFromReader(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("read config failed: %v", err)
+	}
+	cfg, err := parseConfig(data, "config")
+	if err != nil {
+		return err
+	}
+	setConfig(cfg)
+	return nil
+}
+
 /**
  * 加载本地配置（单例模式）
  * @returns {error} 返回加载过程中的错误，成功返回nil
  * @description
  * - 检查全局配置对象是否已初始化
  * - 如果已初始化，直接返回nil
- * - 否则加载本地配置文件
+ * - 否则加载本地配置文件，路径可由COMPLETION_AGENT_CONFIG环境变量指定
+ * - 配置文件所在目录下存在config.d时，按文件名顺序合并其中的*.json覆盖配置
  * - 记录配置加载失败的日志信息
  * - 用于应用程序启动时加载配置
  * @throws
@@ -503,8 +1094,6 @@ func LoadConfig() error {
 		log.Printf("Load failed: %v", err)
 		return err
 	}
-	Config = cfg
-	Context = &cfg.Context
-	Wrapper = &cfg.Wrapper
+	setConfig(cfg)
 	return nil
 }
@@ -2,14 +2,11 @@ package config
 
 import (
 	"bytes"
-	"completion-agent/pkg/logger"
 	"encoding/json"
 	"fmt"
 	"html/template"
 	"os"
 	"path/filepath"
-
-	"go.uber.org/zap"
 )
 
 var CostrictDir string = getCostrictDir()
@@ -83,51 +80,68 @@ func getCodebaseUrl() string {
 /**
  * Localize configuration by processing template strings
  * @param {SoftwareConfig} cfg - Software configuration to localize
+ * @returns {error} Returns the first template error, fields after it are left unchanged
  * @description
  * - Processes tokenizer path template in wrapper configuration
  * - Localizes context URLs (definition, relation, semantic)
- * - Processes model authorization and completion URL templates
+ * - Processes model authorization, completion URL, custom header and tokenizer path templates
  * - Applies environment-specific values to template strings
  * @example
- * localize(config)
+ * if err := localize(config); err != nil {
+ *     return err
+ * }
  * // config fields will be updated with localized values
  */
-func localize(cfg *SoftwareConfig) {
-	cfg.Wrapper.Tokenizer.Path = localizeString(cfg.Wrapper.Tokenizer.Path)
-	cfg.Context.Definition.Url = localizeString(cfg.Context.Definition.Url)
-	cfg.Context.Relation.Url = localizeString(cfg.Context.Relation.Url)
-	cfg.Context.Semantic.Url = localizeString(cfg.Context.Semantic.Url)
+func localize(cfg *SoftwareConfig) error {
+	var err error
+	loc := func(s string) string {
+		if err != nil {
+			return s
+		}
+		s, err = localizeString(s)
+		return s
+	}
+	cfg.Wrapper.Tokenizer.Path = loc(cfg.Wrapper.Tokenizer.Path)
+	cfg.Context.Definition.Url = loc(cfg.Context.Definition.Url)
+	cfg.Context.Relation.Url = loc(cfg.Context.Relation.Url)
+	cfg.Context.Semantic.Url = loc(cfg.Context.Semantic.Url)
+	for i, key := range cfg.Server.Auth.Keys {
+		cfg.Server.Auth.Keys[i] = loc(key)
+	}
 	for i, c := range cfg.Models {
-		cfg.Models[i].Authorization = localizeString(c.Authorization)
-		cfg.Models[i].CompletionsUrl = localizeString(c.CompletionsUrl)
+		cfg.Models[i].Authorization = loc(c.Authorization)
+		cfg.Models[i].CompletionsUrl = loc(c.CompletionsUrl)
+		cfg.Models[i].Tokenizer.Path = loc(c.Tokenizer.Path)
+		for k, v := range c.Headers {
+			cfg.Models[i].Headers[k] = loc(v)
+		}
 	}
+	return err
 }
 
 /**
  * Localize a template string using global environment variables
  * @param {string} s - Template string to localize
- * @returns {string} Returns localized string or original string if parsing fails
+ * @returns {string, error} Returns localized string, or original string and error if template processing fails
  * @description
  * - Parses input string as Go template
  * - Executes template with global environment variables
  * - Supports environment and authentication variables
- * - Logs fatal error and returns original string if template processing fails
+ * - The template itself is not included in the error, as it may contain credentials
  * @example
- * localized := localizeString("{{.Env.CostrictDir}}/path")
+ * localized, err := localizeString("{{.Env.CostrictDir}}/path")
  * // localized will be "/actual/path/path"
  */
-func localizeString(s string) string {
+func localizeString(s string) (string, error) {
 	tpl, err := template.New("config").Parse(s)
 	if err != nil {
-		logger.Fatal("failed to parse template", zap.Error(err))
-		return s
+		return s, fmt.Errorf("failed to parse template: %v", err)
 	}
 
 	var sBuf bytes.Buffer
 	if err := tpl.Execute(&sBuf, globalEnv); err != nil {
-		logger.Fatal("failed to execute template", zap.Error(err))
-		return s
+		return s, fmt.Errorf("failed to execute template: %v", err)
 	}
 
-	return sBuf.String()
+	return sBuf.String(), nil
 }
@@ -0,0 +1,95 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"completion-agent/pkg/env"
+)
+
+func Test_LocalizeError(t *testing.T) {
+	cfg := SoftwareConfig{Models: []ModelConfig{{CompletionsUrl: "{{.Env.CostrictDir}}/v1"}}}
+	if err := localize(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Models[0].CompletionsUrl != getCostrictDir()+"/v1" {
+		t.Fatalf("completionsUrl = %q", cfg.Models[0].CompletionsUrl)
+	}
+
+	// 模板错误返回错误而不是退出进程，错误中不包含模板原文
+	cfg = SoftwareConfig{Models: []ModelConfig{{Authorization: "Bearer sk-secret {{.Auth"}}}
+	err := localize(&cfg)
+	if err == nil {
+		t.Fatal("expected template error")
+	}
+	if cfg.Models[0].Authorization != "Bearer sk-secret {{.Auth" {
+		t.Fatalf("authorization changed on error: %q", cfg.Models[0].Authorization)
+	}
+	if strings.Contains(err.Error(), "sk-secret") {
+		t.Fatalf("error leaks template: %v", err)
+	}
+}
+
+func Test_ConfigOrError(t *testing.T) {
+	saved := Config
+	defer func() { Config = saved }()
+
+	Config = nil
+	if cfg, err := ConfigOrError(); cfg != nil || !errors.Is(err, ErrNotLoaded) {
+		t.Fatalf("ConfigOrError = %v, %v, want ErrNotLoaded", cfg, err)
+	}
+	Config = &SoftwareConfig{}
+	if cfg, err := ConfigOrError(); cfg != Config || err != nil {
+		t.Fatalf("ConfigOrError = %v, %v", cfg, err)
+	}
+}
+
+func Test_LoadConfigFromReader(t *testing.T) {
+	saved, savedContext, savedWrapper, savedServer := Config, Context, Wrapper, Server
+	defer func() { Config, Context, Wrapper, Server = saved, savedContext, savedWrapper, savedServer }()
+
+	if err := LoadConfigFromReader(strings.NewReader(`{"models": [{"modelName": "m1"}], "server": {"maxStreams": 3}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if len(Config.Models) != 1 || Config.Models[0].ModelName != "m1" || Server.MaxStreams != 3 || Server != &Config.Server {
+		t.Fatalf("unexpected config: %+v", Config)
+	}
+	if err := LoadConfigFromReader(strings.NewReader(`{"models": `)); err == nil {
+		t.Fatal("expected error for invalid json")
+	}
+
+	path := filepath.Join(t.TempDir(), "agent.json")
+	if err := os.WriteFile(path, []byte(`{"models": [{"modelName": "m2"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadConfigFromFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if Config.Models[0].ModelName != "m2" {
+		t.Fatalf("unexpected config: %+v", Config)
+	}
+	if err := LoadConfigFromFile(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Fatal("expected error for missing file")
+	}
+}
+
+func Test_LoadConfigFromEnv(t *testing.T) {
+	saved, savedContext, savedWrapper, savedServer := Config, Context, Wrapper, Server
+	defer func() { Config, Context, Wrapper, Server = saved, savedContext, savedWrapper, savedServer }()
+
+	path := filepath.Join(t.TempDir(), "agent.json")
+	if err := os.WriteFile(path, []byte(`{"models": [{"modelName": "from-env"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(env.ConfigPathEnv, path)
+	Config = nil
+	if err := LoadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if Config.Models[0].ModelName != "from-env" {
+		t.Fatalf("unexpected config: %+v", Config)
+	}
+}
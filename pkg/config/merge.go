@@ -0,0 +1,120 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// 覆盖配置目录名，位于配置文件所在目录下
+const overrideDirName = "config.d"
+
+/**
+ * 合并覆盖配置目录中的配置文件
+ * @param {[]byte} base - 主配置文件的内容
+ * @param {string} source - 主配置文件路径，用于错误信息
+ * @param {string} dir - 覆盖配置目录
+ * @returns {[]byte, error} 返回合并后的配置内容，目录不存在或没有*.json文件时原样返回
+ * @description
+ * - 按文件名顺序依次合并目录中的*.json文件，后合并的文件优先
+ * - 对象逐个键递归合并，覆盖文件中没有的键保持不变
+ * - 数组和标量整体替换，null表示恢复为默认值
+ * - 顶层models按modelTitle合并：同名模型递归合并，其他模型按顺序追加在末尾
+ * @example
+ * // config.d/10-host.json: {"models": [{"modelTitle": "DeepSeek", "authorization": "Bearer sk-host"}]}
+ * // 只修改DeepSeek模型的authorization，其余字段和其他模型不变
+ */
+func mergeOverrideDir(base []byte, source, dir string) ([]byte, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil || len(files) == 0 {
+		return base, nil
+	}
+	merged, err := decodeObject(base)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal '%s' failed: %v", source, err)
+	}
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("load '%s' failed: %v", f, err)
+		}
+		override, err := decodeObject(data)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal '%s' failed: %v", f, err)
+		}
+		for k, v := range override {
+			if k == "models" {
+				merged[k] = mergeModels(merged[k], v)
+			} else {
+				merged[k] = mergeValue(merged[k], v)
+			}
+		}
+		log.Printf("Merged config override '%s'", f)
+	}
+	return json.Marshal(merged)
+}
+
+// decodeObject 解析JSON对象，数字保留原文，避免大整数丢失精度
+func decodeObject(data []byte) (map[string]interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var obj map[string]interface{}
+	if err := d.Decode(&obj); err != nil {
+		return nil, err
+	}
+	if obj == nil {
+		obj = map[string]interface{}{}
+	}
+	return obj, nil
+}
+
+// mergeValue 对象递归合并，其他类型以覆盖值为准
+func mergeValue(base, override interface{}) interface{} {
+	bm, ok := base.(map[string]interface{})
+	om, ok2 := override.(map[string]interface{})
+	if !ok || !ok2 {
+		return override
+	}
+	for k, v := range om {
+		bm[k] = mergeValue(bm[k], v)
+	}
+	return bm
+}
+
+// mergeModels 按modelTitle合并模型列表，没有modelTitle或不存在同名模型时追加
+func mergeModels(base, override interface{}) interface{} {
+	bs, ok := base.([]interface{})
+	overrides, ok2 := override.([]interface{})
+	if !ok || !ok2 {
+		return override
+	}
+	for _, o := range overrides {
+		if i := indexModel(bs, modelTitleOf(o)); i >= 0 {
+			bs[i] = mergeValue(bs[i], o)
+		} else {
+			bs = append(bs, o)
+		}
+	}
+	return bs
+}
+
+func modelTitleOf(v interface{}) string {
+	m, _ := v.(map[string]interface{})
+	title, _ := m["modelTitle"].(string)
+	return title
+}
+
+func indexModel(models []interface{}, title string) int {
+	if title == "" {
+		return -1
+	}
+	for i, m := range models {
+		if modelTitleOf(m) == title {
+			return i
+		}
+	}
+	return -1
+}
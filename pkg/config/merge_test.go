@@ -0,0 +1,63 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_MergeOverrideDir(t *testing.T) {
+	saved, savedContext, savedWrapper, savedServer := Config, Context, Wrapper, Server
+	defer func() { Config, Context, Wrapper, Server = saved, savedContext, savedWrapper, savedServer }()
+
+	dir := t.TempDir()
+	write := func(name, content string) {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("agent.json", `{
+		"models": [
+			{"modelTitle": "A", "modelName": "a", "authorization": "Bearer base", "tags": ["fast", "code"], "maxOutput": 64},
+			{"modelTitle": "B", "modelName": "b", "authorization": "Bearer b"}
+		],
+		"server": {"maxStreams": 8, "trustedProxies": ["127.0.0.1", "10.0.0.0/8"], "rateLimit": {"rate": 5, "burst": 10}}
+	}`)
+	// 按文件名顺序合并，20-host.json在10-team.json之后
+	write("config.d/20-host.json", `{
+		"models": [{"modelTitle": "A", "authorization": "Bearer host"}],
+		"server": {"rateLimit": {"burst": 20}}
+	}`)
+	write("config.d/10-team.json", `{
+		"models": [{"modelTitle": "A", "authorization": "Bearer team", "tags": ["slow"]}, {"modelTitle": "C", "modelName": "c"}],
+		"server": {"trustedProxies": ["192.168.0.1"]}
+	}`)
+	write("config.d/notes.txt", `not json`)
+
+	if err := LoadConfigFromFile(filepath.Join(dir, "agent.json")); err != nil {
+		t.Fatal(err)
+	}
+	if len(Config.Models) != 3 {
+		t.Fatalf("got %d models, want 3", len(Config.Models))
+	}
+	a := Config.Models[0]
+	// 只修改authorization，其余字段保持不变；数组整体替换
+	if a.ModelName != "a" || a.Authorization != "Bearer host" || a.MaxOutput != 64 || len(a.Tags) != 1 || a.Tags[0] != "slow" {
+		t.Fatalf("unexpected model A: %+v", a)
+	}
+	if Config.Models[1].Authorization != "Bearer b" || Config.Models[2].ModelName != "c" {
+		t.Fatalf("unexpected models: %+v", Config.Models)
+	}
+	s := Config.Server
+	if s.MaxStreams != 8 || s.RateLimit.Rate != 5 || s.RateLimit.Burst != 20 || len(s.TrustedProxies) != 1 {
+		t.Fatalf("unexpected server config: %+v", s)
+	}
+
+	write("config.d/30-bad.json", `{"models": `)
+	if err := LoadConfigFromFile(filepath.Join(dir, "agent.json")); err == nil {
+		t.Fatal("expected error for invalid override file")
+	}
+}
@@ -5,18 +5,61 @@ import (
 	"path/filepath"
 )
 
+// 覆盖默认路径的环境变量
+const (
+	CostrictDirEnv = "COSTRICT_DIR"             // .costrict基础目录
+	ConfigPathEnv  = "COMPLETION_AGENT_CONFIG"  // 配置文件路径
+	LogDirEnv      = "COMPLETION_AGENT_LOG_DIR" // 日志目录
+)
+
 /**
  * Get costrict directory path
  * @returns {string} Returns costrict directory path
  * @description
- * - 获取用户主目录下的.costrict目录路径
+ * - 设置了COSTRICT_DIR环境变量时使用该目录
+ * - 否则获取用户主目录下的.costrict目录路径
  * - 在Windows系统下为%USERPROFILE%/.costrict
  * - 在Linux/macOS系统下为$HOME/.costrict
+ * - 获取用户主目录失败时使用当前目录下的.costrict
  * - 用于存储应用配置文件和日志
  */
 func GetCostrictDir() string {
-	homeDir, _ := os.UserHomeDir()
+	if dir := os.Getenv(CostrictDirEnv); dir != "" {
+		return dir
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		homeDir = "."
+	}
 	return filepath.Join(homeDir, ".costrict")
 }
 
+/**
+ * Get log directory path
+ * @returns {string} Returns log directory path
+ * @description
+ * - 设置了COMPLETION_AGENT_LOG_DIR环境变量时使用该目录
+ * - 否则为costrict目录下的logs子目录
+ */
+func GetLogDir() string {
+	if dir := os.Getenv(LogDirEnv); dir != "" {
+		return dir
+	}
+	return filepath.Join(GetCostrictDir(), "logs")
+}
+
+/**
+ * Get config file path
+ * @returns {string} Returns config file path
+ * @description
+ * - 设置了COMPLETION_AGENT_CONFIG环境变量时使用该路径
+ * - 否则为costrict目录下的config/completion-agent.json
+ */
+func GetConfigPath() string {
+	if path := os.Getenv(ConfigPathEnv); path != "" {
+		return path
+	}
+	return filepath.Join(GetCostrictDir(), "config", "completion-agent.json")
+}
+
 var DebugMode bool = false
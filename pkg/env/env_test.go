@@ -0,0 +1,34 @@
+package env
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func Test_PathOverrides(t *testing.T) {
+	t.Setenv(CostrictDirEnv, "")
+	t.Setenv(ConfigPathEnv, "")
+	t.Setenv(LogDirEnv, "")
+	if filepath.Base(GetCostrictDir()) != ".costrict" {
+		t.Fatalf("default costrict dir = %q", GetCostrictDir())
+	}
+
+	base := t.TempDir()
+	t.Setenv(CostrictDirEnv, base)
+	if GetCostrictDir() != base {
+		t.Fatalf("costrict dir = %q, want %q", GetCostrictDir(), base)
+	}
+	// 配置文件和日志目录默认位于costrict目录下
+	if want := filepath.Join(base, "config", "completion-agent.json"); GetConfigPath() != want {
+		t.Fatalf("config path = %q, want %q", GetConfigPath(), want)
+	}
+	if want := filepath.Join(base, "logs"); GetLogDir() != want {
+		t.Fatalf("log dir = %q, want %q", GetLogDir(), want)
+	}
+
+	t.Setenv(ConfigPathEnv, "/etc/agent/config.json")
+	t.Setenv(LogDirEnv, "/var/log/agent")
+	if GetConfigPath() != "/etc/agent/config.json" || GetLogDir() != "/var/log/agent" {
+		t.Fatalf("overrides ignored: %q %q", GetConfigPath(), GetLogDir())
+	}
+}
@@ -0,0 +1,112 @@
+package logger
+
+import (
+	"sync/atomic"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// 异步日志缓冲区可容纳的日志条数
+const asyncLogBufferSize = 4096
+
+// 后台写入时单批合并的最大日志条数
+const asyncLogBatchSize = 256
+
+/**
+ * asyncWriter 异步日志写入器
+ * @description
+ * - 日志条目先进入有界通道，由后台goroutine批量写入底层写入器
+ * - 缓冲区满时直接丢弃日志并计数，不阻塞调用方（补全请求）
+ * - Sync会等待缓冲区中已有的日志全部写入后再同步底层写入器
+ * - 实现 zapcore.WriteSyncer 接口
+ */
+type asyncWriter struct {
+	out      zapcore.WriteSyncer
+	entries  chan []byte
+	flushReq chan chan error
+	dropped  atomic.Int64
+}
+
+/**
+ * 创建异步日志写入器，并启动后台写入goroutine
+ * @param {zapcore.WriteSyncer} out - 底层写入器
+ * @param {int} bufferSize - 缓冲的日志条数上限
+ * @returns {*asyncWriter} 返回写入器实例
+ */
+func newAsyncWriter(out zapcore.WriteSyncer, bufferSize int) *asyncWriter {
+	w := &asyncWriter{
+		out:      out,
+		entries:  make(chan []byte, bufferSize),
+		flushReq: make(chan chan error),
+	}
+	go w.run()
+	return w
+}
+
+/**
+ * 写入一条日志，缓冲区满时丢弃
+ * @param {[]byte} p - 日志内容，zap会复用该缓冲区，因此需要拷贝
+ * @returns {int} 总是返回len(p)
+ * @returns {error} 总是返回nil
+ */
+func (w *asyncWriter) Write(p []byte) (int, error) {
+	buf := make([]byte, len(p))
+	copy(buf, p)
+	select {
+	case w.entries <- buf:
+	default:
+		w.dropped.Add(1)
+	}
+	return len(p), nil
+}
+
+/**
+ * 写入缓冲区中的全部日志并同步底层写入器
+ * @returns {error} 底层写入器同步的错误信息
+ */
+func (w *asyncWriter) Sync() error {
+	done := make(chan error)
+	w.flushReq <- done
+	return <-done
+}
+
+// Dropped 返回因缓冲区满而丢弃的日志条数
+func (w *asyncWriter) Dropped() int64 {
+	return w.dropped.Load()
+}
+
+// 后台写入循环，将连续到达的日志合并为一次写入
+func (w *asyncWriter) run() {
+	var batch []byte
+	for {
+		select {
+		case p := <-w.entries:
+			batch = append(batch[:0], p...)
+		collect:
+			for i := 1; i < asyncLogBatchSize; i++ {
+				select {
+				case p = <-w.entries:
+					batch = append(batch, p...)
+				default:
+					break collect
+				}
+			}
+			w.out.Write(batch)
+		case done := <-w.flushReq:
+			w.drain()
+			done <- w.out.Sync()
+		}
+	}
+}
+
+// 把通道中当前所有日志写入底层写入器
+func (w *asyncWriter) drain() {
+	for {
+		select {
+		case p := <-w.entries:
+			w.out.Write(p)
+		default:
+			return
+		}
+	}
+}
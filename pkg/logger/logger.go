@@ -1,7 +1,9 @@
 package logger
 
 import (
+	"compress/gzip"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"sort"
@@ -20,14 +22,19 @@ import (
  * @description
  * - 实现文件大小限制和自动轮转功能
  * - 当文件达到最大大小时，会重命名原文件并创建新文件
+ * - 开启按天轮转时，跨过本地零点后的首次写入也会触发轮转
  * - 线程安全的实现
  * - 实现 zapcore.WriteSyncer 接口
  */
 type sizeLimitedWriter struct {
-	filePath string
-	maxSize  int64
-	file     *os.File
-	mu       sync.Mutex
+	filePath    string
+	maxSize     int64
+	maxBackups  int
+	compress    bool
+	rotateDaily bool
+	openDate    time.Time // 当前日志文件的起始日期，用于按天轮转
+	file        *os.File
+	mu          sync.Mutex
 }
 
 // 实现 zapcore.WriteSyncer 接口
@@ -43,6 +50,7 @@ func (w *sizeLimitedWriter) Sync() error {
 
 var (
 	sizeLimitedWriterInstance *sizeLimitedWriter
+	asyncWriterInstance       *asyncWriter
 )
 
 /**
@@ -56,7 +64,26 @@ var (
  * Logger.Info("应用启动")
  * Logger.Error("发生错误", zap.Error(err))
  */
-var Logger *zap.Logger
+var Logger *zap.Logger = zap.NewNop()
+
+/**
+ * 日志初始化选项
+ * @description
+ * - MaxSize: 单个日志文件的最大大小（字节），小于等于0时使用默认值5MB
+ * - MaxBackups: 保留的轮转备份文件数量，0表示保留全部
+ * - Compress: 轮转后是否将备份文件压缩为.gz格式
+ * - RotateDaily: 是否在每天本地零点后轮转日志，与按大小轮转同时生效
+ * - AsyncLog: 是否异步写日志文件，缓冲区满时丢弃日志而不阻塞请求
+ * @example
+ * opts := Options{MaxSize: 5 * 1024 * 1024, MaxBackups: 10, Compress: true, RotateDaily: true}
+ */
+type Options struct {
+	MaxSize     int64
+	MaxBackups  int
+	Compress    bool
+	RotateDaily bool
+	AsyncLog    bool
+}
 
 /**
  * 初始化日志系统
@@ -75,26 +102,29 @@ var Logger *zap.Logger
 /**
  * InitLogger 初始化日志系统
  * @param {string} logPath - 日志文件路径，如果为空或"console"则使用默认路径
- * @param {string} level - 日志级别，支持"debug", "info", "warn", "error"
- * @param {bool} toConsole - 是否同时输出到控制台
- * @param {int64} maxSize - 日志文件最大大小（字节），默认50MB
+ * @param {string} mode - 运行模式，"debug"模式下控制台输出debug级别日志
+ * @param {Options} opts - 日志选项，包括文件最大大小、备份保留数量、备份压缩和按天轮转
  * @description
  * - 初始化zap日志配置
  * - 支持日志文件大小限制和自动轮转
+ * - 支持按天轮转日志文件
+ * - 支持异步写日志文件，避免磁盘IO和轮转阻塞请求
+ * - 支持将轮转后的备份文件压缩为gzip格式
  * - 自动创建日志目录
  * - 支持同时输出到文件和控制台
  * - 错误级别日志单独保存为JSON格式
  * @throws
  * - 如果日志构建失败，会导致程序panic
  * @example
- * InitLogger("", "info", true, 5*1024*1024)
- * // 使用默认路径，info级别，同时输出到控制台，最大5MB
+ * InitLogger("", "release", Options{MaxSize: 5 * 1024 * 1024, Compress: true})
+ * // 使用默认路径，最大5MB，轮转后的备份压缩保存
  */
-func InitLogger(logPath string, mode string, maxSize int64) {
+func InitLogger(logPath string, mode string, opts Options) {
 	// 设置默认值
 	if logPath == "console" || logPath == "" {
-		logPath = filepath.Join(env.GetCostrictDir(), "logs", "completion-agent.log")
+		logPath = filepath.Join(env.GetLogDir(), "completion-agent.log")
 	}
+	maxSize := opts.MaxSize
 	if maxSize <= 0 {
 		maxSize = 5 * 1024 * 1024 // 默认5MB
 	}
@@ -107,13 +137,18 @@ func InitLogger(logPath string, mode string, maxSize int64) {
 
 	// 创建大小限制的文件写入器
 	var err error
-	sizeLimitedWriterInstance, err = newSizeLimitedWriter(logPath, maxSize)
+	sizeLimitedWriterInstance, err = newSizeLimitedWriter(logPath, maxSize, opts.MaxBackups, opts.Compress, opts.RotateDaily)
 	if err != nil {
 		panic(err)
 	}
-	if err := removeRedundantBackups(logPath, 1); err != nil {
+	if err := removeRedundantBackups(logPath, opts.MaxBackups); err != nil {
 		fmt.Fprintf(os.Stderr, "remove redundant backups: %s", err.Error())
 	}
+	var fileWriter zapcore.WriteSyncer = sizeLimitedWriterInstance
+	if opts.AsyncLog {
+		asyncWriterInstance = newAsyncWriter(sizeLimitedWriterInstance, asyncLogBufferSize)
+		fileWriter = asyncWriterInstance
+	}
 
 	// 根据模式创建不同的配置
 	var core zapcore.Core
@@ -153,7 +188,7 @@ func InitLogger(logPath string, mode string, maxSize int64) {
 		})
 
 		consoleCore := zapcore.NewCore(consoleEncoder, zapcore.Lock(os.Stdout), zapcore.DebugLevel)
-		fileCore := zapcore.NewCore(fileEncoder, sizeLimitedWriterInstance, zapcore.InfoLevel)
+		fileCore := zapcore.NewCore(fileEncoder, fileWriter, zapcore.InfoLevel)
 		core = zapcore.NewTee(consoleCore, fileCore)
 	} else {
 		// 生产模式：控制台和文件都使用JSON格式，但控制台有更好的可读性
@@ -191,7 +226,7 @@ func InitLogger(logPath string, mode string, maxSize int64) {
 		})
 
 		consoleCore := zapcore.NewCore(consoleEncoder, zapcore.Lock(os.Stdout), zapcore.InfoLevel)
-		fileCore := zapcore.NewCore(fileEncoder, sizeLimitedWriterInstance, zapcore.InfoLevel)
+		fileCore := zapcore.NewCore(fileEncoder, fileWriter, zapcore.InfoLevel)
 		core = zapcore.NewTee(consoleCore, fileCore)
 	}
 
@@ -204,13 +239,19 @@ func InitLogger(logPath string, mode string, maxSize int64) {
  * 创建新的大小限制写入器
  * @param {string} filePath - 日志文件路径
  * @param {int64} maxSize - 最大文件大小
+ * @param {int} maxBackups - 保留的备份文件数量，0表示保留全部
+ * @param {bool} compress - 轮转后是否压缩备份文件
+ * @param {bool} rotateDaily - 是否按天轮转
  * @returns {sizeLimitedWriter} 返回写入器实例
  * @returns {error} 返回错误信息
  */
-func newSizeLimitedWriter(filePath string, maxSize int64) (*sizeLimitedWriter, error) {
+func newSizeLimitedWriter(filePath string, maxSize int64, maxBackups int, compress, rotateDaily bool) (*sizeLimitedWriter, error) {
 	w := &sizeLimitedWriter{
-		filePath: filePath,
-		maxSize:  maxSize,
+		filePath:    filePath,
+		maxSize:     maxSize,
+		maxBackups:  maxBackups,
+		compress:    compress,
+		rotateDaily: rotateDaily,
 	}
 
 	if err := w.rotateIfNeeded(); err != nil {
@@ -255,8 +296,11 @@ func (w *sizeLimitedWriter) Close() error {
 }
 
 /**
- * 检查文件大小并轮转
+ * 检查文件大小和日期并轮转
  * @returns {error} 错误信息
+ * @description
+ * - 文件超过最大大小时轮转
+ * - 开启按天轮转时，当前日期与文件起始日期不同则轮转，空文件只更新起始日期
  */
 func (w *sizeLimitedWriter) rotateIfNeeded() error {
 	// 检查文件是否存在并获取大小
@@ -265,8 +309,19 @@ func (w *sizeLimitedWriter) rotateIfNeeded() error {
 		if err != nil {
 			return err
 		}
-		if fileInfo.Size() < w.maxSize {
-			// 文件大小在限制内，不需要轮转
+		needRotate := fileInfo.Size() >= w.maxSize
+		if !needRotate && w.rotateDaily {
+			now := time.Now()
+			if !sameDate(w.openDate, now) {
+				if fileInfo.Size() == 0 {
+					w.openDate = now
+				} else {
+					needRotate = true
+				}
+			}
+		}
+		if !needRotate {
+			// 文件大小和日期都在限制内，不需要轮转
 			return nil
 		}
 		// 关闭当前文件
@@ -279,7 +334,12 @@ func (w *sizeLimitedWriter) rotateIfNeeded() error {
 		if err := os.Rename(w.filePath, backupPath); err != nil {
 			return err
 		}
-		if err := removeRedundantBackups(w.filePath, 1); err != nil {
+		if w.compress {
+			if err := compressFile(backupPath); err != nil {
+				fmt.Fprintf(os.Stderr, "compress log backup: %s", err.Error())
+			}
+		}
+		if err := removeRedundantBackups(w.filePath, w.maxBackups); err != nil {
 			fmt.Fprintf(os.Stderr, "remove redundant backups: %s", err.Error())
 		}
 	}
@@ -291,15 +351,73 @@ func (w *sizeLimitedWriter) rotateIfNeeded() error {
 	}
 
 	w.file = file
+	// 沿用已有日志文件的最后修改日期，使重启后跨天的旧文件也能按天轮转
+	w.openDate = time.Now()
+	if info, err := file.Stat(); err == nil && info.Size() > 0 {
+		w.openDate = info.ModTime()
+	}
 	return nil
 }
 
+// sameDate 判断两个时间是否为本地时区的同一天
+func sameDate(a, b time.Time) bool {
+	ay, am, ad := a.Local().Date()
+	by, bm, bd := b.Local().Date()
+	return ay == by && am == bm && ad == bd
+}
+
+/**
+ * 将文件压缩为同名的.gz文件，成功后删除原文件
+ * @param {string} src - 待压缩的文件路径
+ * @returns {error} 错误信息，压缩失败时保留原文件
+ */
+func compressFile(src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	dst := src + ".gz"
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		gz.Close()
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	in.Close()
+	return os.Remove(src)
+}
+
+/**
+ * 删除多余的日志备份文件
+ * @param {string} filePath - 日志文件路径
+ * @param {int} backupCount - 保留的备份文件数量，小于等于0时保留全部
+ * @returns {error} 错误信息
+ * @description
+ * - 备份文件名格式为<日志文件名>.<时间戳>，压缩后的备份带有.gz后缀
+ * - 按时间戳排序，删除最旧的多余备份
+ */
 func removeRedundantBackups(filePath string, backupCount int) error {
-	if backupCount < 0 {
+	if backupCount <= 0 {
 		return nil
 	}
 	dir := filepath.Dir(filePath)
-	fprefix := filepath.Base(filePath)
+	fprefix := filepath.Base(filePath) + "."
 
 	entries, err := os.ReadDir(dir)
 	if err != nil {
@@ -321,11 +439,11 @@ func removeRedundantBackups(filePath string, backupCount int) error {
 		if !strings.HasPrefix(name, fprefix) {
 			continue
 		}
-		// 后缀必须是 <timestamp>
-		if len(name) < tsLen {
+		// 后缀必须是 <timestamp> 或 <timestamp>.gz
+		tsStr := strings.TrimSuffix(strings.TrimPrefix(name, fprefix), ".gz")
+		if len(tsStr) != tsLen {
 			continue
 		}
-		tsStr := name[len(name)-tsLen:]
 		tm, err := time.Parse("20060102-150405", tsStr)
 		if err != nil {
 			continue // 格式不符，跳过
@@ -375,11 +493,107 @@ func SetLevel(level string) {
 	Logger.Core().Enabled(levelValue)
 }
 
+/**
+ * 日志文件设置
+ * @description
+ * - Path: 日志文件路径
+ * - MaxSize: 单个日志文件的最大大小（字节）
+ * - MaxBackups: 保留的轮转备份文件数量，0表示保留全部
+ */
+type FileSettings struct {
+	Path       string `json:"path"`
+	MaxSize    int64  `json:"maxSize"`
+	MaxBackups int    `json:"maxBackups"`
+}
+
+/**
+ * 获取当前的日志文件设置
+ * @returns {FileSettings, bool} 返回当前设置，日志文件未初始化时返回false
+ */
+func CurrentFileSettings() (FileSettings, bool) {
+	w := sizeLimitedWriterInstance
+	if w == nil {
+		return FileSettings{}, false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return FileSettings{Path: w.filePath, MaxSize: w.maxSize, MaxBackups: w.maxBackups}, true
+}
+
+/**
+ * 运行时修改日志文件的路径、大小上限和备份数量
+ * @param {FileSettings} s - 新的日志文件设置，MaxSize小于等于0时使用默认值5MB
+ * @returns {error} 日志文件未初始化、目录创建失败或新文件打开失败时返回错误，此时继续使用原设置
+ * @description
+ * - 不重建logger，原地切换写入器的目标文件，已创建的logger都随之写入新文件
+ * - 切换前先写出异步日志缓冲区中的日志，切换与写入互斥，日志不会丢失
+ * - 新文件打开成功后才关闭原文件
+ * @example
+ * err := ReloadFile(FileSettings{Path: "/var/log/completion-agent.log", MaxSize: 10 << 20, MaxBackups: 5})
+ */
+func ReloadFile(s FileSettings) error {
+	w := sizeLimitedWriterInstance
+	if w == nil {
+		return fmt.Errorf("file logging is not initialized")
+	}
+	if s.MaxSize <= 0 {
+		s.MaxSize = 5 * 1024 * 1024
+	}
+	if asyncWriterInstance != nil {
+		asyncWriterInstance.Sync()
+	}
+	return w.reload(s)
+}
+
+/**
+ * 切换写入器的目标文件和轮转设置
+ * @param {FileSettings} s - 新的日志文件设置
+ * @returns {error} 错误信息，失败时保持原设置
+ */
+func (w *sizeLimitedWriter) reload(s FileSettings) error {
+	if err := os.MkdirAll(filepath.Dir(s.Path), 0755); err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if s.Path != w.filePath || w.file == nil {
+		file, err := os.OpenFile(s.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		if w.file != nil {
+			w.file.Close()
+		}
+		w.file = file
+		w.openDate = time.Now()
+		if info, err := file.Stat(); err == nil && info.Size() > 0 {
+			w.openDate = info.ModTime()
+		}
+	}
+	w.filePath, w.maxSize, w.maxBackups = s.Path, s.MaxSize, s.MaxBackups
+	if err := removeRedundantBackups(w.filePath, w.maxBackups); err != nil {
+		fmt.Fprintf(os.Stderr, "remove redundant backups: %s", err.Error())
+	}
+	return nil
+}
+
+/**
+ * 获取异步日志因缓冲区满而丢弃的日志条数
+ * @returns {int64} 丢弃的日志条数，未开启异步日志时返回0
+ */
+func DroppedEntries() int64 {
+	if asyncWriterInstance == nil {
+		return 0
+	}
+	return asyncWriterInstance.Dropped()
+}
+
 /**
  * 刷新所有日志到输出
  * @description
  * - 调用全局logger的Sync方法
- * - 确保所有缓冲的日志都被写入输出
+ * - 确保所有缓冲的日志都被写入输出，包括异步日志缓冲区中的日志
  * - 通常在应用程序退出前调用
  * - 用于保证日志数据不丢失
  * @example
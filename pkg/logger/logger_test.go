@@ -1,6 +1,12 @@
 package logger
 
 import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -43,3 +49,269 @@ func Test_ExampleUsage(t *testing.T) {
 		zap.String("requestId", requestId),
 		zap.String("error", "数据库已经连接"))
 }
+
+func Test_RotateCompress(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "test.log")
+	w, err := newSizeLimitedWriter(logPath, 16, 1, true, false)
+	if err != nil {
+		t.Fatalf("newSizeLimitedWriter: %v", err)
+	}
+	defer w.Close()
+
+	first := "0123456789abcdefXYZ\n"
+	if _, err := w.Write([]byte(first)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := w.Write([]byte("next\n")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("read dir: %v", err)
+	}
+	var gzName string
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".gz") {
+			gzName = e.Name()
+		} else if e.Name() != "test.log" {
+			t.Errorf("unexpected uncompressed backup %s", e.Name())
+		}
+	}
+	if gzName == "" {
+		t.Fatalf("no compressed backup found")
+	}
+	f, err := os.Open(filepath.Join(dir, gzName))
+	if err != nil {
+		t.Fatalf("open backup: %v", err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("gzip reader: %v", err)
+	}
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("read backup: %v", err)
+	}
+	if string(data) != first {
+		t.Errorf("backup content = %q, want %q", data, first)
+	}
+}
+
+func Test_RemoveRedundantBackupsCompressed(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "test.log")
+	names := []string{
+		"test.log.20240101-000000.gz",
+		"test.log.20240102-000000",
+		"test.log.20240103-000000.gz",
+	}
+	for _, n := range names {
+		if err := os.WriteFile(filepath.Join(dir, n), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := removeRedundantBackups(logPath, 1); err != nil {
+		t.Fatalf("removeRedundantBackups: %v", err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 || entries[0].Name() != "test.log.20240103-000000.gz" {
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.Name())
+		}
+		t.Errorf("remaining backups = %v", got)
+	}
+}
+
+func Test_RemoveRedundantBackupsCount(t *testing.T) {
+	names := []string{
+		"test.log.20231231-235959",
+		"test.log.20240101-000000.gz",
+		"test.log.20240101-000001",
+		"test.log.20240102-120000.gz",
+		"test.log.bak",
+		"other.log.20200101-000000",
+	}
+	setup := func() string {
+		dir := t.TempDir()
+		for _, n := range names {
+			if err := os.WriteFile(filepath.Join(dir, n), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return dir
+	}
+	remaining := func(dir string) []string {
+		entries, _ := os.ReadDir(dir)
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.Name())
+		}
+		return got
+	}
+
+	dir := setup()
+	if err := removeRedundantBackups(filepath.Join(dir, "test.log"), 2); err != nil {
+		t.Fatalf("removeRedundantBackups: %v", err)
+	}
+	want := []string{
+		"other.log.20200101-000000",
+		"test.log.20240101-000001",
+		"test.log.20240102-120000.gz",
+		"test.log.bak",
+	}
+	if got := remaining(dir); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("remaining = %v, want %v", got, want)
+	}
+
+	dir = setup()
+	if err := removeRedundantBackups(filepath.Join(dir, "test.log"), 0); err != nil {
+		t.Fatalf("removeRedundantBackups: %v", err)
+	}
+	if got := remaining(dir); len(got) != len(names) {
+		t.Errorf("zero should keep all backups, remaining = %v", got)
+	}
+}
+
+func Test_RotateDaily(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "test.log")
+	w, err := newSizeLimitedWriter(logPath, 1024*1024, 0, false, true)
+	if err != nil {
+		t.Fatalf("newSizeLimitedWriter: %v", err)
+	}
+	defer w.Close()
+
+	if _, err := w.Write([]byte("today\n")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("unexpected rotation within the same day: %d files", len(entries))
+	}
+
+	// 模拟跨天
+	w.openDate = time.Now().AddDate(0, 0, -1)
+	if _, err := w.Write([]byte("tomorrow\n")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Fatalf("expected a daily backup, got %d files", len(entries))
+	}
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "tomorrow\n" {
+		t.Errorf("current log = %q, want %q", data, "tomorrow\n")
+	}
+}
+
+// 可阻塞的测试写入器
+type gatedWriter struct {
+	mu    sync.Mutex
+	gate  chan struct{}
+	lines []string
+}
+
+func (g *gatedWriter) Write(p []byte) (int, error) {
+	<-g.gate
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.lines = append(g.lines, strings.Split(strings.TrimSuffix(string(p), "\n"), "\n")...)
+	return len(p), nil
+}
+
+func (g *gatedWriter) Sync() error {
+	return nil
+}
+
+func Test_AsyncWriterFlush(t *testing.T) {
+	out := &gatedWriter{gate: make(chan struct{})}
+	close(out.gate)
+	w := newAsyncWriter(out, 128)
+	for i := 0; i < 100; i++ {
+		w.Write([]byte("line\n"))
+	}
+	if err := w.Sync(); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if len(out.lines) != 100 || w.Dropped() != 0 {
+		t.Errorf("written %d, dropped %d, want 100 written", len(out.lines), w.Dropped())
+	}
+}
+
+func Test_AsyncWriterDrop(t *testing.T) {
+	out := &gatedWriter{gate: make(chan struct{})}
+	w := newAsyncWriter(out, 2)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			w.Write([]byte("line\n"))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Write blocked on a stalled writer")
+	}
+	if w.Dropped() == 0 {
+		t.Errorf("expected dropped entries when buffer is full")
+	}
+
+	close(out.gate)
+	if err := w.Sync(); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if got := int64(len(out.lines)) + w.Dropped(); got != 10 {
+		t.Errorf("written %d + dropped %d != 10", len(out.lines), w.Dropped())
+	}
+}
+
+func Test_ReloadFile(t *testing.T) {
+	savedLogger, savedWriter, savedAsync := Logger, sizeLimitedWriterInstance, asyncWriterInstance
+	defer func() {
+		Logger, sizeLimitedWriterInstance, asyncWriterInstance = savedLogger, savedWriter, savedAsync
+		zap.ReplaceGlobals(Logger)
+	}()
+
+	dir := t.TempDir()
+	oldPath := filepath.Join(dir, "old.log")
+	newPath := filepath.Join(dir, "sub", "new.log")
+	InitLogger(oldPath, "release", Options{AsyncLog: true})
+	defer sizeLimitedWriterInstance.Close()
+
+	named := zap.L().Named("reload")
+	Info("before reload")
+	if err := ReloadFile(FileSettings{Path: newPath, MaxSize: 1 << 20, MaxBackups: 2}); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	Info("after reload")
+	named.Info("named after reload")
+	Sync()
+
+	oldContent, _ := os.ReadFile(oldPath)
+	newContent, _ := os.ReadFile(newPath)
+	if !strings.Contains(string(oldContent), "before reload") || strings.Contains(string(oldContent), "after reload") {
+		t.Errorf("unexpected old log content: %s", oldContent)
+	}
+	if !strings.Contains(string(newContent), "after reload") || !strings.Contains(string(newContent), "named after reload") {
+		t.Errorf("unexpected new log content: %s", newContent)
+	}
+	if s, _ := CurrentFileSettings(); s != (FileSettings{Path: newPath, MaxSize: 1 << 20, MaxBackups: 2}) {
+		t.Errorf("settings = %+v", s)
+	}
+
+	// 新文件无法打开时保持原设置
+	if err := ReloadFile(FileSettings{Path: dir}); err == nil {
+		t.Fatal("expected error reloading to a directory")
+	}
+	if s, _ := CurrentFileSettings(); s.Path != newPath {
+		t.Errorf("path changed after failed reload: %s", s.Path)
+	}
+}
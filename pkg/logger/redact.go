@@ -0,0 +1,54 @@
+package logger
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// 是否在日志中记录代码及提示词原文，默认不记录
+var logPromptContent atomic.Bool
+
+/**
+ * 设置是否在日志中记录代码及提示词原文
+ * @param {bool} enabled - true时日志中保留原文，false时脱敏
+ * @description
+ * - 由配置server.logPromptContent决定，程序加载配置后调用
+ * - 影响RedactText和Sensitive的行为
+ */
+func SetLogPromptContent(enabled bool) {
+	logPromptContent.Store(enabled)
+}
+
+/**
+ * 对敏感文本脱敏
+ * @param {string} text - 可能包含源代码的文本
+ * @returns {string} 未开启原文记录时返回长度和摘要，否则返回原文
+ * @description
+ * - 摘要取SHA256的前6字节，可用于比对相同内容，但无法还原原文
+ * - 空串原样返回
+ * @example
+ * RedactText("func main() {}")
+ * // 返回 "[redacted len=14 sha256=...]"
+ */
+func RedactText(text string) string {
+	if text == "" || logPromptContent.Load() {
+		return text
+	}
+	sum := sha256.Sum256([]byte(text))
+	return fmt.Sprintf("[redacted len=%d sha256=%x]", len(text), sum[:6])
+}
+
+/**
+ * 构造敏感内容的日志字段
+ * @param {string} key - 字段名
+ * @param {string} text - 可能包含源代码的文本
+ * @returns {zap.Field} 按RedactText处理后的字符串字段
+ * @example
+ * zap.L().Info("Prune by Pruners", logger.Sensitive("pre", completionText))
+ */
+func Sensitive(key string, text string) zap.Field {
+	return zap.String(key, RedactText(text))
+}
@@ -1,23 +1,26 @@
 package metrics
 
 import (
+	"fmt"
 	"net/http"
 	"sync"
 
+	"completion-agent/pkg/logger"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// 耗时分布指标的默认桶(毫秒)，覆盖补全请求常见的50ms~10s范围
+var DefaultDurationBuckets = []float64{50, 75, 100, 150, 200, 300, 400, 500, 750, 1000, 1500, 2000, 3000, 5000, 7500, 10000}
+
 var (
-	completionDurations = promauto.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name:    "completion_durations",
-			Help:    "Duration of each phase of completion requests in milliseconds",
-			Buckets: []float64{50, 100, 150, 200, 300, 400, 500, 600, 800, 1000, 1200, 1500, 2000, 2500, 3000, 5000},
-		},
-		[]string{"model", "status", "phase"},
-	)
+	// 补全各阶段(queue/context/llm/total)耗时分布指标 (Histogram)
+	completionDurations = newDurationHistogram(DefaultDurationBuckets)
+
+	// 首个token返回耗时分布指标 (Histogram)，仅流式请求记录
+	completionFirstTokenDurations = newFirstTokenHistogram(DefaultDurationBuckets)
 
 	// Token数量分布指标 (Histogram)
 	completionTokens = promauto.NewHistogramVec(
@@ -55,6 +58,98 @@ var (
 		[]string{"model"},
 	)
 
+	// 瞬时值指标：当前活跃的流式连接数
+	streamsActive = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "completion_streams_active",
+			Help: "Current number of active streaming connections",
+		},
+	)
+
+	// 未知模型供应商回退到默认供应商的次数 (Counter)
+	providerFallbackTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "model_provider_fallback_total",
+			Help: "Total number of models whose unknown provider fell back to the default provider",
+		},
+		[]string{"provider", "model"},
+	)
+
+	// 补全结果因超出token上限被截断的次数 (Counter)
+	completionTruncatedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "completion_truncated_total",
+			Help: "Total number of completions truncated to the configured maximum number of tokens",
+		},
+		[]string{"model"},
+	)
+
+	// 模型给出了补全、但后置处理后为空的次数 (Counter)
+	completionPrunedEmptyTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "completion_pruned_empty_total",
+			Help: "Total number of non-empty model completions reduced to empty by post-processing",
+		},
+		[]string{"model"},
+	)
+
+	// 模型服务响应体超出长度上限的次数 (Counter)
+	responseOversizedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "model_response_oversized_total",
+			Help: "Total number of model responses discarded for exceeding the maximum response size",
+		},
+		[]string{"model"},
+	)
+
+	// 因超出限流被拒绝的补全请求数，按客户端区分 (Counter)
+	// client_id标签的取值由调用方限定在有限的集合内
+	rateLimitedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "completion_rate_limited_total",
+			Help: "Total number of completion requests rejected by the per-client rate limiter",
+		},
+		[]string{"client_id"},
+	)
+
+	// 被过滤器拒绝的补全请求数，按拒绝原因区分 (Counter)
+	rejectionsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "completion_rejections_total",
+			Help: "Total number of completion requests rejected by filters, by reject reason",
+		},
+		[]string{"reason"},
+	)
+
+	// 上下文来源是否因连续失败被跳过，1表示跳过 (Gauge)
+	contextSourceOpen = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "context_source_circuit_open",
+			Help: "Whether a context source is skipped by its circuit breaker (1) or not (0)",
+		},
+		[]string{"source"},
+	)
+
+	// 因熔断而未请求上下文来源的次数 (Counter)
+	contextSourceSkippedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "context_source_skipped_total",
+			Help: "Total number of context source requests skipped by the circuit breaker",
+		},
+		[]string{"source"},
+	)
+
+	// 异步日志因缓冲区满而丢弃的日志条数 (Counter)
+	_ = promauto.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: "log_dropped_entries_total",
+			Help: "Total number of log entries dropped because the async log buffer was full",
+		},
+		func() float64 {
+			return float64(logger.DroppedEntries())
+		},
+	)
+
 	// 互斥锁，确保线程安全
 	metricsMutex sync.Mutex
 )
@@ -67,6 +162,57 @@ const (
 	TokenTypeOutput TokenType = "output"
 )
 
+func newDurationHistogram(buckets []float64) *prometheus.HistogramVec {
+	return promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "completion_durations",
+			Help:    "Duration of each phase of completion requests in milliseconds",
+			Buckets: buckets,
+		},
+		[]string{"model", "status", "phase"},
+	)
+}
+
+func newFirstTokenHistogram(buckets []float64) *prometheus.HistogramVec {
+	return promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "completion_first_token_duration",
+			Help:    "Time to first token of streaming completion requests in milliseconds",
+			Buckets: buckets,
+		},
+		[]string{"model", "status"},
+	)
+}
+
+/**
+ * 设置耗时分布指标的桶
+ * @param {[]float64} buckets - 桶的上界(毫秒)，必须为正数且严格递增；为空时使用DefaultDurationBuckets
+ * @returns {error} 桶不合法时返回错误，已有指标保持不变
+ * @description
+ * - 作用于completion_durations和completion_first_token_duration
+ * - 重新注册指标，已记录的数据被清空，应在启动时、处理请求前调用
+ * @example
+ * err := metrics.SetDurationBuckets([]float64{100, 250, 500, 1000, 2500, 5000, 10000})
+ */
+func SetDurationBuckets(buckets []float64) error {
+	if len(buckets) == 0 {
+		buckets = DefaultDurationBuckets
+	}
+	for i, b := range buckets {
+		if b <= 0 || (i > 0 && b <= buckets[i-1]) {
+			return fmt.Errorf("invalid duration buckets %v: must be positive and strictly increasing", buckets)
+		}
+	}
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	prometheus.Unregister(completionDurations)
+	prometheus.Unregister(completionFirstTokenDurations)
+	completionDurations = newDurationHistogram(buckets)
+	completionFirstTokenDurations = newFirstTokenHistogram(buckets)
+	return nil
+}
+
 // 记录补全各阶段耗时
 func RecordCompletionDuration(model string, status string, queue, context, llm, total int64) {
 	metricsMutex.Lock()
@@ -78,6 +224,14 @@ func RecordCompletionDuration(model string, status string, queue, context, llm,
 	completionDurations.WithLabelValues(model, status, "total").Observe(float64(total))
 }
 
+// 记录首个token的返回耗时
+func RecordFirstTokenDuration(model string, status string, firstToken int64) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	completionFirstTokenDurations.WithLabelValues(model, status).Observe(float64(firstToken))
+}
+
 // 记录每次请求的输入和输出token数分布
 func RecordCompletionTokens(model string, tokenType TokenType, tokenCount int) {
 	metricsMutex.Lock()
@@ -110,6 +264,82 @@ func UpdateCompletionConcurrentByModel(model string, count int) {
 	completionConcurrentByModel.WithLabelValues(model).Set(float64(count))
 }
 
+// 更新当前活跃的流式连接数
+func UpdateStreamsActive(count int) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	streamsActive.Set(float64(count))
+}
+
+// 记录未知模型供应商回退到默认供应商的次数
+func IncrementProviderFallback(provider string, model string) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	providerFallbackTotal.WithLabelValues(provider, model).Inc()
+}
+
+// 记录补全结果因超出token上限被截断的次数
+func IncrementCompletionTruncated(model string) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	completionTruncatedTotal.WithLabelValues(model).Inc()
+}
+
+// 记录模型给出了补全、但后置处理后为空的次数，与模型本身没有输出区分开
+func IncrementCompletionPrunedEmpty(model string) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	completionPrunedEmptyTotal.WithLabelValues(model).Inc()
+}
+
+// 记录模型服务响应体超出长度上限的次数
+func IncrementResponseOversized(model string) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	responseOversizedTotal.WithLabelValues(model).Inc()
+}
+
+// 记录被限流拒绝的补全请求数
+func IncrementRateLimited(client string) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	rateLimitedTotal.WithLabelValues(client).Inc()
+}
+
+// 记录被过滤器拒绝的补全请求数
+func IncrementRejections(reason string) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	rejectionsTotal.WithLabelValues(reason).Inc()
+}
+
+// 记录上下文来源的熔断状态
+func SetContextSourceOpen(source string, open bool) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	value := 0.0
+	if open {
+		value = 1
+	}
+	contextSourceOpen.WithLabelValues(source).Set(value)
+}
+
+// 记录因熔断而跳过的上下文来源请求数
+func IncrementContextSourceSkipped(source string) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	contextSourceSkippedTotal.WithLabelValues(source).Inc()
+}
+
 // 返回Prometheus指标数据的HTTP处理器
 func GetMetricsHandler() http.Handler {
 	return promhttp.Handler()
@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func durationBucketBounds(t *testing.T, name string) []float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range families {
+		if mf.GetName() != name || len(mf.GetMetric()) == 0 {
+			continue
+		}
+		var bounds []float64
+		for _, b := range mf.GetMetric()[0].GetHistogram().GetBucket() {
+			bounds = append(bounds, b.GetUpperBound())
+		}
+		return bounds
+	}
+	return nil
+}
+
+func Test_SetDurationBuckets(t *testing.T) {
+	defer SetDurationBuckets(nil)
+
+	for _, buckets := range [][]float64{{100, 100}, {500, 100}, {0, 100}} {
+		if err := SetDurationBuckets(buckets); err == nil {
+			t.Errorf("expected error for buckets %v", buckets)
+		}
+	}
+	if err := SetDurationBuckets([]float64{100, 1000, 10000}); err != nil {
+		t.Fatal(err)
+	}
+	RecordCompletionDuration("bucket-model", "success", 1, 2, 300, 400)
+	RecordFirstTokenDuration("bucket-model", "success", 200)
+	for _, name := range []string{"completion_durations", "completion_first_token_duration"} {
+		bounds := durationBucketBounds(t, name)
+		if len(bounds) != 3 || bounds[0] != 100 || bounds[2] != 10000 {
+			t.Errorf("%s buckets = %v, want [100 1000 10000]", name, bounds)
+		}
+	}
+
+	// 为空时恢复默认桶
+	if err := SetDurationBuckets(nil); err != nil {
+		t.Fatal(err)
+	}
+	RecordCompletionDuration("bucket-model", "success", 1, 2, 300, 400)
+	if bounds := durationBucketBounds(t, "completion_durations"); len(bounds) != len(DefaultDurationBuckets) {
+		t.Errorf("default buckets = %v", bounds)
+	}
+}
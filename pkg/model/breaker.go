@@ -0,0 +1,107 @@
+package model
+
+import (
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// 未配置cooldown时的熔断持续时间
+const defaultBreakerCooldown = 30 * time.Second
+
+// 模型的熔断状态
+type circuitBreaker struct {
+	failures  int       // 连续失败次数
+	openUntil time.Time // 熔断结束时间，零值表示未熔断过
+}
+
+/**
+ * 各模型的熔断状态
+ * @description
+ * - 按模型实例索引，重新初始化模型时清空
+ * - now可在测试中替换
+ */
+var breakers = struct {
+	states map[LLM]*circuitBreaker
+	now    func() time.Time
+	mutex  sync.Mutex
+}{states: make(map[LLM]*circuitBreaker), now: time.Now}
+
+// 清空所有模型的熔断状态
+func resetBreakers() {
+	breakers.mutex.Lock()
+	defer breakers.mutex.Unlock()
+	breakers.states = make(map[LLM]*circuitBreaker)
+}
+
+// 判断补全状态是否说明模型不可用
+func isBreakerFailure(status CompletionStatus) bool {
+	switch status {
+	case StatusModelError, StatusAuthError, StatusRateLimited, StatusTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+/**
+ * 记录模型请求的结果，更新熔断状态
+ * @param {LLM} m - 请求的模型
+ * @param {CompletionStatus} status - 模型返回的补全状态
+ * @description
+ * - 未配置breaker.failures的模型不记录
+ * - 模型错误、认证失败、限流、超时计为失败，连续失败达到阈值时熔断
+ * - 熔断结束后再失败一次立即重新熔断
+ * - 成功时清零失败次数；请求被取消等与模型无关的状态不影响熔断
+ */
+func RecordResult(m LLM, status CompletionStatus) {
+	if m == nil {
+		return
+	}
+	cfg := m.Config()
+	if cfg.Breaker.Failures <= 0 {
+		return
+	}
+	failed := isBreakerFailure(status)
+	if !failed && status != StatusSuccess {
+		return
+	}
+
+	breakers.mutex.Lock()
+	defer breakers.mutex.Unlock()
+	b, ok := breakers.states[m]
+	if !ok {
+		b = &circuitBreaker{}
+		breakers.states[m] = b
+	}
+	if !failed {
+		if b.failures >= cfg.Breaker.Failures {
+			zap.L().Info("Model circuit breaker closed", zap.String("model", cfg.ModelName))
+		}
+		b.failures = 0
+		return
+	}
+	b.failures++
+	now := breakers.now()
+	if b.failures >= cfg.Breaker.Failures && !now.Before(b.openUntil) {
+		cooldown := cfg.Breaker.Cooldown.Duration()
+		if cooldown <= 0 {
+			cooldown = defaultBreakerCooldown
+		}
+		b.openUntil = now.Add(cooldown)
+		zap.L().Warn("Model circuit breaker opened",
+			zap.String("model", cfg.ModelName),
+			zap.Int("failures", b.failures),
+			zap.String("lastStatus", string(status)),
+			zap.Duration("cooldown", cooldown))
+	}
+}
+
+// 判断模型是否处于熔断状态
+func breakerOpen(m LLM) bool {
+	breakers.mutex.Lock()
+	defer breakers.mutex.Unlock()
+	b, ok := breakers.states[m]
+	return ok && breakers.now().Before(b.openUntil)
+}
@@ -1,38 +1,89 @@
 package model
 
-//	前置模块处理完毕后给到模型进行调用的参数信息
+// 前置模块处理完毕后给到模型进行调用的参数信息
 type CompletionParameter struct {
-	CompletionID string   `json:"completionID"` // 补全请求ID，用于唯一标识一次补全请求
-	ClientID     string   `json:"clientID"`     // 用户ID，唯一标识发起补全请求的用户
-	Language     string   `json:"language"`     // 编程语言
-	Model        string   `json:"model"`        // 模型
-	MaxTokens    int      `json:"max_tokens"`   // 回复内容的最大token数
-	Temperature  float32  `json:"temperature"`  // 温度
-	Stop         []string `json:"stop"`         // 停止符
-	Prefix       string   `json:"prefix"`       // 前缀
-	Suffix       string   `json:"suffix"`       // 后缀
-	CodeContext  string   `json:"context"`      // 上下文
-	Verbose      bool     `json:"verbose"`      // 是否需要更详细的回复，帮助调试
+	CompletionID string   `json:"completionID"`    // 补全请求ID，用于唯一标识一次补全请求
+	ClientID     string   `json:"clientID"`        // 用户ID，唯一标识发起补全请求的用户
+	Language     string   `json:"language"`        // 编程语言
+	Model        string   `json:"model"`           // 模型
+	MaxTokens    int      `json:"max_tokens"`      // 回复内容的最大token数
+	Temperature  float32  `json:"temperature"`     // 温度
+	TopP         float32  `json:"top_p,omitempty"` // 核采样概率，0表示不指定
+	Stop         []string `json:"stop"`            // 停止符
+	Prefix       string   `json:"prefix"`          // 前缀
+	Suffix       string   `json:"suffix"`          // 后缀
+	CodeContext  string   `json:"context"`         // 上下文
+	Verbose      bool     `json:"verbose"`         // 是否需要更详细的回复，帮助调试
+
+	Extra map[string]interface{} `json:"-"` // 客户端透传给模型的请求体字段，仅OpenAI协议的客户端发送
+	Seed  *int                   `json:"-"` // 随机种子，仅SupportsSeed的模型发送
 }
 
 type CompletionVerbose struct {
-	Id     string                 `json:"id"`
-	Input  map[string]interface{} `json:"input"`
-	Output map[string]interface{} `json:"output,omitempty"`
+	Id          string                 `json:"id"`
+	Input       map[string]interface{} `json:"input"`
+	Output      map[string]interface{} `json:"output,omitempty"`
+	Explain     *CompletionExplain     `json:"explain,omitempty"`     // 补全依据说明，verbose请求时填充
+	Diagnostics *CompletionDiagnostics `json:"diagnostics,omitempty"` // 补全过程诊断信息，verbose请求时填充
+}
+
+// 补全过程诊断信息：过滤器结果、提示词截断、发给模型的prompt和各阶段耗时，用于排查补全为空或被拒绝的原因
+type CompletionDiagnostics struct {
+	Prompt     string           `json:"prompt,omitempty"`     // 发给模型的prompt，请求被拒绝时为空
+	Filters    []FilterOutcome  `json:"filters"`              // 拒绝规则的判断结果，按执行顺序，拒绝后的规则不再执行
+	Truncation *TruncationStats `json:"truncation,omitempty"` // 提示词截断统计，请求被拒绝时为空
+	Timings    map[string]int64 `json:"timings"`              // 各阶段耗时(毫秒)：filter/context/truncate/queue/llm/postprocess
+	Degraded   []string         `json:"degraded,omitempty"`   // 因连续失败被熔断跳过的上下文来源
+	Budget     int64            `json:"budget,omitempty"`     // 整个请求的处理时限(毫秒)，未限制时为空
+}
+
+// 一个拒绝规则的判断结果
+type FilterOutcome struct {
+	Filter string `json:"filter"` // 规则名称：score、syntax、min_prefix
+	Result string `json:"result"` // ACCEPTED或拒绝原因
+}
+
+// 提示词截断统计(token数)
+type TruncationStats struct {
+	PrefixTokens   int `json:"prefix_tokens"`   // 截断前的前缀token数
+	SuffixTokens   int `json:"suffix_tokens"`   // 截断前的后缀token数
+	ContextTokens  int `json:"context_tokens"`  // 截断前的上下文token数
+	PrefixDropped  int `json:"prefix_dropped"`  // 前缀被截掉的token数
+	SuffixDropped  int `json:"suffix_dropped"`  // 后缀被截掉的token数
+	ContextDropped int `json:"context_dropped"` // 上下文被截掉的token数
+}
+
+// 补全依据说明：使用的模型、参数以及最终拼入prompt的上下文片段
+type CompletionExplain struct {
+	Model      string                 `json:"model"`           // 实际调用的模型
+	Parameters map[string]interface{} `json:"parameters"`      // 调用模型的主要参数
+	Snippets   []ExplainSnippet       `json:"snippets"`        // 拼入prompt的上下文片段，按拼接顺序
+	Notes      []string               `json:"notes,omitempty"` // 附加说明，如被忽略的请求参数
+}
+
+// 拼入prompt的上下文片段，只包含来源信息，不包含代码内容
+type ExplainSnippet struct {
+	Source   string  `json:"source"` // 片段来源: definition/semantic/relation/client，或clipboard等客户端片段类别
+	FilePath string  `json:"filepath,omitempty"`
+	Score    float64 `json:"score,omitempty"` // 检索得分，后端支持时填充
+	Length   int     `json:"length"`          // 片段内容长度(字节)
 }
 
 type CompletionStatus string
 
 const (
-	StatusSuccess     CompletionStatus = "success"     //补全成功
-	StatusEmpty       CompletionStatus = "empty"       //补全结果为空
-	StatusReqError    CompletionStatus = "reqError"    //请求存在错误
-	StatusServerError CompletionStatus = "serverError" //服务端错误
-	StatusModelError  CompletionStatus = "modelError"  //模型响应错误
-	StatusRejected    CompletionStatus = "rejected"    //根据规则拒绝补全
-	StatusTimeout     CompletionStatus = "timeout"     //补全请求超时
-	StatusCanceled    CompletionStatus = "canceled"    //用户取消
-	StatusBusy        CompletionStatus = "busy"        //服务端繁忙
+	StatusSuccess      CompletionStatus = "success"      //补全成功
+	StatusEmpty        CompletionStatus = "empty"        //补全结果为空
+	StatusReqError     CompletionStatus = "reqError"     //请求存在错误
+	StatusServerError  CompletionStatus = "serverError"  //服务端错误
+	StatusModelError   CompletionStatus = "modelError"   //模型响应错误
+	StatusRejected     CompletionStatus = "rejected"     //根据规则拒绝补全
+	StatusTimeout      CompletionStatus = "timeout"      //补全请求超时
+	StatusCanceled     CompletionStatus = "canceled"     //用户取消
+	StatusBusy         CompletionStatus = "busy"         //服务端繁忙
+	StatusNoSuggestion CompletionStatus = "noSuggestion" //模型正常响应但没有给出建议(choices为空)
+	StatusAuthError    CompletionStatus = "authError"    //模型服务认证失败
+	StatusRateLimited  CompletionStatus = "rateLimited"  //请求频率超出限制(模型服务或本服务限流)
 )
 
 //	OpenAI v1/completions协议的请求和响应结构定义
@@ -0,0 +1,116 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// 无法解析为结构化错误时，错误信息中保留的响应体最大长度
+const maxErrorBodyLen = 256
+
+/**
+ * 模型服务返回的错误
+ * @description
+ * - 模型服务响应非2xx时，从响应体中解析出的错误信息
+ * - 兼容OpenAI格式{"error": {"message", "type", "code"}}、{"error": "..."}以及{"message", "type"}
+ * - 响应体不是上述格式时，Message为截断后的原始响应体
+ * @example
+ * err := &ProviderError{StatusCode: 429, Type: "rate_limit_exceeded", Message: "Rate limit reached"}
+ * err.Error() // "model error (429, rate_limit_exceeded): Rate limit reached"
+ */
+type ProviderError struct {
+	StatusCode int    // 模型服务响应的HTTP状态码
+	Type       string // 错误类型，如invalid_request_error
+	Code       string // 错误码，如context_length_exceeded
+	Message    string // 错误描述
+}
+
+func (e *ProviderError) Error() string {
+	kind := e.Type
+	if e.Code != "" {
+		if kind != "" {
+			kind += "/"
+		}
+		kind += e.Code
+	}
+	if kind != "" {
+		return fmt.Sprintf("model error (%d, %s): %s", e.StatusCode, kind, e.Message)
+	}
+	return fmt.Sprintf("model error (%d): %s", e.StatusCode, e.Message)
+}
+
+/**
+ * 解析模型服务的错误响应
+ * @param {int} statusCode - 响应的HTTP状态码
+ * @param {[]byte} body - 响应体
+ * @returns {*ProviderError} 返回解析出的错误，不会为nil
+ */
+func parseProviderError(statusCode int, body []byte) *ProviderError {
+	e := &ProviderError{StatusCode: statusCode}
+	var data struct {
+		Error   json.RawMessage `json:"error"`
+		Message string          `json:"message"`
+		Type    string          `json:"type"`
+		Code    interface{}     `json:"code"`
+	}
+	if json.Unmarshal(body, &data) == nil {
+		var detail struct {
+			Message string      `json:"message"`
+			Type    string      `json:"type"`
+			Code    interface{} `json:"code"`
+		}
+		var text string
+		switch {
+		case len(data.Error) > 0 && json.Unmarshal(data.Error, &detail) == nil && detail.Message != "":
+			e.Message, e.Type, e.Code = detail.Message, detail.Type, codeString(detail.Code)
+		case len(data.Error) > 0 && json.Unmarshal(data.Error, &text) == nil && text != "":
+			e.Message, e.Type, e.Code = text, data.Type, codeString(data.Code)
+		case data.Message != "":
+			e.Message, e.Type, e.Code = data.Message, data.Type, codeString(data.Code)
+		}
+	}
+	if e.Message == "" {
+		e.Message = strings.TrimSpace(string(body))
+		if len(e.Message) > maxErrorBodyLen {
+			e.Message = e.Message[:maxErrorBodyLen] + "..."
+		}
+		if e.Message == "" {
+			e.Message = http.StatusText(statusCode)
+		}
+	}
+	return e
+}
+
+// 错误码可能是字符串或数字
+func codeString(code interface{}) string {
+	switch v := code.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+/**
+ * 根据模型服务响应的HTTP状态码判断补全状态
+ * @param {int} statusCode - 非2xx的HTTP状态码
+ * @returns {CompletionStatus} 返回对应的补全状态
+ * @description
+ * - 401/403：认证失败，返回StatusAuthError
+ * - 429：模型服务限流，返回StatusRateLimited
+ * - 其他：返回StatusModelError
+ */
+func providerErrorStatus(statusCode int) CompletionStatus {
+	switch statusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return StatusAuthError
+	case http.StatusTooManyRequests:
+		return StatusRateLimited
+	default:
+		return StatusModelError
+	}
+}
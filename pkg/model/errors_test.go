@@ -0,0 +1,110 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"completion-agent/pkg/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func Test_ProviderError(t *testing.T) {
+	cases := []struct {
+		name    string
+		code    int
+		body    string
+		status  CompletionStatus
+		message string
+		errType string
+		errCode string
+	}{
+		{"openai rate limit", 429, `{"error": {"message": "Rate limit reached", "type": "requests", "code": "rate_limit_exceeded"}}`,
+			StatusRateLimited, "Rate limit reached", "requests", "rate_limit_exceeded"},
+		{"invalid key", 401, `{"error": {"message": "Incorrect API key provided", "type": "invalid_request_error", "code": "invalid_api_key"}}`,
+			StatusAuthError, "Incorrect API key provided", "invalid_request_error", "invalid_api_key"},
+		{"context too long", 400, `{"error": {"message": "maximum context length is 4096 tokens", "type": "invalid_request_error", "code": null}}`,
+			StatusModelError, "maximum context length is 4096 tokens", "invalid_request_error", ""},
+		{"string error", 403, `{"error": "forbidden", "code": 40301}`,
+			StatusAuthError, "forbidden", "", "40301"},
+		{"top level message", 500, `{"message": "internal failure", "type": "server_error"}`,
+			StatusModelError, "internal failure", "server_error", ""},
+		{"plain text", 502, "Bad Gateway from upstream",
+			StatusModelError, "Bad Gateway from upstream", "", ""},
+		{"empty body", 503, "",
+			StatusModelError, "Service Unavailable", "", ""},
+	}
+	for _, c := range cases {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(c.code)
+			w.Write([]byte(c.body))
+		}))
+		m := NewOpenAICompletion(&config.ModelConfig{CompletionsUrl: srv.URL, MaxOutput: 16})
+		_, status, err := m.Completions(context.Background(), &CompletionParameter{Prefix: "x", MaxTokens: 16})
+		srv.Close()
+		if status != c.status {
+			t.Errorf("%s: status %s, want %s", c.name, status, c.status)
+		}
+		var pe *ProviderError
+		if !errors.As(err, &pe) {
+			t.Fatalf("%s: expected ProviderError, got %v", c.name, err)
+		}
+		if pe.StatusCode != c.code || pe.Message != c.message || pe.Type != c.errType || pe.Code != c.errCode {
+			t.Errorf("%s: got %+v", c.name, pe)
+		}
+		if !strings.Contains(err.Error(), c.message) {
+			t.Errorf("%s: error %q does not contain message", c.name, err.Error())
+		}
+	}
+}
+
+// 从默认注册表读取响应体超长计数
+func responseOversizedCount(t *testing.T, model string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() != "model_response_oversized_total" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "model" && l.GetValue() == model {
+					return m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func Test_OversizedResponse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"choices": [{"text": "` + strings.Repeat("x", 200) + `"}]}`))
+	}))
+	defer srv.Close()
+
+	for _, newLLM := range []NewLLM{NewOpenAICompletion, NewSangforCompletion} {
+		cfg := &config.ModelConfig{ModelName: "oversized-model", CompletionsUrl: srv.URL, MaxOutput: 16, MaxResponseBytes: 100}
+		m := newLLM(cfg)
+		before := responseOversizedCount(t, "oversized-model")
+		_, status, err := m.Completions(context.Background(), &CompletionParameter{Prefix: "x", MaxTokens: 16})
+		if status != StatusModelError || err == nil || !strings.Contains(err.Error(), "exceeds 100 bytes") {
+			t.Errorf("%T: status %s, error %v", m, status, err)
+		}
+		if got := responseOversizedCount(t, "oversized-model") - before; got != 1 {
+			t.Errorf("%T: oversized count = %v, want 1", m, got)
+		}
+
+		// 未超出上限时正常返回
+		cfg.MaxResponseBytes = 1000
+		if rsp, status, err := m.Completions(context.Background(), &CompletionParameter{Prefix: "x", MaxTokens: 16}); status != StatusSuccess || len(rsp.Choices[0].Text) != 200 {
+			t.Errorf("%T: status %s, error %v", m, status, err)
+		}
+	}
+}
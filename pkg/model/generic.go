@@ -0,0 +1,145 @@
+package model
+
+import (
+	"completion-agent/pkg/config"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// generic供应商默认的响应字段路径，与OpenAI v1/completions协议一致
+const (
+	defaultTextPath  = "choices[0].text"
+	defaultUsagePath = "usage"
+)
+
+// 补全文本路径上的数组为空，如choices为[]
+var errEmptyArray = errors.New("empty array")
+
+/**
+ * 通用模型供应商
+ * @description
+ * - 按OpenAI v1/completions协议组装和发送请求
+ * - 按模型配置的textPath和usagePath从响应中提取补全文本和token用量
+ * - 用于接入响应格式不标准的网关，无需为每个网关单独实现供应商
+ */
+type GenericCompletion struct {
+	OpenAICompletion
+}
+
+func NewGenericCompletion(c *config.ModelConfig) LLM {
+	return &GenericCompletion{
+		OpenAICompletion: *NewOpenAICompletion(c).(*OpenAICompletion),
+	}
+}
+
+func (m *GenericCompletion) Completions(ctx context.Context, p *CompletionParameter) (*CompletionResponse, CompletionStatus, error) {
+	body, status, err := m.request(ctx, p)
+	if err != nil {
+		return nil, status, err
+	}
+	rsp, err := m.parseResponse(body)
+	if errors.Is(err, errEmptyArray) {
+		// 与OpenAI协议choices为空一致，表示模型有意不给出建议，不计为模型错误
+		return nil, StatusNoSuggestion, err
+	}
+	if err != nil {
+		return nil, StatusModelError, err
+	}
+	return rsp, StatusSuccess, nil
+}
+
+/**
+ * 按配置的路径解析模型服务的响应
+ * @param {[]byte} body - 模型服务的响应体
+ * @returns {*CompletionResponse, error} 返回转换后的标准响应，补全文本路径不存在时返回错误
+ * @description
+ * - 补全文本路径必须存在且为字符串；路径上的数组为空时返回errEmptyArray
+ * - token用量路径不存在时用量为0，不视为错误
+ */
+func (m *GenericCompletion) parseResponse(body []byte) (*CompletionResponse, error) {
+	var data interface{}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return nil, err
+	}
+	textPath := m.cfg.TextPath
+	if textPath == "" {
+		textPath = defaultTextPath
+	}
+	v, err := lookupJSONPath(data, textPath)
+	if err != nil {
+		return nil, err
+	}
+	text, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("value at '%s' is not a string", textPath)
+	}
+
+	rsp := &CompletionResponse{
+		Object:  "text_completion",
+		Model:   m.cfg.ModelName,
+		Choices: []CompletionChoice{{Text: text}},
+	}
+	usagePath := m.cfg.UsagePath
+	if usagePath == "" {
+		usagePath = defaultUsagePath
+	}
+	if usage, err := lookupJSONPath(data, usagePath); err == nil {
+		if raw, err := json.Marshal(usage); err == nil {
+			_ = json.Unmarshal(raw, &rsp.Usage)
+		}
+	}
+	return rsp, nil
+}
+
+/**
+ * 按路径读取JSON值
+ * @param {interface{}} data - json.Unmarshal得到的值
+ * @param {string} path - 以'.'分隔的字段路径，数组元素用[n]表示，如data.choices[0].text
+ * @returns {interface{}, error} 返回路径对应的值，路径不存在时返回错误，因数组为空而不存在时错误包含errEmptyArray
+ * @example
+ * v, err := lookupJSONPath(data, "data.output.text")
+ */
+func lookupJSONPath(data interface{}, path string) (interface{}, error) {
+	cur := data
+	for _, part := range strings.Split(path, ".") {
+		name := part
+		var indexes []string
+		if i := strings.Index(part, "["); i >= 0 {
+			name = part[:i]
+			for _, idx := range strings.Split(part[i+1:], "[") {
+				if !strings.HasSuffix(idx, "]") {
+					return nil, fmt.Errorf("invalid path '%s'", path)
+				}
+				indexes = append(indexes, strings.TrimSuffix(idx, "]"))
+			}
+		}
+		if name != "" {
+			obj, ok := cur.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("path '%s' not found at '%s'", path, name)
+			}
+			if cur, ok = obj[name]; !ok {
+				return nil, fmt.Errorf("path '%s' not found at '%s'", path, name)
+			}
+		}
+		for _, idx := range indexes {
+			n, err := strconv.Atoi(idx)
+			if err != nil {
+				return nil, fmt.Errorf("invalid index '%s' in path '%s'", idx, path)
+			}
+			arr, ok := cur.([]interface{})
+			if ok && len(arr) == 0 {
+				return nil, fmt.Errorf("path '%s' not found: %w", path, errEmptyArray)
+			}
+			if !ok || n < 0 || n >= len(arr) {
+				return nil, fmt.Errorf("path '%s' not found at index %d", path, n)
+			}
+			cur = arr[n]
+		}
+	}
+	return cur, nil
+}
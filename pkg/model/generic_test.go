@@ -0,0 +1,85 @@
+package model
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"completion-agent/pkg/config"
+)
+
+func Test_GenericResponsePath(t *testing.T) {
+	cases := []struct {
+		name      string
+		body      string
+		textPath  string
+		usagePath string
+		want      string
+		tokens    int
+	}{
+		{
+			name:      "nested path",
+			body:      `{"data": {"output": {"text": "return a + b"}, "stats": {"prompt_tokens": 12, "completion_tokens": 4}}}`,
+			textPath:  "data.output.text",
+			usagePath: "data.stats",
+			want:      "return a + b",
+			tokens:    4,
+		},
+		{
+			name:   "standard path",
+			body:   `{"choices": [{"text": "return a - b", "index": 0}], "usage": {"prompt_tokens": 10, "completion_tokens": 5}}`,
+			want:   "return a - b",
+			tokens: 5,
+		},
+	}
+	for _, c := range cases {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(c.body))
+		}))
+		m := NewGenericCompletion(&config.ModelConfig{
+			Provider:       "generic",
+			CompletionsUrl: srv.URL,
+			MaxOutput:      16,
+			TextPath:       c.textPath,
+			UsagePath:      c.usagePath,
+		})
+		rsp, status, err := m.Completions(context.Background(), &CompletionParameter{Prefix: "func add(a, b int) int {\n", MaxTokens: 16})
+		srv.Close()
+		if err != nil || status != StatusSuccess {
+			t.Fatalf("%s: unexpected status %s, error %v", c.name, status, err)
+		}
+		if rsp.Choices[0].Text != c.want {
+			t.Errorf("%s: expected text %q, got %q", c.name, c.want, rsp.Choices[0].Text)
+		}
+		if rsp.Usage.CompletionTokens != c.tokens {
+			t.Errorf("%s: expected %d completion tokens, got %d", c.name, c.tokens, rsp.Usage.CompletionTokens)
+		}
+	}
+}
+
+func Test_GenericResponsePathMissing(t *testing.T) {
+	cases := []struct {
+		name     string
+		body     string
+		textPath string
+		want     CompletionStatus
+	}{
+		{"missing field", `{"data": {}}`, "data.output[0].text", StatusModelError},
+		{"not a string", `{"data": {"output": [{"text": 1}]}}`, "data.output[0].text", StatusModelError},
+		// 数组为空与OpenAI协议的choices为空一致，表示没有建议
+		{"empty array", `{"data": {"output": []}}`, "data.output[0].text", StatusNoSuggestion},
+		{"empty choices", `{"choices": [], "usage": {"prompt_tokens": 3}}`, "", StatusNoSuggestion},
+	}
+	for _, c := range cases {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(c.body))
+		}))
+		m := NewGenericCompletion(&config.ModelConfig{CompletionsUrl: srv.URL, TextPath: c.textPath})
+		_, status, err := m.Completions(context.Background(), &CompletionParameter{})
+		srv.Close()
+		if err == nil || status != c.want {
+			t.Errorf("%s: got %s, %v, want %s", c.name, status, err, c.want)
+		}
+	}
+}
@@ -2,10 +2,103 @@ package model
 
 import (
 	"completion-agent/pkg/config"
+	"completion-agent/pkg/metrics"
+	"completion-agent/pkg/tokenizers"
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
 )
 
+// 未配置maxResponseBytes时，模型服务响应体的最大字节数
+const defaultMaxResponseBytes = 1 << 20
+
 type LLM interface {
 	Completions(ctx context.Context, param *CompletionParameter) (*CompletionResponse, CompletionStatus, error)
 	Config() *config.ModelConfig
+	Tokenizer() *tokenizers.Tokenizer
+}
+
+// 支持随机种子的模型客户端
+type seedSupporter interface {
+	supportsSeed() bool
+}
+
+/**
+ * 判断模型是否支持随机种子
+ * @param {LLM} m - 模型实例
+ * @returns {bool} 模型客户端会把seed发给模型服务时返回true
+ * @description
+ * - 按OpenAI协议请求的客户端(openai、generic)支持，sangfor/v2协议不支持
+ */
+func SupportsSeed(m LLM) bool {
+	s, ok := m.(seedSupporter)
+	return ok && s.supportsSeed()
+}
+
+/**
+ * 根据请求模型服务的错误判断补全状态
+ * @param {error} err - 发送请求或读取响应时的错误
+ * @returns {CompletionStatus} 返回对应的补全状态
+ * @description
+ * - http.Client返回的错误经过url.Error包装，需用errors.Is判断
+ * - 请求上下文被取消(客户端断开连接)返回StatusCanceled
+ * - 上下文超时或http.Client超时返回StatusTimeout
+ * - 其他错误返回StatusServerError
+ */
+func requestErrorStatus(err error) CompletionStatus {
+	if errors.Is(err, context.Canceled) {
+		return StatusCanceled
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return StatusTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return StatusTimeout
+	}
+	return StatusServerError
+}
+
+/**
+ * 设置请求模型服务的HTTP头部
+ * @param {*http.Request} req - 发往模型服务的请求
+ * @param {*config.ModelConfig} cfg - 模型配置，提供认证信息和自定义头部
+ * @description
+ * - 设置Content-Type和Authorization
+ * - 再设置模型配置的headers，同名时覆盖前面的默认值
+ */
+func setRequestHeaders(req *http.Request, cfg *config.ModelConfig) {
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", cfg.Authorization)
+	for k, v := range cfg.Headers {
+		req.Header.Set(k, v)
+	}
+}
+
+/**
+ * 读取模型服务的响应体，限制最大长度
+ * @param {*config.ModelConfig} cfg - 模型配置，按maxResponseBytes限制响应体长度
+ * @param {io.Reader} r - 响应体
+ * @returns {[]byte, CompletionStatus, error} 返回响应体，读取失败或超出长度时返回状态和错误
+ * @description
+ * - 避免异常的模型服务返回超大响应体耗尽内存
+ * - 超出长度时不再继续读取，返回StatusModelError并记录指标
+ */
+func readResponseBody(cfg *config.ModelConfig, r io.Reader) ([]byte, CompletionStatus, error) {
+	limit := cfg.MaxResponseBytes
+	if limit <= 0 {
+		limit = defaultMaxResponseBytes
+	}
+	body, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, requestErrorStatus(err), err
+	}
+	if len(body) > limit {
+		metrics.IncrementResponseOversized(cfg.ModelName)
+		return nil, StatusModelError, fmt.Errorf("model response exceeds %d bytes", limit)
+	}
+	return body, StatusSuccess, nil
 }
@@ -2,6 +2,9 @@ package model
 
 import (
 	"completion-agent/pkg/config"
+	"completion-agent/pkg/metrics"
+	"completion-agent/pkg/tokenizers"
+	"errors"
 	"fmt"
 	"sync"
 
@@ -17,8 +20,8 @@ import (
  * - 维护当前模型索引用于轮询
  * @example
  * // 通常通过Init函数初始化
- * model := GetAutoModel()
- * response, err := model.Completions(ctx, &para)
+ * model, err := GetAutoModel()
+ * response, status, err := model.Completions(ctx, &para)
  */
 type LLManager struct {
 	models []LLM
@@ -44,68 +47,121 @@ type NewLLM func(*config.ModelConfig) LLM
 var modelDefs = map[string]NewLLM{
 	"openai":  NewOpenAICompletion,
 	"sangfor": NewSangforCompletion,
+	"generic": NewGenericCompletion,
 }
 
+// 未指定或未知provider时使用的默认模型供应商
+const defaultProvider = "sangfor"
+
+// 没有已初始化的模型，如尚未调用Init或配置中没有模型
+var ErrNoModels = errors.New("no models available")
+
 /**
  * 自动获取模型实例
- * @returns {LLM} 返回选中的LLM模型实例
+ * @returns {LLM, error} 返回选中的LLM模型实例，没有模型时返回ErrNoModels
  * @description
  * - 使用轮询算法自动选择模型
+ * - 跳过处于熔断状态的模型；所有模型都熔断时仍按轮询选择，避免请求无模型可用
  * - 线程安全，使用互斥锁保护共享状态
- * - 如果没有可用模型会panic
  * - 按顺序循环使用所有配置的模型
- * @throws
- * - 如果没有可用模型，会导致程序panic
  * @example
- * model := GetAutoModel()
- * response, err := model.Completions(ctx, &para)
+ * model, err := GetAutoModel()
+ * if err != nil {
+ *     return err
+ * }
+ * response, status, err := model.Completions(ctx, &para)
  */
-func GetAutoModel() LLM {
+func GetAutoModel() (LLM, error) {
 	manager.mutex.Lock()
 	defer manager.mutex.Unlock()
 	modelLen := len(manager.models)
 	if modelLen == 0 {
-		panic(manager)
+		return nil, ErrNoModels
 	}
-	// 采用轮转法选择模型进行响应
-	var model LLM
-	if manager.index < modelLen {
-		model = manager.models[manager.index]
-		manager.index++
-	} else {
-		manager.index = 1
-		model = manager.models[0]
+	// 采用轮转法选择模型进行响应，跳过熔断的模型
+	start := manager.index % modelLen
+	for i := 0; i < modelLen; i++ {
+		idx := (start + i) % modelLen
+		if !breakerOpen(manager.models[idx]) {
+			manager.index = idx + 1
+			return manager.models[idx], nil
+		}
 	}
-	return model
+	manager.index = start + 1
+	return manager.models[start], nil
 }
 
 /**
  * 根据索引获取模型实例
  * @param {int} idx - 模型索引，从0开始
- * @returns {LLM} 返回指定索引的LLM模型实例
+ * @returns {LLM, error} 返回指定索引的LLM模型实例，没有模型时返回ErrNoModels，索引超出范围时返回错误
  * @description
  * - 根据指定的索引获取模型实例
  * - 线程安全，使用互斥锁保护共享状态
- * - 如果索引超出范围会panic
  * - 用于获取特定的模型实例
- * @throws
- * - 如果索引超出范围，会导致程序panic
  * @example
- * model := GetModel(0)
- * response, err := model.Completions(ctx, &para)
+ * model, err := GetModel(0)
+ * if err != nil {
+ *     return err
+ * }
+ * response, status, err := model.Completions(ctx, &para)
  */
-func GetModel(idx int) LLM {
+func GetModel(idx int) (LLM, error) {
 	manager.mutex.Lock()
 	defer manager.mutex.Unlock()
 
-	if idx >= len(manager.models) {
-		panic(manager)
+	if len(manager.models) == 0 {
+		return nil, ErrNoModels
 	}
-	return manager.models[idx]
+	if idx < 0 || idx >= len(manager.models) {
+		return nil, fmt.Errorf("model index %d out of range, %d models available", idx, len(manager.models))
+	}
+	return manager.models[idx], nil
 }
 
 var manager = &LLManager{}
 
+/**
+ * 获取所有已初始化的模型实例
+ * @returns {[]LLM} 返回模型实例列表的副本，顺序与配置一致
+ * @description
+ * - 线程安全，使用互斥锁保护共享状态
+ * - 用于列出当前可用的模型
+ */
+func Models() []LLM {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	return append([]LLM(nil), manager.models...)
+}
+
+/**
+ * 加载模型专用的分词器
+ * @param {*config.ModelConfig} c - 模型配置，包含模型自己的分词器路径
+ * @returns {*tokenizers.Tokenizer} 返回模型专用的分词器，未配置或加载失败时返回nil
+ * @description
+ * - 模型未配置tokenizer.path时返回nil，由调用方退回使用全局分词器
+ * - 相同路径的分词器在多个模型之间共享
+ * - 加载失败时记录告警日志，不影响模型初始化
+ * @example
+ * tokenizer := loadModelTokenizer(&config.ModelConfig{
+ *     Tokenizer: config.TokenizerConfig{Path: "/path/to/codellama/tokenizer.json"},
+ * })
+ */
+func loadModelTokenizer(c *config.ModelConfig) *tokenizers.Tokenizer {
+	if c.Tokenizer.Path == "" {
+		return nil
+	}
+	t, err := tokenizers.LoadTokenizer(c.Tokenizer.Path)
+	if err != nil {
+		zap.L().Warn("Load model tokenizer failed, use the global tokenizer instead",
+			zap.String("model", c.ModelTitle),
+			zap.String("path", c.Tokenizer.Path),
+			zap.Error(err))
+		return nil
+	}
+	return t
+}
+
 /**
  * 初始化模型管理器
  * @param {[]config.ModelConfig} cfgModels - 模型配置数组，包含所有要初始化的模型配置
@@ -113,11 +169,14 @@ var manager = &LLManager{}
  * @description
  * - 根据配置数组初始化所有模型实例
  * - 根据provider类型选择对应的模型工厂函数
- * - 如果provider不存在，默认使用Sangfor模型
- * - 如果没有可用模型，记录fatal日志并返回错误
- * - 线程安全，初始化完成后可用于模型选择
+ * - 如果provider为空，默认使用Sangfor模型
+ * - 如果provider未知，记录告警和指标后回退到Sangfor模型；严格模式下返回错误
+ * - 开启了suffixProbe的模型先探测是否支持原生suffix，不支持时改用FIM模式
+ * - 如果没有可用模型，返回ErrNoModels，由调用方决定是否退出
+ * - 线程安全，可与模型选择和Models()并发调用；探测在持锁之前完成，完成后一次性替换模型列表
  * @throws
- * - 如果没有可用模型，记录fatal日志并返回错误
+ * - 严格模式下provider未知时返回错误
+ * - 如果没有可用模型，返回ErrNoModels，由调用方决定是否退出
  * @example
  * models := []config.ModelConfig{
  *     {Provider: "openai", ModelName: "gpt-3.5-turbo"},
@@ -130,16 +189,32 @@ var manager = &LLManager{}
 func Init(cfgModels []config.ModelConfig) error {
 	models := make([]LLM, 0)
 	for _, c := range cfgModels {
-		newLLM, exists := modelDefs[c.Provider]
+		provider := c.Provider
+		if provider == "" {
+			provider = defaultProvider
+		}
+		newLLM, exists := modelDefs[provider]
 		if !exists {
-			newLLM = NewSangforCompletion
+			if config.Config != nil && config.Config.StrictProvider {
+				return fmt.Errorf("unknown provider '%s' of model '%s'", c.Provider, c.ModelTitle)
+			}
+			zap.L().Warn("Unknown model provider, fall back to the default provider",
+				zap.String("provider", c.Provider),
+				zap.String("model", c.ModelTitle),
+				zap.String("default", defaultProvider))
+			metrics.IncrementProviderFallback(c.Provider, c.ModelTitle)
+			newLLM = modelDefs[defaultProvider]
 		}
-		models = append(models, newLLM(&c))
+		m := newLLM(&c)
+		applySuffixProbe(m)
+		models = append(models, m)
 	}
 	if len(models) == 0 {
-		zap.L().Fatal("No models available")
-		return fmt.Errorf("no models available")
+		return ErrNoModels
 	}
+	manager.mutex.Lock()
 	manager.models = models
+	manager.mutex.Unlock()
+	resetBreakers()
 	return nil
 }
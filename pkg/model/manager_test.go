@@ -0,0 +1,178 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"completion-agent/pkg/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// 从默认注册表读取回退计数
+func providerFallbackCount(t *testing.T, provider, model string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() != "model_provider_fallback_total" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["provider"] == provider && labels["model"] == model {
+				return m.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+func Test_InitUnknownProvider(t *testing.T) {
+	saved := config.Config
+	defer func() { config.Config = saved }()
+	config.Config = &config.SoftwareConfig{}
+
+	cfgs := []config.ModelConfig{
+		{Provider: "openia", ModelTitle: "typo-model"},
+		{Provider: "openai", ModelTitle: "gpt"},
+	}
+	before := providerFallbackCount(t, "openia", "typo-model")
+	if err := Init(cfgs); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	if _, ok := manager.models[0].(*SangforCompletion); !ok {
+		t.Errorf("unknown provider should fall back to sangfor, got %T", manager.models[0])
+	}
+	if _, ok := manager.models[1].(*OpenAICompletion); !ok {
+		t.Errorf("openai provider should be kept, got %T", manager.models[1])
+	}
+	if got := providerFallbackCount(t, "openia", "typo-model") - before; got != 1 {
+		t.Errorf("fallback metric increased by %v, want 1", got)
+	}
+	if got := providerFallbackCount(t, "openai", "gpt"); got != 0 {
+		t.Errorf("known provider should not be counted, got %v", got)
+	}
+
+	config.Config.StrictProvider = true
+	if err := Init(cfgs); err == nil {
+		t.Errorf("strict mode should reject unknown provider")
+	}
+}
+
+func Test_GetAutoModelSkipsOpenBreaker(t *testing.T) {
+	var cfgs []config.ModelConfig
+	if err := json.Unmarshal([]byte(`[
+		{"provider": "openai", "modelName": "bad", "breaker": {"failures": 2, "cooldown": "10s"}},
+		{"provider": "openai", "modelName": "good", "breaker": {"failures": 2, "cooldown": "10s"}}
+	]`), &cfgs); err != nil {
+		t.Fatal(err)
+	}
+	if err := Init(cfgs); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1000, 0)
+	savedNow := breakers.now
+	defer func() { breakers.now = savedNow }()
+	breakers.now = func() time.Time { return now }
+	bad, good := manager.models[0], manager.models[1]
+
+	// 取消不计为失败，一次失败不足以熔断
+	RecordResult(bad, StatusCanceled)
+	RecordResult(bad, StatusModelError)
+	if breakerOpen(bad) {
+		t.Fatal("breaker opened before reaching failures")
+	}
+	RecordResult(bad, StatusTimeout)
+	if !breakerOpen(bad) {
+		t.Fatal("breaker not opened after consecutive failures")
+	}
+	for i := 0; i < 4; i++ {
+		if m, _ := GetAutoModel(); m != good {
+			t.Fatalf("request %d routed to %s, want good", i, m.Config().ModelName)
+		}
+	}
+
+	// 所有模型都熔断时仍然返回模型
+	RecordResult(good, StatusAuthError)
+	RecordResult(good, StatusRateLimited)
+	if m, err := GetAutoModel(); m == nil || err != nil {
+		t.Fatal("no model returned while all breakers open")
+	}
+
+	// 熔断结束后恢复轮询，再失败一次立即重新熔断
+	now = now.Add(11 * time.Second)
+	first, _ := GetAutoModel()
+	second, _ := GetAutoModel()
+	seen := map[LLM]bool{first: true, second: true}
+	if !seen[bad] || !seen[good] {
+		t.Fatal("models not rotated after cooldown")
+	}
+	RecordResult(bad, StatusModelError)
+	if !breakerOpen(bad) {
+		t.Fatal("half-open breaker not reopened by a failure")
+	}
+	now = now.Add(11 * time.Second)
+	RecordResult(bad, StatusSuccess)
+	RecordResult(bad, StatusModelError)
+	if breakerOpen(bad) {
+		t.Fatal("success did not reset failures")
+	}
+}
+
+func Test_NoModels(t *testing.T) {
+	saved := manager.models
+	defer func() { manager.models = saved }()
+
+	if err := Init(nil); !errors.Is(err, ErrNoModels) {
+		t.Fatalf("Init error = %v, want ErrNoModels", err)
+	}
+	manager.models = nil
+	if m, err := GetAutoModel(); m != nil || !errors.Is(err, ErrNoModels) {
+		t.Fatalf("GetAutoModel = %v, %v, want ErrNoModels", m, err)
+	}
+	if _, err := GetModel(0); !errors.Is(err, ErrNoModels) {
+		t.Fatalf("GetModel error = %v, want ErrNoModels", err)
+	}
+
+	if err := Init([]config.ModelConfig{{Provider: "openai", ModelName: "only"}}); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := GetModel(0); err != nil || m.Config().ModelName != "only" {
+		t.Fatalf("GetModel(0) = %v, %v", m, err)
+	}
+	for _, idx := range []int{-1, 1} {
+		if m, err := GetModel(idx); m != nil || err == nil {
+			t.Errorf("GetModel(%d) should fail", idx)
+		}
+	}
+}
+
+// 服务先启动再异步初始化模型，初始化期间可能有请求读取模型列表，需在-race下通过
+func Test_InitConcurrentModels(t *testing.T) {
+	saved := manager.models
+	defer func() { manager.models = saved }()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			Models()
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		if err := Init([]config.ModelConfig{{Provider: "openai", ModelName: "concurrent"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+	if models := Models(); len(models) != 1 || models[0].Config().ModelName != "concurrent" {
+		t.Fatalf("unexpected models %v", models)
+	}
+}
@@ -3,17 +3,19 @@ package model
 import (
 	"bytes"
 	"completion-agent/pkg/config"
+	"completion-agent/pkg/tokenizers"
 	"context"
 	"encoding/json"
-	"fmt"
-	"io"
 	"net/http"
-	"strings"
+	"slices"
+
+	"go.uber.org/zap"
 )
 
 type OpenAICompletion struct {
-	cfg    *config.ModelConfig
-	client *http.Client
+	cfg       *config.ModelConfig
+	client    *http.Client
+	tokenizer *tokenizers.Tokenizer
 }
 
 func NewOpenAICompletion(c *config.ModelConfig) LLM {
@@ -22,6 +24,7 @@ func NewOpenAICompletion(c *config.ModelConfig) LLM {
 		client: &http.Client{
 			Timeout: c.Timeout.Duration(),
 		},
+		tokenizer: loadModelTokenizer(c),
 	}
 }
 
@@ -29,29 +32,49 @@ func (m *OpenAICompletion) Config() *config.ModelConfig {
 	return m.cfg
 }
 
-/**
- * 获取加了FIM标记的prompt文本
- */
-func (m *OpenAICompletion) getFimPrompt(prefix, suffix, codeContext string, cfg *config.ModelConfig) string {
-	return cfg.FimBegin + codeContext + "\n" + prefix + cfg.FimHole + suffix + cfg.FimEnd
+func (m *OpenAICompletion) supportsSeed() bool {
+	return true
+}
+
+func (m *OpenAICompletion) Tokenizer() *tokenizers.Tokenizer {
+	if m.tokenizer != nil {
+		return m.tokenizer
+	}
+	return tokenizers.GetTokenizer()
 }
 
 func (m *OpenAICompletion) Completions(ctx context.Context, p *CompletionParameter) (*CompletionResponse, CompletionStatus, error) {
-	var prefix string
-	if m.cfg.FimMode {
-		prefix = m.getFimPrompt(p.Prefix, p.Suffix, p.CodeContext, m.cfg)
-	} else {
-		if p.CodeContext != "" {
-			prefix = strings.Join([]string{p.CodeContext, p.Prefix}, "\n")
-		} else {
-			prefix = p.Prefix
-		}
+	body, status, err := m.request(ctx, p)
+	if err != nil {
+		return nil, status, err
+	}
+	var rsp CompletionResponse
+	if err := json.Unmarshal(body, &rsp); err != nil {
+		return nil, StatusServerError, err
 	}
+	return &rsp, StatusSuccess, nil
+}
+
+/**
+ * 按OpenAI v1/completions协议请求模型服务
+ * @param {context.Context} ctx - 请求上下文
+ * @param {*CompletionParameter} p - 补全参数
+ * @returns {[]byte, CompletionStatus, error} 返回模型服务的响应体，失败时返回状态和错误
+ * @description
+ * - 按BuildPrompt组装prompt(FIM模式或上下文+前缀)和请求体
+ * - FIM模式下模型配置的fimStop总是加入stop，与补全参数中的停用词去重，配置了maxStopWords时不超过该个数
+ * - 按模型配置的requestBody改名标准字段、合并附加字段
+ * - 最后合并客户端透传的字段，透传字段不会覆盖model、prompt等已有字段
+ * - 响应状态码非2xx时解析响应体中的错误信息，返回*ProviderError，按状态码区分认证失败、限流和其他错误
+ * - 响应体的解析由调用方负责，便于兼容不同的响应格式
+ */
+func (m *OpenAICompletion) request(ctx context.Context, p *CompletionParameter) ([]byte, CompletionStatus, error) {
+	prefix := BuildPrompt(m.cfg, p)
 	maxTokens := min(p.MaxTokens, m.cfg.MaxOutput)
 	data := map[string]interface{}{
 		"model":       m.cfg.ModelName,
 		"prompt":      prefix,
-		"stop":        p.Stop,
+		"stop":        requestStopWords(m.cfg, p.Stop),
 		"temperature": p.Temperature,
 		"max_tokens":  maxTokens,
 		"stream":      false,
@@ -59,6 +82,21 @@ func (m *OpenAICompletion) Completions(ctx context.Context, p *CompletionParamet
 	if !m.cfg.FimMode && p.Suffix != "" {
 		data["suffix"] = p.Suffix
 	}
+	if p.TopP > 0 {
+		data["top_p"] = p.TopP
+	}
+	if p.Seed != nil {
+		data["seed"] = *p.Seed
+	}
+	data = customizeBody(data, &m.cfg.RequestBody)
+	for k, v := range p.Extra {
+		// 透传字段不能覆盖请求体中已有的字段，也不能以标准字段的原名绕过改名
+		if _, exists := data[k]; exists || openAIBodyFields[k] {
+			zap.L().Debug("ignore reserved extra field", zap.String("completionID", p.CompletionID), zap.String("field", k))
+			continue
+		}
+		data[k] = v
+	}
 	// 将data转换为JSON
 	jsonData, err := json.Marshal(data)
 	if err != nil {
@@ -72,32 +110,99 @@ func (m *OpenAICompletion) Completions(ctx context.Context, p *CompletionParamet
 	}
 
 	// 设置请求头
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", m.cfg.Authorization)
+	setRequestHeaders(req, m.cfg)
 
 	// 发送请求
 	resp, err := m.client.Do(req)
 	if err != nil {
-		status := StatusServerError
-		switch err {
-		case context.Canceled:
-			status = StatusCanceled
-		case context.DeadlineExceeded:
-			status = StatusTimeout
-		}
-		return nil, status, err
+		return nil, requestErrorStatus(err), err
 	}
 	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
+	body, status, err := readResponseBody(m.cfg, resp.Body)
 	if err != nil {
-		return nil, StatusServerError, err
+		return nil, status, err
 	}
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return nil, StatusModelError, fmt.Errorf("invalid StatusCode(%d)", resp.StatusCode)
+		return nil, providerErrorStatus(resp.StatusCode), parseProviderError(resp.StatusCode, body)
 	}
-	var rsp CompletionResponse
-	if err := json.Unmarshal(body, &rsp); err != nil {
-		return nil, StatusServerError, err
+	return body, StatusSuccess, nil
+}
+
+/**
+ * 生成请求体中的停用词
+ * @param {*config.ModelConfig} cfg - 模型配置
+ * @param {[]string} stop - 补全参数中的停用词，系统停用词在前，请求中的停用词在后
+ * @returns {[]string} 返回去重后的停用词，配置了maxStopWords时不超过该个数
+ * @description
+ * - FIM模式下模型配置的结束符fimStop排在最前，截断时优先保留
+ * - 其余按补全参数中的顺序保留；超出maxStopWords的部分丢弃并记录告警日志
+ * - maxStopWords为0时不限制，vLLM等服务接受的停用词个数不止OpenAI官方接口的4个
+ */
+func requestStopWords(cfg *config.ModelConfig, stop []string) []string {
+	var words []string
+	if cfg.FimMode {
+		words = appendStopWords(words, cfg.FimStop...)
 	}
-	return &rsp, StatusSuccess, nil
+	words = appendStopWords(words, stop...)
+	if limit := cfg.MaxStopWords; limit > 0 && len(words) > limit {
+		zap.L().Warn("drop stop words over the model limit",
+			zap.String("model", cfg.ModelName),
+			zap.Int("maxStopWords", limit),
+			zap.Strings("dropped", words[limit:]))
+		words = words[:limit]
+	}
+	return words
+}
+
+// 追加停用词，跳过空字符串和已有的停用词
+func appendStopWords(words []string, add ...string) []string {
+	for _, w := range add {
+		if w != "" && !slices.Contains(words, w) {
+			words = append(words, w)
+		}
+	}
+	return words
+}
+
+// OpenAI协议请求体的标准字段，客户端透传的字段不能使用这些名称
+var openAIBodyFields = map[string]bool{
+	"model":       true,
+	"prompt":      true,
+	"suffix":      true,
+	"stop":        true,
+	"temperature": true,
+	"max_tokens":  true,
+	"top_p":       true,
+	"stream":      true,
+}
+
+/**
+ * 按配置定制OpenAI协议的请求体
+ * @param {map[string]interface{}} data - 标准字段组成的请求体
+ * @param {*config.RequestBodyConfig} cfg - 请求体定制配置
+ * @returns {map[string]interface{}} 返回定制后的请求体，未配置时原样返回
+ * @description
+ * - 先按rename改名标准字段，再合并extra中的字段
+ * - extra中与请求体已有字段同名的，override为false时保留已有字段
+ * @example
+ * data = customizeBody(data, &config.RequestBodyConfig{Rename: map[string]string{"max_tokens": "max_new_tokens"}})
+ */
+func customizeBody(data map[string]interface{}, cfg *config.RequestBodyConfig) map[string]interface{} {
+	if len(cfg.Rename) == 0 && len(cfg.Extra) == 0 {
+		return data
+	}
+	body := make(map[string]interface{}, len(data)+len(cfg.Extra))
+	for k, v := range data {
+		if name, ok := cfg.Rename[k]; ok && name != "" {
+			k = name
+		}
+		body[k] = v
+	}
+	for k, v := range cfg.Extra {
+		if _, exists := body[k]; exists && !cfg.Override {
+			continue
+		}
+		body[k] = v
+	}
+	return body
 }
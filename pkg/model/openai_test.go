@@ -0,0 +1,273 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"completion-agent/pkg/config"
+)
+
+func Test_OpenAITopP(t *testing.T) {
+	var body map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body = nil
+		json.NewDecoder(r.Body).Decode(&body)
+		w.Write([]byte(`{"choices": [{"text": "x"}]}`))
+	}))
+	defer srv.Close()
+	m := NewOpenAICompletion(&config.ModelConfig{Provider: "openai", CompletionsUrl: srv.URL, MaxOutput: 16})
+
+	if _, status, err := m.Completions(context.Background(), &CompletionParameter{Prefix: "a", MaxTokens: 16}); status != StatusSuccess {
+		t.Fatalf("unexpected status %s, error %v", status, err)
+	}
+	if _, ok := body["top_p"]; ok {
+		t.Errorf("top_p sent when unset: %v", body["top_p"])
+	}
+	if _, status, err := m.Completions(context.Background(), &CompletionParameter{Prefix: "a", MaxTokens: 16, TopP: 0.5}); status != StatusSuccess {
+		t.Fatalf("unexpected status %s, error %v", status, err)
+	}
+	if body["top_p"] != 0.5 {
+		t.Errorf("top_p = %v, want 0.5", body["top_p"])
+	}
+}
+
+func Test_OpenAIFimOrder(t *testing.T) {
+	var body map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body = nil
+		json.NewDecoder(r.Body).Decode(&body)
+		w.Write([]byte(`{"choices": [{"text": "x"}]}`))
+	}))
+	defer srv.Close()
+
+	cases := []struct {
+		order string
+		want  string
+	}{
+		{"", "<B>ctx\npre<H>suf<E>"},
+		{config.FimOrderPSM, "<B>ctx\npre<H>suf<E>"},
+		{config.FimOrderSPM, "<B><H>suf<E>ctx\npre"},
+	}
+	for _, c := range cases {
+		m := NewOpenAICompletion(&config.ModelConfig{
+			Provider:       "openai",
+			CompletionsUrl: srv.URL,
+			MaxOutput:      16,
+			FimMode:        true,
+			FimBegin:       "<B>",
+			FimHole:        "<H>",
+			FimEnd:         "<E>",
+			FimOrder:       c.order,
+		})
+		para := &CompletionParameter{Prefix: "pre", Suffix: "suf", CodeContext: "ctx", MaxTokens: 16}
+		if _, status, err := m.Completions(context.Background(), para); status != StatusSuccess {
+			t.Fatalf("%q: unexpected status %s, error %v", c.order, status, err)
+		}
+		if body["prompt"] != c.want {
+			t.Errorf("%q: prompt = %q, want %q", c.order, body["prompt"], c.want)
+		}
+		if _, ok := body["suffix"]; ok {
+			t.Errorf("%q: suffix sent separately in FIM mode", c.order)
+		}
+	}
+}
+
+func Test_CustomHeaders(t *testing.T) {
+	var header http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Clone()
+		w.Write([]byte(`{"choices": [{"text": "x"}]}`))
+	}))
+	defer srv.Close()
+
+	cfg := &config.ModelConfig{
+		CompletionsUrl: srv.URL,
+		MaxOutput:      16,
+		Authorization:  "Bearer sk-test",
+		Headers:        map[string]string{"X-Tenant": "team-a", "X-Model-Version": "2"},
+	}
+	constructors := []struct {
+		name   string
+		newLLM NewLLM
+	}{
+		{"NewOpenAICompletion", NewOpenAICompletion},
+		{"NewSangforCompletion", NewSangforCompletion},
+	}
+	for _, c := range constructors {
+		header = nil
+		if _, status, err := c.newLLM(cfg).Completions(context.Background(), &CompletionParameter{Prefix: "a", MaxTokens: 16}); status != StatusSuccess {
+			t.Fatalf("%s: unexpected status %s, error %v", c.name, status, err)
+		}
+		if header.Get("X-Tenant") != "team-a" || header.Get("X-Model-Version") != "2" {
+			t.Errorf("%s: custom headers not sent: %v", c.name, header)
+		}
+		if header.Get("Authorization") != "Bearer sk-test" || header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s: default headers missing: %v", c.name, header)
+		}
+	}
+}
+
+func Test_OpenAIRequestBody(t *testing.T) {
+	var body map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body = nil
+		json.NewDecoder(r.Body).Decode(&body)
+		w.Write([]byte(`{"choices": [{"text": "x"}]}`))
+	}))
+	defer srv.Close()
+
+	cfg := &config.ModelConfig{ModelName: "m", CompletionsUrl: srv.URL, MaxOutput: 16, RequestBody: config.RequestBodyConfig{
+		Rename: map[string]string{"max_tokens": "max_new_tokens", "stop": "stop_sequences"},
+		Extra:  map[string]interface{}{"repetition_penalty": 1.1, "model": "other", "max_new_tokens": 99},
+	}}
+	m := NewOpenAICompletion(cfg)
+	para := &CompletionParameter{Prefix: "a", MaxTokens: 8, Stop: []string{"\n"}}
+	if _, status, err := m.Completions(context.Background(), para); status != StatusSuccess {
+		t.Fatalf("unexpected status %s, error %v", status, err)
+	}
+	if _, ok := body["max_tokens"]; ok {
+		t.Errorf("renamed field still sent: %v", body)
+	}
+	if body["max_new_tokens"] != 8.0 || body["stop_sequences"] == nil {
+		t.Errorf("renamed fields missing: %v", body)
+	}
+	if body["repetition_penalty"] != 1.1 {
+		t.Errorf("extra field missing: %v", body)
+	}
+	// 默认不覆盖标准字段
+	if body["model"] != "m" || body["prompt"] != "a" {
+		t.Errorf("standard fields clobbered: %v", body)
+	}
+
+	cfg.RequestBody.Override = true
+	if _, status, err := m.Completions(context.Background(), para); status != StatusSuccess {
+		t.Fatalf("unexpected status %s, error %v", status, err)
+	}
+	if body["model"] != "other" || body["max_new_tokens"] != 99.0 {
+		t.Errorf("override not applied: %v", body)
+	}
+}
+
+func Test_OpenAIPassthrough(t *testing.T) {
+	var body map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body = nil
+		json.NewDecoder(r.Body).Decode(&body)
+		w.Write([]byte(`{"choices": [{"text": "x"}]}`))
+	}))
+	defer srv.Close()
+
+	m := NewOpenAICompletion(&config.ModelConfig{ModelName: "m", CompletionsUrl: srv.URL, MaxOutput: 16, RequestBody: config.RequestBodyConfig{
+		Rename: map[string]string{"max_tokens": "max_new_tokens"},
+	}})
+	para := &CompletionParameter{Prefix: "a", MaxTokens: 8, Extra: map[string]interface{}{
+		"seed":           7,
+		"model":          "other",
+		"prompt":         "injected",
+		"max_tokens":     1000,
+		"max_new_tokens": 1000,
+	}}
+	if _, status, err := m.Completions(context.Background(), para); status != StatusSuccess {
+		t.Fatalf("unexpected status %s, error %v", status, err)
+	}
+	if body["seed"] != 7.0 {
+		t.Errorf("extra field not forwarded: %v", body)
+	}
+	if body["model"] != "m" || body["prompt"] != "a" || body["max_new_tokens"] != 8.0 {
+		t.Errorf("reserved fields overridden: %v", body)
+	}
+	if _, ok := body["max_tokens"]; ok {
+		t.Errorf("renamed field reintroduced by extra: %v", body)
+	}
+}
+
+func Test_OpenAISeed(t *testing.T) {
+	var body map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body = nil
+		json.NewDecoder(r.Body).Decode(&body)
+		w.Write([]byte(`{"choices": [{"text": "x"}]}`))
+	}))
+	defer srv.Close()
+	cfg := &config.ModelConfig{CompletionsUrl: srv.URL, MaxOutput: 16}
+
+	m := NewOpenAICompletion(cfg)
+	if _, status, err := m.Completions(context.Background(), &CompletionParameter{Prefix: "a", MaxTokens: 16}); status != StatusSuccess {
+		t.Fatalf("unexpected status %s, error %v", status, err)
+	}
+	if _, ok := body["seed"]; ok {
+		t.Errorf("seed sent when unset: %v", body["seed"])
+	}
+	seed := 0
+	if _, status, err := m.Completions(context.Background(), &CompletionParameter{Prefix: "a", MaxTokens: 16, Seed: &seed}); status != StatusSuccess {
+		t.Fatalf("unexpected status %s, error %v", status, err)
+	}
+	if body["seed"] != 0.0 {
+		t.Errorf("seed = %v, want 0", body["seed"])
+	}
+
+	if !SupportsSeed(m) || !SupportsSeed(NewGenericCompletion(cfg)) {
+		t.Error("OpenAI protocol clients should support seed")
+	}
+	if SupportsSeed(NewSangforCompletion(cfg)) {
+		t.Error("sangfor client should not support seed")
+	}
+}
+
+func Test_OpenAIFimStop(t *testing.T) {
+	var body map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body = nil
+		json.NewDecoder(r.Body).Decode(&body)
+		w.Write([]byte(`{"choices": [{"text": "x"}]}`))
+	}))
+	defer srv.Close()
+	cfg := &config.ModelConfig{Provider: "openai", CompletionsUrl: srv.URL, MaxOutput: 16,
+		FimMode: true, FimStop: []string{"<|endoftext|>", "<|fim_pad|>"}}
+	m := NewOpenAICompletion(cfg)
+
+	p := &CompletionParameter{Prefix: "a", MaxTokens: 16, Stop: []string{"\n\n", "<|endoftext|>"}}
+	if _, status, err := m.Completions(context.Background(), p); status != StatusSuccess {
+		t.Fatalf("unexpected status %s, error %v", status, err)
+	}
+	want := []interface{}{"<|endoftext|>", "<|fim_pad|>", "\n\n"}
+	if got, _ := body["stop"].([]interface{}); !reflect.DeepEqual(got, want) {
+		t.Errorf("stop = %q, want %q", body["stop"], want)
+	}
+	if len(p.Stop) != 2 {
+		t.Errorf("parameter stop modified: %q", p.Stop)
+	}
+
+	// 非FIM模式不追加
+	cfg.FimMode = false
+	if _, status, err := m.Completions(context.Background(), p); status != StatusSuccess {
+		t.Fatalf("unexpected status %s, error %v", status, err)
+	}
+	if got, _ := body["stop"].([]interface{}); len(got) != 2 {
+		t.Errorf("stop = %q, want parameter stop only", body["stop"])
+	}
+
+	// 未配置maxStopWords时不限制个数
+	cfg.FimMode = true
+	p.Stop = []string{"\n\n", "\n}", "\n\tx", "\nfunc"}
+	if _, status, err := m.Completions(context.Background(), p); status != StatusSuccess {
+		t.Fatalf("unexpected status %s, error %v", status, err)
+	}
+	if got, _ := body["stop"].([]interface{}); len(got) != 6 {
+		t.Errorf("stop = %q, want all 6 stop words", body["stop"])
+	}
+
+	// 超过maxStopWords时截去末尾的停用词，结束符优先保留
+	cfg.MaxStopWords = 4
+	if _, status, err := m.Completions(context.Background(), p); status != StatusSuccess {
+		t.Fatalf("unexpected status %s, error %v", status, err)
+	}
+	want = []interface{}{"<|endoftext|>", "<|fim_pad|>", "\n\n", "\n}"}
+	if got, _ := body["stop"].([]interface{}); !reflect.DeepEqual(got, want) {
+		t.Errorf("stop = %q, want %q", body["stop"], want)
+	}
+}
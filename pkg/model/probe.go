@@ -0,0 +1,111 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// 探测请求的超时时间
+const probeTimeout = 10 * time.Second
+
+// 探测用的代码：后缀已经写好了函数之后的代码，支持后缀的模型只会补全中间的表达式
+const (
+	probePrefix = "def add(a, b):\n    return "
+	probeSuffix = "\n\n\nprint(add(1, 2))\n"
+	probeMarker = "print(add(1, 2))"
+)
+
+/**
+ * 各模型服务的后缀探测结果
+ * @description
+ * - 按模型名称和补全地址索引，重新初始化模型时不重复探测
+ * - 只缓存有结论的探测，探测失败的模型下次初始化时重新探测
+ */
+var suffixProbes = struct {
+	results map[string]bool
+	mutex   sync.Mutex
+}{results: make(map[string]bool)}
+
+/**
+ * 探测模型服务是否支持原生suffix
+ * @param {LLM} m - 要探测的模型，按非FIM模式发送请求
+ * @returns {bool, error} 返回是否支持，无法得出结论时返回错误
+ * @description
+ * - 发送一个带后缀的小请求，补全文本中重复了后缀的代码，说明模型忽略了后缀，不支持原生suffix
+ * - 模型服务以400/422拒绝带suffix的请求时，同样视为不支持
+ * - 网络错误、超时、认证失败等其他错误无法得出结论
+ */
+func probeSuffixSupport(m LLM) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	rsp, status, err := m.Completions(ctx, &CompletionParameter{
+		CompletionID: "suffix-probe",
+		Model:        m.Config().ModelName,
+		MaxTokens:    32,
+		Prefix:       probePrefix,
+		Suffix:       probeSuffix,
+	})
+	if err != nil {
+		var pe *ProviderError
+		if errors.As(err, &pe) && (pe.StatusCode == http.StatusBadRequest || pe.StatusCode == http.StatusUnprocessableEntity) {
+			return false, nil
+		}
+		return false, err
+	}
+	if status != StatusSuccess || rsp == nil || len(rsp.Choices) == 0 {
+		return false, errors.New("no completion returned")
+	}
+	return !strings.Contains(rsp.Choices[0].Text, probeMarker), nil
+}
+
+/**
+ * 按探测结果选择FIM模式或原生suffix
+ * @param {LLM} m - 新创建的模型实例
+ * @description
+ * - 只处理开启了suffixProbe且未开启fimMode的模型
+ * - 未配置FIM标记时无法切换，记录告警后不探测
+ * - 探测到不支持原生suffix时开启模型配置的fimMode
+ * - 探测失败时保持原配置
+ * - 在模型投入使用前调用，之后不再修改配置
+ */
+func applySuffixProbe(m LLM) {
+	cfg := m.Config()
+	if !cfg.SuffixProbe || cfg.FimMode {
+		return
+	}
+	if cfg.FimBegin == "" || cfg.FimHole == "" || cfg.FimEnd == "" {
+		zap.L().Warn("Suffix probe skipped, FIM tokens are not configured",
+			zap.String("model", cfg.ModelTitle))
+		return
+	}
+	key := cfg.ModelName + "@" + cfg.CompletionsUrl
+	suffixProbes.mutex.Lock()
+	supported, ok := suffixProbes.results[key]
+	suffixProbes.mutex.Unlock()
+	if !ok {
+		var err error
+		supported, err = probeSuffixSupport(m)
+		if err != nil {
+			zap.L().Warn("Suffix probe failed, keep the configured mode",
+				zap.String("model", cfg.ModelTitle),
+				zap.Error(err))
+			return
+		}
+		suffixProbes.mutex.Lock()
+		suffixProbes.results[key] = supported
+		suffixProbes.mutex.Unlock()
+	}
+	if !supported {
+		cfg.FimMode = true
+	}
+	zap.L().Info("Suffix probe finished",
+		zap.String("model", cfg.ModelTitle),
+		zap.Bool("suffixSupported", supported),
+		zap.Bool("fimMode", cfg.FimMode))
+}
@@ -0,0 +1,70 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"completion-agent/pkg/config"
+)
+
+func Test_SuffixProbe(t *testing.T) {
+	// 忽略后缀、直接续写前缀的模型服务
+	var probes atomic.Int32
+	var body map[string]interface{}
+	ignoring := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body = nil
+		json.NewDecoder(r.Body).Decode(&body)
+		if body["suffix"] != nil {
+			probes.Add(1)
+		}
+		w.Write([]byte(`{"choices": [{"text": "a + b\n\nprint(add(1, 2))\n"}]}`))
+	}))
+	defer ignoring.Close()
+	// 正确填充中间部分的模型服务
+	infilling := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"choices": [{"text": "a + b"}]}`))
+	}))
+	defer infilling.Close()
+
+	fim := config.ModelConfig{Provider: "openai", FimBegin: "<B>", FimHole: "<H>", FimEnd: "<E>", MaxOutput: 16, SuffixProbe: true}
+	ignoringCfg, infillingCfg, unprobedCfg := fim, fim, fim
+	ignoringCfg.ModelName, ignoringCfg.CompletionsUrl = "probe-ignoring", ignoring.URL
+	infillingCfg.ModelName, infillingCfg.CompletionsUrl = "probe-infilling", infilling.URL
+	unprobedCfg.ModelName, unprobedCfg.CompletionsUrl, unprobedCfg.SuffixProbe = "probe-disabled", ignoring.URL, false
+	if err := Init([]config.ModelConfig{ignoringCfg, infillingCfg, unprobedCfg}); err != nil {
+		t.Fatal(err)
+	}
+	models := Models()
+	if !models[0].Config().FimMode {
+		t.Error("model ignoring suffix not switched to FIM mode")
+	}
+	if models[1].Config().FimMode {
+		t.Error("model supporting suffix switched to FIM mode")
+	}
+	if models[2].Config().FimMode {
+		t.Error("model without suffixProbe switched to FIM mode")
+	}
+	if probes.Load() != 1 {
+		t.Fatalf("probe requests = %d, want 1", probes.Load())
+	}
+
+	// 切换后按FIM模式组装prompt，不再发送suffix
+	if _, status, err := models[0].Completions(context.Background(), &CompletionParameter{Prefix: "pre", Suffix: "suf", MaxTokens: 16}); status != StatusSuccess {
+		t.Fatalf("unexpected status %s, error %v", status, err)
+	}
+	if body["prompt"] != "<B>\npre<H>suf<E>" || body["suffix"] != nil {
+		t.Errorf("unexpected request after switching to FIM: %v", body)
+	}
+
+	// 重新初始化时使用缓存的探测结果
+	if err := Init([]config.ModelConfig{ignoringCfg}); err != nil {
+		t.Fatal(err)
+	}
+	if !Models()[0].Config().FimMode || probes.Load() != 1 {
+		t.Errorf("probe not cached: fimMode %v, probe requests %d", Models()[0].Config().FimMode, probes.Load())
+	}
+}
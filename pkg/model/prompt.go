@@ -0,0 +1,54 @@
+package model
+
+import "completion-agent/pkg/config"
+
+/**
+ * 组装加了FIM标记的prompt文本
+ * @param {*config.ModelConfig} cfg - 模型配置，包含FIM标记和拼接顺序
+ * @param {string} prefix - 代码前缀文本
+ * @param {string} suffix - 代码后缀文本
+ * @param {string} codeContext - 代码上下文文本
+ * @returns {string} 返回添加了FIM标记的完整prompt文本
+ * @description
+ * - FIM模式下prompt的组装方式，由BuildPrompt调用
+ * - fimOrder为psm(默认)时格式为：FimBegin + codeContext + "\n" + prefix + FimHole + suffix + FimEnd
+ * - fimOrder为spm时格式为：FimBegin + FimHole + suffix + FimEnd + codeContext + "\n" + prefix，模型接着前缀续写
+ * @example
+ * cfg := &config.ModelConfig{
+ *     FimBegin: "<fim-prefix>",
+ *     FimHole: "<fim-suffix>",
+ *     FimEnd: "<fim-middle>",
+ * }
+ * prompt := FimPrompt(cfg, "function test", "}", "context")
+ * // prompt = "<fim-prefix>context\nfunction test<fim-suffix>}<fim-middle>"
+ */
+func FimPrompt(cfg *config.ModelConfig, prefix, suffix, codeContext string) string {
+	if cfg.FimOrder == config.FimOrderSPM {
+		return cfg.FimBegin + cfg.FimHole + suffix + cfg.FimEnd + codeContext + "\n" + prefix
+	}
+	return cfg.FimBegin + codeContext + "\n" + prefix + cfg.FimHole + suffix + cfg.FimEnd
+}
+
+/**
+ * 组装发给模型服务的prompt文本
+ * @param {*config.ModelConfig} cfg - 模型配置
+ * @param {*CompletionParameter} p - 补全参数，包含截断后的前缀、后缀和上下文
+ * @returns {string} 返回请求体中prompt字段的内容
+ * @description
+ * - prompt由模型客户端在请求时组装，这里是唯一的组装位置；补全处理器只负责截断各部分，不自行拼接
+ * - FIM模式下按FimPrompt拼接前缀、后缀和上下文
+ * - 非FIM模式下为上下文 + "\n" + 前缀，后缀由客户端作为单独的suffix字段发送
+ * - 统计prompt的token数时应基于本函数的结果，与实际发送的内容一致
+ * @example
+ * prompt := BuildPrompt(&config.ModelConfig{}, &CompletionParameter{Prefix: "x := ", CodeContext: "// ctx"})
+ * // prompt = "// ctx\nx := "
+ */
+func BuildPrompt(cfg *config.ModelConfig, p *CompletionParameter) string {
+	if cfg.FimMode {
+		return FimPrompt(cfg, p.Prefix, p.Suffix, p.CodeContext)
+	}
+	if p.CodeContext != "" {
+		return p.CodeContext + "\n" + p.Prefix
+	}
+	return p.Prefix
+}
@@ -3,15 +3,18 @@ package model
 import (
 	"bytes"
 	"completion-agent/pkg/config"
+	"completion-agent/pkg/tokenizers"
 	"context"
 	"encoding/json"
-	"io"
+	"errors"
+	"fmt"
 	"net/http"
 )
 
 type SangforCompletion struct {
-	cfg    *config.ModelConfig
-	client *http.Client
+	cfg       *config.ModelConfig
+	client    *http.Client
+	tokenizer *tokenizers.Tokenizer
 }
 
 func NewSangforCompletion(c *config.ModelConfig) LLM {
@@ -20,6 +23,7 @@ func NewSangforCompletion(c *config.ModelConfig) LLM {
 		client: &http.Client{
 			Timeout: c.Timeout.Duration(),
 		},
+		tokenizer: loadModelTokenizer(c),
 	}
 }
 
@@ -27,6 +31,13 @@ func (m *SangforCompletion) Config() *config.ModelConfig {
 	return m.cfg
 }
 
+func (m *SangforCompletion) Tokenizer() *tokenizers.Tokenizer {
+	if m.tokenizer != nil {
+		return m.tokenizer
+	}
+	return tokenizers.GetTokenizer()
+}
+
 func (m *SangforCompletion) Completions(ctx context.Context, p *CompletionParameter) (*CompletionResponse, CompletionStatus, error) {
 	// 将data转换为JSON
 	jsonData, err := json.Marshal(p)
@@ -41,29 +52,63 @@ func (m *SangforCompletion) Completions(ctx context.Context, p *CompletionParame
 	}
 
 	// 设置请求头
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", m.cfg.Authorization)
+	setRequestHeaders(req, m.cfg)
 
 	// 发送请求
 	resp, err := m.client.Do(req)
 	if err != nil {
-		status := StatusServerError
-		switch err {
-		case context.Canceled:
-			status = StatusCanceled
-		case context.DeadlineExceeded:
-			status = StatusTimeout
-		}
-		return nil, status, err
+		return nil, requestErrorStatus(err), err
 	}
 	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
+	body, status, err := readResponseBody(m.cfg, resp.Body)
 	if err != nil {
-		return nil, StatusServerError, err
+		return nil, status, err
 	}
 	var rsp CompletionResponse
-	if err := json.Unmarshal(body, &rsp); err != nil {
-		return nil, StatusServerError, err
+	parseErr := json.Unmarshal(body, &rsp)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		// 响应体明确给出了错误状态时以其为准，否则按HTTP状态码判断
+		if parseErr == nil && rsp.Status != "" && rsp.Status != StatusSuccess {
+			return &rsp, rsp.Status, parseProviderError(resp.StatusCode, body)
+		}
+		return nil, providerErrorStatus(resp.StatusCode), parseProviderError(resp.StatusCode, body)
+	}
+	if parseErr != nil {
+		return nil, StatusServerError, parseErr
+	}
+	return &rsp, sangforStatus(&rsp), sangforError(&rsp)
+}
+
+/**
+ * 判断sangfor/v2响应的补全状态
+ * @param {*CompletionResponse} rsp - 解析后的响应
+ * @returns {CompletionStatus} 返回补全状态
+ * @description
+ * - 响应给出了status时直接使用
+ * - 未给出status时，有choices视为成功，否则视为模型响应错误，避免把无法识别的响应当作成功
+ */
+func sangforStatus(rsp *CompletionResponse) CompletionStatus {
+	switch {
+	case rsp.Status != "":
+		return rsp.Status
+	case len(rsp.Choices) > 0:
+		return StatusSuccess
+	default:
+		return StatusModelError
+	}
+}
+
+// 非成功状态的错误说明，优先使用响应中的error字段
+func sangforError(rsp *CompletionResponse) error {
+	status := sangforStatus(rsp)
+	switch {
+	case status == StatusSuccess:
+		return nil
+	case rsp.Error != "":
+		return errors.New(rsp.Error)
+	case rsp.Status == "":
+		return errors.New("model response has neither status nor choices")
+	default:
+		return fmt.Errorf("model returned status '%s'", status)
 	}
-	return &rsp, rsp.Status, nil
 }
@@ -0,0 +1,56 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"completion-agent/pkg/config"
+)
+
+func Test_SangforStatus(t *testing.T) {
+	cases := []struct {
+		name   string
+		code   int
+		body   string
+		status CompletionStatus
+		err    string
+	}{
+		{"success", 200, `{"status": "success", "choices": [{"text": "x"}]}`, StatusSuccess, ""},
+		{"status omitted", 200, `{"choices": [{"text": "x"}]}`, StatusSuccess, ""},
+		{"empty choices", 200, `{"choices": []}`, StatusModelError, "model response has neither status nor choices"},
+		{"unknown shape", 200, `{"result": "x"}`, StatusModelError, "model response has neither status nor choices"},
+		{"malformed", 200, `{"choices": [`, StatusServerError, ""},
+		{"upstream status", 200, `{"status": "busy"}`, StatusBusy, "model returned status 'busy'"},
+		{"upstream error", 200, `{"status": "timeout", "error": "inference timeout"}`, StatusTimeout, "inference timeout"},
+		{"http error with status", 500, `{"status": "serverError", "error": "oom"}`, StatusServerError, "model error (500): oom"},
+		{"http error", 502, `Bad Gateway`, StatusModelError, "model error (502): Bad Gateway"},
+		{"http error with success body", 500, `{"status": "success", "choices": [{"text": "x"}]}`, StatusModelError, ""},
+	}
+	for _, c := range cases {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(c.code)
+			w.Write([]byte(c.body))
+		}))
+		m := NewSangforCompletion(&config.ModelConfig{CompletionsUrl: srv.URL, MaxOutput: 16})
+		_, status, err := m.Completions(context.Background(), &CompletionParameter{Prefix: "x", MaxTokens: 16})
+		srv.Close()
+		if status != c.status {
+			t.Errorf("%s: status %s, want %s", c.name, status, c.status)
+		}
+		if (status == StatusSuccess) != (err == nil) {
+			t.Errorf("%s: status %s with error %v", c.name, status, err)
+		}
+		if c.err != "" && (err == nil || err.Error() != c.err) {
+			t.Errorf("%s: error %v, want %q", c.name, err, c.err)
+		}
+		if c.code != 200 {
+			var pe *ProviderError
+			if !errors.As(err, &pe) || pe.StatusCode != c.code {
+				t.Errorf("%s: expected ProviderError with status %d, got %v", c.name, c.code, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package parser
+
+import "strings"
+
+/**
+ * Cap a completion to at most maxLines lines, cutting at a syntactically safe point
+ * @param {string} text - The completion text to be processed
+ * @param {string} prefix - The prefix text before cursor position
+ * @param {string} language - Programming language identifier
+ * @param {int} maxLines - Maximum number of lines to keep, non-positive means unlimited
+ * @returns {string} Completion text with at most maxLines lines, or text unchanged if it is short enough
+ * @description
+ * - Prefers the last cut within maxLines that doesn't leave a block opened by the completion unfinished:
+ *   for indentation-scoped languages (python) the line after the cut is not indented deeper than the
+ *   completion's first line; for other languages no bracket opened by the completion is still open
+ * - Falls back to cutting right at the maxLines-th line when no such point exists
+ * - Trailing blank lines don't count, and trailing whitespace is removed after cutting
+ * @example
+ * processed := CutMaxLines("if ok {\n\ta()\n}\nb()\nc()", "", "go", 4)
+ * // processed will be "if ok {\n\ta()\n}\nb()"
+ * processed = CutMaxLines("if ok {\n\ta()\n\tb()\n}", "", "go", 2)
+ * // processed will be "if ok {\n\ta()", no safe point within two lines
+ */
+func CutMaxLines(text, prefix, language string, maxLines int) string {
+	if maxLines <= 0 {
+		return text
+	}
+	lines := strings.Split(strings.TrimRight(text, " \t\r\n"), "\n")
+	if len(lines) <= maxLines {
+		return text
+	}
+	var safe func(n int) bool
+	if indentScopedLanguages[strings.ToLower(language)] {
+		safe = indentSafeCuts(lines, prefix)
+	} else {
+		safe = bracketSafeCuts(lines, language)
+	}
+	keep := maxLines
+	for n := maxLines; n > 0; n-- {
+		if safe(n) {
+			keep = n
+			break
+		}
+	}
+	return strings.TrimRight(strings.Join(lines[:keep], "\n"), " \t\r\n")
+}
+
+/**
+ * Find cuts that close every bracket opened by the completion
+ * @param {[]string} lines - Completion lines
+ * @param {string} language - Programming language identifier
+ * @returns {func(int) bool} Reports whether keeping the first n lines leaves no bracket opened by the completion open
+ */
+func bracketSafeCuts(lines []string, language string) func(n int) bool {
+	depths := make([]int, len(lines))
+	text := strings.Join(lines, "\n")
+	lineEnd, line, depth := len(lines[0]), 0, 0
+	walkBrackets(text, language, func(i, d int) bool {
+		for i > lineEnd {
+			depths[line] = depth
+			line++
+			lineEnd += 1 + len(lines[line])
+		}
+		depth = d
+		return true
+	})
+	for ; line < len(lines); line++ {
+		depths[line] = depth
+	}
+	return func(n int) bool {
+		return depths[n-1] <= 0
+	}
+}
+
+/**
+ * Find cuts that don't split a block nested inside the completion
+ * @param {[]string} lines - Completion lines
+ * @param {string} prefix - The prefix text before cursor position, gives the first line's indentation
+ * @returns {func(int) bool} Reports whether the next non-blank line after the first n lines is
+ *   indented no deeper than the completion's first line
+ */
+func indentSafeCuts(lines []string, prefix string) func(n int) bool {
+	prefixLines := strings.Split(prefix, "\n")
+	baseIndent := leadingIndent(prefixLines[len(prefixLines)-1] + lines[0])
+	return func(n int) bool {
+		for _, line := range lines[n:] {
+			if strings.TrimSpace(line) != "" {
+				return leadingIndent(line) <= baseIndent
+			}
+		}
+		return true
+	}
+}
@@ -0,0 +1,32 @@
+package parser
+
+import "testing"
+
+func Test_CutMaxLines(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		prefix   string
+		language string
+		maxLines int
+		want     string
+	}{
+		{"short enough", "a()\nb()\n", "", "go", 2, "a()\nb()\n"},
+		{"unlimited", "a()\nb()\nc()", "", "go", 0, "a()\nb()\nc()"},
+		{"plain lines", "a()\nb()\nc()", "", "go", 2, "a()\nb()"},
+		{"after closed block", "if ok {\n\ta()\n}\nb()\nc()", "", "go", 4, "if ok {\n\ta()\n}\nb()"},
+		{"back off from open block", "a()\nif ok {\n\tb()\n\tc()\n}", "", "go", 3, "a()"},
+		{"no safe point", "if ok {\n\ta()\n\tb()\n}", "", "go", 2, "if ok {\n\ta()"},
+		{"brackets in strings", "a(\")\")\nb()\nc()", "", "go", 2, "a(\")\")\nb()"},
+		{"closing enclosing scope", "return x\n}\n\nfunc next() {\n}", "func f() {\n\t", "go", 3, "return x\n}"},
+		{"python nested block", "x = 1\n    if x:\n        y = 2\n        z = 3\n    w = 4", "    ", "python", 3, "x = 1"},
+		{"python dedent", "x = 1\n    y = 2\nz = 3\nw = 4", "if a:\n    ", "python", 3, "x = 1\n    y = 2\nz = 3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CutMaxLines(tt.text, tt.prefix, tt.language, tt.maxLines); got != tt.want {
+				t.Errorf("CutMaxLines() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
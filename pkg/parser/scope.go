@@ -0,0 +1,154 @@
+package parser
+
+import "strings"
+
+// Languages whose blocks are delimited by indentation instead of braces
+var indentScopedLanguages = map[string]bool{
+	"python": true,
+}
+
+/**
+ * Cut a completion right after the scope opened at the cursor closes
+ * @param {string} text - The completion text to be processed
+ * @param {string} prefix - The prefix text before cursor position
+ * @param {string} language - Programming language identifier
+ * @returns {string} Completion text ending where the cursor's scope closes, or text unchanged if it never closes
+ * @description
+ * - Indentation-scoped languages (python) end the scope at the first line dedented
+ *   below the cursor's block; that line and everything after it are dropped
+ * - Other languages track (), [] and {} nesting from the cursor, skipping string literals
+ *   and line comments; the completion ends right after the bracket closing the scope
+ * - Used for block completion requests, so the model's extra code after the block is discarded
+ * @example
+ * // prefix: "func add(a, b int) int {\n\t"
+ * processed := CutScopeEnd("return a + b\n}\n\nfunc sub() {}", prefix, "go")
+ * // processed will be "return a + b\n}"
+ */
+func CutScopeEnd(text, prefix, language string) string {
+	if indentScopedLanguages[strings.ToLower(language)] {
+		return cutIndentScopeEnd(text, prefix)
+	}
+	return cutBracketScopeEnd(text, language)
+}
+
+/**
+ * Cut a completion at the bracket closing the scope opened at the cursor
+ * @param {string} text - The completion text to be processed
+ * @param {string} language - Programming language identifier, decides the line comment marker
+ * @returns {string} Processed text ending with the closing bracket
+ */
+func cutBracketScopeEnd(text, language string) string {
+	end := len(text)
+	walkBrackets(text, language, func(i, depth int) bool {
+		if depth < 0 {
+			end = i + 1
+			return false
+		}
+		return true
+	})
+	return text[:end]
+}
+
+// lineCommentMarker returns the line comment marker of a language
+func lineCommentMarker(language string) string {
+	switch strings.ToLower(language) {
+	case "shell", "bash", "ruby", "perl", "r", "yaml", "toml":
+		return "#"
+	case "sql", "lua":
+		return "--"
+	default:
+		return "//"
+	}
+}
+
+/**
+ * Walk the (), [] and {} brackets of a code text
+ * @param {string} text - The code text to walk
+ * @param {string} language - Programming language identifier, decides the line comment marker
+ * @param {func(int, int) bool} visit - Called with the byte offset of every bracket and the nesting
+ *   depth after it, relative to the start of text; returning false stops the walk
+ * @description
+ * - Brackets inside string literals and line comments are skipped
+ * - Unclosed strings other than backtick strings end at the line end
+ */
+func walkBrackets(text, language string, visit func(i, depth int) bool) {
+	lineComment := lineCommentMarker(language)
+	depth := 0
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		ch := text[i]
+		if quote != 0 {
+			switch {
+			case ch == '\\' && quote != '`':
+				i++
+			case ch == quote:
+				quote = 0
+			case ch == '\n' && quote != '`':
+				// 字符串未闭合，按行结束处理
+				quote = 0
+			}
+			continue
+		}
+		if strings.HasPrefix(text[i:], lineComment) {
+			if end := strings.IndexByte(text[i:], '\n'); end >= 0 {
+				i += end
+				continue
+			}
+			break
+		}
+		switch ch {
+		case '"', '\'', '`':
+			quote = ch
+		case '(', '[', '{':
+			depth++
+			if !visit(i, depth) {
+				return
+			}
+		case ')', ']', '}':
+			depth--
+			if !visit(i, depth) {
+				return
+			}
+		}
+	}
+}
+
+/**
+ * Cut a completion at the first line dedented out of the cursor's block
+ * @param {string} text - The completion text to be processed
+ * @param {string} prefix - The prefix text before cursor position
+ * @returns {string} Processed text without the dedented line and what follows
+ * @description
+ * - The block indentation is taken from the first non-blank completion line,
+ *   measured together with the cursor line prefix when the cursor line has no code yet
+ * - When the cursor line already has code, the block is the one that line belongs to
+ */
+func cutIndentScopeEnd(text, prefix string) string {
+	prefixLines := strings.Split(prefix, "\n")
+	linePrefix := prefixLines[len(prefixLines)-1]
+	lines := strings.Split(text, "\n")
+
+	blockIndent := -1
+	if strings.TrimSpace(linePrefix) != "" {
+		blockIndent = leadingIndent(linePrefix)
+	}
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if i == 0 {
+			if blockIndent < 0 {
+				blockIndent = leadingIndent(linePrefix + line)
+			}
+			continue
+		}
+		if blockIndent < 0 {
+			blockIndent = leadingIndent(line)
+			continue
+		}
+		if leadingIndent(line) < blockIndent {
+			return strings.TrimRight(strings.Join(lines[:i], "\n"), " \t\r\n")
+		}
+	}
+	return text
+}
@@ -53,6 +53,23 @@ func NeedSingleCompletion(cursorLinePrefix, cursorLineSuffix, language string) b
 	return true
 }
 
+/**
+ * CursorLine 从完整的前缀/后缀中提取光标所在行的文本
+ * @param prefix 光标之前的全部文本
+ * @param suffix 光标之后的全部文本
+ * @return linePrefix 光标行中光标之前的部分，前缀以换行结尾时为空
+ * @return lineSuffix 光标行中光标之后的部分，不含行尾的换行
+ * @description
+ * 支持\n和\r\n换行，返回的文本不含\r
+ * 前缀为空(光标在文件开头)或后缀为空(光标在文件末尾)时对应部分为空
+ * 结果可直接传给NeedSingleCompletion
+ */
+func CursorLine(prefix, suffix string) (linePrefix, lineSuffix string) {
+	linePrefix = prefix[strings.LastIndex(prefix, "\n")+1:]
+	lineSuffix, _, _ = strings.Cut(suffix, "\n")
+	return strings.TrimSuffix(linePrefix, "\r"), strings.TrimSuffix(lineSuffix, "\r")
+}
+
 /**
  * getCodeBlockKeywords 获取指定语言的关键词列表
  * @param language 编程语言类型
@@ -0,0 +1,41 @@
+package parser
+
+import "testing"
+
+func Test_CursorLine(t *testing.T) {
+	cases := []struct {
+		name       string
+		prefix     string
+		suffix     string
+		linePrefix string
+		lineSuffix string
+	}{
+		{"middle of line", "func f() {\n\tx := ", "y\n}", "\tx := ", "y"},
+		{"empty prefix", "", "package main\n", "", "package main"},
+		{"empty suffix at end of file", "a\nreturn x", "", "return x", ""},
+		{"prefix ends at newline", "a := 1\n", "\nb := 2", "", ""},
+		{"crlf", "a := 1\r\n\tb := ", "c\r\nd", "\tb := ", "c"},
+		{"prefix ends at crlf", "a := 1\r\n", "\r\n", "", ""},
+		{"single line", "x := ", "y", "x := ", "y"},
+		{"both empty", "", "", "", ""},
+	}
+	for _, c := range cases {
+		linePrefix, lineSuffix := CursorLine(c.prefix, c.suffix)
+		if linePrefix != c.linePrefix || lineSuffix != c.lineSuffix {
+			t.Errorf("%s: got (%q, %q), want (%q, %q)", c.name, linePrefix, lineSuffix, c.linePrefix, c.lineSuffix)
+		}
+	}
+}
+
+func Test_NeedSingleCompletionCursorLine(t *testing.T) {
+	// 光标行后缀非空，单行
+	linePrefix, lineSuffix := CursorLine("x := foo(", ")\n")
+	if !NeedSingleCompletion(linePrefix, lineSuffix, "go") {
+		t.Error("expected single line when cursor line has suffix")
+	}
+	// 光标在空行开头，多行
+	linePrefix, lineSuffix = CursorLine("func f() {\r\n", "\r\n}")
+	if NeedSingleCompletion(linePrefix, lineSuffix, "go") {
+		t.Error("expected multi line on empty cursor line")
+	}
+}
@@ -625,3 +625,77 @@ func IsValidBrackets(text string) bool {
 
 	return len(stack) == 0
 }
+
+/**
+ * Count the leading indentation of a line
+ * @param {string} line - The line to measure
+ * @returns {int} Number of leading spaces and tabs
+ */
+func leadingIndent(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " \t"))
+}
+
+/**
+ * Cut completion lines that would dedent below the code following the cursor
+ * @param {string} text - The completion text to be processed
+ * @param {string} prefix - The prefix text before cursor position
+ * @param {string} suffix - The suffix text after cursor position
+ * @returns {string} Processed text whose last line keeps the suffix's indentation valid
+ * @description
+ * - Only applies when the rest of the cursor line in suffix is blank
+ * - Takes the indentation of the first non-blank suffix line after the cursor line as the floor
+ * - The first completion line is measured together with the cursor line prefix,
+ *   and is only checked when the cursor line has no code before the cursor
+ * - Cuts the completion at the first line indented less than the floor, unless that line is
+ *   the last one and opens a block (ends with ':'), which the suffix then continues
+ * - Intended for indentation-sensitive languages such as python
+ * @example
+ * // prefix: "    for item in items:\n        ", suffix: "\n    return result"
+ * processed := CutSuffixIndent("result += item\nprint(result)", prefix, suffix)
+ * // processed will be "result += item"
+ */
+func CutSuffixIndent(text, prefix, suffix string) string {
+	suffixLines := strings.Split(suffix, "\n")
+	// 光标行后面还有代码时属于行内补全，不处理
+	if strings.TrimSpace(suffixLines[0]) != "" {
+		return text
+	}
+	floor := 0
+	for _, line := range suffixLines[1:] {
+		if strings.TrimSpace(line) != "" {
+			floor = leadingIndent(line)
+			break
+		}
+	}
+	if floor == 0 {
+		return text
+	}
+
+	prefixLines := strings.Split(prefix, "\n")
+	linePrefix := prefixLines[len(prefixLines)-1]
+	lines := strings.Split(text, "\n")
+	lastLine := len(lines) - 1
+	for lastLine > 0 && strings.TrimSpace(lines[lastLine]) == "" {
+		lastLine--
+	}
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if i == 0 {
+			// 光标前已有代码时，首行是对该行的续写
+			if strings.TrimSpace(linePrefix) != "" {
+				continue
+			}
+			line = linePrefix + line
+		}
+		if leadingIndent(line) >= floor {
+			continue
+		}
+		if i == lastLine && strings.HasSuffix(strings.TrimSpace(line), ":") {
+			break
+		}
+		return strings.TrimRight(strings.Join(lines[:i], "\n"), " \t\r\n")
+	}
+	return text
+}
@@ -0,0 +1,160 @@
+package selftest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"completion-agent/pkg/codebase_context"
+	"completion-agent/pkg/config"
+	"completion-agent/pkg/model"
+	"completion-agent/pkg/tokenizers"
+)
+
+// 每个模型试补全的超时时间
+const modelTimeout = 30 * time.Second
+
+// 试补全使用的提示词，足够短，任何代码模型都能快速响应
+const (
+	probePrefix = "def add(a, b):\n    return "
+	probeSuffix = "\n"
+)
+
+/**
+ * 自检项结果
+ * @description
+ * - Err为nil且Skipped为false时表示通过
+ * - Skipped表示该项未配置，不计入失败
+ */
+type Check struct {
+	Name     string
+	Err      error
+	Skipped  bool
+	Duration time.Duration
+}
+
+/**
+ * 执行启动自检并输出报告
+ * @param {context.Context} ctx - 上下文，用于取消自检
+ * @param {io.Writer} w - 报告输出目标
+ * @returns {bool} 全部自检项通过(或跳过)时返回true
+ * @description
+ * - 要求已加载配置(config.LoadConfig)
+ * - 初始化分词器，并用其对示例代码分词
+ * - 初始化所有模型，向每个模型发送一次很短的补全请求
+ * - 探测已启用的上下文服务是否可达，与保活探测使用相同的请求
+ * - 每项输出一行PASS/FAIL/SKIP，最后输出汇总
+ * - 用于部署前在CI/CD中验证配置和依赖服务
+ * @example
+ * if !selftest.Run(context.Background(), os.Stdout) {
+ *     os.Exit(1)
+ * }
+ */
+func Run(ctx context.Context, w io.Writer) bool {
+	var checks []Check
+	checks = append(checks, checkTokenizer())
+	checks = append(checks, checkModels(ctx)...)
+	checks = append(checks, checkContextServices(ctx)...)
+	return report(w, checks)
+}
+
+// checkTokenizer 初始化全局分词器，并确认能正常分词
+func checkTokenizer() Check {
+	start := time.Now()
+	check := Check{Name: "tokenizer"}
+	if tokenizers.GetTokenizer() == nil {
+		if err := tokenizers.Init(); err != nil {
+			check.Err = err
+			return check
+		}
+	}
+	if tokenizers.GetTokenizer().GetTokenCount(probePrefix) == 0 {
+		check.Err = fmt.Errorf("tokenizer returned no tokens")
+	}
+	check.Duration = time.Since(start)
+	return check
+}
+
+// checkModels 初始化所有模型，并向每个模型发送一次试补全
+func checkModels(ctx context.Context) []Check {
+	cfg, err := config.ConfigOrError()
+	if err != nil {
+		return []Check{{Name: "models", Err: err}}
+	}
+	if len(cfg.Models) == 0 {
+		return []Check{{Name: "models", Err: fmt.Errorf("no models configured")}}
+	}
+	if err := model.Init(cfg.Models); err != nil {
+		return []Check{{Name: "models", Err: err}}
+	}
+	var checks []Check
+	for i, m := range model.Models() {
+		cfg := m.Config()
+		check := Check{Name: fmt.Sprintf("model[%d] %s", i, modelLabel(cfg))}
+		para := &model.CompletionParameter{
+			CompletionID: "selftest",
+			ClientID:     "selftest",
+			Language:     "python",
+			Model:        cfg.ModelName,
+			MaxTokens:    8,
+			Prefix:       probePrefix,
+			Suffix:       probeSuffix,
+		}
+		mctx, cancel := context.WithTimeout(ctx, modelTimeout)
+		start := time.Now()
+		_, status, err := m.Completions(mctx, para)
+		check.Duration = time.Since(start)
+		cancel()
+		if status != model.StatusSuccess {
+			if err == nil {
+				err = fmt.Errorf("status %s", status)
+			}
+			check.Err = fmt.Errorf("%s: %v", status, err)
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+// checkContextServices 探测已启用的上下文服务，全部禁用时跳过
+func checkContextServices(ctx context.Context) []Check {
+	results := codebase_context.CheckServices(ctx)
+	if len(results) == 0 {
+		return []Check{{Name: "context services", Skipped: true}}
+	}
+	var checks []Check
+	for _, r := range results {
+		checks = append(checks, Check{Name: "context " + r.Name + " " + r.Url, Err: r.Err})
+	}
+	return checks
+}
+
+func modelLabel(cfg *config.ModelConfig) string {
+	if cfg.ModelTitle != "" {
+		return cfg.ModelTitle
+	}
+	return cfg.ModelName
+}
+
+// report 逐项输出结果和汇总，返回是否全部通过
+func report(w io.Writer, checks []Check) bool {
+	failed := 0
+	for _, c := range checks {
+		switch {
+		case c.Skipped:
+			fmt.Fprintf(w, "SKIP  %s\n", c.Name)
+		case c.Err != nil:
+			failed++
+			fmt.Fprintf(w, "FAIL  %s: %v\n", c.Name, c.Err)
+		default:
+			fmt.Fprintf(w, "PASS  %s (%dms)\n", c.Name, c.Duration.Milliseconds())
+		}
+	}
+	if failed > 0 {
+		fmt.Fprintf(w, "selftest failed: %d of %d checks failed\n", failed, len(checks))
+		return false
+	}
+	fmt.Fprintf(w, "selftest passed: %d checks\n", len(checks))
+	return true
+}
@@ -0,0 +1,67 @@
+package selftest
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"completion-agent/pkg/config"
+)
+
+func Test_Run(t *testing.T) {
+	const tokenizerPath = "../../bin/deepseek-tokenizer/tokenizer.json"
+	if _, err := os.Stat(tokenizerPath); err != nil {
+		t.Skip("tokenizer file not found:", tokenizerPath)
+	}
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"choices": [{"text": "a + b"}], "usage": {"prompt_tokens": 9, "completion_tokens": 3}}`)
+	}))
+	defer healthy.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	savedConfig, savedWrapper, savedContext := config.Config, config.Wrapper, config.Context
+	defer func() { config.Config, config.Wrapper, config.Context = savedConfig, savedWrapper, savedContext }()
+	config.Wrapper = &config.WrapperConfig{Tokenizer: config.TokenizerConfig{Path: tokenizerPath}}
+	config.Context = &config.ContextConfig{
+		Definition: config.DefinitionConfig{Url: healthy.URL + "/definition"},
+		Semantic:   config.SemanticConfig{Disabled: true},
+		Relation:   config.RelationConfig{Disabled: true},
+	}
+	config.Config = &config.SoftwareConfig{Models: []config.ModelConfig{
+		{Provider: "openai", ModelTitle: "healthy", ModelName: "healthy-model", CompletionsUrl: healthy.URL},
+	}}
+
+	var out bytes.Buffer
+	if !Run(context.Background(), &out) {
+		t.Fatalf("selftest failed:\n%s", out.String())
+	}
+	for _, want := range []string{"PASS  tokenizer", "PASS  model[0] healthy", "PASS  context definition", "selftest passed"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("report misses %q:\n%s", want, out.String())
+		}
+	}
+
+	config.Config.Models = append(config.Config.Models, config.ModelConfig{
+		Provider: "openai", ModelTitle: "broken", ModelName: "broken-model", CompletionsUrl: broken.URL,
+	})
+	out.Reset()
+	if Run(context.Background(), &out) {
+		t.Fatalf("selftest passed with a broken model:\n%s", out.String())
+	}
+	for _, want := range []string{"PASS  model[0] healthy", "FAIL  model[1] broken", "1 of 4 checks failed"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("report misses %q:\n%s", want, out.String())
+		}
+	}
+}
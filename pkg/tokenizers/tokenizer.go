@@ -1,14 +1,19 @@
 package tokenizers
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"runtime"
 
 	"github.com/sugarme/tokenizer"
 	"github.com/sugarme/tokenizer/pretrained"
 )
 
-// Tokenizer wraps sugarme/tokenizer library, providing a unified interface
+// Tokenizer wraps sugarme/tokenizer library, providing a unified interface.
+// A Tokenizer is safe for concurrent use and is shared between requests and models:
+// Encode, Decode and GetTokenCount don't modify the loaded tokenizer, except for the
+// BPE cache, which sugarme/tokenizer guards with its own lock (see Test_ConcurrentUse, run with -race)
 type Tokenizer struct {
 	tokenizer *tokenizer.Tokenizer
 }
@@ -49,6 +54,40 @@ func (t *Tokenizer) Encode(text string) []int {
 	return encoding.GetIds()
 }
 
+// encodeSlots bounds the background encodings started by EncodeContext. The underlying
+// encoder can't be interrupted, so an encoding abandoned at the deadline keeps running
+// until it finishes; without a bound, slow encodings would pile up under load
+var encodeSlots = make(chan struct{}, runtime.GOMAXPROCS(0))
+
+// EncodeContext encodes text like Encode, but returns ctx.Err() as soon as ctx is done,
+// so a request close to its deadline doesn't wait for a long encoding to finish.
+// At most cap(encodeSlots) encodings run at a time, including abandoned ones;
+// callers wait for a free slot until ctx is done
+func (t *Tokenizer) EncodeContext(ctx context.Context, text string) ([]int, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if ctx.Done() == nil {
+		return t.Encode(text), nil
+	}
+	select {
+	case encodeSlots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	done := make(chan []int, 1)
+	go func() {
+		defer func() { <-encodeSlots }()
+		done <- t.Encode(text)
+	}()
+	select {
+	case ids := <-done:
+		return ids, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
 // Decode decodes token IDs back to text
 func (t *Tokenizer) Decode(ids []int) string {
 	return t.tokenizer.Decode(ids, true)
@@ -1,9 +1,17 @@
 package tokenizers
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
+	"sync"
 	"testing"
+	"time"
+
+	"completion-agent/pkg/config"
 )
 
 // to test tokenizer
@@ -400,3 +408,124 @@ func min(a, b int) int {
 	}
 	return b
 }
+
+func Test_LoadFirstFallback(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal("Failed to get working directory:", err)
+	}
+	tokenizerPath := filepath.Join(filepath.Dir(filepath.Dir(wd)), defaultTokenizerPath)
+
+	tk, path, err := loadFirst([]string{"missing/tokenizer.json", tokenizerPath})
+	if err != nil {
+		t.Fatal("Expected fallback path to be loaded:", err)
+	}
+	defer tk.Close()
+	if path != tokenizerPath {
+		t.Errorf("Expected tokenizer loaded from %s, got %s", tokenizerPath, path)
+	}
+
+	if _, _, err := loadFirst([]string{"missing/tokenizer.json"}); err == nil {
+		t.Error("Expected error when every candidate is missing")
+	}
+
+	paths := candidatePaths(defaultTokenizerPath)
+	if paths[0] != defaultTokenizerPath {
+		t.Errorf("Expected configured path first, got %v", paths)
+	}
+	for i := 1; i < len(paths); i++ {
+		if paths[i] == paths[0] {
+			t.Errorf("Expected no duplicate candidates, got %v", paths)
+		}
+	}
+}
+
+// go test -race ./pkg/tokenizers/ -run Test_ConcurrentUse
+func Test_ConcurrentUse(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tk, err := NewTokenizer(filepath.Join(filepath.Dir(filepath.Dir(wd)), defaultTokenizerPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tk.Close()
+
+	texts := []string{
+		"func main() {\n\tfmt.Println(\"hello\")\n}",
+		"def add(a, b):\n    return a + b\n",
+		"中文注释 // 代码补全",
+		"",
+		"    if err != nil {\n        return err\n    }",
+	}
+	want := make([][]int, len(texts))
+	for i, text := range texts {
+		want[i] = tk.Encode(text)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan string, 64)
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for n := 0; n < 20; n++ {
+				i := (g + n) % len(texts)
+				ids := tk.Encode(texts[i])
+				if !slices.Equal(ids, want[i]) {
+					errs <- fmt.Sprintf("Encode(%q) = %v, want %v", texts[i], ids, want[i])
+					return
+				}
+				if c := tk.GetTokenCount(texts[i]); c != len(want[i]) {
+					errs <- fmt.Sprintf("GetTokenCount(%q) = %d, want %d", texts[i], c, len(want[i]))
+					return
+				}
+				tk.Decode(ids)
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for e := range errs {
+		t.Error(e)
+	}
+}
+
+func Test_InitFallback(t *testing.T) {
+	savedWrapper, savedGlobal := config.Wrapper, global
+	defer func() { config.Wrapper, global = savedWrapper, savedGlobal }()
+
+	config.Wrapper = &config.WrapperConfig{}
+	config.Wrapper.Tokenizer.Path = "missing/tokenizer.json"
+	if err := Init(); err == nil {
+		t.Error("Expected error when the tokenizer is missing and fallback is unset")
+	}
+
+	config.Wrapper.Tokenizer.Fallback = config.TokenizerFallbackEstimate
+	if err := Init(); err != nil {
+		t.Fatal("Expected estimate fallback to continue without a tokenizer:", err)
+	}
+	if GetTokenizer() != nil {
+		t.Error("Expected no global tokenizer with estimate fallback")
+	}
+}
+
+func Test_EncodeContextBounded(t *testing.T) {
+	saved := encodeSlots
+	defer func() { encodeSlots = saved }()
+	encodeSlots = make(chan struct{}, 1)
+
+	// All slots are taken by an encoding still running after its request gave up:
+	// a new request waits for a slot and gives up at its own deadline without encoding
+	encodeSlots <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	tk := &Tokenizer{}
+	if ids, err := tk.EncodeContext(ctx, "x := 1"); !errors.Is(err, context.DeadlineExceeded) || ids != nil {
+		t.Fatalf("EncodeContext = %v, %v, want deadline exceeded", ids, err)
+	}
+	if len(encodeSlots) != 1 {
+		t.Fatalf("slots in use = %d, want 1", len(encodeSlots))
+	}
+}
@@ -2,15 +2,44 @@ package tokenizers
 
 import (
 	"completion-agent/pkg/config"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"unicode/utf8"
 
 	"go.uber.org/zap"
 )
 
 var global *Tokenizer
 
+// Tokenizer file shipped with the program, relative to the working directory or the executable
+const defaultTokenizerPath = "bin/deepseek-tokenizer/tokenizer.json"
+
+// Average characters per token used by estimates when wrapper.tokenizer.charsPerToken is unset
+const defaultCharsPerToken = 4
+
+// Tokenizers loaded for models that declare their own tokenizer path, keyed by path
+var (
+	loaded     = make(map[string]*Tokenizer)
+	loadedLock sync.Mutex
+)
+
+// Init loads the global tokenizer, trying the configured path first and then the fallback candidates,
+// so a path template rendering to a missing file doesn't disable tokenization.
+// When no candidate can be loaded, it returns the error unless wrapper.tokenizer.fallback is
+// "estimate", in which case it logs a warning and leaves the global tokenizer nil, so token
+// counts and prompt truncation are estimated by characters
 func Init() error {
-	t, err := NewTokenizer(config.Wrapper.Tokenizer.Path)
+	t, _, err := loadFirst(candidatePaths(config.Wrapper.Tokenizer.Path))
 	if err != nil {
+		if config.Wrapper.Tokenizer.Fallback == config.TokenizerFallbackEstimate {
+			zap.L().Warn("Tokenizer unavailable, token counts and truncation are estimated by characters",
+				zap.String("path", config.Wrapper.Tokenizer.Path), zap.Error(err))
+			global = nil
+			return nil
+		}
 		zap.L().Error("init tokenizer error",
 			zap.String("path", config.Wrapper.Tokenizer.Path), zap.Error(err))
 		return err
@@ -19,6 +48,91 @@ func Init() error {
 	return nil
 }
 
+// candidatePaths lists the tokenizer files to try, in order: the configured (rendered) path,
+// the configured path relative to the executable, then the default file relative to
+// the working directory and to the executable. Duplicates are removed.
+func candidatePaths(configured string) []string {
+	exeDir := ""
+	if exe, err := os.Executable(); err == nil {
+		exeDir = filepath.Dir(exe)
+	}
+	var paths []string
+	add := func(p string) {
+		if p == "" {
+			return
+		}
+		for _, existing := range paths {
+			if existing == p {
+				return
+			}
+		}
+		paths = append(paths, p)
+	}
+	add(configured)
+	if configured != "" && !filepath.IsAbs(configured) && exeDir != "" {
+		add(filepath.Join(exeDir, configured))
+	}
+	add(defaultTokenizerPath)
+	if exeDir != "" {
+		add(filepath.Join(exeDir, defaultTokenizerPath))
+	}
+	return paths
+}
+
+// loadFirst loads the first tokenizer that can be created from paths, logging each failed candidate
+func loadFirst(paths []string) (*Tokenizer, string, error) {
+	var lastErr error
+	for i, path := range paths {
+		t, err := NewTokenizer(path)
+		if err != nil {
+			zap.L().Warn("tokenizer candidate unavailable", zap.String("path", path), zap.Error(err))
+			lastErr = err
+			continue
+		}
+		if i > 0 {
+			zap.L().Warn("tokenizer loaded from fallback path",
+				zap.String("configured", paths[0]), zap.String("path", path))
+		}
+		return t, path, nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no tokenizer path configured")
+	}
+	return nil, "", lastErr
+}
+
+// CharsPerToken returns the average characters (runes) per token used when estimating
+// token counts without a tokenizer, taken from wrapper.tokenizer.charsPerToken
+func CharsPerToken() float64 {
+	if config.Wrapper != nil && config.Wrapper.Tokenizer.CharsPerToken > 0 {
+		return config.Wrapper.Tokenizer.CharsPerToken
+	}
+	return defaultCharsPerToken
+}
+
+// EstimateTokens estimates the token count of text from its rune count and CharsPerToken,
+// rounding a partial token up
+func EstimateTokens(text string) int {
+	return int(math.Ceil(float64(utf8.RuneCountInString(text)) / CharsPerToken()))
+}
+
+// GetTokenizer returns the global default tokenizer
 func GetTokenizer() *Tokenizer {
 	return global
 }
+
+// LoadTokenizer loads the tokenizer at the given path, sharing one instance between models using the same file
+func LoadTokenizer(path string) (*Tokenizer, error) {
+	loadedLock.Lock()
+	defer loadedLock.Unlock()
+
+	if t, exists := loaded[path]; exists {
+		return t, nil
+	}
+	t, err := NewTokenizer(path)
+	if err != nil {
+		return nil, err
+	}
+	loaded[path] = t
+	return t, nil
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"completion-agent/pkg/config"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// 不需要认证的接口，供探活和监控采集使用
+var authSkipPaths = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+	"/metrics": true,
+}
+
+/**
+ * API Key认证中间件
+ * @returns {gin.HandlerFunc} 返回认证中间件
+ * @description
+ * - 按server.auth.keys校验"Authorization: Bearer <key>"头部，不匹配时返回401
+ * - 未配置keys时不做认证
+ * - /healthz、/readyz和/metrics不需要认证
+ * - 比较前先计算摘要，比较耗时与key的内容和长度无关，且逐个比较全部key，避免计时攻击
+ * - 配置在创建路由时读取
+ */
+func authRequired() gin.HandlerFunc {
+	var keys [][sha256.Size]byte
+	if config.Server != nil {
+		for _, key := range config.Server.Auth.Keys {
+			if key != "" {
+				keys = append(keys, sha256.Sum256([]byte(key)))
+			}
+		}
+	}
+	return func(c *gin.Context) {
+		if len(keys) == 0 || authSkipPaths[c.Request.URL.Path] {
+			c.Next()
+			return
+		}
+		if !matchAPIKey(keys, bearerToken(c.GetHeader("Authorization"))) {
+			zap.L().Warn("unauthorized request",
+				zap.String("path", c.Request.URL.Path),
+				zap.String("clientIP", c.ClientIP()))
+			c.Header("WWW-Authenticate", "Bearer")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// bearerToken 提取Authorization头部中的Bearer令牌，格式不符时返回空串
+func bearerToken(header string) string {
+	const prefix = "bearer "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(header[len(prefix):])
+}
+
+// matchAPIKey 以恒定时间比较令牌与全部已配置的key
+func matchAPIKey(keys [][sha256.Size]byte, token string) bool {
+	if token == "" {
+		return false
+	}
+	sum := sha256.Sum256([]byte(token))
+	matched := 0
+	for i := range keys {
+		matched |= subtle.ConstantTimeCompare(sum[:], keys[i][:])
+	}
+	return matched == 1
+}
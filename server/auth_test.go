@@ -0,0 +1,51 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"completion-agent/pkg/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+func Test_AuthRequired(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	withConfig(t, &config.ServerConfig{Auth: config.APIKeyConfig{Keys: []string{"sk-a", "sk-b"}}})
+	r := SetupRouter()
+
+	cases := []struct {
+		path          string
+		authorization string
+		want          int
+	}{
+		{"/completion-agent/api/v1/models", "", http.StatusUnauthorized},
+		{"/completion-agent/api/v1/models", "Bearer sk-wrong", http.StatusUnauthorized},
+		{"/completion-agent/api/v1/models", "sk-a", http.StatusUnauthorized},
+		{"/completion-agent/api/v1/models", "Bearer sk-a", http.StatusOK},
+		{"/completion-agent/api/v1/models", "bearer sk-b", http.StatusOK},
+		{"/healthz", "", http.StatusOK},
+		{"/metrics", "", http.StatusOK},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, c.path, nil)
+		if c.authorization != "" {
+			req.Header.Set("Authorization", c.authorization)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != c.want {
+			t.Errorf("%s with %q: status %d, want %d", c.path, c.authorization, w.Code, c.want)
+		}
+	}
+
+	// 未配置key时不认证
+	config.Server = &config.ServerConfig{}
+	req := httptest.NewRequest(http.MethodGet, "/completion-agent/api/v1/models", nil)
+	w := httptest.NewRecorder()
+	SetupRouter().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("without keys: status %d, want %d", w.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"completion-agent/pkg/completions"
+	"completion-agent/pkg/config"
+	"completion-agent/pkg/model"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// 未配置时每批的最大请求数
+const defaultBatchMaxItems = 100
+
+// 未配置时同一批中同时处理的请求数
+const defaultBatchConcurrency = 4
+
+// 批量补全接口的限制
+func batchLimits() (maxItems, concurrency int) {
+	maxItems, concurrency = defaultBatchMaxItems, defaultBatchConcurrency
+	if config.Server != nil {
+		if config.Server.Batch.MaxItems > 0 {
+			maxItems = config.Server.Batch.MaxItems
+		}
+		if config.Server.Batch.Concurrency > 0 {
+			concurrency = config.Server.Batch.Concurrency
+		}
+	}
+	return maxItems, concurrency
+}
+
+// batchCompletions 批量补全接口路由处理
+// @Summary 批量代码补全
+// @Description 一次提交多个补全请求，按server.batch.concurrency并发处理，按请求的顺序返回各自的补全响应；单个请求失败不影响整批
+// @Tags completions
+// @Accept json
+// @Produce json
+// @Param request body []completions.CompletionRequest true "补全请求列表"
+// @Success 200 {array} completions.CompletionResponse
+// @Failure 400 {object} completions.CompletionResponse
+// @Failure 413 {object} map[string]interface{}
+// @Failure 503 {object} completions.CompletionResponse
+// @Router /completion-agent/api/v1/completions/batch [post]
+func batchCompletions(c *gin.Context) {
+	perf := &completions.CompletionPerformance{ReceiveTime: time.Now().Local()}
+	var reqs []completions.CompletionRequest
+	if err := c.ShouldBindJSON(&reqs); err != nil {
+		if isBodyTooLarge(err) {
+			abortBodyTooLarge(c, maxBodyBytes())
+			return
+		}
+		batchError(c, model.StatusReqError, perf, err)
+		return
+	}
+	maxItems, concurrency := batchLimits()
+	if len(reqs) > maxItems {
+		batchError(c, model.StatusReqError, perf, fmt.Errorf("too many requests in batch (%d > %d)", len(reqs), maxItems))
+		return
+	}
+	if !initialized.Load() {
+		batchError(c, model.StatusBusy, perf, errServiceInitializing)
+		return
+	}
+	// 与单个补全接口一样读完请求体，使客户端断开时能够及时取消
+	io.Copy(io.Discard, c.Request.Body)
+
+	rsps := make([]*completions.CompletionResponse, len(reqs))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := range reqs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			// gin.Recovery只保护处理函数所在的goroutine，单项panic不能使整个进程退出
+			defer func() {
+				if r := recover(); r != nil {
+					zap.L().Error("Batch completions panic", zap.Any("panic", r), zap.Stack("stack"))
+					perf := &completions.CompletionPerformance{ReceiveTime: time.Now().Local()}
+					rsps[i] = completions.ErrorResponse(reqs[i].CompletionID, reqs[i].Model, model.StatusServerError,
+						perf, nil, fmt.Errorf("panic: %v", r))
+				}
+			}()
+			rsps[i] = processBatchItem(c, &reqs[i])
+		}(i)
+	}
+	wg.Wait()
+	c.JSON(http.StatusOK, rsps)
+}
+
+// 以补全响应格式返回整批请求的错误，与单个补全接口的错误响应保持一致
+func batchError(c *gin.Context, status model.CompletionStatus, perf *completions.CompletionPerformance, err error) {
+	zap.L().Error("Batch completions error", zap.Error(err))
+	rsp := completions.ErrorResponse("", "", status, perf, nil, err)
+	respCompletion(c, &completions.CompletionRequest{}, rsp)
+}
+
+// 处理批量请求中的一项，测试时可替换
+var processBatchItem = batchItem
+
+/**
+ * 处理批量请求中的一项
+ * @param {*gin.Context} c - Gin上下文对象，提供请求头部和请求上下文
+ * @param {*completions.CompletionRequest} req - 补全请求
+ * @returns {*completions.CompletionResponse} 返回该项的补全响应，失败时响应中带有对应的状态
+ * @description
+ * - 每项各自按client_id限流，并记录访问日志
+ * - 同一批中client_id相同的请求互不取代
+ */
+func batchItem(c *gin.Context, req *completions.CompletionRequest) *completions.CompletionResponse {
+	perf := &completions.CompletionPerformance{ReceiveTime: time.Now().Local()}
+	rsp := rateLimitResponse(c, req, perf)
+	if rsp == nil {
+		rsp = handleBatchItem(c, req, perf)
+	}
+	accessLog(req, rsp)
+	return rsp
+}
+
+// 调用补全处理器处理批量请求中的一项
+func handleBatchItem(c *gin.Context, req *completions.CompletionRequest, perf *completions.CompletionPerformance) *completions.CompletionResponse {
+	handler, err := completions.NewAutoCompletionHandler()
+	if err != nil {
+		zap.L().Error("Batch completions error", zap.Error(err))
+		return completions.ErrorResponse(req.CompletionID, req.Model, handlerErrorStatus(err), perf, nil, err)
+	}
+	input := &completions.CompletionInput{CompletionRequest: *req, Headers: c.Request.Header}
+	rc := completions.NewCompletionContext(c.Request.Context(), perf)
+	rc.Batch = true
+	return handler.HandleCompletion(rc, input)
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"completion-agent/pkg/completions"
+	"completion-agent/pkg/config"
+	"completion-agent/pkg/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+func Test_BatchCompletions(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// 上游模型服务：按prompt中的编号给出补全，记录同时处理的请求数
+	itemPattern := regexp.MustCompile(`item(\d+)`)
+	var active, peak atomic.Int32
+	withConfig(t, &config.ServerConfig{Batch: config.BatchConfig{MaxItems: 8, Concurrency: 2}})
+	withUpstream(t, config.ModelConfig{ModelName: "batch-test"}, func(w http.ResponseWriter, r *http.Request) {
+		n := active.Add(1)
+		defer active.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		var body struct {
+			Prompt string `json:"prompt"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		time.Sleep(20 * time.Millisecond)
+		m := itemPattern.FindStringSubmatch(body.Prompt)
+		if m == nil {
+			http.Error(w, "bad prompt", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"choices": [{"text": "value`+m[1]+`"}]}`)
+	})
+	r := SetupRouter()
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/completion-agent/api/v1/completions/batch", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// 同一客户端的多个请求互不取代，缺少prompt_options的一项单独失败
+	var items []string
+	for i := 0; i < 5; i++ {
+		items = append(items, fmt.Sprintf(`{"client_id": "batch-client", "completion_id": "c%d", "trigger_mode": "manual", "prompt_options": {"prefix": "item%d = ", "suffix": "\n"}}`, i, i))
+	}
+	items = append(items, `{"client_id": "batch-client", "completion_id": "bad"}`)
+	w := post("[" + strings.Join(items, ",") + "]")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status code = %d, body %s", w.Code, w.Body.String())
+	}
+	var rsps []completions.CompletionResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &rsps); err != nil {
+		t.Fatal(err)
+	}
+	if len(rsps) != len(items) {
+		t.Fatalf("got %d responses, want %d", len(rsps), len(items))
+	}
+	for i, rsp := range rsps[:5] {
+		if rsp.ID != fmt.Sprintf("c%d", i) || rsp.Status != model.StatusSuccess || rsp.Choices[0].Text != fmt.Sprintf("value%d", i) {
+			t.Errorf("item %d: unexpected response %+v", i, rsp)
+		}
+	}
+	if last := rsps[5]; last.ID != "bad" || last.Status == model.StatusSuccess {
+		t.Errorf("invalid item: unexpected response %+v", last)
+	}
+	if p := peak.Load(); p > 2 {
+		t.Errorf("peak concurrency = %d, want at most 2", p)
+	}
+
+	// 整批请求的错误与单个补全接口一样使用补全响应格式
+	for name, body := range map[string]string{
+		"oversized batch": "[" + strings.Repeat("{},", 8) + "{}]",
+		"non-array body":  `{"prompt_options": {}}`,
+	} {
+		w := post(body)
+		var rsp completions.CompletionResponse
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status code = %d, want 400", name, w.Code)
+		} else if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil || rsp.Status != model.StatusReqError || rsp.Error == "" {
+			t.Errorf("%s: unexpected response %s", name, w.Body.String())
+		}
+	}
+}
+
+func Test_BatchCompletionsPanic(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	withConfig(t, nil)
+	saved := processBatchItem
+	t.Cleanup(func() { processBatchItem = saved })
+	processBatchItem = func(c *gin.Context, req *completions.CompletionRequest) *completions.CompletionResponse {
+		if req.CompletionID == "boom" {
+			panic("injected panic")
+		}
+		perf := &completions.CompletionPerformance{ReceiveTime: time.Now().Local()}
+		return completions.SuccessResponse(req.CompletionID, req.Model, "ok", perf, nil)
+	}
+
+	r := SetupRouter()
+	body := `[{"completion_id": "a"}, {"completion_id": "boom"}, {"completion_id": "b"}]`
+	req := httptest.NewRequest(http.MethodPost, "/completion-agent/api/v1/completions/batch", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status code = %d, body %s", w.Code, w.Body.String())
+	}
+	var rsps []completions.CompletionResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &rsps); err != nil || len(rsps) != 3 {
+		t.Fatalf("unexpected body %s", w.Body.String())
+	}
+	if rsps[0].Status != model.StatusSuccess || rsps[2].Status != model.StatusSuccess {
+		t.Errorf("other items should succeed: %+v", rsps)
+	}
+	if rsps[1].ID != "boom" || rsps[1].Status != model.StatusServerError || !strings.Contains(rsps[1].Error, "injected panic") {
+		t.Errorf("panicking item: unexpected response %+v", rsps[1])
+	}
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"completion-agent/pkg/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 未配置maxBodyBytes时请求体的最大字节数
+const defaultMaxBodyBytes = 8 << 20
+
+// 请求体的最大字节数，0或负数表示不限制
+func maxBodyBytes() int64 {
+	if config.Server == nil || config.Server.MaxBodyBytes == 0 {
+		return defaultMaxBodyBytes
+	}
+	return max(config.Server.MaxBodyBytes, 0)
+}
+
+/**
+ * 请求体大小限制中间件
+ * @param {int64} limit - 请求体的最大字节数，0表示不限制
+ * @returns {gin.HandlerFunc} 返回gin中间件
+ * @description
+ * - Content-Length超出上限的请求不读取请求体，直接返回413
+ * - 没有Content-Length(分块传输)的请求在读取超出上限时失败，由处理函数通过isBodyTooLarge识别后返回413
+ */
+func limitBody(limit int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if limit <= 0 || c.Request.Body == nil {
+			c.Next()
+			return
+		}
+		if c.Request.ContentLength > limit {
+			abortBodyTooLarge(c, limit)
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+		c.Next()
+	}
+}
+
+// 判断读取请求体的错误是否因为超出大小限制
+func isBodyTooLarge(err error) bool {
+	var tooLarge *http.MaxBytesError
+	return errors.As(err, &tooLarge)
+}
+
+// 以413中止请求
+func abortBodyTooLarge(c *gin.Context, limit int64) {
+	err := fmt.Errorf("request body too large (max %d bytes)", limit)
+	c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+}
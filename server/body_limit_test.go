@@ -0,0 +1,54 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"completion-agent/pkg/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+func Test_BodyLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	withConfig(t, &config.ServerConfig{MaxBodyBytes: 64})
+	r := SetupRouter()
+
+	post := func(path, body string, chunked bool) int {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if chunked {
+			req.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	large := `{"client_id":"` + strings.Repeat("x", 100) + `"}`
+	const completionsPath = "/completion-agent/api/v1/completions"
+
+	if code := post(completionsPath, large, false); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("content length over limit: status %d, want 413", code)
+	}
+	if code := post(completionsPath, large, true); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("chunked body over limit: status %d, want 413", code)
+	}
+	if code := post(completionsPath, `{"client_id":"small"}`, false); code == http.StatusRequestEntityTooLarge {
+		t.Error("small body rejected")
+	}
+	if code := post("/completion-agent/api/v1/logs", large, false); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("logs over limit: status %d, want 413", code)
+	}
+
+	config.Server = &config.ServerConfig{MaxBodyBytes: -1}
+	r = SetupRouter()
+	if code := post(completionsPath, large, true); code == http.StatusRequestEntityTooLarge {
+		t.Error("unlimited body rejected")
+	}
+	config.Server = nil
+	if got := maxBodyBytes(); got != defaultMaxBodyBytes {
+		t.Errorf("default limit = %d, want %d", got, defaultMaxBodyBytes)
+	}
+}
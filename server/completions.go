@@ -2,7 +2,12 @@ package server
 
 import (
 	"completion-agent/pkg/completions"
+	"completion-agent/pkg/config"
+	"completion-agent/pkg/env"
+	"completion-agent/pkg/logger"
 	"completion-agent/pkg/model"
+	"errors"
+	"io"
 	"net/http"
 	"time"
 
@@ -18,57 +23,111 @@ import (
 // @Produce json
 // @Param request body completions.CompletionRequest true "补全请求"
 // @Success 200 {object} completions.CompletionResponse
-// @Failure 400 {object} map[string]interface{}
+// @Header 200,400,429 {string} X-Completion-Id "补全请求ID"
+// @Header 200,400,429 {string} X-Completion-Status "补全状态"
+// @Failure 400 {object} completions.CompletionResponse
+// @Failure 413 {object} map[string]interface{}
+// @Failure 429 {object} completions.CompletionResponse
+// @Failure 503 {object} completions.CompletionResponse
 // @Failure 500 {object} map[string]interface{}
 // @Router /completion-agent/api/v1/completions [post]
 func Completions(c *gin.Context) {
+	perf := &completions.CompletionPerformance{
+		ReceiveTime: time.Now().Local(),
+	}
 	var req completions.CompletionInput
 	if err := c.ShouldBindJSON(&req.CompletionRequest); err != nil {
-		zap.L().Error("Completions error", zap.Any("body", c.Request.Form), zap.Error(err))
-		c.JSON(http.StatusBadRequest, gin.H{
-			"status": model.StatusReqError,
-			"error":  err.Error(),
-		})
+		zap.L().Error("Completions error", zap.Error(err))
+		if isBodyTooLarge(err) {
+			abortBodyTooLarge(c, maxBodyBytes())
+			return
+		}
+		// 与其他错误保持同样的响应格式，便于客户端统一处理
+		rsp := completions.ErrorResponse(req.CompletionID, req.Model, model.StatusReqError, perf, nil, err)
+		respCompletion(c, &req.CompletionRequest, rsp)
+		return
+	}
+	if !initialized.Load() {
+		rsp := completions.ErrorResponse(req.CompletionID, req.Model, model.StatusBusy, perf, nil, errServiceInitializing)
+		respCompletion(c, &req.CompletionRequest, rsp)
+		return
+	}
+	if !checkRateLimit(c, &req.CompletionRequest, perf) {
 		return
 	}
 	req.Headers = c.Request.Header
+	// 读完请求体(到EOF)后，http.Server才会在后台检测连接关闭并取消请求上下文，
+	// 使客户端断开时能够及时中断对模型的请求
+	io.Copy(io.Discard, c.Request.Body)
 
-	handler := completions.NewCompletionHandler(nil)
-	perf := &completions.CompletionPerformance{
-		ReceiveTime: time.Now().Local(),
+	handler, err := completions.NewAutoCompletionHandler()
+	if err != nil {
+		zap.L().Error("Completions error", zap.Error(err))
+		rsp := completions.ErrorResponse(req.CompletionID, req.Model, handlerErrorStatus(err), perf, nil, err)
+		respCompletion(c, &req.CompletionRequest, rsp)
+		return
 	}
 	rc := completions.NewCompletionContext(c.Request.Context(), perf)
 	rsp := handler.HandleCompletion(rc, &req)
 	respCompletion(c, &req.CompletionRequest, rsp)
 }
 
+/**
+ * 获取无法创建补全处理器时的补全状态
+ * @param {error} err - NewAutoCompletionHandler返回的错误
+ * @returns {model.CompletionStatus} 没有可用的模型时返回StatusBusy(503)，其他错误返回StatusServerError
+ */
+func handlerErrorStatus(err error) model.CompletionStatus {
+	if errors.Is(err, model.ErrNoModels) {
+		return model.StatusBusy
+	}
+	return model.StatusServerError
+}
+
 /**
  * 处理补全响应
  * @param {*gin.Context} c - Gin上下文对象，用于HTTP响应
  * @param {*completions.CompletionRequest} req - 补全请求对象，包含请求参数
  * @param {*completions.CompletionResponse} rsp - 补全响应对象，包含处理结果
  * @description
- * - 根据补全响应的状态记录相应的日志信息
+ * - 根据补全响应的状态记录相应的访问日志
  * - 成功时记录info级别日志，失败时记录warn级别日志
  * - 根据响应状态映射到对应的HTTP状态码
  * - 将响应对象以JSON格式返回给客户端
- * - 支持多种状态码：200(成功)、408(超时)、504(网关超时)、503(服务不可用)等
+ * - 支持多种状态码：200(成功)、408(超时)、504(网关超时)、503(服务不可用)、401(模型认证失败)、429(限流)等
+ * - 模型没有给出建议时按server.noSuggestionStatus返回，配置为204时不返回响应体
+ * - 未配置server.disableEchoHeaders时，在X-Completion-Id和X-Completion-Status头部中回显completion_id和状态
  * @example
  * req := &completions.CompletionRequest{...}
  * rsp := &completions.CompletionResponse{...}
  * respCompletion(c, req, rsp)
  */
 func respCompletion(c *gin.Context, req *completions.CompletionRequest, rsp *completions.CompletionResponse) {
+	accessLog(req, rsp)
+	if config.Server == nil || !config.Server.DisableEchoHeaders {
+		c.Header("X-Completion-Id", rsp.ID)
+		c.Header("X-Completion-Status", string(rsp.Status))
+	}
 	statusCode := http.StatusOK
 	switch rsp.Status {
 	case model.StatusSuccess, model.StatusEmpty:
 		statusCode = http.StatusOK
+	case model.StatusNoSuggestion:
+		if config.Server != nil && config.Server.NoSuggestionStatus == http.StatusNoContent {
+			c.Status(http.StatusNoContent)
+			return
+		}
+		statusCode = http.StatusOK
 	case model.StatusCanceled:
 		statusCode = http.StatusRequestTimeout
 	case model.StatusTimeout:
 		statusCode = http.StatusGatewayTimeout
 	case model.StatusBusy:
 		statusCode = http.StatusServiceUnavailable
+	case model.StatusAuthError:
+		statusCode = http.StatusUnauthorized
+	case model.StatusRateLimited:
+		statusCode = http.StatusTooManyRequests
 	case model.StatusReqError, model.StatusRejected:
 		statusCode = http.StatusBadRequest
 	case model.StatusServerError, model.StatusModelError:
@@ -78,3 +137,40 @@ func respCompletion(c *gin.Context, req *completions.CompletionRequest, rsp *com
 	}
 	c.JSON(statusCode, rsp)
 }
+
+/**
+ * 记录补全接口的访问日志
+ * @param {*completions.CompletionRequest} req - 补全请求对象
+ * @param {*completions.CompletionResponse} rsp - 补全响应对象
+ * @description
+ * - 每个请求输出一行日志，各项指标作为独立字段，便于检索和统计
+ * - 补全文本只在调试模式下记录，避免生产日志过大；未开启server.logPromptContent时脱敏
+ * - 成功、空结果或没有建议记录info级别，其他状态记录warn级别
+ */
+func accessLog(req *completions.CompletionRequest, rsp *completions.CompletionResponse) {
+	fields := []zap.Field{
+		zap.String("completionID", rsp.ID),
+		zap.String("clientID", req.ClientID),
+		zap.String("model", rsp.Model),
+		zap.String("languageID", req.LanguageID),
+		zap.String("status", string(rsp.Status)),
+		zap.Int64("queueDuration", rsp.Usage.QueueDuration),
+		zap.Int64("contextDuration", rsp.Usage.ContextDuration),
+		zap.Int64("llmDuration", rsp.Usage.LLMDuration),
+		zap.Int64("firstTokenDuration", rsp.Usage.FirstTokenDuration),
+		zap.Int64("totalDuration", rsp.Usage.TotalDuration),
+		zap.Int("promptTokens", rsp.Usage.PromptTokens),
+		zap.Int("completionTokens", rsp.Usage.CompletionTokens),
+	}
+	if rsp.Error != "" {
+		fields = append(fields, zap.String("error", rsp.Error))
+	}
+	if env.DebugMode && len(rsp.Choices) > 0 {
+		fields = append(fields, logger.Sensitive("text", rsp.Choices[0].Text))
+	}
+	if rsp.Status == model.StatusSuccess || rsp.Status == model.StatusEmpty || rsp.Status == model.StatusNoSuggestion {
+		zap.L().Info("completion access", fields...)
+	} else {
+		zap.L().Warn("completion access", fields...)
+	}
+}
@@ -0,0 +1,261 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"completion-agent/pkg/completions"
+	"completion-agent/pkg/config"
+	"completion-agent/pkg/model"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func Test_CompletionsBadRequest(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := SetupRouter()
+
+	body := `{"completion_id": "abc", "prompt_options": {"prefix": "x"`
+	req := httptest.NewRequest(http.MethodPost, "/completion-agent/api/v1/completions", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status code = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	var rsp completions.CompletionResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+		t.Fatalf("response is not a CompletionResponse: %v, body: %s", err, w.Body.String())
+	}
+	if rsp.Status != model.StatusReqError {
+		t.Errorf("status = %q, want %q", rsp.Status, model.StatusReqError)
+	}
+	if rsp.Error == "" {
+		t.Errorf("expected parse error in response")
+	}
+	if rsp.Object != "text_completion" || len(rsp.Choices) != 1 {
+		t.Errorf("unexpected response shape: %s", w.Body.String())
+	}
+}
+
+// withConfig 为测试设置全局配置，测试结束时恢复原来的配置
+// Config和Context为空配置，Wrapper关闭了过滤器和修剪器，server为nil时使用空的服务配置
+func withConfig(t *testing.T, server *config.ServerConfig) {
+	t.Helper()
+	savedConfig, savedWrapper, savedContext, savedServer := config.Config, config.Wrapper, config.Context, config.Server
+	t.Cleanup(func() {
+		config.Config, config.Wrapper, config.Context, config.Server = savedConfig, savedWrapper, savedContext, savedServer
+	})
+	if server == nil {
+		server = &config.ServerConfig{}
+	}
+	config.Config = &config.SoftwareConfig{}
+	config.Context = &config.ContextConfig{}
+	config.Server = server
+	config.Wrapper = &config.WrapperConfig{
+		Score:  config.ScoreFilterConfig{Disabled: true},
+		Syntax: config.SyntaxFilterConfig{Disabled: true},
+		Prune:  config.PruneConfig{Disabled: true},
+	}
+}
+
+// withUpstream 启动模拟的模型服务并初始化只含一个指向它的OpenAI协议模型，测试结束时关闭
+// cfg中未设置的长度限制使用100/100/16
+func withUpstream(t *testing.T, cfg config.ModelConfig, handler http.HandlerFunc) {
+	t.Helper()
+	upstream := httptest.NewServer(handler)
+	t.Cleanup(upstream.Close)
+	cfg.Provider, cfg.CompletionsUrl = "openai", upstream.URL
+	if cfg.MaxPrefix == 0 {
+		cfg.MaxPrefix = 100
+	}
+	if cfg.MaxSuffix == 0 {
+		cfg.MaxSuffix = 100
+	}
+	if cfg.MaxOutput == 0 {
+		cfg.MaxOutput = 16
+	}
+	if err := model.Init([]config.ModelConfig{cfg}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 从默认注册表读取补全请求计数
+func completionRequestCount(t *testing.T, modelName string, status model.CompletionStatus) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() != "completion_requests_total" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["model"] == modelName && labels["status"] == string(status) {
+				return m.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+func Test_CompletionsClientDisconnect(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// 上游模型服务：收到请求后一直挂起，直到请求上下文被取消
+	received := make(chan struct{})
+	upstreamCanceled := make(chan struct{})
+	withConfig(t, nil)
+	const modelName = "disconnect-test"
+	withUpstream(t, config.ModelConfig{ModelName: modelName}, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		close(received)
+		select {
+		case <-r.Context().Done():
+			close(upstreamCanceled)
+		case <-time.After(10 * time.Second):
+		}
+	})
+	successBefore := completionRequestCount(t, modelName, model.StatusSuccess)
+	canceledBefore := completionRequestCount(t, modelName, model.StatusCanceled)
+
+	agent := httptest.NewServer(SetupRouter())
+	defer agent.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-received
+		cancel() // 客户端在模型响应前断开连接
+	}()
+	body := `{"completion_id": "cmpl-disconnect", "prompt_options": {"prefix": "func main() {\n", "suffix": "}"}}`
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, agent.URL+"/completion-agent/api/v1/completions", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if rsp, err := http.DefaultClient.Do(req); err == nil {
+		rsp.Body.Close()
+		t.Fatalf("expected client request to be aborted, got status %d", rsp.StatusCode)
+	}
+
+	select {
+	case <-upstreamCanceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream request was not canceled after client disconnected")
+	}
+
+	// 处理协程在上游请求中断后记录取消状态
+	deadline := time.Now().Add(5 * time.Second)
+	for completionRequestCount(t, modelName, model.StatusCanceled) == canceledBefore {
+		if time.Now().After(deadline) {
+			t.Fatal("canceled completion was not recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := completionRequestCount(t, modelName, model.StatusSuccess); n != successBefore {
+		t.Errorf("expected no success recorded, got %v", n-successBefore)
+	}
+}
+
+func Test_CompletionsNoSuggestion(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// 上游模型服务：正常响应，但choices为空
+	withConfig(t, nil)
+	const modelName = "no-suggestion-test"
+	withUpstream(t, config.ModelConfig{ModelName: modelName}, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id": "up-1", "object": "text_completion", "choices": [], "usage": {"prompt_tokens": 12, "completion_tokens": 0}}`)
+	})
+	r := SetupRouter()
+	post := func() *httptest.ResponseRecorder {
+		body := `{"completion_id": "cmpl-empty", "prompt_options": {"prefix": "func main() {\n", "suffix": "}"}}`
+		req := httptest.NewRequest(http.MethodPost, "/completion-agent/api/v1/completions", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	before := completionRequestCount(t, modelName, model.StatusNoSuggestion)
+
+	w := post()
+	if w.Code != http.StatusOK {
+		t.Fatalf("status code = %d, want %d", w.Code, http.StatusOK)
+	}
+	var rsp completions.CompletionResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+		t.Fatalf("response is not a CompletionResponse: %v, body: %s", err, w.Body.String())
+	}
+	if rsp.Status != model.StatusNoSuggestion {
+		t.Errorf("status = %q, want %q", rsp.Status, model.StatusNoSuggestion)
+	}
+	if rsp.Usage.PromptTokens != 12 {
+		t.Errorf("prompt tokens = %d, want 12", rsp.Usage.PromptTokens)
+	}
+
+	config.Server.NoSuggestionStatus = http.StatusNoContent
+	w = post()
+	if w.Code != http.StatusNoContent || w.Body.Len() != 0 {
+		t.Errorf("status code = %d, body %q, want 204 without body", w.Code, w.Body.String())
+	}
+	if n := completionRequestCount(t, modelName, model.StatusNoSuggestion); n != before+2 {
+		t.Errorf("noSuggestion recorded %v times, want 2", n-before)
+	}
+}
+
+func Test_RespCompletionStatus(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cases := map[model.CompletionStatus]int{
+		model.StatusSuccess:     http.StatusOK,
+		model.StatusAuthError:   http.StatusUnauthorized,
+		model.StatusRateLimited: http.StatusTooManyRequests,
+		model.StatusModelError:  http.StatusInternalServerError,
+	}
+	for status, want := range cases {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		respCompletion(c, &completions.CompletionRequest{}, &completions.CompletionResponse{Status: status})
+		if w.Code != want {
+			t.Errorf("status %q: code = %d, want %d", status, w.Code, want)
+		}
+	}
+}
+
+func Test_RespCompletionEchoHeaders(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	withConfig(t, nil)
+
+	for _, status := range []model.CompletionStatus{model.StatusSuccess, model.StatusRejected} {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		respCompletion(c, &completions.CompletionRequest{}, &completions.CompletionResponse{ID: "cmpl-echo", Status: status})
+		var rsp completions.CompletionResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+			t.Fatal(err)
+		}
+		if got := w.Header().Get("X-Completion-Id"); got != rsp.ID {
+			t.Errorf("X-Completion-Id = %q, body id %q", got, rsp.ID)
+		}
+		if got := w.Header().Get("X-Completion-Status"); got != string(rsp.Status) {
+			t.Errorf("X-Completion-Status = %q, body status %q", got, rsp.Status)
+		}
+	}
+
+	config.Server.DisableEchoHeaders = true
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	respCompletion(c, &completions.CompletionRequest{}, &completions.CompletionResponse{ID: "cmpl-echo", Status: model.StatusSuccess})
+	if w.Header().Get("X-Completion-Id") != "" || w.Header().Get("X-Completion-Status") != "" {
+		t.Errorf("echo headers sent when disabled: %v", w.Header())
+	}
+}
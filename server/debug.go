@@ -0,0 +1,60 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"completion-agent/pkg/completions"
+	"completion-agent/pkg/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+// debugPrompt 提示词预览处理器，仅在调试模式下注册
+// @Summary 预览提示词
+// @Description 执行完整的前置处理(上下文合并、截断、FIM组装、停用词)，返回将要发给模型的prompt和停用词，不调用模型
+// @Tags debug
+// @Accept json
+// @Produce json
+// @Param request body completions.CompletionRequest true "补全请求"
+// @Success 200 {object} completions.PromptPreview
+// @Failure 400 {object} map[string]interface{}
+// @Failure 413 {object} map[string]interface{}
+// @Failure 503 {object} map[string]interface{}
+// @Router /completion-agent/api/v1/debug/prompt [post]
+func debugPrompt(c *gin.Context) {
+	var req completions.CompletionInput
+	if err := c.ShouldBindJSON(&req.CompletionRequest); err != nil {
+		if isBodyTooLarge(err) {
+			abortBodyTooLarge(c, maxBodyBytes())
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !initialized.Load() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errServiceInitializing.Error()})
+		return
+	}
+	req.Headers = c.Request.Header
+
+	handler, err := completions.NewAutoCompletionHandler()
+	if err != nil {
+		code := http.StatusInternalServerError
+		if errors.Is(err, model.ErrNoModels) {
+			code = http.StatusServiceUnavailable
+		}
+		c.JSON(code, gin.H{"error": err.Error()})
+		return
+	}
+	rc := completions.NewCompletionContext(c.Request.Context(), &completions.CompletionPerformance{
+		ReceiveTime: time.Now().Local(),
+	})
+	preview, err := handler.PreviewPrompt(rc, &req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, preview)
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"completion-agent/pkg/completions"
+	"completion-agent/pkg/config"
+	"completion-agent/pkg/env"
+
+	"github.com/gin-gonic/gin"
+)
+
+func Test_DebugPrompt(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	savedDebug := env.DebugMode
+	defer func() { env.DebugMode = savedDebug }()
+	withConfig(t, nil)
+	withUpstream(t, config.ModelConfig{
+		ModelName: "debug-prompt-test",
+		FimMode:   true,
+		FimBegin:  "<B>",
+		FimHole:   "<H>",
+		FimEnd:    "<E>",
+	}, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("model called by prompt preview")
+	})
+
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/completion-agent/api/v1/debug/prompt", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		SetupRouter().ServeHTTP(w, req)
+		return w
+	}
+	body := `{"completion_id": "dbg", "prompt_options": {"prefix": "func main() {\n\tx := ", "suffix": "\n}"}}`
+
+	env.DebugMode = false
+	if w := post(body); w.Code != http.StatusNotFound {
+		t.Fatalf("status code outside debug mode = %d, want 404", w.Code)
+	}
+
+	env.DebugMode = true
+	w := post(body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status code = %d, body %s", w.Code, w.Body.String())
+	}
+	var preview completions.PromptPreview
+	if err := json.Unmarshal(w.Body.Bytes(), &preview); err != nil {
+		t.Fatal(err)
+	}
+	if preview.Prompt != "<B>\nfunc main() {\n\tx := <H>\n}<E>" {
+		t.Errorf("prompt = %q", preview.Prompt)
+	}
+	if preview.Model != "debug-prompt-test" || preview.MaxTokens != 16 || preview.Stop == nil {
+		t.Errorf("unexpected preview: %+v", preview)
+	}
+
+	if w := post(`{"completion_id": "dbg"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("missing prompt_options status = %d, want 400", w.Code)
+	}
+
+	// 只注册了POST，与接口文档一致
+	req := httptest.NewRequest(http.MethodGet, "/completion-agent/api/v1/debug/prompt", strings.NewReader(body))
+	w = httptest.NewRecorder()
+	SetupRouter().ServeHTTP(w, req)
+	if w.Code == http.StatusOK {
+		t.Errorf("GET should not be routed to the prompt preview")
+	}
+}
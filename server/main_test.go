@@ -0,0 +1,12 @@
+package server
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// 测试直接创建路由，不经过main中的初始化流程
+	SetReady()
+	os.Exit(m.Run())
+}
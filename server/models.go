@@ -0,0 +1,54 @@
+package server
+
+import (
+	"completion-agent/pkg/model"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ModelInfo 对外公开的模型信息，不包含认证信息和服务地址
+type ModelInfo struct {
+	ModelTitle string   `json:"modelTitle"` // 模型标题
+	ModelName  string   `json:"modelName"`  // 真实的模型名称
+	Provider   string   `json:"provider"`   // 模型供应商
+	Tags       []string `json:"tags"`       // 模型标签，补全请求可按标签选择模型
+	FimMode    bool     `json:"fimMode"`    // 是否由服务端填充FIM标记
+}
+
+// ModelsResponse 模型列表响应
+type ModelsResponse struct {
+	Models []ModelInfo `json:"models"`
+}
+
+// listModels 模型列表处理器
+// @Summary 模型列表
+// @Description 列出已配置的补全模型及其标签，供客户端选择模型
+// @Tags models
+// @Produce json
+// @Success 200 {object} ModelsResponse
+// @Failure 503 {object} map[string]interface{}
+// @Router /completion-agent/api/v1/models [get]
+func listModels(c *gin.Context) {
+	// 模型在服务启动后异步初始化，完成前返回503
+	if !initialized.Load() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errServiceInitializing.Error()})
+		return
+	}
+	rsp := ModelsResponse{Models: []ModelInfo{}}
+	for _, m := range model.Models() {
+		cfg := m.Config()
+		tags := cfg.Tags
+		if tags == nil {
+			tags = []string{}
+		}
+		rsp.Models = append(rsp.Models, ModelInfo{
+			ModelTitle: cfg.ModelTitle,
+			ModelName:  cfg.ModelName,
+			Provider:   cfg.Provider,
+			Tags:       tags,
+			FimMode:    cfg.FimMode,
+		})
+	}
+	c.JSON(http.StatusOK, rsp)
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"completion-agent/pkg/config"
+	"completion-agent/pkg/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+func Test_ListModels(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	if err := model.Init([]config.ModelConfig{
+		{
+			Provider:       "openai",
+			ModelTitle:     "DeepSeek Coder",
+			ModelName:      "deepseek-coder",
+			CompletionsUrl: "http://127.0.0.1:1/v1/completions",
+			Tags:           []string{"fast"},
+			Authorization:  "Bearer secret-token",
+			FimMode:        true,
+		},
+		{
+			Provider:   "sangfor",
+			ModelTitle: "Internal",
+			ModelName:  "internal-v2",
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/completion-agent/api/v1/models", nil)
+	w := httptest.NewRecorder()
+	SetupRouter().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status code = %d, want %d", w.Code, http.StatusOK)
+	}
+	if strings.Contains(w.Body.String(), "secret-token") || strings.Contains(w.Body.String(), "127.0.0.1") {
+		t.Fatalf("response leaks model credentials or address: %s", w.Body.String())
+	}
+	var rsp ModelsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+		t.Fatal(err)
+	}
+	want := []ModelInfo{
+		{ModelTitle: "DeepSeek Coder", ModelName: "deepseek-coder", Provider: "openai", Tags: []string{"fast"}, FimMode: true},
+		{ModelTitle: "Internal", ModelName: "internal-v2", Provider: "sangfor", Tags: []string{}},
+	}
+	if len(rsp.Models) != len(want) {
+		t.Fatalf("got %d models, want %d", len(rsp.Models), len(want))
+	}
+	for i, m := range rsp.Models {
+		if m.ModelTitle != want[i].ModelTitle || m.ModelName != want[i].ModelName || m.Provider != want[i].Provider ||
+			strings.Join(m.Tags, ",") != strings.Join(want[i].Tags, ",") || m.FimMode != want[i].FimMode {
+			t.Errorf("model %d = %+v, want %+v", i, m, want[i])
+		}
+	}
+}
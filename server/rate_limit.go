@@ -0,0 +1,212 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"completion-agent/pkg/completions"
+	"completion-agent/pkg/config"
+	"completion-agent/pkg/metrics"
+	"completion-agent/pkg/model"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// 请求体中没有client_id时，从该头部获取客户端标识
+const clientIDHeader = "X-Client-ID"
+
+// 没有客户端标识的请求共用的令牌桶，在指标中的标签值
+const defaultClientLabel = "default"
+
+// 不单独计数的客户端在指标中的标签值
+const otherClientLabel = "other"
+
+// 未配置metricClients时，在指标中单独计数的客户端数上限
+const maxClientLabels = 20
+
+// 清理空闲令牌桶的最小间隔
+const rateLimitSweepInterval = time.Minute
+
+// 单个客户端的令牌桶
+type tokenBucket struct {
+	tokens float64   // 当前剩余令牌数
+	last   time.Time // 上次补充令牌的时间
+}
+
+/**
+ * 按客户端的补全请求限流器
+ * @description
+ * - 每个client_id一个令牌桶，按rate匀速补充，最多积累burst个令牌
+ * - 每个请求消耗一个令牌，没有令牌时拒绝
+ * - 没有客户端标识的请求共用一个令牌桶
+ * - 已经补满的令牌桶与新建的等价，定期清理，避免客户端数不断增长占用内存
+ * - 指标中的客户端标签限定在metricClients或最先被限流的maxClientLabels个客户端之内
+ */
+type rateLimiter struct {
+	rate          float64
+	burst         float64
+	buckets       map[string]*tokenBucket
+	lastSweep     time.Time
+	now           func() time.Time
+	metricClients map[string]bool     // 配置的单独计数的客户端，为nil时按labeled动态选取
+	labeled       map[string]struct{} // 已分配了独立标签的客户端
+	mutex         sync.Mutex
+}
+
+/**
+ * 创建按客户端的补全请求限流器
+ * @param {float64} rate - 每个客户端每秒允许的请求数，0或负数表示不限流
+ * @param {int} burst - 令牌桶容量，0或负数时取rate向上取整(至少为1)
+ * @returns {*rateLimiter} 返回限流器
+ */
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst <= 0 {
+		burst = int(math.Max(1, math.Ceil(rate)))
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+		labeled: make(map[string]struct{}),
+	}
+}
+
+// 补全接口共用的限流器，由SetupRouter按server.rateLimit创建
+var rateLimit *rateLimiter
+
+// 尝试为客户端消耗一个令牌，没有可用令牌时返回false
+func (l *rateLimiter) allow(clientID string) bool {
+	if l == nil || l.rate <= 0 {
+		return true
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+	b, ok := l.buckets[clientID]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[clientID] = b
+	} else {
+		b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// 删除已经补满的令牌桶，调用方需持有锁
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for id, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, id)
+		}
+	}
+}
+
+/**
+ * 获取被限流的客户端在指标中的标签值
+ * @param {string} clientID - 客户端标识，可为空
+ * @returns {string} 返回客户端标识、default或other
+ * @description
+ * - 没有客户端标识时返回default
+ * - 配置了metricClients时，只有其中的客户端使用自己的标识，其余返回other
+ * - 否则最先被限流的maxClientLabels个客户端使用自己的标识，之后的客户端返回other
+ */
+func (l *rateLimiter) metricLabel(clientID string) string {
+	if clientID == "" {
+		return defaultClientLabel
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.metricClients != nil {
+		if l.metricClients[clientID] {
+			return clientID
+		}
+		return otherClientLabel
+	}
+	if _, ok := l.labeled[clientID]; !ok {
+		if len(l.labeled) >= maxClientLabels {
+			return otherClientLabel
+		}
+		l.labeled[clientID] = struct{}{}
+	}
+	return clientID
+}
+
+/**
+ * 检查补全请求是否超出所属客户端的频率限制
+ * @param {*gin.Context} c - Gin上下文对象，超出限制时直接写入响应
+ * @param {*completions.CompletionRequest} req - 已解析的补全请求
+ * @param {*completions.CompletionPerformance} perf - 请求的性能统计信息
+ * @returns {bool} 允许继续处理返回true，已被限流返回false
+ * @description
+ * - 客户端标识取请求体中的client_id，没有时取X-Client-ID头部
+ * - 超出限制时以补全响应格式返回rateLimited状态，HTTP状态码429
+ * - 被拒绝的请求按客户端计入completion_rate_limited_total指标，标签基数见metricLabel
+ * - 每次拒绝只记录debug日志，避免客户端大量重试时日志泛滥
+ */
+func checkRateLimit(c *gin.Context, req *completions.CompletionRequest, perf *completions.CompletionPerformance) bool {
+	if rsp := rateLimitResponse(c, req, perf); rsp != nil {
+		respCompletion(c, req, rsp)
+		return false
+	}
+	return true
+}
+
+/**
+ * 按客户端消耗一个令牌
+ * @param {*gin.Context} c - Gin上下文对象，用于读取X-Client-ID头部
+ * @param {*completions.CompletionRequest} req - 已解析的补全请求
+ * @param {*completions.CompletionPerformance} perf - 请求的性能统计信息
+ * @returns {*completions.CompletionResponse} 允许继续处理返回nil，被限流时返回rateLimited状态的响应
+ */
+func rateLimitResponse(c *gin.Context, req *completions.CompletionRequest, perf *completions.CompletionPerformance) *completions.CompletionResponse {
+	clientID := req.ClientID
+	if clientID == "" {
+		clientID = c.GetHeader(clientIDHeader)
+	}
+	if rateLimit.allow(clientID) {
+		return nil
+	}
+	label := clientID
+	if label == "" {
+		label = defaultClientLabel
+	}
+	metrics.IncrementRateLimited(rateLimit.metricLabel(clientID))
+	zap.L().Debug("completion rate limited", zap.String("completionID", req.CompletionID), zap.String("clientID", label))
+
+	err := fmt.Errorf("rate limit exceeded for client '%s'", label)
+	return completions.ErrorResponse(req.CompletionID, req.Model, model.StatusRateLimited, perf, nil, err)
+}
+
+// 按配置创建补全请求限流器
+func setupRateLimit() {
+	var cfg config.RateLimitConfig
+	if config.Server != nil {
+		cfg = config.Server.RateLimit
+	}
+	rateLimit = newRateLimiter(cfg.Rate, cfg.Burst)
+	if len(cfg.MetricClients) > 0 {
+		rateLimit.metricClients = make(map[string]bool, len(cfg.MetricClients))
+		for _, id := range cfg.MetricClients {
+			rateLimit.metricClients[id] = true
+		}
+	}
+	if cfg.Rate > 0 {
+		zap.L().Info("completion rate limit enabled",
+			zap.Float64("rate", cfg.Rate), zap.Int("burst", int(rateLimit.burst)))
+	}
+}
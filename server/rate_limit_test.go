@@ -0,0 +1,160 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"completion-agent/pkg/completions"
+	"completion-agent/pkg/config"
+	"completion-agent/pkg/model"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func Test_RateLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := newRateLimiter(2, 3)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if !l.allow("a") {
+			t.Fatalf("request %d within burst rejected", i)
+		}
+	}
+	if l.allow("a") {
+		t.Fatal("request over burst allowed")
+	}
+	// 其他客户端不受影响
+	if !l.allow("b") {
+		t.Fatal("other client rejected")
+	}
+	// 0.5秒补充一个令牌
+	now = now.Add(500 * time.Millisecond)
+	if !l.allow("a") {
+		t.Fatal("refilled token rejected")
+	}
+	if l.allow("a") {
+		t.Fatal("only one token should be refilled")
+	}
+	// 长时间空闲后令牌不超过burst，补满的桶被清理
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if !l.allow("a") {
+			t.Fatalf("request %d after idle rejected", i)
+		}
+	}
+	if l.allow("a") {
+		t.Fatal("tokens exceeded burst after idle")
+	}
+	if _, ok := l.buckets["b"]; ok {
+		t.Fatal("idle bucket not swept")
+	}
+
+	if !newRateLimiter(0, 0).allow("a") {
+		t.Fatal("disabled limiter rejected")
+	}
+	if l := newRateLimiter(0.5, 0); l.burst != 1 {
+		t.Fatalf("default burst = %v, want 1", l.burst)
+	}
+}
+
+func Test_RateLimitMetricLabel(t *testing.T) {
+	l := newRateLimiter(1, 1)
+	if got := l.metricLabel(""); got != defaultClientLabel {
+		t.Errorf("empty client label = %q", got)
+	}
+	// 未配置metricClients时，超出上限的新客户端合并为other，已分配的客户端保持原标签
+	for i := 0; i < maxClientLabels; i++ {
+		if id := fmt.Sprintf("client-%d", i); l.metricLabel(id) != id {
+			t.Fatalf("client %d should get its own label", i)
+		}
+	}
+	if got := l.metricLabel("client-new"); got != otherClientLabel {
+		t.Errorf("label over the cap = %q, want %q", got, otherClientLabel)
+	}
+	if got := l.metricLabel("client-0"); got != "client-0" {
+		t.Errorf("labeled client = %q", got)
+	}
+
+	l.metricClients = map[string]bool{"team-a": true}
+	if l.metricLabel("team-a") != "team-a" || l.metricLabel("client-0") != otherClientLabel {
+		t.Error("configured metric clients should decide the labels")
+	}
+}
+
+func rateLimitedCount(t *testing.T, client string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range families {
+		if mf.GetName() != "completion_rate_limited_total" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "client_id" && l.GetValue() == client {
+					return m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func Test_CompletionsRateLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	withConfig(t, &config.ServerConfig{RateLimit: config.RateLimitConfig{Rate: 0.001, Burst: 1, MetricClients: []string{"rl-client"}}})
+	r := SetupRouter()
+
+	post := func(body string, header string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/completion-agent/api/v1/completions", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if header != "" {
+			req.Header.Set(clientIDHeader, header)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	before := rateLimitedCount(t, "rl-client")
+	beforeDefault := rateLimitedCount(t, defaultClientLabel)
+
+	// 缺少prompt_options的请求在限流之后才被拒绝，不会调用模型
+	if w := post(`{"client_id":"rl-client"}`, ""); w.Code == http.StatusTooManyRequests {
+		t.Fatal("first request rate limited")
+	}
+	w := post(`{"client_id":"rl-client","completion_id":"c2"}`, "")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want 429", w.Code)
+	}
+	var rsp completions.CompletionResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+		t.Fatal(err)
+	}
+	if rsp.Status != model.StatusRateLimited || rsp.ID != "c2" {
+		t.Fatalf("unexpected response: %+v", rsp)
+	}
+	if got := rateLimitedCount(t, "rl-client") - before; got != 1 {
+		t.Fatalf("rate limited count = %v, want 1", got)
+	}
+
+	// 头部中的客户端标识使用独立的令牌桶
+	if w := post(`{}`, "rl-header"); w.Code == http.StatusTooManyRequests {
+		t.Fatal("header client rate limited")
+	}
+	// 没有客户端标识的请求共用默认令牌桶
+	post(`{}`, "")
+	if w := post(`{}`, ""); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("default bucket status = %d, want 429", w.Code)
+	}
+	if got := rateLimitedCount(t, defaultClientLabel) - beforeDefault; got != 1 {
+		t.Fatalf("default rate limited count = %v, want 1", got)
+	}
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"completion-agent/pkg/config"
+	"completion-agent/pkg/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 就绪检查的默认超时时间和结果缓存时长
+const (
+	defaultReadyTimeout  = 3 * time.Second
+	defaultReadyCacheTTL = 5 * time.Second
+)
+
+// 就绪检查试补全使用的提示词
+const readyProbePrefix = "def add(a, b):\n    return "
+
+// ModelReadiness 单个模型的就绪检查结果
+type ModelReadiness struct {
+	ModelTitle string `json:"modelTitle"`      // 模型标题
+	ModelName  string `json:"modelName"`       // 真实的模型名称
+	Reachable  bool   `json:"reachable"`       // 模型服务是否正常响应
+	Status     string `json:"status"`          // 试补全的补全状态
+	Error      string `json:"error,omitempty"` // 不可达的原因
+	LatencyMs  int64  `json:"latencyMs"`       // 试补全耗时(毫秒)
+}
+
+// ReadyResponse 就绪检查响应
+type ReadyResponse struct {
+	Status string           `json:"status"` // ready、unavailable或initializing
+	Time   string           `json:"time"`   // 检查时间
+	Models []ModelReadiness `json:"models"` // 各模型的检查结果
+}
+
+// 配置、分词器和模型等是否已全部初始化完成，完成前补全接口返回503
+var initialized atomic.Bool
+
+// 初始化完成前请求补全时返回的错误
+var errServiceInitializing = errors.New("service is initializing")
+
+/**
+ * 标记服务已完成初始化
+ * @description
+ * - 由main在配置、过滤器、分词器和模型全部初始化成功后调用
+ * - 调用前/readyz返回503及initializing状态，补全和提示词预览接口返回503
+ * - HTTP服务在初始化期间即可启动，/healthz用于存活检查
+ */
+func SetReady() {
+	initialized.Store(true)
+}
+
+// 缓存的就绪检查结果，避免负载均衡器频繁探测时反复调用模型
+var readyCache = struct {
+	rsp     *ReadyResponse
+	expires time.Time
+	now     func() time.Time
+	mutex   sync.Mutex
+}{now: time.Now}
+
+// readyCheck 就绪检查处理器
+// @Summary 就绪检查
+// @Description 初始化完成后，向每个模型发送max_tokens为1的试补全，报告各模型是否可达；尚未初始化完成或没有可达的模型时返回503
+// @Tags health
+// @Produce json
+// @Success 200 {object} ReadyResponse
+// @Failure 503 {object} ReadyResponse
+// @Router /readyz [get]
+func readyCheck(c *gin.Context) {
+	if !initialized.Load() {
+		c.JSON(http.StatusServiceUnavailable, ReadyResponse{
+			Status: "initializing",
+			Time:   time.Now().Format(time.RFC3339),
+			Models: []ModelReadiness{},
+		})
+		return
+	}
+	rsp := checkReadiness()
+	code := http.StatusOK
+	if rsp.Status != "ready" {
+		code = http.StatusServiceUnavailable
+	}
+	c.JSON(code, rsp)
+}
+
+/**
+ * 检查各模型是否可达
+ * @returns {*ReadyResponse} 返回各模型的检查结果，至少一个模型可达时状态为ready
+ * @description
+ * - 并发向每个模型发送试补全，每个模型的超时时间为server.ready.timeout
+ * - 结果由多个请求共享，试补全不使用请求的上下文，发起检查的请求被取消不影响缓存的结果
+ * - 模型正常响应(包括结果为空或没有建议)即视为可达
+ * - 结果缓存server.ready.cacheTTL，检查期间的并发请求等待同一次检查的结果
+ */
+func checkReadiness() *ReadyResponse {
+	timeout, ttl := defaultReadyTimeout, defaultReadyCacheTTL
+	if config.Server != nil {
+		if d := config.Server.Ready.Timeout.Duration(); d > 0 {
+			timeout = d
+		}
+		if d := config.Server.Ready.CacheTTL.Duration(); d > 0 {
+			ttl = d
+		}
+	}
+	readyCache.mutex.Lock()
+	defer readyCache.mutex.Unlock()
+	now := readyCache.now()
+	if readyCache.rsp != nil && now.Before(readyCache.expires) {
+		return readyCache.rsp
+	}
+
+	models := model.Models()
+	results := make([]ModelReadiness, len(models))
+	var wg sync.WaitGroup
+	for i, m := range models {
+		wg.Add(1)
+		go func(i int, m model.LLM) {
+			defer wg.Done()
+			results[i] = probeModel(context.Background(), m, timeout)
+		}(i, m)
+	}
+	wg.Wait()
+
+	rsp := &ReadyResponse{Status: "unavailable", Time: now.Format(time.RFC3339), Models: results}
+	for _, r := range results {
+		if r.Reachable {
+			rsp.Status = "ready"
+			break
+		}
+	}
+	readyCache.rsp, readyCache.expires = rsp, now.Add(ttl)
+	return rsp
+}
+
+// probeModel 向模型发送max_tokens为1的试补全
+func probeModel(ctx context.Context, m model.LLM, timeout time.Duration) ModelReadiness {
+	cfg := m.Config()
+	r := ModelReadiness{ModelTitle: cfg.ModelTitle, ModelName: cfg.ModelName}
+	para := &model.CompletionParameter{
+		CompletionID: "readyz",
+		ClientID:     "readyz",
+		Language:     "python",
+		Model:        cfg.ModelName,
+		MaxTokens:    1,
+		Prefix:       readyProbePrefix,
+		Suffix:       "\n",
+	}
+	mctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	_, status, err := m.Completions(mctx, para)
+	r.LatencyMs = time.Since(start).Milliseconds()
+	r.Status = string(status)
+	switch status {
+	case model.StatusSuccess, model.StatusEmpty, model.StatusNoSuggestion:
+		r.Reachable = true
+	default:
+		if err != nil {
+			r.Error = err.Error()
+		}
+	}
+	return r
+}
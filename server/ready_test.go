@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"completion-agent/pkg/completions"
+	"completion-agent/pkg/config"
+	"completion-agent/pkg/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+func Test_ReadyCheck(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	savedNow := readyCache.now
+	defer func() {
+		readyCache.now = savedNow
+		readyCache.rsp = nil
+	}()
+	now := time.Unix(1000, 0)
+	readyCache.now = func() time.Time { return now }
+	readyCache.rsp = nil
+
+	calls := 0
+	var maxTokens interface{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		maxTokens = body["max_tokens"]
+		w.Write([]byte(`{"choices": [{"text": "a"}]}`))
+	}))
+	defer upstream.Close()
+
+	initModels := func(urls ...string) {
+		var cfgs []config.ModelConfig
+		for _, url := range urls {
+			cfgs = append(cfgs, config.ModelConfig{Provider: "openai", ModelName: "ready-" + url, CompletionsUrl: url, MaxOutput: 16})
+		}
+		if err := model.Init(cfgs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func() (int, ReadyResponse) {
+		req := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+		w := httptest.NewRecorder()
+		SetupRouter().ServeHTTP(w, req)
+		var rsp ReadyResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, rsp
+	}
+
+	initModels(upstream.URL, "http://127.0.0.1:1/v1/completions")
+	code, rsp := get()
+	if code != http.StatusOK || rsp.Status != "ready" || len(rsp.Models) != 2 {
+		t.Fatalf("unexpected readiness: %d %+v", code, rsp)
+	}
+	if !rsp.Models[0].Reachable || rsp.Models[1].Reachable || rsp.Models[1].Error == "" {
+		t.Fatalf("unexpected model readiness: %+v", rsp.Models)
+	}
+	if maxTokens != float64(1) {
+		t.Fatalf("probe max_tokens = %v, want 1", maxTokens)
+	}
+
+	// 缓存期内不再调用模型
+	get()
+	if calls != 1 {
+		t.Fatalf("model calls = %d, want cached result", calls)
+	}
+
+	// 发起检查的请求被取消时仍完成检查，不缓存失败的结果
+	now = now.Add(time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodGet, "/readyz", nil).WithContext(ctx)
+	SetupRouter().ServeHTTP(httptest.NewRecorder(), req)
+	if code, rsp := get(); code != http.StatusOK || !rsp.Models[0].Reachable {
+		t.Fatalf("readiness after a canceled check: %d %+v", code, rsp)
+	}
+
+	// 没有可达的模型时返回503
+	now = now.Add(time.Minute)
+	initModels("http://127.0.0.1:1/v1/completions")
+	if code, rsp := get(); code != http.StatusServiceUnavailable || rsp.Status != "unavailable" {
+		t.Fatalf("unexpected readiness: %d %+v", code, rsp)
+	}
+}
+
+func Test_NotInitialized(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	initialized.Store(false)
+	defer SetReady()
+	r := SetupRouter()
+
+	req := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var ready ReadyResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &ready); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusServiceUnavailable || ready.Status != "initializing" {
+		t.Fatalf("unexpected readiness: %d %+v", w.Code, ready)
+	}
+
+	// 初始化完成前不调用模型，直接返回503
+	body := `{"completion_id": "cmpl-init", "prompt_options": {"prefix": "func main() {\n", "suffix": "}"}}`
+	req = httptest.NewRequest(http.MethodPost, "/completion-agent/api/v1/completions", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var rsp completions.CompletionResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusServiceUnavailable || rsp.Status != model.StatusBusy || rsp.ID != "cmpl-init" {
+		t.Fatalf("unexpected response: %d %+v", w.Code, rsp)
+	}
+
+	// 模型列表同样等待初始化完成
+	req = httptest.NewRequest(http.MethodGet, "/completion-agent/api/v1/models", nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), errServiceInitializing.Error()) {
+		t.Fatalf("unexpected models response: %d %s", w.Code, w.Body.String())
+	}
+}
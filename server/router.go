@@ -1,27 +1,52 @@
 package server
 
 import (
+	"fmt"
 	"net/http"
+	"path/filepath"
+	"strings"
 	"time"
 
+	"completion-agent/pkg/config"
+	"completion-agent/pkg/env"
 	"completion-agent/pkg/logger"
 	"completion-agent/pkg/metrics"
 
 	"github.com/gin-gonic/gin"
 	swaggerFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
+	"go.uber.org/zap"
 )
 
+// 默认仅信任本机回环地址上的代理
+var defaultTrustedProxies = []string{"127.0.0.1", "::1"}
+
 // SetupRouter 设置路由
 func SetupRouter() *gin.Engine {
 	// 创建Gin实例
 	r := gin.New()
 
+	// 设置受信任的代理，使c.ClientIP()只采信来自这些代理的转发头部
+	setTrustedProxies(r)
+
 	// 使用恢复中间件，防止panic导致服务器崩溃
 	r.Use(gin.Recovery())
 
+	// API Key认证，健康检查和指标接口除外
+	r.Use(authRequired())
+
+	// 限制请求体的大小，超出时返回413
+	r.Use(limitBody(maxBodyBytes()))
+
+	// 流式接口的连接数限制
+	setupStreamLimit()
+
+	// 补全接口按client_id限流
+	setupRateLimit()
+
 	// 健康检查接口
 	r.GET("/healthz", healthCheck)
+	r.GET("/readyz", readyCheck)
 
 	// Prometheus指标接口
 	r.GET("/metrics", func(c *gin.Context) {
@@ -38,14 +63,33 @@ func SetupRouter() *gin.Engine {
 		c.Next()
 	})
 	api.POST("/completions", Completions)
+	api.POST("/completions/batch", batchCompletions)
+	api.GET("/models", listModels)
 	api.POST("/logs", logHandler)
+	// 提示词预览接口只在调试模式下开放
+	if env.DebugMode {
+		api.POST("/debug/prompt", debugPrompt)
+	}
 
 	return r
 }
 
+// setTrustedProxies 按配置设置受信任的代理，未配置或配置无效时仅信任回环地址
+func setTrustedProxies(r *gin.Engine) {
+	proxies := defaultTrustedProxies
+	if config.Server != nil && len(config.Server.TrustedProxies) > 0 {
+		proxies = config.Server.TrustedProxies
+	}
+	if err := r.SetTrustedProxies(proxies); err != nil {
+		zap.L().Error("invalid trusted proxies, fall back to loopback",
+			zap.Strings("trustedProxies", proxies), zap.Error(err))
+		_ = r.SetTrustedProxies(defaultTrustedProxies)
+	}
+}
+
 // healthCheck 健康检查处理器
 // @Summary 健康检查
-// @Description 检查服务是否正常运行
+// @Description 检查服务是否正常运行，只用于存活检查，不探测模型
 // @Tags health
 // @Accept json
 // @Produce json
@@ -59,12 +103,38 @@ func healthCheck(c *gin.Context) {
 }
 
 type LogSettings struct {
-	Level string `json:"level"`
+	Level      string `json:"level,omitempty"`      // 日志级别，为空表示不修改
+	Path       string `json:"path,omitempty"`       // 日志文件路径，为空表示不修改
+	MaxSize    int64  `json:"maxSize,omitempty"`    // 单个日志文件的最大字节数，为0表示不修改
+	MaxBackups *int   `json:"maxBackups,omitempty"` // 保留的备份文件数量，0表示保留全部，未指定表示不修改
 }
 
-// logHandler 日志级别设置处理器
-// @Summary 设置日志级别
-// @Description 设置应用程序的日志级别
+/**
+ * 校验请求指定的日志文件路径
+ * @param {string} path - 请求中的日志文件路径，相对路径按日志目录解析
+ * @returns {string, error} 返回清理后的绝对路径，路径不在日志目录(env.GetLogDir())之内时返回错误
+ * @description
+ * - 日志接口不要求调试模式，路径必须限制在日志目录内，避免调用方在任意可写位置创建目录、写入日志或删除同名备份
+ */
+func logFilePath(path string) (string, error) {
+	dir, err := filepath.Abs(env.GetLogDir())
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	path = filepath.Clean(path)
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("log path must be inside the log directory %s", dir)
+	}
+	return path, nil
+}
+
+// logHandler 日志设置处理器
+// @Summary 设置日志级别和日志文件
+// @Description 设置应用程序的日志级别，或在运行时修改日志文件的路径、大小上限和备份数量；路径只能位于日志目录之内
 // @Tags logs
 // @Accept json
 // @Produce json
@@ -78,10 +148,45 @@ func logHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	logger.SetLevel(req.Level)
-
-	c.JSON(http.StatusOK, gin.H{
+	if req.Level != "" {
+		logger.SetLevel(req.Level)
+	}
+	rsp := gin.H{
 		"status": "ok",
 		"level":  req.Level,
-	})
+	}
+	if req.Path != "" {
+		path, err := logFilePath(req.Path)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		req.Path = path
+	}
+	if req.Path != "" || req.MaxSize > 0 || req.MaxBackups != nil {
+		settings, ok := logger.CurrentFileSettings()
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "file logging is not initialized"})
+			return
+		}
+		if req.Path != "" {
+			settings.Path = req.Path
+		}
+		if req.MaxSize > 0 {
+			settings.MaxSize = req.MaxSize
+		}
+		if req.MaxBackups != nil {
+			settings.MaxBackups = *req.MaxBackups
+		}
+		if err := logger.ReloadFile(settings); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		zap.L().Info("Log file settings changed",
+			zap.String("path", settings.Path),
+			zap.Int64("maxSize", settings.MaxSize),
+			zap.Int("maxBackups", settings.MaxBackups))
+		rsp["file"] = settings
+	}
+	c.JSON(http.StatusOK, rsp)
 }
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"completion-agent/pkg/config"
+	"completion-agent/pkg/env"
+
+	"github.com/gin-gonic/gin"
+)
+
+func clientIPOf(r *gin.Engine, remoteAddr, forwardedFor string) string {
+	req := httptest.NewRequest(http.MethodGet, "/test/client-ip", nil)
+	req.RemoteAddr = remoteAddr
+	if forwardedFor != "" {
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w.Body.String()
+}
+
+func newClientIPRouter() *gin.Engine {
+	r := SetupRouter()
+	r.GET("/test/client-ip", func(c *gin.Context) {
+		c.String(http.StatusOK, c.ClientIP())
+	})
+	return r
+}
+
+func Test_TrustedProxies(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	withConfig(t, nil)
+
+	// 未配置时仅信任回环地址
+	config.Server = nil
+	r := newClientIPRouter()
+	if ip := clientIPOf(r, "127.0.0.1:5000", "203.0.113.7"); ip != "203.0.113.7" {
+		t.Errorf("behind loopback proxy: got %s, want 203.0.113.7", ip)
+	}
+	if ip := clientIPOf(r, "198.51.100.2:5000", "203.0.113.7"); ip != "198.51.100.2" {
+		t.Errorf("spoofed header from untrusted peer: got %s, want 198.51.100.2", ip)
+	}
+
+	// 配置的代理网段
+	config.Server = &config.ServerConfig{TrustedProxies: []string{"10.0.0.0/8"}}
+	r = newClientIPRouter()
+	if ip := clientIPOf(r, "10.1.2.3:5000", "203.0.113.7"); ip != "203.0.113.7" {
+		t.Errorf("behind configured proxy: got %s, want 203.0.113.7", ip)
+	}
+	if ip := clientIPOf(r, "127.0.0.1:5000", "203.0.113.7"); ip != "127.0.0.1" {
+		t.Errorf("loopback no longer trusted: got %s, want 127.0.0.1", ip)
+	}
+	if ip := clientIPOf(r, "10.1.2.3:5000", ""); ip != "10.1.2.3" {
+		t.Errorf("no forwarded header: got %s, want 10.1.2.3", ip)
+	}
+
+	// 无效配置回退到回环地址
+	config.Server = &config.ServerConfig{TrustedProxies: []string{"not-an-ip"}}
+	r = newClientIPRouter()
+	if ip := clientIPOf(r, "127.0.0.1:5000", "203.0.113.7"); ip != "203.0.113.7" {
+		t.Errorf("invalid config fallback: got %s, want 203.0.113.7", ip)
+	}
+}
+
+func Test_LogPathRestricted(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logDir := t.TempDir()
+	t.Setenv(env.LogDirEnv, logDir)
+	outside := t.TempDir()
+	r := SetupRouter()
+
+	cases := []string{
+		"../evil.log",
+		"sub/../../evil.log",
+		filepath.Join(outside, "evil.log"),
+		logDir,
+	}
+	for _, path := range cases {
+		body, _ := json.Marshal(LogSettings{Path: path})
+		req := httptest.NewRequest(http.MethodPost, "/completion-agent/api/v1/logs", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "log directory") {
+			t.Errorf("path %q: status %d, body %s", path, w.Code, w.Body.String())
+		}
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+		t.Errorf("files created outside the log directory: %v", entries)
+	}
+
+	for path, want := range map[string]string{
+		"agent.log":                      filepath.Join(logDir, "agent.log"),
+		"sub/../agent.log":               filepath.Join(logDir, "agent.log"),
+		filepath.Join(logDir, "a/b.log"): filepath.Join(logDir, "a", "b.log"),
+	} {
+		if got, err := logFilePath(path); err != nil || got != want {
+			t.Errorf("logFilePath(%q) = %q, %v, want %q", path, got, err, want)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"completion-agent/pkg/completions"
+	"completion-agent/pkg/config"
+	"completion-agent/pkg/metrics"
+	"completion-agent/pkg/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+ * 流式连接数限制器
+ * @description
+ * - 流式(SSE)连接持续时间长，限制同时存在的连接数，避免耗尽服务端资源
+ * - 超出上限的新连接直接返回StatusBusy(503)，不排队
+ * - 处理函数返回时立即释放名额；流式处理函数需在客户端断开(请求上下文取消)时及时返回
+ * - 通过completion_streams_active指标暴露当前活跃连接数
+ */
+type streamLimiter struct {
+	max    int
+	active int
+	mutex  sync.Mutex
+}
+
+/**
+ * 创建流式连接数限制器
+ * @param {int} max - 同时存在的流式连接数上限，0或负数表示不限制
+ * @returns {*streamLimiter} 返回限制器
+ */
+func newStreamLimiter(max int) *streamLimiter {
+	return &streamLimiter{max: max}
+}
+
+// 流式接口共用的连接数限制器，由SetupRouter按server.maxStreams创建
+var streamLimit *streamLimiter
+
+// 尝试占用一个名额，已达上限时返回false
+func (l *streamLimiter) acquire() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.max > 0 && l.active >= l.max {
+		return false
+	}
+	l.active++
+	metrics.UpdateStreamsActive(l.active)
+	return true
+}
+
+// 释放一个名额
+func (l *streamLimiter) release() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.active--
+	metrics.UpdateStreamsActive(l.active)
+}
+
+/**
+ * 流式接口的连接数限制中间件
+ * @returns {gin.HandlerFunc} 返回gin中间件，注册流式接口时加在处理函数之前
+ * @description
+ * - 占用名额失败时以补全响应格式返回StatusBusy，HTTP状态码503
+ * - 处理函数返回后释放名额，包括客户端断开和panic的情况
+ * @example
+ * api.POST("/completions/stream", streamLimit.Handle(), StreamCompletions)
+ */
+func (l *streamLimiter) Handle() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !l.acquire() {
+			perf := &completions.CompletionPerformance{ReceiveTime: time.Now().Local()}
+			err := fmt.Errorf("too many streaming connections (max %d)", l.max)
+			rsp := completions.ErrorResponse("", "", model.StatusBusy, perf, nil, err)
+			respCompletion(c, &completions.CompletionRequest{}, rsp)
+			c.Abort()
+			return
+		}
+		defer l.release()
+		c.Next()
+	}
+}
+
+// 按配置创建流式连接数限制器
+func setupStreamLimit() {
+	max := 0
+	if config.Server != nil {
+		max = config.Server.MaxStreams
+	}
+	streamLimit = newStreamLimiter(max)
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"completion-agent/pkg/completions"
+	"completion-agent/pkg/config"
+	"completion-agent/pkg/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+func Test_StreamLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	withConfig(t, &config.ServerConfig{MaxStreams: 2})
+
+	entered := make(chan struct{}, 10)
+	r := SetupRouter()
+	r.GET("/test/stream", streamLimit.Handle(), func(c *gin.Context) {
+		c.Header("Content-Type", "text/event-stream")
+		c.Writer.WriteHeader(http.StatusOK)
+		c.Writer.Flush()
+		entered <- struct{}{}
+		<-c.Request.Context().Done()
+	})
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	open := func(ctx context.Context) *http.Response {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/test/stream", nil)
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rsp
+	}
+
+	// 占满两个名额
+	var cancels []context.CancelFunc
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancels = append(cancels, cancel)
+		rsp := open(ctx)
+		defer rsp.Body.Close()
+		<-entered
+	}
+	defer func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}()
+
+	rsp := open(context.Background())
+	body, _ := io.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("status code = %d, want %d", rsp.StatusCode, http.StatusServiceUnavailable)
+	}
+	var busy completions.CompletionResponse
+	if err := json.Unmarshal(body, &busy); err != nil || busy.Status != model.StatusBusy {
+		t.Errorf("expected busy completion response, got %s", body)
+	}
+
+	// 客户端断开后名额及时释放
+	cancels[0]()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ctx, cancel := context.WithCancel(context.Background())
+		rsp := open(ctx)
+		code := rsp.StatusCode
+		if code == http.StatusOK {
+			<-entered
+			cancel()
+			rsp.Body.Close()
+			break
+		}
+		rsp.Body.Close()
+		cancel()
+		if time.Now().After(deadline) {
+			t.Fatalf("slot was not released after disconnect, last status %d", code)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}